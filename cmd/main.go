@@ -1,10 +1,30 @@
 package main
 
 import (
+    "os"
+
     "netcat/internal/app" 
 )
 
 func main() {
+    // Operate a running server through its admin socket
+    if len(os.Args) > 1 && os.Args[1] == "admin" {
+        app.RunAdmin(os.Args[2:])
+        return
+    }
+
+    // Check the audit trail for tampering
+    if len(os.Args) > 1 && os.Args[1] == "audit" {
+        app.RunAudit(os.Args[2:])
+        return
+    }
+
+    // Chat as a user with the built-in client
+    if len(os.Args) > 1 && os.Args[1] == "client" {
+        app.RunClient(os.Args[2:])
+        return
+    }
+
     // Run the server
     app.RunServer()
 }
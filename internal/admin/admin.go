@@ -0,0 +1,215 @@
+// Package admin implements the local control socket used to operate a running
+// server, and the client side used by the `TCPChat admin` subcommand.
+//
+// The protocol is one JSON Request per line answered by one JSON Response per line.
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"netcat/internal/logging"
+	"netcat/internal/storage"
+)
+
+// DefaultSocket is the socket path used when none is given.
+const DefaultSocket = "admin.sock"
+
+// Request is a single admin command.
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response is the reply to a Request.
+type Response struct {
+	OK       bool              `json:"ok"`
+	Error    string            `json:"error,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Clients  []ClientInfo      `json:"clients,omitempty"`
+	Messages []storage.Message `json:"messages,omitempty"`
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	Name        string    `json:"name"`
+	Addr        string    `json:"addr"`
+	Connected   time.Time `json:"connected"`
+	IdleSeconds int64     `json:"idle_seconds"`
+}
+
+// Controller is implemented by the server to carry out admin commands.
+type Controller interface {
+	// ListClients returns the clients currently in the chat.
+	ListClients() []ClientInfo
+	// Kick disconnects the named client.
+	Kick(name string) error
+	// Ban refuses a username or IP address and kicks any matching client.
+	Ban(target string) error
+	// Unban lifts a ban added with Ban.
+	Unban(target string) error
+	// Notice broadcasts a server notice to every client.
+	Notice(text string) error
+	// Reload re-reads the welcome message and the config file.
+	Reload() error
+	// RotateLogs moves the current log file aside and starts a new one.
+	RotateLogs() error
+	// Export returns the message history with edits, deletions and reply links applied.
+	Export() ([]storage.Message, error)
+}
+
+// ListenAndServe listens on the Unix socket at path and serves admin requests.
+// A socket left behind by a previous run is replaced; any other file at path,
+// or a socket a running server still answers on, is left alone and refused.
+func ListenAndServe(path string, c Controller) error {
+	if err := removeStaleSocket(path); err != nil {
+		logging.Logger(err.Error())
+		return err
+	}
+
+	// Only the owner of the server process may operate it. The socket is
+	// created without group and other permissions rather than restricted
+	// after Listen, so nobody can connect in between.
+	mask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		logging.Logger(err.Error())
+		return fmt.Errorf("failed to listen on admin socket: %v", err)
+	}
+	defer listener.Close()
+	logging.Logger("Admin socket listening on " + path)
+
+	return Serve(listener, c)
+}
+
+// removeStaleSocket removes the socket at path if no server answers on it.
+// A missing path is fine; anything else there is an error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check admin socket: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("admin socket path %s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("admin socket %s is in use by another server", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale admin socket: %v", err)
+	}
+	return nil
+}
+
+// Serve accepts connections on listener and answers their requests.
+func Serve(listener net.Listener, c Controller) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logging.Logger(err.Error())
+			return err
+		}
+		go serveConn(conn, c)
+	}
+}
+
+// serveConn answers requests on a single admin connection until it is closed.
+func serveConn(conn net.Conn, c Controller) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req Request
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp = Response{Error: fmt.Sprintf("invalid request: %v", err)}
+		} else {
+			resp = Handle(c, req)
+		}
+		if err := encoder.Encode(resp); err != nil {
+			logging.Logger(err.Error())
+			return
+		}
+	}
+}
+
+// Handle dispatches a request to the controller.
+func Handle(c Controller, req Request) Response {
+	logging.Logger("Admin command: " + req.Command + " " + strings.Join(req.Args, " "))
+	log.Printf("Admin command: %s %s", req.Command, strings.Join(req.Args, " "))
+
+	var err error
+	switch req.Command {
+	case "list":
+		return Response{OK: true, Clients: c.ListClients()}
+	case "kick":
+		if len(req.Args) != 1 {
+			return Response{Error: "usage: kick <name>"}
+		}
+		err = c.Kick(req.Args[0])
+	case "ban":
+		if len(req.Args) != 1 {
+			return Response{Error: "usage: ban <name|ip>"}
+		}
+		err = c.Ban(req.Args[0])
+	case "unban":
+		if len(req.Args) != 1 {
+			return Response{Error: "usage: unban <name|ip>"}
+		}
+		err = c.Unban(req.Args[0])
+	case "notice":
+		if len(req.Args) == 0 {
+			return Response{Error: "usage: notice <text>"}
+		}
+		err = c.Notice(strings.Join(req.Args, " "))
+	case "reload":
+		err = c.Reload()
+	case "rotate-logs":
+		err = c.RotateLogs()
+	case "export":
+		messages, err := c.Export()
+		if err != nil {
+			return Response{Error: err.Error()}
+		}
+		return Response{OK: true, Messages: messages}
+	default:
+		return Response{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return Response{OK: true}
+}
+
+// Call sends a single request to the admin socket at path and returns the response.
+func Call(path string, req Request) (Response, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to connect to admin socket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{}, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,167 @@
+package admin
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+	"netcat/internal/storage"
+)
+
+// fakeController records the commands it is given.
+type fakeController struct {
+	calls []string
+}
+
+func (c *fakeController) ListClients() []ClientInfo {
+	return []ClientInfo{{Name: "layla", Addr: "127.0.0.1:4242", Connected: time.Now(), IdleSeconds: 90}}
+}
+
+func (c *fakeController) Kick(name string) error {
+	c.calls = append(c.calls, "kick "+name)
+	if name != "layla" {
+		return errors.New("no client named " + name)
+	}
+	return nil
+}
+
+func (c *fakeController) Ban(target string) error {
+	c.calls = append(c.calls, "ban "+target)
+	return nil
+}
+
+func (c *fakeController) Unban(target string) error {
+	c.calls = append(c.calls, "unban "+target)
+	return nil
+}
+
+func (c *fakeController) Notice(text string) error {
+	c.calls = append(c.calls, "notice "+text)
+	return nil
+}
+
+func (c *fakeController) Reload() error {
+	c.calls = append(c.calls, "reload")
+	return errors.New("reload rejected: bad config")
+}
+
+func (c *fakeController) RotateLogs() error {
+	c.calls = append(c.calls, "rotate-logs")
+	return nil
+}
+
+func (c *fakeController) Export() ([]storage.Message, error) {
+	return []storage.Message{{ID: 1, Room: "general", Name: "layla", Body: "hi"}}, nil
+}
+
+// TestHandle tests that each command reaches the controller with its
+// arguments, and that wrong arguments and controller errors are answered.
+func TestHandle(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHandle...")
+	c := &fakeController{}
+
+	tests := []struct {
+		req   Request
+		ok    bool
+		error string
+	}{
+		{Request{Command: "kick", Args: []string{"layla"}}, true, ""},
+		{Request{Command: "kick", Args: []string{"lucas"}}, false, "no client named lucas"},
+		{Request{Command: "kick"}, false, "usage: kick <name>"},
+		{Request{Command: "ban", Args: []string{"203.0.113.7"}}, true, ""},
+		{Request{Command: "ban", Args: []string{"a", "b"}}, false, "usage: ban <name|ip>"},
+		{Request{Command: "unban", Args: []string{"203.0.113.7"}}, true, ""},
+		{Request{Command: "notice", Args: []string{"back", "in", "5"}}, true, ""},
+		{Request{Command: "notice"}, false, "usage: notice <text>"},
+		{Request{Command: "reload"}, false, "reload rejected: bad config"},
+		{Request{Command: "rotate-logs"}, true, ""},
+		{Request{Command: "shutdown"}, false, `unknown command "shutdown"`},
+	}
+	for _, test := range tests {
+		if resp := Handle(c, test.req); resp.OK != test.ok || resp.Error != test.error {
+			colortest.LogError(t, test.req.Command+": unexpected response: "+resp.Error)
+		}
+	}
+	want := "kick layla\nkick lucas\nban 203.0.113.7\nunban 203.0.113.7\nnotice back in 5\nreload\nrotate-logs"
+	if got := strings.Join(c.calls, "\n"); got != want {
+		colortest.LogError(t, "unexpected calls:\n"+got)
+	}
+
+	if resp := Handle(c, Request{Command: "list"}); !resp.OK || len(resp.Clients) != 1 || resp.Clients[0].Name != "layla" {
+		colortest.LogError(t, "unexpected list response")
+	}
+	if resp := Handle(c, Request{Command: "export"}); !resp.OK || len(resp.Messages) != 1 || resp.Messages[0].Body != "hi" {
+		colortest.LogError(t, "unexpected export response")
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestHandle completed successfully")
+	}
+}
+
+// TestSocket tests the admin subcommand against a served socket, that the
+// socket is only usable by its owner, and that only a stale socket is
+// replaced.
+func TestSocket(t *testing.T) {
+	colortest.LogInfo(t, "Running TestSocket...")
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "notes.txt")
+	os.WriteFile(file, []byte("keep me"), 0644)
+	if err := ListenAndServe(file, &fakeController{}); err == nil {
+		colortest.LogError(t, "a regular file was taken for a socket")
+	}
+	if content, err := os.ReadFile(file); err != nil || string(content) != "keep me" {
+		colortest.LogError(t, "a regular file at the socket path was removed")
+	}
+
+	// A socket left behind by a server that is gone
+	path := filepath.Join(dir, "admin.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	c := &fakeController{}
+	go ListenAndServe(path, c)
+	var out bytes.Buffer
+	for i := 0; i < 100; i++ {
+		out.Reset()
+		if RunCLI([]string{"-socket", path, "list"}, &out) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(out.String(), "NAME") || !strings.Contains(out.String(), "layla  127.0.0.1:4242") {
+		colortest.LogError(t, "unexpected list output: "+out.String())
+	}
+	if fi, err := os.Lstat(path); err != nil || fi.Mode().Perm()&0077 != 0 {
+		colortest.LogError(t, "admin socket is open to other users")
+	}
+	if err := ListenAndServe(path, &fakeController{}); err == nil || !strings.Contains(err.Error(), "in use") {
+		colortest.LogError(t, "a socket in use was replaced")
+	}
+
+	out.Reset()
+	if code := RunCLI([]string{"-socket", path, "kick", "lucas"}, &out); code != 1 || out.String() != "Error: no client named lucas\n" {
+		colortest.LogError(t, "unexpected kick output: "+out.String())
+	}
+	out.Reset()
+	if code := RunCLI([]string{"-socket", path, "export"}, &out); code != 0 || !strings.Contains(out.String(), `"body":"hi"`) {
+		colortest.LogError(t, "unexpected export output: "+out.String())
+	}
+	out.Reset()
+	if code := RunCLI([]string{"-socket", path}, &out); code != 2 || !strings.HasPrefix(out.String(), "[USAGE]") {
+		colortest.LogError(t, "unexpected usage output: "+out.String())
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestSocket completed successfully")
+	}
+}
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// CLIUsage is printed when the admin subcommand is used incorrectly.
+const CLIUsage = `[USAGE]: ./TCPChat admin [-socket path] <command> [args]
+
+Commands:
+  list                 list connected clients with address and idle time
+  kick <name>          disconnect a client
+  ban <name|ip>        ban a username or IP address and kick matching clients
+  unban <name|ip>      lift a ban
+  notice <text>        broadcast a server notice
+  reload               re-read the welcome message and config file
+  rotate-logs          start a new log file
+  export               print the message history as JSON lines`
+
+// RunCLI runs the admin subcommand with the given arguments and returns the exit code.
+func RunCLI(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	socket := fs.String("socket", DefaultSocket, "path of the server's admin socket")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Fprintln(out, CLIUsage)
+		return 2
+	}
+
+	req := Request{Command: fs.Arg(0), Args: fs.Args()[1:]}
+	resp, err := Call(*socket, req)
+	if err != nil {
+		fmt.Fprintln(out, "Error:", err)
+		return 1
+	}
+	if !resp.OK {
+		fmt.Fprintln(out, "Error:", resp.Error)
+		return 1
+	}
+
+	switch {
+	case req.Command == "list":
+		printClients(out, resp.Clients)
+	case req.Command == "export":
+		encoder := json.NewEncoder(out)
+		for _, m := range resp.Messages {
+			encoder.Encode(m)
+		}
+	case resp.Message != "":
+		fmt.Fprintln(out, resp.Message)
+	default:
+		fmt.Fprintln(out, "OK")
+	}
+	return 0
+}
+
+// printClients writes the client list as an aligned table.
+func printClients(out io.Writer, clients []ClientInfo) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tCONNECTED\tIDLE")
+	for _, c := range clients {
+		idle := time.Duration(c.IdleSeconds) * time.Second
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Addr, c.Connected.Format("2006-01-02 15:04:05"), idle)
+	}
+	w.Flush()
+}
@@ -0,0 +1,294 @@
+// Package api serves the HTTP interface that lets services such as CI jobs
+// post to the chat and read it without an interactive session.
+//
+// Every request carries "Authorization: Bearer <token>"; the token decides
+// the service identity messages are posted as. Routes:
+//
+//	POST /api/v1/rooms/{room}/messages   {"body": "...", "reply_to": "<id>"}
+//	GET  /api/v1/rooms/{room}/messages   ?limit=50&before=<id>
+//	GET  /api/v1/users                   ?room=<room>
+//
+// Message pages are returned oldest first; pass the page's next_before as
+// before to fetch the messages preceding it.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"netcat/internal/logging"
+	"netcat/internal/metrics"
+	"netcat/internal/storage"
+)
+
+// Page sizes for history requests.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// maxBody is the largest request body accepted.
+const maxBody = 64 * 1024
+
+// Error is returned by a Backend to answer with a status other than 500.
+type Error struct {
+	Status  int    // HTTP status code
+	Message string // Sent to the caller
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// NotFound returns an Error answered with 404.
+func NotFound(format string, args ...any) error {
+	return &Error{Status: http.StatusNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+// Invalid returns an Error answered with 400.
+func Invalid(format string, args ...any) error {
+	return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+var requests = metrics.Default.NewCounterVec(
+	"netcat_api_requests_total", "HTTP API requests, by route and status code.", "route", "code")
+
+// Token is one configured API credential.
+type Token struct {
+	Name  string `json:"name"`  // Service identity messages are posted as, after ServicePrefix
+	Token string `json:"token"` // Bearer token, at least MinTokenLength characters
+}
+
+// ServicePrefix starts the name a service's messages are posted under. No
+// username may contain a /, so a service is never taken for a user.
+const ServicePrefix = "api/"
+
+// MinTokenLength is the shortest token accepted, to keep them unguessable.
+const MinTokenLength = 16
+
+// Validate checks that the token can be used.
+func (t Token) Validate() error {
+	if t.Name == "" || len(t.Name) > 15 {
+		return fmt.Errorf("api token name %q must be 1 to 15 characters", t.Name)
+	}
+	if strings.ContainsAny(t.Name, "/@") {
+		return fmt.Errorf("api token name %q cannot contain / or @", t.Name)
+	}
+	if len(t.Token) < MinTokenLength {
+		return fmt.Errorf("api token for %q must be at least %d characters", t.Name, MinTokenLength)
+	}
+	return nil
+}
+
+// Lookup returns the name of the token in tokens matching presented,
+// comparing in constant time.
+func Lookup(tokens []Token, presented string) (string, bool) {
+	name, found := "", false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(presented)) == 1 && !found {
+			name, found = t.Name, true
+		}
+	}
+	return name, found
+}
+
+// Message is a chat message as returned by the API.
+type Message struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	Name    string    `json:"name"`
+	Body    string    `json:"body"`
+	ReplyTo string    `json:"reply_to,omitempty"`
+	Edited  bool      `json:"edited,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+	Service bool      `json:"service,omitempty"` // Posted through the API rather than by a user
+}
+
+// NewMessage converts a stored message.
+func NewMessage(m storage.Message) Message {
+	msg := Message{ID: storage.FormatID(m.ID), Time: m.Time, Room: m.Room, Name: m.Name, Body: m.Body, Edited: m.Edited, Deleted: m.Deleted, Service: m.Service}
+	if m.Parent != 0 {
+		msg.ReplyTo = storage.FormatID(m.Parent)
+	}
+	return msg
+}
+
+// User is a client currently in the chat.
+type User struct {
+	Name        string    `json:"name"`
+	Room        string    `json:"room"`
+	Bot         bool      `json:"bot,omitempty"`
+	State       string    `json:"state"`            // online, away or busy
+	Status      string    `json:"status,omitempty"` // Message given with the state
+	Connected   time.Time `json:"connected"`
+	IdleSeconds int64     `json:"idle_seconds"`
+}
+
+// Backend is implemented by the server to carry out API requests.
+type Backend interface {
+	// Authenticate returns the service name for a bearer token sent from
+	// the remote address addr.
+	Authenticate(token, addr string) (string, bool)
+	// PostAs posts body to room as the named service, replying to replyTo
+	// unless it is empty, and returns the stored message.
+	PostAs(service, room, body, replyTo string) (storage.Message, error)
+	// RoomHistory returns up to limit messages of room older than the
+	// message before, or the newest ones if before is 0, oldest first. more
+	// reports whether older messages remain.
+	RoomHistory(room string, before int64, limit int) (messages []storage.Message, more bool, err error)
+	// OnlineUsers returns the clients in room, or in every room if room is empty.
+	OnlineUsers(room string) []User
+}
+
+// postRequest is the body of a POST to a room's messages.
+type postRequest struct {
+	Body    string `json:"body"`
+	ReplyTo string `json:"reply_to"`
+}
+
+// historyPage is the answer to a GET of a room's messages.
+type historyPage struct {
+	Messages   []Message `json:"messages"`
+	NextBefore string    `json:"next_before,omitempty"` // Pass as before for the previous page
+}
+
+// errorBody is the JSON sent with every failed request.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the HTTP handler for the API.
+func Handler(b Backend) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/rooms/{room}/messages", authenticated(b, "post_message", postMessage(b)))
+	mux.Handle("GET /api/v1/rooms/{room}/messages", authenticated(b, "get_messages", getMessages(b)))
+	mux.Handle("GET /api/v1/users", authenticated(b, "get_users", getUsers(b)))
+	return mux
+}
+
+// ListenAndServe serves the API on addr.
+func ListenAndServe(addr string, b Backend) error {
+	logging.Logger("HTTP API listening on " + addr)
+	server := &http.Server{Addr: addr, Handler: Handler(b), ReadHeaderTimeout: 10 * time.Second}
+	return server.ListenAndServe()
+}
+
+// serviceHandler handles a request made by an authenticated service and
+// returns the status code it answered with.
+type serviceHandler func(w http.ResponseWriter, r *http.Request, service string) int
+
+// authenticated checks the bearer token before calling next, and counts the
+// request under route.
+func authenticated(b Backend, route string, next serviceHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		service, valid := b.Authenticate(strings.TrimSpace(token), r.RemoteAddr)
+		if !ok || !valid {
+			logging.Logger(fmt.Sprintf("API request to %s from %s refused: bad token", r.URL.Path, r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tcpchat"`)
+			code := writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+			return
+		}
+		code := next(w, r, service)
+		requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	})
+}
+
+// postMessage handles POST /api/v1/rooms/{room}/messages.
+func postMessage(b Backend) serviceHandler {
+	return func(w http.ResponseWriter, r *http.Request, service string) int {
+		var req postRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			return writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		}
+
+		stored, err := b.PostAs(service, r.PathValue("room"), req.Body, req.ReplyTo)
+		if err != nil {
+			return writeBackendError(w, err)
+		}
+		logging.Logger(fmt.Sprintf("API message #%s posted by %s", storage.FormatID(stored.ID), service))
+		return writeJSON(w, http.StatusCreated, NewMessage(stored))
+	}
+}
+
+// getMessages handles GET /api/v1/rooms/{room}/messages.
+func getMessages(b Backend) serviceHandler {
+	return func(w http.ResponseWriter, r *http.Request, service string) int {
+		query := r.URL.Query()
+		limit := DefaultLimit
+		if value := query.Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > MaxLimit {
+				return writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", MaxLimit))
+			}
+			limit = n
+		}
+		var before int64
+		if value := query.Get("before"); value != "" {
+			id, err := storage.ParseID(value)
+			if err != nil {
+				return writeError(w, http.StatusBadRequest, err.Error())
+			}
+			before = id
+		}
+
+		messages, more, err := b.RoomHistory(r.PathValue("room"), before, limit)
+		if err != nil {
+			return writeBackendError(w, err)
+		}
+		page := historyPage{Messages: make([]Message, 0, len(messages))}
+		for _, m := range messages {
+			page.Messages = append(page.Messages, NewMessage(m))
+		}
+		if more && len(messages) > 0 {
+			page.NextBefore = storage.FormatID(messages[0].ID)
+		}
+		return writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// getUsers handles GET /api/v1/users.
+func getUsers(b Backend) serviceHandler {
+	return func(w http.ResponseWriter, r *http.Request, service string) int {
+		users := b.OnlineUsers(r.URL.Query().Get("room"))
+		if users == nil {
+			users = []User{}
+		}
+		return writeJSON(w, http.StatusOK, struct {
+			Users []User `json:"users"`
+		}{users})
+	}
+}
+
+// writeBackendError answers with the status matching err.
+func writeBackendError(w http.ResponseWriter, err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return writeError(w, apiErr.Status, apiErr.Message)
+	}
+	logging.Logger(err.Error())
+	return writeError(w, http.StatusInternalServerError, "internal error, please try again")
+}
+
+// writeError answers with status and a JSON error message.
+func writeError(w http.ResponseWriter, status int, text string) int {
+	return writeJSON(w, status, errorBody{Error: text})
+}
+
+// writeJSON answers with status and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v any) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Logger(err.Error())
+	}
+	return status
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+	"netcat/internal/storage"
+)
+
+// fakeBackend keeps messages in memory for one room, "general".
+type fakeBackend struct {
+	tokens   []Token
+	messages []storage.Message
+}
+
+func (b *fakeBackend) Authenticate(token, addr string) (string, bool) { return Lookup(b.tokens, token) }
+
+func (b *fakeBackend) PostAs(service, room, body, replyTo string) (storage.Message, error) {
+	if room != "general" {
+		return storage.Message{}, NotFound("no room named %q", room)
+	}
+	if body == "" {
+		return storage.Message{}, Invalid("message cannot be empty")
+	}
+	m := storage.Message{ID: int64(len(b.messages) + 1), Time: time.Now(), Room: room, Name: service, Body: body}
+	b.messages = append(b.messages, m)
+	return m, nil
+}
+
+func (b *fakeBackend) RoomHistory(room string, before int64, limit int) ([]storage.Message, bool, error) {
+	end := len(b.messages)
+	if before != 0 && int(before)-1 < end {
+		end = int(before) - 1
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return b.messages[start:end], start > 0, nil
+}
+
+func (b *fakeBackend) OnlineUsers(room string) []User {
+	return []User{{Name: "layla", Room: "general"}}
+}
+
+// do sends a request with token to the handler and decodes the JSON answer into v.
+func do(t *testing.T, h http.Handler, method, target, token, body string, v any) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			colortest.LogError(t, "invalid JSON answer: "+rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+// TestHandler tests authentication, posting, paging through history and
+// listing users.
+func TestHandler(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHandler...")
+	const token = "0123456789abcdef"
+	h := Handler(&fakeBackend{tokens: []Token{{Name: "ci", Token: token}}})
+
+	if code := do(t, h, "GET", "/api/v1/users", "", "", nil); code != http.StatusUnauthorized {
+		colortest.LogError(t, "request without a token was not refused")
+	}
+	if code := do(t, h, "GET", "/api/v1/users", "wrong-token-0000", "", nil); code != http.StatusUnauthorized {
+		colortest.LogError(t, "request with a wrong token was not refused")
+	}
+
+	for _, body := range []string{"one", "two", "three"} {
+		var msg Message
+		if code := do(t, h, "POST", "/api/v1/rooms/general/messages", token, `{"body":"`+body+`"}`, &msg); code != http.StatusCreated || msg.Name != "ci" {
+			colortest.LogError(t, "post failed: "+msg.Body)
+		}
+	}
+	var failure errorBody
+	if code := do(t, h, "POST", "/api/v1/rooms/random/messages", token, `{"body":"x"}`, &failure); code != http.StatusNotFound {
+		colortest.LogError(t, "post to an unknown room answered: "+failure.Error)
+	}
+	if code := do(t, h, "POST", "/api/v1/rooms/general/messages", token, `{"body":""}`, &failure); code != http.StatusBadRequest {
+		colortest.LogError(t, "empty post was accepted")
+	}
+
+	var page historyPage
+	do(t, h, "GET", "/api/v1/rooms/general/messages?limit=2", token, "", &page)
+	if len(page.Messages) != 2 || page.Messages[0].Body != "two" || page.NextBefore != "2" {
+		colortest.LogError(t, "unexpected first page")
+	}
+	page = historyPage{}
+	do(t, h, "GET", "/api/v1/rooms/general/messages?limit=2&before="+"2", token, "", &page)
+	if len(page.Messages) != 1 || page.Messages[0].Body != "one" || page.NextBefore != "" {
+		colortest.LogError(t, "unexpected second page")
+	}
+	if code := do(t, h, "GET", "/api/v1/rooms/general/messages?limit=1000", token, "", nil); code != http.StatusBadRequest {
+		colortest.LogError(t, "oversized limit was accepted")
+	}
+
+	var users struct{ Users []User }
+	do(t, h, "GET", "/api/v1/users", token, "", &users)
+	if len(users.Users) != 1 || users.Users[0].Name != "layla" {
+		colortest.LogError(t, "unexpected user list")
+		return
+	}
+	colortest.LogSuccess(t, "TestHandler completed successfully")
+}
@@ -4,14 +4,20 @@ package app
 import (
 	"fmt"
 	"log"
+	"netcat/internal/admin"
+	"netcat/internal/api"
+	"netcat/internal/audit"
 	"netcat/internal/app/client" // Import the client package
 	"netcat/internal/app/server"
 	"netcat/internal/app/utils"
 	"netcat/internal/interfaces"
 	"netcat/internal/logging"
+	"netcat/internal/metrics"
+	"netcat/internal/plugin"
+	"netcat/internal/plugin/dice"
 	"os"
-	// "os/signal"
-	// "syscall"
+	"os/signal"
+	"syscall"
 )
 
 // App represents the main application struct, which encapsulates the server and client initializers.
@@ -19,6 +25,11 @@ type App struct {
 	serverInitializer interfaces.ServerInitializer
 }
 
+// builtinBots are the plugins that can be started with -bots, by name.
+var builtinBots = map[string]func() plugin.Plugin{
+	"dice": func() plugin.Plugin { return dice.New() },
+}
+
 // NewApp creates a new instance of the application with the given server initializer.
 func NewApp(serverInitializer interfaces.ServerInitializer) *App {
 	return &App{
@@ -43,33 +54,97 @@ func (a *App) StartServer(port int) {
 	}
 }
 
-//Not Used
-// StartClient starts the NetCat client connection.
-func (a *App) StartClient() {
-	// Start the client connection
-	client.ClientConnect()
+// RunAdmin runs the `TCPChat admin` subcommand against a running server and exits.
+func RunAdmin(args []string) {
+	os.Exit(admin.RunCLI(args, os.Stdout))
+}
+
+// RunAudit runs the `TCPChat audit` subcommand on the audit trail and exits.
+func RunAudit(args []string) {
+	os.Exit(audit.RunCLI(args, os.Stdout))
+}
+
+// RunClient runs the `TCPChat client` subcommand and exits.
+func RunClient(args []string) {
+	os.Exit(client.RunCLI(args, os.Stdin, os.Stdout, os.Stderr))
 }
 
 // RunServer is a convenience function to start the NetCat server using command-line arguments.
 func RunServer() {
 	logging.CreateLogger() 
-	// A channel to handle the shutdown signal
-	// shutdownSignal := make(chan os.Signal, 1)
-	// signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGTERM)
 	
-	// Parse the port number from command-line arguments.
-	port := utils.ParsePortFromArgs(os.Args)
+	// Parse the port number and flags from command-line arguments.
+	opts := utils.ParseOptions(os.Args)
+
+	// Serve the optional Prometheus endpoint alongside the chat.
+	if opts.MetricsAddr != "" {
+		go func() {
+			if err := metrics.ListenAndServe(opts.MetricsAddr); err != nil {
+				logging.Logger(err.Error())
+				log.Printf("Metrics endpoint error: %v", err)
+			}
+		}()
+		log.Printf("Serving metrics on %s/metrics", opts.MetricsAddr)
+	}
 
-	// Create a new server initializer instance.
-	serverInitializer := server.NewServer()
+	// Create a new server instance with the requested bots.
+	var plugins []plugin.Plugin
+	for _, name := range opts.Bots {
+		newBot, ok := builtinBots[name]
+		if !ok {
+			log.Fatalf("Unknown bot %q", name)
+		}
+		plugins = append(plugins, newBot())
+	}
+	srv := server.NewServer(plugins...).(*server.Server)
+	srv.ConfigPath = opts.ConfigPath
+
+	// Reload the welcome message and config on SIGHUP, and optionally on change.
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			logging.Logger("SIGHUP received, reloading configuration")
+			srv.Reload()
+		}
+	}()
+	if opts.WatchInterval > 0 {
+		go srv.WatchConfig(opts.WatchInterval)
+	}
+
+	// Flush webhook deliveries and close federation links on shutdown.
+	shutdownSignal := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-shutdownSignal
+		logging.Logger(fmt.Sprintf("%v received, shutting down", sig))
+		srv.Close()
+		os.Exit(0)
+	}()
+
+	// Serve the local admin socket for the `TCPChat admin` subcommand.
+	if opts.AdminSocket != "" {
+		go func() {
+			if err := admin.ListenAndServe(opts.AdminSocket, srv); err != nil {
+				log.Printf("Admin socket error: %v", err)
+			}
+		}()
+	}
+
+	// Serve the HTTP API for services that post without a chat session.
+	if opts.APIAddr != "" {
+		go func() {
+			if err := api.ListenAndServe(opts.APIAddr, srv); err != nil {
+				logging.Logger(err.Error())
+				log.Printf("HTTP API error: %v", err)
+			}
+		}()
+		log.Printf("Serving the HTTP API on %s/api/v1", opts.APIAddr)
+	}
 
 	// Create a new application instance with the server initializer.
-	app := NewApp(serverInitializer)
+	app := NewApp(srv)
 
 	// Start the server with the specified port.
-	app.StartServer(port)
-
-	//Not Used
-	// Start the client connection concurrently
-	go app.StartClient()
+	app.StartServer(opts.Port)
 }
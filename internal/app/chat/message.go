@@ -1,3 +1,247 @@
+// Package chat renders chat lines through text/template so the layout of
+// messages, prompts and notices can be changed per server and per user.
 package chat
 
-//TODO REFACTOR
\ No newline at end of file
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Line kinds, each rendered by the template of the same name.
+const (
+	KindPrompt  = "prompt"  // Input prompt redrawn after every line
+	KindMessage = "message" // A chat message
+	KindQuote   = "quote"   // The quoted parent shown above a reply
+	KindJoin    = "join"    // A user joined the room
+	KindLeave   = "leave"   // A user left the room
+	KindSystem  = "system"  // Server notices and edit/delete notifications
+	KindDM      = "dm"      // A private message
+)
+
+// DefaultTimeLayout is the timestamp layout used unless the config or user changes it.
+const DefaultTimeLayout = "2006-01-02 15:04:05"
+
+// DefaultTemplates reproduce the classic TCP-Chat layout.
+var DefaultTemplates = map[string]string{
+	KindPrompt:  "[{{.Time}}][{{.Name}}]:",
+	KindMessage: "[{{.Time}}][{{.Name}}] #{{.ID}}: {{.Body}}",
+	KindQuote:   "> {{.Name}} #{{.ID}}: {{.Body}}",
+	KindJoin:    "{{.Name}} has joined our chat...",
+	KindLeave:   "{{.Name}} has left our chat...",
+	KindSystem:  "{{.Body}}",
+	KindDM:      "[{{.Time}}][DM from {{.Name}}]: {{.Body}}",
+}
+
+// Line is the data a template is rendered with.
+type Line struct {
+	Time time.Time
+	Name string
+	Room string
+	Body string
+	ID   string
+
+	Quote *Line // Parent of a reply, rendered with the quote template above a message
+}
+
+// lineData is what templates see: Line with the time already formatted.
+type lineData struct {
+	Time string // Timestamp in the configured layout and zone
+	TZ   string // Zone abbreviation, e.g. UTC or CEST
+	Name string
+	Room string
+	Body string
+	ID   string
+}
+
+// Format selects the timestamp layout, zone and templates. Empty fields and
+// missing templates fall back to the format it is merged over.
+type Format struct {
+	TimeLayout string            `json:"time_layout,omitempty"`
+	TimeZone   string            `json:"time_zone,omitempty"`
+	Templates  map[string]string `json:"templates,omitempty"`
+}
+
+// IsZero reports whether f changes nothing.
+func (f Format) IsZero() bool {
+	return f.TimeLayout == "" && f.TimeZone == "" && len(f.Templates) == 0
+}
+
+// Merge returns f with every setting in override applied on top.
+func (f Format) Merge(override Format) Format {
+	merged := Format{TimeLayout: f.TimeLayout, TimeZone: f.TimeZone, Templates: make(map[string]string)}
+	for kind, text := range f.Templates {
+		merged.Templates[kind] = text
+	}
+	if override.TimeLayout != "" {
+		merged.TimeLayout = override.TimeLayout
+	}
+	if override.TimeZone != "" {
+		merged.TimeZone = override.TimeZone
+	}
+	for kind, text := range override.Templates {
+		merged.Templates[kind] = text
+	}
+	return merged
+}
+
+// Renderer renders lines with a parsed Format.
+type Renderer struct {
+	format   Format
+	base     *Renderer
+	layout   string
+	location *time.Location
+	tmpl     *template.Template
+}
+
+// NewRenderer parses f over the defaults, rejecting unknown kinds, unknown
+// time zones and templates that do not parse or execute.
+func NewRenderer(f Format) (*Renderer, error) {
+	r := &Renderer{format: f, layout: DefaultTimeLayout, location: time.Local, tmpl: template.New("chat")}
+	if f.TimeLayout != "" {
+		r.layout = f.TimeLayout
+	}
+	if f.TimeZone != "" {
+		location, err := time.LoadLocation(f.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", f.TimeZone)
+		}
+		r.location = location
+	}
+
+	for kind := range f.Templates {
+		if _, ok := DefaultTemplates[kind]; !ok {
+			return nil, fmt.Errorf("unknown template %q, expected one of %s", kind, strings.Join(Kinds(), ", "))
+		}
+	}
+	for kind, text := range DefaultTemplates {
+		if custom, ok := f.Templates[kind]; ok {
+			text = custom
+		}
+		if _, err := r.tmpl.New(kind).Option("missingkey=error").Parse(text); err != nil {
+			return nil, fmt.Errorf("invalid %s template: %v", kind, err)
+		}
+		// Try it once so a reference to an unknown field is caught now, not mid-chat.
+		if err := r.tmpl.ExecuteTemplate(new(strings.Builder), kind, lineData{}); err != nil {
+			return nil, fmt.Errorf("invalid %s template: %v", kind, err)
+		}
+	}
+	return r, nil
+}
+
+// Override returns a renderer with the settings in f applied over r's.
+func (r *Renderer) Override(f Format) (*Renderer, error) {
+	override, err := NewRenderer(r.format.Merge(f))
+	if err != nil {
+		return nil, err
+	}
+	override.base = r
+	return override, nil
+}
+
+// Base returns the renderer r was derived from with Override, or nil.
+func (r *Renderer) Base() *Renderer {
+	return r.base
+}
+
+// Format returns the settings the renderer was built from.
+func (r *Renderer) Format() Format {
+	return r.format
+}
+
+// Layout returns the effective timestamp layout.
+func (r *Renderer) Layout() string {
+	return r.layout
+}
+
+// Location returns the effective time zone.
+func (r *Renderer) Location() *time.Location {
+	return r.location
+}
+
+// Template returns the effective template text for kind.
+func (r *Renderer) Template(kind string) string {
+	if text, ok := r.format.Templates[kind]; ok {
+		return text
+	}
+	return DefaultTemplates[kind]
+}
+
+// Render renders l with the template for kind. A message with a Quote is
+// preceded by the rendered quote line.
+func (r *Renderer) Render(kind string, l Line) string {
+	if kind == KindMessage && l.Quote != nil {
+		return r.Render(KindQuote, *l.Quote) + "\n" + r.Render(kind, Line{Time: l.Time, Name: l.Name, Room: l.Room, Body: l.Body, ID: l.ID})
+	}
+
+	t := l.Time.In(r.location)
+	data := lineData{Time: t.Format(r.layout), TZ: t.Format("MST"), Name: l.Name, Room: l.Room, Body: l.Body, ID: l.ID}
+
+	var b strings.Builder
+	if err := r.tmpl.ExecuteTemplate(&b, kind, data); err != nil {
+		// Templates are checked when parsed, so this only happens for a bad kind.
+		return l.Body
+	}
+	return b.String()
+}
+
+// MaxUserTemplate is the longest template a user may set for themselves.
+const MaxUserTemplate = 200
+
+// CheckUserTemplate rejects a template a user may not set for themselves.
+// Only text, field references and if/else are allowed: functions, range and
+// nested templates could be used to make the server render unbounded output.
+func CheckUserTemplate(text string) error {
+	if len(text) > MaxUserTemplate {
+		return fmt.Errorf("template is longer than %d characters", MaxUserTemplate)
+	}
+	// No function map is given, so any function call fails to parse.
+	trees, err := parse.Parse("user", text, "", "")
+	if err != nil {
+		return fmt.Errorf("invalid template: %v", err)
+	}
+	if len(trees) != 1 {
+		return fmt.Errorf("templates may not define other templates")
+	}
+	for _, tree := range trees {
+		if err := checkUserNodes(tree.Root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUserNodes walks a parsed user template looking for disallowed actions.
+func checkUserNodes(list *parse.ListNode) error {
+	if list == nil {
+		return nil
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode, *parse.ActionNode:
+		case *parse.IfNode:
+			if err := checkUserNodes(n.List); err != nil {
+				return err
+			}
+			if err := checkUserNodes(n.ElseList); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("only fields and if/else may be used in templates")
+		}
+	}
+	return nil
+}
+
+// Kinds returns every template kind in sorted order.
+func Kinds() []string {
+	kinds := make([]string, 0, len(DefaultTemplates))
+	for kind := range DefaultTemplates {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
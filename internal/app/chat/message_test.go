@@ -0,0 +1,48 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestRenderer tests the default layout, overrides and template validation.
+func TestRenderer(t *testing.T) {
+	colortest.LogInfo(t, "Running TestRenderer...")
+	at := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	line := Line{Time: at, Name: "layla", Body: "hi", ID: "2", Quote: &Line{Name: "sara", Body: "hello", ID: "1"}}
+
+	server, err := NewRenderer(Format{TimeZone: "UTC"})
+	if err != nil {
+		colortest.LogError(t, "default format rejected: "+err.Error())
+		return
+	}
+	if got := server.Render(KindMessage, line); got != "> sara #1: hello\n[2024-03-01 09:30:00][layla] #2: hi" {
+		colortest.LogError(t, "unexpected default rendering: "+got)
+	}
+
+	user, err := server.Override(Format{TimeLayout: "15:04", Templates: map[string]string{KindPrompt: "{{.Time}} {{.Name}}>"}})
+	if err != nil {
+		colortest.LogError(t, "override rejected: "+err.Error())
+		return
+	}
+	if got := user.Render(KindPrompt, line); got != "09:30 layla>" || user.Base() != server {
+		colortest.LogError(t, "override not applied: "+got)
+	}
+
+	if _, err := NewRenderer(Format{Templates: map[string]string{KindJoin: "{{.Nick}}"}}); err == nil {
+		colortest.LogError(t, "template with an unknown field accepted")
+	}
+	for _, text := range []string{`{{printf "%999999999d" 1}}`, "{{range 1000000000}}x{{end}}", `{{define "x"}}{{end}}`} {
+		if CheckUserTemplate(text) == nil {
+			colortest.LogError(t, "unsafe user template accepted: "+text)
+			return
+		}
+	}
+	if err := CheckUserTemplate("{{if .ID}}#{{.ID}} {{end}}{{.Body}}"); err != nil {
+		colortest.LogError(t, "plain user template rejected: "+err.Error())
+	} else {
+		colortest.LogSuccess(t, "TestRenderer completed successfully")
+	}
+}
@@ -2,9 +2,9 @@ package client
 
 import (
 	"bufio"
+	"netcat/internal/app/chat"
 	"net"
-	"fmt"
-	"os"
+	"time"
 )
 
 // Client represents a connected client
@@ -13,52 +13,21 @@ type Client struct {
 	Conn net.Conn
 	// Messages chan string
 	Writer *bufio.Writer
-}
-
-//Not Used
-func ClientConnect() {
-	// Connect to the server
-	conn, err := net.Dial("tcp", "localhost:9898")
-	if err != nil {
-		fmt.Println("Error connecting:", err)
-		return
-	}
-	defer conn.Close()
-
-	// Create a bufio Reader to read messages from the server
-	reader := bufio.NewReader(conn)
-
-	// Create a bufio Writer to send messages to the server
-	writer := bufio.NewWriter(conn)
-
-	// Start a goroutine to continuously read messages from the server
-	go func() {
-		for {
-			message, err := reader.ReadString('\n')
-			if err != nil {
-				fmt.Println("Error reading:", err)
-				return
-			}
-			fmt.Print("Server:", message)
-		}
-	}()
-
-	// Start a loop to send messages to the server
-	for {
-		// Read user input from the console
-		fmt.Print("Enter message: ")
-		message, err := bufio.NewReader(os.Stdin).ReadString('\n')
-		if err != nil {
-			fmt.Println("Error reading from console:", err)
-			continue
-		}
 
-		// Send the message to the server
-		_, err = writer.WriteString(message)
-		if err != nil {
-			fmt.Println("Error sending message:", err)
-			continue
-		}
-		writer.Flush() // Flush the buffer to ensure the message is sent immediately
-	}
+	Connected  time.Time // When the client joined the chat
+	LastActive time.Time // When the client last sent a message
+	Operator   bool      // Whether the client has logged in with /oper
+	Identified bool      // Whether the client gave the password of their name with /register or /identify
+	Room       string    // Room the client is chatting in
+	Terminal   bool      // Whether the transport can display ANSI escapes
+	NoColor    bool      // Whether the client turned colors off with /nocolor
+	Proto      string    // Machine-readable protocol in use, empty for humans
+	TypingCap  bool      // Whether the client asked for typing events with CAPS typing
+	Bot        bool      // Whether the client is an in-process plugin
+	LastSpoke  time.Time // When the client last posted a message, zero if never
+	Presence   string    // "away" or "busy" when set with /away or /busy, empty when online
+	Status     string    // Message given with /away or /busy
+
+	Format   chat.Format    // Rendering overrides set with /format
+	Renderer *chat.Renderer // Renderer for Format, rebuilt when the server's changes
 }
@@ -0,0 +1,383 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+	"netcat/internal/protocol"
+)
+
+// syncBuffer collects the client's output from several goroutines.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// fakeServer answers the handshake on conn like the chat server: the
+// banner, the protocol ack, then the answer to the nick or RESUME line,
+// which it returns.
+func fakeServer(t *testing.T, conn net.Conn) (*bufio.Reader, string) {
+	reader := bufio.NewReader(conn)
+	if line, _ := reader.ReadString('\n'); line != protocol.Handshake+"\n" {
+		t.Fatalf("unexpected handshake %q", line)
+	}
+	conn.Write([]byte("Welcome!\n[ENTER YOUR NAME]: "))
+	conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Proto: protocol.Version}))
+	line, _ := reader.ReadString('\n')
+	return reader, strings.TrimSpace(line)
+}
+
+// TestReconnect tests that a dropped client resumes its session from the
+// last message it received, sends what was typed, and keeps the messages in
+// its scrollback, which is shown when it is started again.
+func TestReconnect(t *testing.T) {
+	colortest.LogInfo(t, "Running TestReconnect...")
+	minBackoff = 10 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	opts := Options{Addr: addr, Name: "layla", Room: "general", CacheDir: t.TempDir()}
+
+	resumed := make(chan string, 1)
+	typed := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, nick := fakeServer(t, conn)
+		if !strings.Contains(nick, `"name":"layla"`) {
+			t.Errorf("unexpected nick %q", nick)
+		}
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Ref: "nick", Name: "layla", Room: "general"}))
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeMessage, ID: "1", Time: "2024-03-01T09:30:00Z", Room: "general", Name: "sara", Body: "hello"}))
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeSession, Name: "layla", Session: "tok"}))
+		conn.Close()
+
+		conn, err = listener.Accept()
+		if err != nil {
+			return
+		}
+		// Left open: the client closes it when it quits
+		reader, resume := fakeServer(t, conn)
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Name: "layla", Room: "general", Session: "tok"}))
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeMessage, ID: "2", Time: "2024-03-01T09:31:00Z", Room: "general", Name: "sara", Body: "again"}))
+		resumed <- resume
+
+		// Skip the /who and /help sent for completion
+		var ev protocol.Event
+		for ev.Body == "" || strings.HasPrefix(ev.Body, "/") {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			ev, _ = protocol.Decode(line)
+		}
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Ref: ev.Ref, ID: "3", Time: "2024-03-01T09:32:00Z"}))
+		typed <- ev.Body
+	}()
+
+	in, input := io.Pipe()
+	out := &syncBuffer{}
+	finished := make(chan error, 1)
+	go func() { finished <- Run(opts, in, out) }()
+
+	select {
+	case resume := <-resumed:
+		if resume != "RESUME tok 1" {
+			colortest.LogError(t, "unexpected resume line: "+resume)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect: " + out.String())
+	}
+	input.Write([]byte("hi there\n"))
+	if body := <-typed; body != "hi there" {
+		colortest.LogError(t, "unexpected message: "+body)
+	}
+	time.Sleep(50 * time.Millisecond) // Let the ack be handled
+	input.Close()
+	if err := <-finished; err != nil {
+		colortest.LogError(t, "Run failed: "+err.Error())
+	}
+	if text := out.String(); !strings.Contains(text, "[sara] #1: hello") || !strings.Contains(text, "[sara] #2: again") || !strings.Contains(text, "*** Reconnected to "+addr+" as layla") {
+		colortest.LogError(t, "unexpected output: "+text)
+	}
+
+	events := OpenScrollback(opts.CacheDir, addr, "general").Events()
+	if len(events) != 3 || events[2].Name != "layla" || events[2].Body != "hi there" {
+		colortest.LogError(t, "unexpected scrollback")
+	}
+
+	// Started again with the server gone, the cached conversation is shown
+	listener.Close()
+	out = &syncBuffer{}
+	Run(opts, strings.NewReader(""), out)
+	if text := out.String(); !strings.Contains(text, "Recent messages") || !strings.Contains(text, "[layla] #3: hi there") {
+		colortest.LogError(t, "scrollback not shown: "+text)
+	} else {
+		colortest.LogSuccess(t, "TestReconnect completed successfully")
+	}
+}
+
+// TestRefused tests that a connection dropped after a notice or error is
+// reconnected, and that the client only gives up on a refused event.
+func TestRefused(t *testing.T) {
+	colortest.LogInfo(t, "Running TestRefused...")
+	minBackoff = 10 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for _, last := range []protocol.Event{
+			{Type: protocol.TypeNotice, Body: "The server restarts now."},
+			{Type: protocol.TypeError, Error: "unknown event type"},
+			{Type: protocol.TypeRefused, Code: protocol.CodeKicked, Error: "You have been kicked by the server operator."},
+		} {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fakeServer(t, conn)
+			conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Ref: "nick", Name: "layla", Room: "general"}))
+			conn.Write(protocol.Encode(last))
+			conn.Close()
+		}
+	}()
+
+	in, input := io.Pipe()
+	defer input.Close()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- Run(Options{Addr: listener.Addr().String(), Name: "layla", Room: "general"}, in, io.Discard)
+	}()
+	select {
+	case err := <-finished:
+		var refused *RefusedError
+		if !errors.As(err, &refused) || refused.Code != protocol.CodeKicked {
+			colortest.LogError(t, fmt.Sprintf("expected a refusal for being kicked, got %v", err))
+		} else {
+			colortest.LogSuccess(t, "TestRefused completed successfully")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not stop when refused")
+	}
+}
+
+// TestTypingIndicator tests that a client typing in an Editor declares the
+// typing capability, tells the server when the user starts and stops typing,
+// and shows who else is typing before the prompt.
+func TestTypingIndicator(t *testing.T) {
+	colortest.LogInfo(t, "Running TestTypingIndicator...")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	caps := make(chan string, 1)
+	typing := make(chan string, 10)
+	server := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader, line := fakeServer(t, conn)
+		caps <- line
+		reader.ReadString('\n')
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Ref: "nick", Name: "layla", Room: "general"}))
+		server <- conn
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if ev, _ := protocol.Decode(line); ev.Type == protocol.TypeTyping {
+				typing <- ev.State
+			}
+		}
+	}()
+
+	keys, typed := io.Pipe()
+	out := &syncBuffer{}
+	ed := newEditor(keys, out, "")
+	finished := make(chan error, 1)
+	go func() { finished <- Run(Options{Addr: listener.Addr().String(), Name: "layla"}, ed, ed) }()
+
+	if line := <-caps; line != "CAPS "+protocol.CapTyping {
+		colortest.LogError(t, "typing capability not declared: "+line)
+	}
+	conn := <-server
+	conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeTyping, Room: "general", Name: "sara", State: protocol.TypingStart}))
+	// shown waits for the typist to be shown, or not, before the prompt
+	shown := func(want bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			text := out.String()
+			if strings.LastIndex(text, "\r> ") < strings.LastIndex(text, "\r[sara is typing] > ") == want {
+				return true
+			}
+		}
+		return false
+	}
+	if !shown(true) {
+		colortest.LogError(t, "typist not shown: "+out.String())
+	}
+
+	// One start for the first keys, a stop when the line is cleared
+	typed.Write([]byte("he"))
+	typed.Write([]byte("y\x15"))
+	for _, want := range []string{protocol.TypingStart, protocol.TypingStop} {
+		select {
+		case state := <-typing:
+			if state != want {
+				colortest.LogError(t, "unexpected typing state "+state+", want "+want)
+			}
+		case <-time.After(2 * time.Second):
+			colortest.LogError(t, "no typing "+want+" sent")
+		}
+	}
+
+	conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeTyping, Room: "general", Name: "sara", State: protocol.TypingStop}))
+	if !shown(false) {
+		colortest.LogError(t, "typist still shown after stopping: "+out.String())
+	}
+	typed.Close()
+	if err := <-finished; err != nil {
+		colortest.LogError(t, "Run failed: "+err.Error())
+	} else if len(typing) > 0 {
+		colortest.LogError(t, "more typing events than expected")
+	} else {
+		colortest.LogSuccess(t, "TestTypingIndicator completed successfully")
+	}
+}
+
+// TestHeadless tests that the scripted mode sends its messages, streams
+// what it receives as JSON and exits with the code for each refusal.
+func TestHeadless(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHeadless...")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	// Each connection is answered by the next script
+	scripts := make(chan func(conn net.Conn, reader *bufio.Reader, nick string), 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader, nick := fakeServer(t, conn)
+			(<-scripts)(conn, reader, nick)
+			conn.Close()
+		}
+	}()
+	accept := func(conn net.Conn, nick string) {
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Ref: "nick", Name: "deploybot", Room: "general"}))
+	}
+
+	var sent []string
+	scripts <- func(conn net.Conn, reader *bufio.Reader, nick string) {
+		accept(conn, nick)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			ev, _ := protocol.Decode(line)
+			if ev.Type == protocol.TypeLeave {
+				return
+			}
+			sent = append(sent, ev.Body)
+			conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeMessage, ID: "7", Room: "general", Name: "sara", Body: "seen it"}))
+			conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Ref: ev.Ref, ID: "8"}))
+		}
+	}
+	out := &syncBuffer{}
+	code := RunCLI([]string{"-name", "deploybot", "-send", "deployed v42", "-send", "-", addr}, strings.NewReader("from stdin\n\n"), out, io.Discard)
+	if code != ExitOK || strings.Join(sent, "|") != "deployed v42|from stdin" || out.String() != "" {
+		colortest.LogError(t, "unexpected send: "+strings.Join(sent, "|"))
+	}
+
+	scripts <- func(conn net.Conn, reader *bufio.Reader, nick string) {
+		accept(conn, nick)
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeMessage, ID: "6", Room: "general", Name: "sara", Body: "old", History: true}))
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeMessage, ID: "9", Room: "general", Name: "sara", Body: "new"}))
+	}
+	out = &syncBuffer{}
+	if code := RunCLI([]string{"-name", "deploybot", "-listen", addr}, strings.NewReader(""), out, io.Discard); code != ExitError || strings.Contains(out.String(), "old") || !strings.Contains(out.String(), `"body":"new"`) {
+		colortest.LogError(t, "unexpected listen output: "+out.String())
+	}
+
+	scripts <- func(conn net.Conn, reader *bufio.Reader, nick string) {
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeError, Ref: "nick", Code: protocol.CodeNameTaken, Error: "username already exists"}))
+	}
+	if code := RunCLI([]string{"-name", "deploybot", "-send", "hi", addr}, strings.NewReader(""), io.Discard, io.Discard); code != ExitNameTaken {
+		colortest.LogError(t, "name taken: unexpected exit code "+strconv.Itoa(code))
+	}
+
+	// Exit codes follow the code of the error, not its wording
+	scripts <- func(conn net.Conn, reader *bufio.Reader, nick string) {
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeError, Ref: "nick", Error: "username already exists, or so"}))
+	}
+	if code := RunCLI([]string{"-name", "deploybot", "-send", "hi", addr}, strings.NewReader(""), io.Discard, io.Discard); code != ExitError {
+		colortest.LogError(t, "uncoded error: unexpected exit code "+strconv.Itoa(code))
+	}
+
+	scripts <- func(conn net.Conn, reader *bufio.Reader, nick string) {
+		accept(conn, nick)
+		line, _ := reader.ReadString('\n')
+		ev, _ := protocol.Decode(line)
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeError, Ref: ev.Ref, Code: protocol.CodeWaiting, Error: "the chat room is full, you are number 1 on the waiting list"}))
+	}
+	if code := RunCLI([]string{"-name", "deploybot", "-send", "hi", addr}, strings.NewReader(""), io.Discard, io.Discard); code != ExitRoomFull {
+		colortest.LogError(t, "waiting: unexpected exit code "+strconv.Itoa(code))
+	}
+
+	if code := RunCLI([]string{"-name", "deploybot", "-room", "general", "-send", "hi", addr}, strings.NewReader(""), io.Discard, io.Discard); code != ExitUsage {
+		colortest.LogError(t, "-room: unexpected exit code "+strconv.Itoa(code))
+	}
+
+	scripts <- func(conn net.Conn, reader *bufio.Reader, nick string) {
+		accept(conn, nick)
+		conn.Write(protocol.Encode(protocol.Event{Type: protocol.TypeRefused, Code: protocol.CodeChatFull, Error: "Sorry, the chat room is full. Please try again later."}))
+	}
+	if code := RunCLI([]string{"-name", "deploybot", "-listen", addr}, strings.NewReader(""), io.Discard, io.Discard); code != ExitRoomFull {
+		colortest.LogError(t, "room full: unexpected exit code "+strconv.Itoa(code))
+	}
+
+	listener.Close()
+	if code := RunCLI([]string{"-name", "deploybot", "-send", "hi", addr}, strings.NewReader(""), io.Discard, io.Discard); code != ExitConnRefused {
+		colortest.LogError(t, "connection refused: unexpected exit code "+strconv.Itoa(code))
+	} else {
+		colortest.LogSuccess(t, "TestHeadless completed successfully")
+	}
+}
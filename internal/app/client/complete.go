@@ -0,0 +1,146 @@
+package client
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// completions holds what the line editor completes: the users in the room,
+// learned from /who and from joins, leaves and messages, and the slash
+// commands listed by /help.
+type completions struct {
+	mu       sync.Mutex
+	names    map[string]bool
+	commands []string
+}
+
+func newCompletions() *completions {
+	return &completions{names: make(map[string]bool)}
+}
+
+// complete returns the completions of word, sorted. A word starting with a
+// slash at the start of the line is a command, and one starting with @ a
+// mention; any other word completes a name.
+func (c *completions) complete(word string, first bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var matches []string
+	switch {
+	case first && strings.HasPrefix(word, "/"):
+		for _, cmd := range c.commands {
+			if strings.HasPrefix(cmd, word) {
+				matches = append(matches, cmd)
+			}
+		}
+	default:
+		at := ""
+		if strings.HasPrefix(word, "@") {
+			at, word = "@", word[1:]
+		}
+		for name := range c.names {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(word)) {
+				matches = append(matches, at+name)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// addName adds a user seen in the room.
+func (c *completions) addName(name string) {
+	if name == "" {
+		return
+	}
+	c.mu.Lock()
+	c.names[name] = true
+	c.mu.Unlock()
+}
+
+// removeName removes a user who left the room.
+func (c *completions) removeName(name string) {
+	c.mu.Lock()
+	delete(c.names, name)
+	c.mu.Unlock()
+}
+
+// setWho replaces the users with those listed in a /who reply.
+func (c *completions) setWho(reply string) {
+	names := parseWho(reply)
+	if names == nil {
+		return
+	}
+	c.mu.Lock()
+	c.names = make(map[string]bool, len(names))
+	for _, name := range names {
+		c.names[name] = true
+	}
+	c.mu.Unlock()
+}
+
+// setHelp replaces the commands with those listed in a /help reply.
+func (c *completions) setHelp(reply string) {
+	commands := parseHelp(reply)
+	if len(commands) == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.commands = commands
+	c.mu.Unlock()
+}
+
+// parseWho returns the names in a /who reply such as
+// "In general (2): layla (online, idle 5s), sara@other", or nil if reply is
+// not one. The state in brackets may itself hold commas.
+func parseWho(reply string) []string {
+	if !strings.HasPrefix(reply, "In ") {
+		return nil
+	}
+	_, list, found := strings.Cut(reply, "): ")
+	if !found {
+		if strings.HasSuffix(reply, "(0): ") {
+			return []string{}
+		}
+		return nil
+	}
+
+	names := []string{}
+	depth, start := 0, 0
+	add := func(entry string) {
+		name, _, _ := strings.Cut(strings.TrimSpace(entry), " (")
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	for i, r := range list {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				add(list[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(list[start:])
+	return names
+}
+
+// parseHelp returns the commands listed in a /help reply, one per line
+// starting with its usage.
+func parseHelp(reply string) []string {
+	var commands []string
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+			commands = append(commands, fields[0])
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
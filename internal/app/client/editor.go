@@ -0,0 +1,539 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// maxHistory is how many entered lines the editor remembers.
+const maxHistory = 1000
+
+// secretCommands take a password, so lines using them are not remembered.
+var secretCommands = []string{"/oper ", "/register ", "/identify "}
+
+// defaultPrompt is shown before the line being typed.
+const defaultPrompt = "> "
+
+// Keys read from escape sequences, outside the range of runes typed.
+const (
+	keyUp rune = -1 - iota
+	keyDown
+	keyRight
+	keyLeft
+	keyHome
+	keyEnd
+	keyDelete
+	keyWordLeft
+	keyWordRight
+	keyKillWord
+	keyKillWordBack
+	keyNone
+)
+
+// Control characters, as sent by Ctrl and a letter.
+const (
+	ctrlA     = 'A' - '@'
+	ctrlB     = 'B' - '@'
+	ctrlC     = 'C' - '@'
+	ctrlD     = 'D' - '@'
+	ctrlE     = 'E' - '@'
+	ctrlF     = 'F' - '@'
+	ctrlH     = 'H' - '@'
+	tab       = 'I' - '@'
+	ctrlK     = 'K' - '@'
+	ctrlL     = 'L' - '@'
+	ctrlN     = 'N' - '@'
+	ctrlP     = 'P' - '@'
+	ctrlT     = 'T' - '@'
+	ctrlU     = 'U' - '@'
+	ctrlW     = 'W' - '@'
+	ctrlY     = 'Y' - '@'
+	escape    = 27
+	backspace = 127
+)
+
+// Editor reads lines from a terminal in raw mode with Emacs-style editing,
+// history recall persisted to a file and tab completion. Output written
+// through it appears above the line being typed, which is redrawn after it.
+// It implements io.Reader, giving one entered line at a time, and io.Writer.
+//
+// Keys: Left/Right or Ctrl-B/F move, Alt-B/F move by word, Home/End or
+// Ctrl-A/E go to the start and end, Up/Down or Ctrl-P/N recall history,
+// Backspace and Delete or Ctrl-D delete, Ctrl-K/U kill to the end and start,
+// Ctrl-W and Alt-D kill a word, Ctrl-Y yanks, Ctrl-T transposes, Ctrl-L
+// clears the screen and Tab completes. Ctrl-C clears the line, and Ctrl-C or
+// Ctrl-D on an empty line ends the input.
+type Editor struct {
+	// Complete returns the completions of word, the text before the cursor
+	// back to a space; first is set when it is the first word of the line.
+	Complete func(word string, first bool) []string
+	// Edited is called after a key changes the line being typed, reporting
+	// whether it is now empty. It is called without the editor locked.
+	Edited func(empty bool)
+
+	fd       int
+	in       *bufio.Reader
+	out      io.Writer
+	restore  func() error
+	histPath string
+	pending  []byte // Rest of the line being returned by Read
+
+	mu      sync.Mutex
+	partial string   // Output written without a newline, shown as the prompt
+	status  string   // Shown before the prompt, see SetStatus
+	buf     []rune   // Line being typed
+	pos     int      // Cursor position in buf
+	history []string // Entered lines, oldest first
+	histPos int      // History entry shown, len(history) for the new line
+	draft   []rune   // New line kept while browsing history
+	killed  []rune   // Last text killed, for Ctrl-Y
+	ended   bool     // The input has ended: output is no longer redrawn around a line
+}
+
+// NewEditor puts the terminal on in into raw mode and returns an editor
+// reading from it and writing to out. Lines entered are kept in the file at
+// historyPath, unless it is empty. Close restores the terminal.
+func NewEditor(in *os.File, out io.Writer, historyPath string) (*Editor, error) {
+	fd := int(in.Fd())
+	if !isTerminal(fd) {
+		return nil, fmt.Errorf("input is not a terminal")
+	}
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up the terminal: %v", err)
+	}
+	e := newEditor(in, out, historyPath)
+	e.fd, e.restore = fd, restore
+	return e, nil
+}
+
+// newEditor returns an editor on in and out without touching the terminal.
+func newEditor(in io.Reader, out io.Writer, historyPath string) *Editor {
+	e := &Editor{fd: -1, in: bufio.NewReader(in), out: out, histPath: historyPath}
+	e.loadHistory()
+	return e
+}
+
+// Close restores the terminal.
+func (e *Editor) Close() error {
+	if e.restore == nil {
+		return nil
+	}
+	return e.restore()
+}
+
+// Read implements io.Reader, returning the lines entered with their newline.
+func (e *Editor) Read(p []byte) (int, error) {
+	if len(e.pending) == 0 {
+		if e.ended {
+			return 0, io.EOF
+		}
+		line, err := e.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		e.pending = []byte(line + "\n")
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// Write implements io.Writer. Complete lines are shown above the line being
+// typed; text after the last newline becomes its prompt.
+func (e *Editor) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	text := e.partial + string(p)
+	end := strings.LastIndexByte(text, '\n')
+	e.partial = text[end+1:]
+	if end >= 0 {
+		io.WriteString(e.out, "\r\033[K"+text[:end+1])
+	}
+	e.redraw()
+	return len(p), nil
+}
+
+// ReadLine reads one line, returning io.EOF when the input ends.
+func (e *Editor) ReadLine() (string, error) {
+	e.mu.Lock()
+	e.buf, e.pos, e.histPos, e.draft = nil, 0, len(e.history), nil
+	e.redraw()
+	e.mu.Unlock()
+
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+		e.mu.Lock()
+		before := string(e.buf)
+		line, done, err := e.handleKey(key)
+		if !done {
+			e.redraw()
+		}
+		changed, empty := !done && string(e.buf) != before, len(e.buf) == 0
+		e.mu.Unlock()
+		if done {
+			return line, err
+		}
+		if changed && e.Edited != nil {
+			e.Edited(empty)
+		}
+	}
+}
+
+// SetStatus shows status before the prompt, such as who is typing, until it
+// is set again; an empty status shows none.
+func (e *Editor) SetStatus(status string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.status = status
+	e.redraw()
+}
+
+// readKey reads one key, decoding the escape sequences of special keys.
+func (e *Editor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil {
+		e.mu.Lock()
+		e.ended = true
+		e.mu.Unlock()
+		return 0, err
+	}
+	if r != escape {
+		return r, nil
+	}
+	if e.in.Buffered() == 0 {
+		// A lone Escape
+		return keyNone, nil
+	}
+	r, _, err = e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case 'b', 'B':
+		return keyWordLeft, nil
+	case 'f', 'F':
+		return keyWordRight, nil
+	case 'd', 'D':
+		return keyKillWord, nil
+	case backspace, ctrlH:
+		return keyKillWordBack, nil
+	case '[', 'O':
+	default:
+		return keyNone, nil
+	}
+
+	r, _, err = e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case 'C':
+		return keyRight, nil
+	case 'D':
+		return keyLeft, nil
+	case 'H':
+		return keyHome, nil
+	case 'F':
+		return keyEnd, nil
+	}
+	if r < '0' || r > '9' {
+		return keyNone, nil
+	}
+	// A numbered key such as ESC [ 3 ~, possibly with modifiers after a ';'
+	code := string(r)
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		if r == '~' {
+			break
+		}
+		if (r < '0' || r > '9') && r != ';' {
+			return keyNone, nil
+		}
+		code += string(r)
+	}
+	switch strings.SplitN(code, ";", 2)[0] {
+	case "1", "7":
+		return keyHome, nil
+	case "4", "8":
+		return keyEnd, nil
+	case "3":
+		return keyDelete, nil
+	}
+	return keyNone, nil
+}
+
+// handleKey applies a key to the line. It reports whether the line is done,
+// with the entered line or io.EOF. The caller holds e.mu.
+func (e *Editor) handleKey(key rune) (string, bool, error) {
+	switch key {
+	case '\r', '\n':
+		line := string(e.buf)
+		e.pos = len(e.buf)
+		e.redraw()
+		io.WriteString(e.out, "\n")
+		e.partial, e.buf, e.pos = "", nil, 0
+		e.addHistory(line)
+		return line, true, nil
+	case ctrlC:
+		if len(e.buf) == 0 {
+			return e.end()
+		}
+		e.buf, e.pos = nil, 0
+	case ctrlD:
+		if len(e.buf) == 0 {
+			return e.end()
+		}
+		e.deleteRange(e.pos, e.pos+1)
+	case keyDelete:
+		e.deleteRange(e.pos, e.pos+1)
+	case backspace, ctrlH:
+		e.deleteRange(e.pos-1, e.pos)
+	case ctrlA, keyHome:
+		e.pos = 0
+	case ctrlE, keyEnd:
+		e.pos = len(e.buf)
+	case ctrlB, keyLeft:
+		e.pos = max(e.pos-1, 0)
+	case ctrlF, keyRight:
+		e.pos = min(e.pos+1, len(e.buf))
+	case keyWordLeft:
+		e.pos = e.wordStart(e.pos)
+	case keyWordRight:
+		e.pos = e.wordEnd(e.pos)
+	case ctrlP, keyUp:
+		e.recall(e.histPos - 1)
+	case ctrlN, keyDown:
+		e.recall(e.histPos + 1)
+	case ctrlK:
+		e.kill(e.pos, len(e.buf))
+	case ctrlU:
+		e.kill(0, e.pos)
+	case ctrlW, keyKillWordBack:
+		e.kill(e.wordStart(e.pos), e.pos)
+	case keyKillWord:
+		e.kill(e.pos, e.wordEnd(e.pos))
+	case ctrlY:
+		e.insert(e.killed)
+	case ctrlT:
+		if e.pos > 0 && len(e.buf) > 1 {
+			if e.pos == len(e.buf) {
+				e.pos--
+			}
+			e.buf[e.pos-1], e.buf[e.pos] = e.buf[e.pos], e.buf[e.pos-1]
+			e.pos++
+		}
+	case ctrlL:
+		io.WriteString(e.out, "\033[H\033[2J")
+	case tab:
+		e.complete()
+	default:
+		if key >= ' ' && unicode.IsPrint(key) {
+			e.insert([]rune{key})
+		}
+	}
+	return "", false, nil
+}
+
+// end ends the input on an empty line.
+func (e *Editor) end() (string, bool, error) {
+	io.WriteString(e.out, "\r\033[K")
+	e.partial, e.ended = "", true
+	return "", true, io.EOF
+}
+
+// insert inserts text at the cursor.
+func (e *Editor) insert(text []rune) {
+	buf := make([]rune, 0, len(e.buf)+len(text))
+	buf = append(buf, e.buf[:e.pos]...)
+	buf = append(buf, text...)
+	e.buf = append(buf, e.buf[e.pos:]...)
+	e.pos += len(text)
+}
+
+// deleteRange deletes the runes from start to end, clamped to the line.
+func (e *Editor) deleteRange(start int, end int) {
+	start, end = max(start, 0), min(end, len(e.buf))
+	if start >= end {
+		return
+	}
+	e.buf = append(e.buf[:start:start], e.buf[end:]...)
+	if e.pos > end {
+		e.pos -= end - start
+	} else if e.pos > start {
+		e.pos = start
+	}
+}
+
+// kill deletes the runes from start to end and keeps them for Ctrl-Y.
+func (e *Editor) kill(start int, end int) {
+	if start < end {
+		e.killed = append([]rune(nil), e.buf[start:end]...)
+		e.deleteRange(start, end)
+	}
+}
+
+// wordStart returns the start of the word before pos.
+func (e *Editor) wordStart(pos int) int {
+	for pos > 0 && e.buf[pos-1] == ' ' {
+		pos--
+	}
+	for pos > 0 && e.buf[pos-1] != ' ' {
+		pos--
+	}
+	return pos
+}
+
+// wordEnd returns the end of the word after pos.
+func (e *Editor) wordEnd(pos int) int {
+	for pos < len(e.buf) && e.buf[pos] == ' ' {
+		pos++
+	}
+	for pos < len(e.buf) && e.buf[pos] != ' ' {
+		pos++
+	}
+	return pos
+}
+
+// recall shows history entry i, or the new line past the last one.
+func (e *Editor) recall(i int) {
+	if i < 0 || i > len(e.history) || i == e.histPos {
+		return
+	}
+	if e.histPos == len(e.history) {
+		e.draft = e.buf
+	}
+	e.histPos = i
+	if i == len(e.history) {
+		e.buf = e.draft
+	} else {
+		e.buf = []rune(e.history[i])
+	}
+	e.pos = len(e.buf)
+}
+
+// complete completes the word before the cursor. With several candidates it
+// completes their common prefix, or lists them if there is none to add.
+func (e *Editor) complete() {
+	if e.Complete == nil {
+		return
+	}
+	start := e.pos
+	for start > 0 && e.buf[start-1] != ' ' {
+		start--
+	}
+	word := string(e.buf[start:e.pos])
+	candidates := e.Complete(word, strings.TrimSpace(string(e.buf[:start])) == "")
+	switch len(candidates) {
+	case 0:
+		io.WriteString(e.out, "\a")
+	case 1:
+		// The word is replaced, as names match regardless of case
+		e.deleteRange(start, e.pos)
+		e.insert([]rune(candidates[0] + " "))
+	default:
+		prefix := candidates[0]
+		for _, c := range candidates[1:] {
+			for !strings.HasPrefix(c, prefix) {
+				prefix = prefix[:len(prefix)-1]
+			}
+		}
+		if len(prefix) > len(word) {
+			e.deleteRange(start, e.pos)
+			e.insert([]rune(prefix))
+			return
+		}
+		io.WriteString(e.out, "\r\033[K"+strings.Join(candidates, "  ")+"\n")
+	}
+}
+
+// redraw shows the prompt and the line, scrolled sideways to keep the cursor
+// on screen. The caller holds e.mu.
+func (e *Editor) redraw() {
+	if e.ended {
+		return
+	}
+	prompt := e.partial
+	if prompt == "" {
+		prompt = defaultPrompt
+	}
+	prompt = e.status + prompt
+	width := terminalWidth(e.fd)
+	room := max(width-len([]rune(prompt))-1, 10)
+	start := max(e.pos-room, 0)
+	end := min(len(e.buf), start+room)
+
+	line := "\r" + prompt + string(e.buf[start:end]) + "\033[K\r"
+	if col := len([]rune(prompt)) + e.pos - start; col > 0 {
+		line += fmt.Sprintf("\033[%dC", col)
+	}
+	io.WriteString(e.out, line)
+}
+
+// loadHistory reads the history file, keeping its last maxHistory lines.
+func (e *Editor) loadHistory() {
+	if e.histPath == "" {
+		return
+	}
+	content, err := os.ReadFile(e.histPath)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+		os.WriteFile(e.histPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	for _, line := range lines {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+}
+
+// addHistory remembers an entered line, unless it is empty, repeats the
+// last one or gives a password, and appends it to the history file.
+func (e *Editor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	for _, prefix := range secretCommands {
+		if strings.HasPrefix(line, prefix) {
+			return
+		}
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+	if e.histPath == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(e.histPath), 0700); err != nil {
+		return
+	}
+	file, err := os.OpenFile(e.histPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	io.WriteString(file, line+"\n")
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// readAll returns the lines an editor reads from the typed keys.
+func readAll(ed *Editor) []string {
+	var lines []string
+	for {
+		line, err := ed.ReadLine()
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// TestEditor tests the editing keys, history recall and its file.
+func TestEditor(t *testing.T) {
+	colortest.LogInfo(t, "Running TestEditor...")
+	path := filepath.Join(t.TempDir(), "history.txt")
+	os.WriteFile(path, []byte("old line\n"), 0600)
+
+	keys := strings.Join([]string{
+		"helo\033[D\033[Dl\r",        // Left arrow twice, insert
+		"world\x01hello \x05!\r",     // Ctrl-A, Ctrl-E
+		"one two three\033b\x17\r",   // Alt-B, Ctrl-W
+		"abc\x02\x02\x0b\x01\x19\r",  // Ctrl-B twice, Ctrl-K, Ctrl-A, Ctrl-Y
+		"\033[A\033[A\033[A\033[B\r", // Up three times, down once
+		"xy\x14\r",                   // Ctrl-T at the end
+		"gone\x03",                   // Ctrl-C clears the line
+		"/identify hunter22pw\r",     // Not remembered
+		"a\033[3~\033[Hb\033[3~\r",   // Delete, Home, Delete
+		"\x04",                       // Ctrl-D on an empty line ends the input
+		"after\r",
+	}, "")
+	ed := newEditor(strings.NewReader(keys), io.Discard, path)
+	got := readAll(ed)
+	want := []string{"hello", "hello world!", "one three", "bca", "one three", "yx", "/identify hunter22pw", "b"}
+	if !reflect.DeepEqual(got, want) {
+		colortest.LogError(t, "unexpected lines: "+strings.Join(got, " | "))
+	}
+
+	// A second editor recalls what the first one entered
+	ed = newEditor(strings.NewReader("\033[A\033[A\r"), io.Discard, path)
+	content, _ := os.ReadFile(path)
+	if got := readAll(ed); len(got) != 1 || got[0] != "yx" {
+		colortest.LogError(t, "history not persisted: "+strings.Join(got, " | "))
+	} else if strings.Contains(string(content), "hunter22pw") {
+		colortest.LogError(t, "password kept in the history file")
+	} else {
+		colortest.LogSuccess(t, "TestEditor completed successfully")
+	}
+}
+
+// TestCompletion tests tab completion of commands and names from the
+// replies to /help and /who.
+func TestCompletion(t *testing.T) {
+	colortest.LogInfo(t, "Running TestCompletion...")
+	words := newCompletions()
+	words.setHelp("Commands:\n  /help                list the available commands\n  /who                 list the users in your room\n  /whisper <name> <text> whisper")
+	words.setWho("In general (3): layla (away: lunch, back soon, idle 5m), lucas (online, idle 2s), sara@other")
+	words.addName("leon")
+
+	if got := parseWho("In general (0): "); got == nil || len(got) != 0 {
+		colortest.LogError(t, "empty /who not parsed")
+	}
+	if got := words.complete("l", false); !reflect.DeepEqual(got, []string{"layla", "leon", "lucas"}) {
+		colortest.LogError(t, "unexpected names: "+strings.Join(got, " "))
+	}
+
+	keys := strings.Join([]string{
+		"/wh\t\r",     // Common prefix of /who and /whisper
+		"/he\tme\r",   // Single match, with a space
+		"hi @sa\t\r",  // Mention
+		"Lu\t\r",      // Names complete regardless of case
+		"say /he\t\r", // Not a command after the first word
+	}, "")
+	ed := newEditor(strings.NewReader(keys), io.Discard, "")
+	ed.Complete = words.complete
+	got := readAll(ed)
+	want := []string{"/wh", "/help me", "hi @sara@other ", "lucas ", "say /he"}
+	if !reflect.DeepEqual(got, want) {
+		colortest.LogError(t, "unexpected completions: "+strings.Join(got, " | "))
+	} else {
+		colortest.LogSuccess(t, "TestCompletion completed successfully")
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"netcat/internal/protocol"
+)
+
+// Exit codes of the client subcommand, so scripts can tell failures apart.
+const (
+	ExitOK          = 0
+	ExitError       = 1 // Any other failure
+	ExitUsage       = 2 // Wrong arguments
+	ExitNameTaken   = 3 // The name is in use
+	ExitRoomFull    = 4 // The chat is full, or the client is on its waiting list
+	ExitConnRefused = 5 // Nothing listens at the address
+)
+
+// ExitCode returns the exit code for an error returned by Run or Headless,
+// told apart by the code the server gave with its refusal.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ExitConnRefused
+	}
+	var refused *RefusedError
+	if errors.As(err, &refused) {
+		switch refused.Code {
+		case protocol.CodeNameTaken:
+			return ExitNameTaken
+		case protocol.CodeChatFull, protocol.CodeWaiting:
+			return ExitRoomFull
+		}
+	}
+	return ExitError
+}
+
+// Headless joins the chat without interaction, for scripts. It sends
+// opts.Messages in order, waiting for the server to accept each one; a "-"
+// stands for the lines read from in. With opts.Listen it then writes the
+// messages it receives to out as JSON lines until the connection ends.
+// Replies to commands are written to out as text. It does not reconnect:
+// any failure is returned, see ExitCode.
+func Headless(opts Options, in io.Reader, out io.Writer) error {
+	if opts.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	l, err := dial(opts.Addr, opts.Name, "", "")
+	if err != nil {
+		return err
+	}
+	defer l.leave()
+
+	h := &headless{link: l, out: out, listen: opts.Listen}
+	for _, body := range opts.Messages {
+		if body != "-" {
+			if err := h.send(body); err != nil {
+				return err
+			}
+			continue
+		}
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			if err := h.send(scanner.Text()); err != nil {
+				return err
+			}
+		}
+	}
+	if !opts.Listen {
+		return nil
+	}
+
+	for {
+		ev, err := l.read()
+		if err != nil {
+			return err
+		}
+		if ev.Type == protocol.TypeRefused {
+			return &RefusedError{Reason: ev.Error, Code: ev.Code}
+		}
+		h.show(ev)
+	}
+}
+
+// headless is the state of a client run by Headless.
+type headless struct {
+	link    *link
+	out     io.Writer
+	listen  bool // Received messages are written out
+	nextRef int
+}
+
+// send sends a message and waits for the server to acknowledge it. Blank
+// lines are skipped.
+func (h *headless) send(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return nil
+	}
+	h.nextRef++
+	ref := strconv.Itoa(h.nextRef)
+	if err := h.link.send(protocol.Event{Type: protocol.TypeMessage, Body: body, Ref: ref}); err != nil {
+		return err
+	}
+
+	h.link.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer h.link.conn.SetReadDeadline(time.Time{})
+	for {
+		ev, err := h.link.read()
+		if err != nil {
+			return err
+		}
+		switch {
+		case ev.Type == protocol.TypeError && ev.Ref == ref && ev.Code == protocol.CodeWaiting:
+			// On the server's waiting list: not joined yet
+			return &RefusedError{Reason: ev.Error, Code: ev.Code}
+		case ev.Type == protocol.TypeError && ev.Ref == ref:
+			return fmt.Errorf("message not sent: %s", ev.Error)
+		case ev.Type == protocol.TypeRefused:
+			return &RefusedError{Reason: ev.Error, Code: ev.Code}
+		case ev.Type == protocol.TypeAck && ev.Ref == ref:
+			if ev.Body != "" {
+				fmt.Fprintln(h.out, strings.TrimRight(ev.Body, "\n"))
+			}
+			return nil
+		}
+		h.show(ev)
+	}
+}
+
+// show writes a live message or direct message received while listening.
+// Replayed history is left out, so only new messages are streamed.
+func (h *headless) show(ev protocol.Event) {
+	if h.listen && (ev.Type == protocol.TypeMessage || ev.Type == protocol.TypeDM) && !ev.History {
+		h.out.Write(protocol.Encode(ev))
+	}
+}
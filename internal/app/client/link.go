@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"netcat/internal/protocol"
+)
+
+// handshakeTimeout bounds how long joining may take once connected.
+const handshakeTimeout = 15 * time.Second
+
+// RefusedError is returned when the server turns the client away, with the
+// reason it gave, such as a name that is taken or a full room. Retrying does
+// not help.
+type RefusedError struct {
+	Reason string
+	Code   string // Code of the refused event, if the server sent one
+}
+
+func (e *RefusedError) Error() string {
+	return e.Reason
+}
+
+// link is one connection to the server in the JSON protocol, after joining.
+type link struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	name    string // Name the server accepted
+	room    string // Room the client is in
+	resumed bool   // The session was resumed rather than joined afresh
+}
+
+// dial connects to addr and joins the chat as name, declaring caps, the
+// optional events the client handles. With a session token it first tries
+// to resume that session, asking for the messages after lastID, and joins
+// afresh if the session has expired.
+func dial(addr string, name string, token string, lastID string, caps ...string) (*link, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	l := &link{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := l.join(name, token, lastID, caps); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return l, nil
+}
+
+// join performs the handshake on a new connection.
+func (l *link) join(name string, token string, lastID string, caps []string) error {
+	if _, err := l.conn.Write([]byte(protocol.Handshake + "\n")); err != nil {
+		return err
+	}
+
+	// The welcome banner and name prompt come first, in text
+	var text string
+	for {
+		line, err := l.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && strings.TrimSpace(text) != "" {
+				// Refused before the handshake, e.g. a banned address
+				return &RefusedError{Reason: strings.TrimSpace(text)}
+			}
+			return err
+		}
+		start := strings.Index(line, `{"type":`)
+		if start < 0 {
+			text = line
+			continue
+		}
+		ev, err := protocol.Decode(line[start:])
+		if err != nil {
+			return err
+		}
+		if ev.Type == protocol.TypeError || ev.Type == protocol.TypeRefused {
+			return &RefusedError{Reason: ev.Error, Code: ev.Code}
+		}
+		if ev.Type == protocol.TypeAck && ev.Proto != "" {
+			break
+		}
+	}
+
+	if len(caps) > 0 {
+		if err := l.writeLine("CAPS " + strings.Join(caps, " ")); err != nil {
+			return err
+		}
+	}
+
+	if token != "" {
+		resume := "RESUME " + token
+		if lastID != "" {
+			resume += " " + lastID
+		}
+		if err := l.writeLine(resume); err != nil {
+			return err
+		}
+		ev, err := l.read()
+		if err != nil {
+			return err
+		}
+		if ev.Type == protocol.TypeAck && ev.Name != "" {
+			l.name, l.room, l.resumed = ev.Name, ev.Room, true
+			return nil
+		}
+		if ev.Type == protocol.TypeRefused {
+			return &RefusedError{Reason: ev.Error, Code: ev.Code}
+		}
+		// The session has expired: join as a new user
+	}
+
+	if err := l.send(protocol.Event{Type: protocol.TypeNick, Name: name, Ref: "nick"}); err != nil {
+		return err
+	}
+	for {
+		ev, err := l.read()
+		if err != nil {
+			return err
+		}
+		switch {
+		case ev.Type == protocol.TypeError || ev.Type == protocol.TypeRefused:
+			return &RefusedError{Reason: ev.Error, Code: ev.Code}
+		case ev.Type == protocol.TypeAck && ev.Ref == "nick":
+			l.name, l.room = ev.Name, ev.Room
+			return nil
+		}
+	}
+}
+
+// read returns the next event from the server, skipping lines that are not one.
+func (l *link) read() (protocol.Event, error) {
+	for {
+		line, err := l.reader.ReadString('\n')
+		if err != nil {
+			return protocol.Event{}, err
+		}
+		if ev, err := protocol.Decode(strings.TrimSpace(line)); err == nil {
+			return ev, nil
+		}
+	}
+}
+
+// send writes an event to the server.
+func (l *link) send(ev protocol.Event) error {
+	_, err := l.conn.Write(protocol.Encode(ev))
+	return err
+}
+
+// writeLine writes a line of the handshake.
+func (l *link) writeLine(line string) error {
+	_, err := fmt.Fprintf(l.conn, "%s\n", line)
+	return err
+}
+
+// leave tells the server the user leaves for good, so their session is not
+// held for resuming, and ends the connection.
+func (l *link) leave() {
+	l.send(protocol.Event{Type: protocol.TypeLeave})
+	l.close()
+}
+
+// close ends the connection.
+func (l *link) close() {
+	l.conn.Close()
+}
@@ -0,0 +1,532 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+)
+
+// CLIUsage is printed when the client subcommand is used incorrectly.
+const CLIUsage = `[USAGE]: ./TCPChat client [-name name] [-cache dir] [-send text]... [-listen] host:port
+
+Connects to a chat server, reconnecting and resuming the session when the
+connection drops. Type /quit or press Ctrl-D to leave.
+
+With -send or -listen it runs without interaction, for scripts: it joins as
+-name, sends each -send text (- sends the lines of the standard input), and
+with -listen writes the messages received to the standard output as JSON
+lines. It exits with 3 if the name is taken, 4 if the chat is full and 5 if
+the connection is refused.`
+
+// Reconnection backoff: each failed attempt doubles the delay up to
+// maxBackoff, and a random part of it is taken off so that clients dropped
+// together do not all come back at once.
+var (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// defaultRoom is the room the server puts every client in.
+const defaultRoom = "general"
+
+// scrollbackShown is how many cached messages are shown on start.
+const scrollbackShown = 50
+
+// maxPending is how many lines typed while disconnected are kept to send.
+const maxPending = 100
+
+// typingInterval is how often a typing start is repeated while the user
+// goes on typing, as the server lets one that is not renewed expire.
+const typingInterval = 3 * time.Second
+
+// Options configures the built-in client.
+type Options struct {
+	Addr     string   // Server address, host:port
+	Name     string   // Name to join with, asked for when empty
+	Room     string   // Room whose scrollback is shown before joining, usually defaultRoom
+	CacheDir string   // Directory of the scrollback cache, empty to keep none
+	Messages []string // Messages sent by Headless, "-" for the lines of its input
+	Listen   bool     // Headless writes the messages received until disconnected
+}
+
+// RunCLI runs the client subcommand with the given arguments and returns the
+// exit code. Errors are written to errOut.
+func RunCLI(args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := Options{Room: defaultRoom}
+	fs.StringVar(&opts.Name, "name", "", "name to join with")
+	fs.StringVar(&opts.CacheDir, "cache", defaultCacheDir(), "directory of the local scrollback, empty to keep none")
+	fs.Func("send", "message to send without interaction, - for the standard input", func(text string) error {
+		opts.Messages = append(opts.Messages, text)
+		return nil
+	})
+	fs.BoolVar(&opts.Listen, "listen", false, "write the messages received as JSON lines")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(errOut, CLIUsage)
+		return ExitUsage
+	}
+	opts.Addr = fs.Arg(0)
+
+	if len(opts.Messages) > 0 || opts.Listen {
+		if err := Headless(opts, in, out); err != nil {
+			fmt.Fprintln(errOut, "Error:", err)
+			return ExitCode(err)
+		}
+		return ExitOK
+	}
+
+	if file, ok := in.(*os.File); ok && isTerminal(int(file.Fd())) {
+		historyPath := ""
+		if opts.CacheDir != "" {
+			historyPath = filepath.Join(opts.CacheDir, "history.txt")
+		}
+		if ed, err := NewEditor(file, out, historyPath); err == nil {
+			defer ed.Close()
+			in, out = ed, ed
+		}
+	}
+
+	if err := Run(opts, in, out); err != nil {
+		fmt.Fprintln(errOut, "Error:", err)
+		return ExitCode(err)
+	}
+	return ExitOK
+}
+
+// defaultCacheDir returns where the scrollback is kept unless -cache is given.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tcpchat")
+}
+
+// session is the state of the client that outlives a connection.
+type session struct {
+	opts     Options
+	out      io.Writer
+	renderer *chat.Renderer
+	cache    *Scrollback
+	shown    map[string]bool   // Messages already shown, by ID and time
+	token    string            // Session token for RESUME
+	lastID   int64             // Latest message received
+	name     string            // Name to join with
+	room     string            // Room the client is in
+	pending  []string          // Lines typed while disconnected
+	sent     map[string]string // Bodies of sent messages awaiting their ack, by ref
+	queries  map[string]string // Commands sent for completion, whose replies are not shown, by ref
+	words    *completions
+	nextRef  int
+
+	editor     *Editor         // Terminal the user types in, nil if the input is not one
+	edits      chan bool       // Latest change of the line being typed, true if it is empty
+	typingSent time.Time       // When a typing start was last sent, zero once stopped
+	typists    map[string]bool // Others typing in the room, shown in the prompt
+}
+
+// Run connects to the server and chats until the input ends or /quit is
+// typed. A dropped connection is re-established with backoff and the session
+// resumed; it only returns an error when the server refuses the client.
+// Reading from an Editor, names and commands are tab-completed, the server
+// is told when the user is typing and who else is typing is shown.
+func Run(opts Options, in io.Reader, out io.Writer) error {
+	renderer, _ := chat.NewRenderer(chat.Format{})
+	s := &session{opts: opts, out: out, renderer: renderer, shown: make(map[string]bool), name: opts.Name, room: opts.Room, sent: make(map[string]string), queries: make(map[string]string), words: newCompletions(), typists: make(map[string]bool)}
+	var caps []string
+	if ed, ok := in.(*Editor); ok {
+		ed.Complete = s.words.complete
+		s.editor, s.edits = ed, make(chan bool, 1)
+		ed.Edited = s.edited
+		caps = append(caps, protocol.CapTyping)
+	}
+	lines := readLines(in)
+
+	if opts.CacheDir != "" {
+		s.cache = OpenScrollback(opts.CacheDir, opts.Addr, opts.Room)
+		s.showScrollback()
+	}
+	if s.name == "" && !s.askName(lines) {
+		return nil
+	}
+
+	delay := minBackoff
+	for {
+		l, err := dial(opts.Addr, s.name, s.token, s.lastIDString(), caps...)
+		var refused *RefusedError
+		switch {
+		case errors.As(err, &refused) && opts.Name == "" && s.token == "":
+			// A name typed at the prompt may be taken: ask for another
+			fmt.Fprintln(out, "error: "+refused.Reason)
+			if !s.askName(lines) {
+				return nil
+			}
+			continue
+		case errors.As(err, &refused):
+			return err
+		case err != nil:
+			wait := jitter(delay)
+			fmt.Fprintf(out, "*** Cannot reach %s (%v), retrying in %s\n", opts.Addr, err, wait.Round(100*time.Millisecond))
+			if !s.waitOrQueue(wait, lines) {
+				return nil
+			}
+			delay = min(2*delay, maxBackoff)
+			continue
+		}
+
+		delay = minBackoff
+		if l.resumed {
+			fmt.Fprintf(out, "*** Reconnected to %s as %s\n", opts.Addr, l.name)
+		} else {
+			fmt.Fprintf(out, "*** Joined %s as %s\n", opts.Addr, l.name)
+		}
+		if l.room != s.room {
+			s.room = l.room
+			if opts.CacheDir != "" {
+				s.cache = OpenScrollback(opts.CacheDir, opts.Addr, l.room)
+			}
+		}
+		quit, err := s.serve(l, lines)
+		if quit {
+			l.leave()
+			return nil
+		}
+		l.close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "*** Connection lost, reconnecting...")
+	}
+}
+
+// askName asks for the name to join with. It returns false if the input ended.
+func (s *session) askName(lines <-chan string) bool {
+	fmt.Fprint(s.out, "Your name: ")
+	name, ok := <-lines
+	s.name = strings.TrimSpace(name)
+	return ok
+}
+
+// jitter returns a random delay between half of d and d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// readLines reads the input on its own goroutine, so no line is lost while
+// the client is reconnecting. The channel is closed when the input ends.
+func readLines(in io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// waitOrQueue waits for d while keeping the lines typed meanwhile. It
+// returns false if the user quit.
+func (s *session) waitOrQueue(d time.Duration, lines <-chan string) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case line, ok := <-lines:
+			if !ok || isQuit(line) {
+				return false
+			}
+			s.queue(line)
+		}
+	}
+}
+
+// queue keeps a line typed while disconnected, to send once reconnected.
+func (s *session) queue(line string) {
+	if len(s.pending) >= maxPending {
+		fmt.Fprintln(s.out, "*** Not connected, line dropped")
+		return
+	}
+	s.pending = append(s.pending, line)
+	fmt.Fprintln(s.out, "*** Not connected, will send when reconnected")
+}
+
+// isQuit reports whether line asks to leave the client.
+func isQuit(line string) bool {
+	return strings.TrimSpace(line) == "/quit"
+}
+
+// serve chats over l until the connection drops, in which case it returns
+// false, or the user quits. It returns an error if the server ended the
+// session on purpose.
+func (s *session) serve(l *link, lines <-chan string) (bool, error) {
+	events := make(chan protocol.Event)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			ev, err := l.read()
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case events <- ev:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for _, line := range s.pending {
+		s.send(l, line)
+	}
+	s.pending = nil
+	// Typing states did not outlive the old connection
+	s.typingSent = time.Time{}
+	clear(s.typists)
+	s.showTypists()
+	// Learn who is here and which commands there are, for completion
+	s.query(l, "/who")
+	s.query(l, "/help")
+
+	// A server that turns us away, as when the user is kicked or banned,
+	// says so with a refused event; any other drop is reconnected
+	var refused *RefusedError
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || isQuit(line) {
+				return true, nil
+			}
+			if err := s.send(l, line); err != nil {
+				s.queue(line)
+			}
+			// Sending a message ends the typing state on the server
+			s.typingSent = time.Time{}
+		case empty := <-s.edits:
+			s.sendTyping(l, empty)
+		case ev := <-events:
+			if ev.Type == protocol.TypeRefused {
+				refused = &RefusedError{Reason: ev.Error, Code: ev.Code}
+				continue
+			}
+			s.handle(ev)
+		case <-failed:
+			if refused != nil {
+				return false, refused
+			}
+			return false, nil
+		}
+	}
+}
+
+// send sends a typed line as a message; commands are run by the server.
+func (s *session) send(l *link, line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	s.nextRef++
+	ref := strconv.Itoa(s.nextRef)
+	s.sent[ref] = line
+	return l.send(protocol.Event{Type: protocol.TypeMessage, Body: line, Ref: ref})
+}
+
+// edited is the Editor's Edited callback. It runs on the goroutine reading
+// the input and hands the change to serve, keeping only the latest.
+func (s *session) edited(empty bool) {
+	for {
+		select {
+		case s.edits <- empty:
+			return
+		case <-s.edits:
+		}
+	}
+}
+
+// sendTyping tells the server the user is typing, again every typingInterval
+// while they go on, or that they stopped when the line is cleared.
+func (s *session) sendTyping(l *link, empty bool) {
+	switch {
+	case !empty && time.Since(s.typingSent) >= typingInterval:
+		s.typingSent = time.Now()
+		l.send(protocol.Event{Type: protocol.TypeTyping, State: protocol.TypingStart})
+	case empty && !s.typingSent.IsZero():
+		s.typingSent = time.Time{}
+		l.send(protocol.Event{Type: protocol.TypeTyping, State: protocol.TypingStop})
+	}
+}
+
+// showTypists shows who else is typing before the prompt.
+func (s *session) showTypists() {
+	if s.editor == nil {
+		return
+	}
+	names := make([]string, 0, len(s.typists))
+	for name := range s.typists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	status := ""
+	switch len(names) {
+	case 0:
+	case 1:
+		status = fmt.Sprintf("[%s is typing] ", names[0])
+	case 2:
+		status = fmt.Sprintf("[%s and %s are typing] ", names[0], names[1])
+	default:
+		status = fmt.Sprintf("[%d people are typing] ", len(names))
+	}
+	s.editor.SetStatus(status)
+}
+
+// query runs a command whose reply feeds completion instead of being shown.
+func (s *session) query(l *link, command string) {
+	s.nextRef++
+	ref := strconv.Itoa(s.nextRef)
+	s.queries[ref] = command
+	l.send(protocol.Event{Type: protocol.TypeMessage, Body: command, Ref: ref})
+}
+
+// learn updates the completions from the reply to a command.
+func (s *session) learn(command string, reply string) {
+	switch strings.TrimSpace(command) {
+	case "/who":
+		s.words.setWho(reply)
+	case "/help":
+		s.words.setHelp(reply)
+	}
+}
+
+// handle shows an event from the server and keeps what the client needs.
+func (s *session) handle(ev protocol.Event) {
+	switch ev.Type {
+	case protocol.TypeSession:
+		s.token = ev.Session
+	case protocol.TypeMessage:
+		s.words.addName(ev.Name)
+		s.receive(ev)
+	case protocol.TypeAck:
+		if command, ok := s.queries[ev.Ref]; ok {
+			delete(s.queries, ev.Ref)
+			s.learn(command, ev.Body)
+			return
+		}
+		body, ok := s.sent[ev.Ref]
+		delete(s.sent, ev.Ref)
+		s.learn(body, ev.Body)
+		switch {
+		case ev.Body != "":
+			// The reply to a command
+			fmt.Fprintln(s.out, strings.TrimRight(ev.Body, "\n"))
+		case ok && ev.ID != "":
+			// Our own message, already on screen as typed
+			s.remember(protocol.Event{Type: protocol.TypeMessage, ID: ev.ID, Time: ev.Time, Room: s.room, Name: s.name, Body: body})
+		}
+	case protocol.TypeError:
+		fmt.Fprintln(s.out, "error: "+ev.Error)
+	case protocol.TypeJoin:
+		s.words.addName(ev.Name)
+		fmt.Fprintln(s.out, s.render(chat.KindJoin, ev))
+	case protocol.TypeLeave:
+		s.words.removeName(ev.Name)
+		fmt.Fprintln(s.out, s.render(chat.KindLeave, ev))
+		if s.typists[ev.Name] {
+			delete(s.typists, ev.Name)
+			s.showTypists()
+		}
+	case protocol.TypeTyping:
+		if ev.State == protocol.TypingStart {
+			s.typists[ev.Name] = true
+		} else {
+			delete(s.typists, ev.Name)
+		}
+		s.showTypists()
+	case protocol.TypeDM:
+		fmt.Fprintln(s.out, s.render(chat.KindDM, ev))
+	case protocol.TypeNotice:
+		fmt.Fprintln(s.out, strings.TrimSpace(ev.Body))
+	}
+}
+
+// receive shows a message unless it already has been, as when the server
+// replays history that is in the scrollback.
+func (s *session) receive(ev protocol.Event) {
+	if s.remember(ev) {
+		fmt.Fprintln(s.out, s.render(chat.KindMessage, ev))
+	}
+}
+
+// remember records a message as shown and caches it, reporting whether it is new.
+func (s *session) remember(ev protocol.Event) bool {
+	if id, err := storage.ParseID(ev.ID); err == nil && id > s.lastID {
+		s.lastID = id
+	}
+	key := ev.ID + " " + ev.Time
+	if s.shown[key] {
+		return false
+	}
+	s.shown[key] = true
+	if s.cache != nil {
+		if err := s.cache.Append(ev); err != nil {
+			fmt.Fprintln(s.out, "*** "+err.Error())
+		}
+	}
+	return true
+}
+
+// showScrollback shows the end of the cached conversation.
+func (s *session) showScrollback() {
+	events := s.cache.Events()
+	if len(events) == 0 {
+		return
+	}
+	if len(events) > scrollbackShown {
+		events = events[len(events)-scrollbackShown:]
+	}
+	fmt.Fprintln(s.out, "*** Recent messages from the local scrollback:")
+	for _, ev := range events {
+		s.shown[ev.ID+" "+ev.Time] = true
+		fmt.Fprintln(s.out, s.render(chat.KindMessage, ev))
+	}
+	fmt.Fprintln(s.out, "*** End of scrollback")
+}
+
+// render formats an event with the default chat templates.
+func (s *session) render(kind string, ev protocol.Event) string {
+	at, _ := time.Parse(time.RFC3339Nano, ev.Time)
+	body := ev.Body
+	switch {
+	case ev.Deleted:
+		body = "[message deleted]"
+	case ev.Edited:
+		body += " (edited)"
+	}
+	return s.renderer.Render(kind, chat.Line{Time: at, Name: ev.Name, Room: ev.Room, Body: body, ID: ev.ID})
+}
+
+// lastIDString returns the latest message ID for RESUME, or "" if none.
+func (s *session) lastIDString() string {
+	if s.lastID == 0 {
+		return ""
+	}
+	return storage.FormatID(s.lastID)
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"netcat/internal/protocol"
+)
+
+// scrollbackLines is how many messages a scrollback file keeps.
+const scrollbackLines = 500
+
+// Scrollback caches the recent messages of one room of one server on disk,
+// as protocol events in a JSON lines file, so they can be shown before the
+// client is connected.
+type Scrollback struct {
+	path   string
+	events []protocol.Event // Cached messages, oldest first
+	lines  int              // Lines in the file, compacted once it holds twice scrollbackLines
+}
+
+// OpenScrollback opens the cache for room on server under dir. A missing or
+// unreadable cache starts empty.
+func OpenScrollback(dir string, server string, room string) *Scrollback {
+	sb := &Scrollback{path: filepath.Join(dir, cacheName(server), cacheName(room)+".jsonl")}
+	content, err := os.ReadFile(sb.path)
+	if err != nil {
+		return sb
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if ev, err := protocol.Decode(scanner.Text()); err == nil {
+			sb.events = append(sb.events, ev)
+		}
+		sb.lines++
+	}
+	if len(sb.events) > scrollbackLines {
+		sb.events = sb.events[len(sb.events)-scrollbackLines:]
+	}
+	return sb
+}
+
+// cacheName turns a server address or room into a safe file name.
+func cacheName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// Events returns the cached messages, oldest first.
+func (sb *Scrollback) Events() []protocol.Event {
+	return sb.events
+}
+
+// Append adds a message to the cache.
+func (sb *Scrollback) Append(ev protocol.Event) error {
+	ev.History = false
+	sb.events = append(sb.events, ev)
+	if len(sb.events) > scrollbackLines {
+		sb.events = sb.events[len(sb.events)-scrollbackLines:]
+	}
+	if sb.lines >= 2*scrollbackLines {
+		return sb.compact()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sb.path), 0700); err != nil {
+		return fmt.Errorf("error creating scrollback directory: %v", err)
+	}
+	file, err := os.OpenFile(sb.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening scrollback: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(protocol.Encode(ev)); err != nil {
+		return fmt.Errorf("error writing scrollback: %v", err)
+	}
+	sb.lines++
+	return nil
+}
+
+// compact rewrites the file with only the messages kept in memory.
+func (sb *Scrollback) compact() error {
+	var content bytes.Buffer
+	for _, ev := range sb.events {
+		content.Write(protocol.Encode(ev))
+	}
+	tmp := sb.path + ".tmp"
+	if err := os.WriteFile(tmp, content.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing scrollback: %v", err)
+	}
+	if err := os.Rename(tmp, sb.path); err != nil {
+		return fmt.Errorf("error replacing scrollback: %v", err)
+	}
+	sb.lines = len(sb.events)
+	return nil
+}
@@ -0,0 +1,9 @@
+package client
+
+import "syscall"
+
+// Requests reading and setting the terminal attributes.
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
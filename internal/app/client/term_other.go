@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package client
+
+import "errors"
+
+// isTerminal reports whether fd is a terminal. The line editor is only
+// supported on Linux and macOS; elsewhere the client reads plain lines.
+func isTerminal(fd int) bool {
+	return false
+}
+
+// makeRaw is not supported on this platform.
+func makeRaw(fd int) (func() error, error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+// terminalWidth returns the default width.
+func terminalWidth(fd int) int {
+	return 80
+}
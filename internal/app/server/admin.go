@@ -0,0 +1,229 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"netcat/internal/admin"
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/audit"
+	"netcat/internal/logging"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+	"netcat/internal/webhook"
+)
+
+// ListClients implements admin.Controller.
+func (s *Server) ListClients() []admin.ClientInfo {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	now := time.Now()
+	infos := make([]admin.ClientInfo, 0, len(s.clients))
+	for _, client := range s.clients {
+		infos = append(infos, admin.ClientInfo{
+			Name:        client.Name,
+			Addr:        client.Conn.RemoteAddr().String(),
+			Connected:   client.Connected,
+			IdleSeconds: int64(now.Sub(client.LastActive).Seconds()),
+		})
+	}
+	return infos
+}
+
+// Kick implements admin.Controller. Closing the connection ends the client's
+// read loop, which removes it and broadcasts the usual leave message; the
+// session is ended first so the user cannot resume it.
+func (s *Server) Kick(name string) error {
+	s.Mutex.Lock()
+	target := s.findClient(name)
+	s.Mutex.Unlock()
+
+	if target == nil {
+		return fmt.Errorf("no client named %q", name)
+	}
+	if target.Bot {
+		return fmt.Errorf("%q is a bot and cannot be kicked", name)
+	}
+	s.dropSession(name)
+	s.Mutex.Lock()
+	refuseClient(target, protocol.CodeKicked, "\nYou have been kicked by the server operator.\n")
+	s.Mutex.Unlock()
+	s.webhooks.Send(s.current().Config.Webhooks, webhook.Event{Event: webhook.EventKick, Time: time.Now(), Room: target.Room, Name: name, Reason: "kicked"})
+	target.Conn.Close()
+	logging.Logger("Client kicked: " + name)
+	s.record(audit.Event{Action: audit.ActionKick, Actor: audit.ActorAdmin, Target: name, Addr: target.Conn.RemoteAddr().String()})
+	return nil
+}
+
+// Ban implements admin.Controller. An IP address bans the host; anything else
+// bans the username and, if that user is connected, their host as well.
+func (s *Server) Ban(target string) error {
+	var kicked []*client.Client
+
+	s.Mutex.Lock()
+	if ip := net.ParseIP(target); ip != nil {
+		s.bannedIPs[ip.String()] = true
+		for _, client := range s.clients {
+			if remoteIP(client.Conn.RemoteAddr()) == ip.String() {
+				kicked = append(kicked, client)
+			}
+		}
+	} else {
+		s.bannedNames[target] = true
+		if client := s.findClient(target); client != nil {
+			if ip := remoteIP(client.Conn.RemoteAddr()); ip != "" {
+				s.bannedIPs[ip] = true
+			}
+			kicked = append(kicked, client)
+		}
+	}
+	s.Mutex.Unlock()
+
+	logging.Logger("Banned: " + target)
+	s.record(audit.Event{Action: audit.ActionBan, Actor: audit.ActorAdmin, Target: target})
+	s.removeBanned(kicked)
+	return nil
+}
+
+// removeBanned tells banned clients so and closes their connections, ending
+// their sessions first so they cannot resume them.
+func (s *Server) removeBanned(banned []*client.Client) {
+	for _, client := range banned {
+		s.dropSession(client.Name)
+		s.Mutex.Lock()
+		refuseClient(client, protocol.CodeBanned, "\nYou have been banned from this server.\n")
+		s.Mutex.Unlock()
+		s.webhooks.Send(s.current().Config.Webhooks, webhook.Event{Event: webhook.EventKick, Time: time.Now(), Room: client.Room, Name: client.Name, Reason: "banned"})
+		client.Conn.Close()
+	}
+}
+
+// Unban implements admin.Controller.
+func (s *Server) Unban(target string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if ip := net.ParseIP(target); ip != nil {
+		target = ip.String()
+	}
+	if !s.bannedNames[target] && !s.bannedIPs[target] {
+		return fmt.Errorf("%q is not banned", target)
+	}
+	delete(s.bannedNames, target)
+	delete(s.bannedIPs, target)
+	logging.Logger("Unbanned: " + target)
+	s.record(audit.Event{Action: audit.ActionUnban, Actor: audit.ActorAdmin, Target: target})
+	return nil
+}
+
+// Notice implements admin.Controller.
+func (s *Server) Notice(text string) error {
+	s.broadcast(chat.KindSystem, chat.Line{Time: time.Now(), Room: DefaultRoom, Body: "[SERVER NOTICE]: " + text}, nil)
+	return nil
+}
+
+// RotateLogs implements admin.Controller.
+func (s *Server) RotateLogs() error {
+	return logging.Rotate()
+}
+
+// Export implements admin.Controller.
+func (s *Server) Export() ([]storage.Message, error) {
+	messages, err := s.history.Messages()
+	if err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("load").Inc()
+	}
+	return messages, err
+}
+
+// isBanned reports whether a username or remote address is banned, either at
+// runtime or by the config. Empty or nil arguments are not checked.
+func (s *Server) isBanned(username string, addr net.Addr) bool {
+	cfg := s.current().Config
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if username != "" {
+		if s.bannedNames[username] {
+			return true
+		}
+		for _, name := range cfg.BannedNames {
+			if name == username {
+				return true
+			}
+		}
+	}
+	if addr != nil {
+		ip := remoteIP(addr)
+		if s.bannedIPs[ip] {
+			return true
+		}
+		for _, banned := range cfg.BannedIPs {
+			if parsed := net.ParseIP(banned); parsed != nil && parsed.String() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findClient returns the connected client with the given name. Callers must hold s.Mutex.
+func (s *Server) findClient(name string) *client.Client {
+	for _, client := range s.clients {
+		if client.Name == name {
+			return client
+		}
+	}
+	return nil
+}
+
+// clientByConn returns the connected client using conn, or nil.
+func (s *Server) clientByConn(conn net.Conn) *client.Client {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.findClientByConn(conn)
+}
+
+// findClientByConn returns the client on conn, or nil. The caller must hold s.Mutex.
+func (s *Server) findClientByConn(conn net.Conn) *client.Client {
+	for _, client := range s.clients {
+		if client.Conn == conn {
+			return client
+		}
+	}
+	return nil
+}
+
+// touchClient records activity for the client on conn.
+func (s *Server) touchClient(conn net.Conn) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, client := range s.clients {
+		if client.Conn == conn {
+			client.LastActive = time.Now()
+			return
+		}
+	}
+}
+
+// remoteIP returns the IP part of a remote address, or "" if it has none.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
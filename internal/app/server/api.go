@@ -0,0 +1,132 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"netcat/internal/api"
+	"netcat/internal/audit"
+	"netcat/internal/storage"
+)
+
+// Authenticate implements api.Backend using the api_tokens from the config.
+// Refused requests are recorded in the audit trail.
+func (s *Server) Authenticate(token, addr string) (string, bool) {
+	if token == "" {
+		s.record(audit.Event{Action: audit.ActionAuthFailed, Addr: addr, Detail: "missing API token"})
+		return "", false
+	}
+	service, ok := api.Lookup(s.current().Config.APITokens, token)
+	if !ok {
+		s.record(audit.Event{Action: audit.ActionAuthFailed, Addr: addr, Detail: "invalid API token"})
+	}
+	return service, ok
+}
+
+// PostAs implements api.Backend. The message goes through postMessage like
+// one typed by a user, so it is stored, broadcast to every client and sent to
+// webhooks. It is posted under the service's name after api.ServicePrefix and
+// tagged as a service message, which no user can change.
+func (s *Server) PostAs(service, room, body, replyTo string) (storage.Message, error) {
+	service = api.ServicePrefix + service
+	if room != DefaultRoom {
+		return storage.Message{}, api.NotFound("no room named %q", room)
+	}
+	if errMsg := verifyMessage(body); errMsg != "" {
+		return storage.Message{}, api.Invalid("%s", errMsg)
+	}
+
+	var parent *storage.Message
+	if replyTo != "" {
+		msg, errMsg := s.lookupMessage(replyTo)
+		if errMsg != "" {
+			return storage.Message{}, api.Invalid("%s", errMsg)
+		}
+		parent = &msg
+	}
+	body, notice, ok := s.screenMessage(service, room, body)
+	if !ok && notice != "" {
+		return storage.Message{}, api.Invalid("%s", notice)
+	}
+	if !ok {
+		// Dropped silently: the service is answered as if it was posted
+		return storage.Message{Time: time.Now(), Room: room, Name: service, Body: body}, nil
+	}
+	return s.postMessage(nil, service, body, parent), nil
+}
+
+// isService reports whether name is that of a service posting through the
+// HTTP API, here or on a linked server.
+func isService(name string) bool {
+	return strings.HasPrefix(name, api.ServicePrefix)
+}
+
+// RoomHistory implements api.Backend.
+func (s *Server) RoomHistory(room string, before int64, limit int) ([]storage.Message, bool, error) {
+	if room != DefaultRoom {
+		return nil, false, api.NotFound("no room named %q", room)
+	}
+	messages, err := s.history.Messages()
+	if err != nil {
+		historyErrors.WithLabelValues("load").Inc()
+		return nil, false, err
+	}
+
+	// Walk back from the newest message, keeping the page's window.
+	end := len(messages)
+	if before != 0 {
+		for end > 0 && messages[end-1].ID >= before {
+			end--
+		}
+	}
+	var page []storage.Message
+	i := end - 1
+	for ; i >= 0 && len(page) < limit; i-- {
+		if inRoom(messages[i], room) {
+			page = append(page, messages[i])
+		}
+	}
+	more := false
+	for ; i >= 0; i-- {
+		if inRoom(messages[i], room) {
+			more = true
+			break
+		}
+	}
+
+	// Oldest first.
+	for l, r := 0, len(page)-1; l < r; l, r = l+1, r-1 {
+		page[l], page[r] = page[r], page[l]
+	}
+	return page, more, nil
+}
+
+// inRoom reports whether m was sent to room. Messages saved before rooms
+// existed belong to the default room.
+func inRoom(m storage.Message, room string) bool {
+	return m.Room == room || (m.Room == "" && room == DefaultRoom)
+}
+
+// OnlineUsers implements api.Backend.
+func (s *Server) OnlineUsers(room string) []api.User {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	now := time.Now()
+	users := make([]api.User, 0, len(s.clients))
+	for _, client := range s.clients {
+		if room != "" && client.Room != room {
+			continue
+		}
+		users = append(users, api.User{
+			Name:        client.Name,
+			Room:        client.Room,
+			Bot:         client.Bot,
+			State:       presenceOf(client),
+			Status:      client.Status,
+			Connected:   client.Connected,
+			IdleSeconds: int64(now.Sub(client.LastActive).Seconds()),
+		})
+	}
+	return users
+}
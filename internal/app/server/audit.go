@@ -0,0 +1,17 @@
+package server
+
+import (
+	"log"
+
+	"netcat/internal/audit"
+	"netcat/internal/logging"
+)
+
+// record adds ev to the audit trail. A failure to write it is logged and
+// does not stop what is being recorded.
+func (s *Server) record(ev audit.Event) {
+	if err := s.trail.Record(ev); err != nil {
+		logging.Logger(err.Error())
+		log.Printf("Error writing the audit trail: %v", err)
+	}
+}
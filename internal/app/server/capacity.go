@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"netcat/internal/audit"
+	"netcat/internal/logging"
+	"netcat/internal/protocol"
+)
+
+// errChatFull is returned when a client finds no place and cannot wait for one.
+var errChatFull = errors.New("maximum client limit reached")
+
+// waiter is a client waiting for a place in the full chat. It is admitted
+// by admitWaiting, in the order of arrival, as soon as a place frees up.
+type waiter struct {
+	conn     net.Conn
+	name     string
+	operator bool          // May take the places kept for operators
+	admitted bool          // Added to the chat by admitWaiting, guarded by Mutex
+	moved    chan struct{} // Signalled when the waiter moves up, closed when it leaves the list
+	told     chan struct{} // Closed when tellMoves has returned
+}
+
+// hasPlace reports whether a client can join: the chat is below its
+// capacity, not counting the places kept for operators unless operator is
+// set. Users whose session is held keep their place, bots take none. The
+// caller must hold s.Mutex.
+func (s *Server) hasPlace(operator bool) bool {
+	cfg := s.current().Config
+	people := 0
+	for _, c := range s.clients {
+		if !c.Bot {
+			people++
+		}
+	}
+	for _, sess := range s.sessions {
+		if sess.held {
+			people++
+		}
+	}
+
+	limit := cfg.MaxClients
+	if !operator {
+		limit -= cfg.OperSlots
+	}
+	return people < limit
+}
+
+// waitForPlace puts the client on conn, refused by addClient, on the waiting
+// list and blocks until it is admitted, returning nil, or leaves. Lines the
+// client sends meanwhile are answered with its place in the list, except one
+// it was sending when admitted, which is left to handleClientMessages. It
+// returns errChatFull if the waiting list is off or full.
+func (s *Server) waitForPlace(conn net.Conn, username string) error {
+	w := &waiter{conn: conn, name: username, operator: operDeclared(conn), moved: make(chan struct{}, 1), told: make(chan struct{})}
+	s.Mutex.Lock()
+	if len(s.waiting) >= s.current().Config.WaitingList {
+		s.Mutex.Unlock()
+		return errChatFull
+	}
+	s.waiting = append(s.waiting, w)
+	position := len(s.waiting)
+	waitingClients.Set(float64(len(s.waiting)))
+	s.Mutex.Unlock()
+
+	log.Printf("'%s' is number %d on the waiting list", username, position)
+	sendNotice(conn, fmt.Sprintf("The chat room is full. You are number %d on the waiting list and will join as soon as a place frees up.\n", position))
+	go s.tellMoves(w)
+	// Nothing more is written about the waiting list once the client is in
+	defer func() { <-w.told }()
+
+	reader := lineReader(conn)
+	for {
+		line, err := readLine(reader)
+		s.Mutex.Lock()
+		admitted := w.admitted
+		if err != nil && !admitted {
+			s.leaveWaiting(w)
+		}
+		position := s.waitingPosition(w)
+		s.Mutex.Unlock()
+
+		if admitted {
+			// admitWaiting interrupted the read, or the line came in as it did
+			conn.SetReadDeadline(time.Time{})
+			if err == nil {
+				line += "\n"
+			}
+			unread(conn, line)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		text := fmt.Sprintf("the chat room is full, you are number %d on the waiting list", position)
+		if jsonMode(conn) {
+			ev, _ := protocol.Decode(line)
+			writeEvent(conn, protocol.Event{Type: protocol.TypeError, Ref: ev.Ref, Error: text, Code: protocol.CodeWaiting})
+		} else {
+			conn.Write([]byte(text + "\n"))
+		}
+	}
+}
+
+// waitingPosition returns the place of w on the waiting list, counting from
+// 1, or 0 if it is not on it. The caller must hold s.Mutex.
+func (s *Server) waitingPosition(w *waiter) int {
+	for i, other := range s.waiting {
+		if other == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// tellMoves tells the client waiting as w its new place each time it moves
+// up, until it leaves the list. It writes without holding s.Mutex, so a
+// client that does not read cannot hold up the server.
+func (s *Server) tellMoves(w *waiter) {
+	defer close(w.told)
+	for range w.moved {
+		s.Mutex.Lock()
+		position := s.waitingPosition(w)
+		s.Mutex.Unlock()
+		if position == 0 {
+			return
+		}
+		sendNotice(w.conn, fmt.Sprintf("You are now number %d on the waiting list.\n", position))
+	}
+}
+
+// leaveWaiting takes w off the waiting list and tells those behind it their
+// new place. The caller must hold s.Mutex.
+func (s *Server) leaveWaiting(w *waiter) {
+	i := s.waitingPosition(w) - 1
+	if i < 0 {
+		return
+	}
+	s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+	close(w.moved)
+	waitingClients.Set(float64(len(s.waiting)))
+	log.Printf("'%s' left the waiting list", w.name)
+	s.tellPositions(i)
+}
+
+// admitWaiting adds the clients on the waiting list to the chat while there
+// are places for them, in order. An operator may be admitted to a place kept
+// for operators ahead of those before it. Called whenever a place may have
+// freed up; the caller must hold s.Mutex.
+func (s *Server) admitWaiting() {
+	first := -1
+	for i := 0; i < len(s.waiting); {
+		w := s.waiting[i]
+		if !s.hasPlace(w.operator) {
+			i++
+			continue
+		}
+		s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+		close(w.moved)
+		w.admitted = true
+		s.addClientToList(w.conn, w.name)
+		// Wake waitForPlace from its read
+		w.conn.SetReadDeadline(time.Now())
+		log.Printf("'%s' admitted from the waiting list", w.name)
+		if first < 0 {
+			first = i
+		}
+	}
+	if first >= 0 {
+		waitingClients.Set(float64(len(s.waiting)))
+		s.tellPositions(first)
+	}
+}
+
+// tellPositions has tellMoves tell the clients on the waiting list from
+// index start on their new place. It never blocks; the caller must hold
+// s.Mutex.
+func (s *Server) tellPositions(start int) {
+	for _, w := range s.waiting[start:] {
+		select {
+		case w.moved <- struct{}{}:
+		default: // Already signalled, the notice will give the latest place
+		}
+	}
+}
+
+// checkOper answers an OPER line sent before joining, granting the client
+// on t operator rights, and the places kept for operators, if the password
+// matches the config.
+func (s *Server) checkOper(t *transport) {
+	password, given := s.current().Config.OperPassword, t.oper
+	t.oper = ""
+	switch {
+	case password == "":
+		sendError(t, "operator login is disabled on this server")
+	case passwordWait(t) > 0:
+		sendError(t, fmt.Sprintf("too many wrong passwords, try again in %s", passwordWait(t).Round(time.Second)))
+	case subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1:
+		passwordFailed(t)
+		logging.Logger("Failed operator login from " + t.RemoteAddr().String())
+		s.record(audit.Event{Action: audit.ActionAuthFailed, Addr: t.RemoteAddr().String(), Detail: "wrong operator password"})
+		sendError(t, "wrong operator password")
+	default:
+		t.opered = true
+		logging.Logger("Operator rights granted to " + t.RemoteAddr().String())
+		if jsonMode(t) {
+			writeEvent(t, protocol.Event{Type: protocol.TypeAck, Body: "you are now a chat operator"})
+		} else {
+			t.Write([]byte("you are now a chat operator\n"))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/app/ui"
+	"netcat/internal/logging"
+)
+
+// colorEnabled reports whether ANSI colors should be sent to c: its transport
+// must support a terminal and it must not have turned them off with /nocolor.
+func colorEnabled(c *client.Client) bool {
+	return c != nil && c.Terminal && !c.NoColor
+}
+
+// nameColor returns the color a user's name is shown in: the one they chose
+// with /color, or one derived from their name.
+func (s *Server) nameColor(name string) string {
+	if user, ok, err := s.users.Get(name); err == nil && ok && user.Color != "" {
+		return user.Color
+	}
+	return ui.DefaultNameColor(name)
+}
+
+// colorNames returns line with the speaker's name, and that of any quoted
+// message, in their colors.
+func (s *Server) colorNames(line chat.Line) chat.Line {
+	if line.Name != "" {
+		line.Name = ui.Colorize(line.Name, s.nameColor(line.Name))
+	}
+	if line.Quote != nil {
+		quote := s.colorNames(*line.Quote)
+		line.Quote = &quote
+	}
+	return line
+}
+
+// cmdColor shows or changes the color of the sender's name, as seen by everyone.
+func (s *Server) cmdColor(sender *client.Client, args string) string {
+	switch args {
+	case "":
+		return fmt.Sprintf("your name is shown in %s; choose one of: %s", s.nameColor(sender.Name), strings.Join(ui.ColorNames(), ", "))
+	case "reset":
+		args = ""
+	default:
+		if _, ok := ui.NameColors[args]; !ok {
+			return fmt.Sprintf("unknown color %q, choose one of: %s", args, strings.Join(ui.ColorNames(), ", "))
+		}
+	}
+
+	if err := s.users.SetColor(sender.Name, args); err != nil {
+		logging.Logger(err.Error())
+		return "could not save your color, please try again"
+	}
+	return fmt.Sprintf("your name is now shown in %s", s.nameColor(sender.Name))
+}
+
+// cmdNocolor toggles colors for the sender's connection.
+func (s *Server) cmdNocolor(sender *client.Client, args string) string {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if !sender.Terminal {
+		return "your connection declared no terminal support, colors stay off"
+	}
+	sender.NoColor = !sender.NoColor
+	if sender.NoColor {
+		return "colors off, type /nocolor again to turn them back on"
+	}
+	return "colors on"
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/audit"
+	"netcat/internal/logging"
+	"netcat/internal/storage"
+	"netcat/internal/webhook"
+)
+
+// editWindow is how long after sending a user may edit or delete their own message.
+const editWindow = 15 * time.Minute
+
+// command is a slash command typed by a client. run returns the reply shown
+// to the sender only.
+type command struct {
+	usage string
+	help  string
+	run   func(s *Server, sender *client.Client, args string) string
+}
+
+// commands maps a command name, without the leading slash, to its handler.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"help": {
+			usage: "/help",
+			help:  "list the available commands",
+			run:   (*Server).cmdHelp,
+		},
+		"who": {
+			usage: "/who",
+			help:  "list the users in your room",
+			run:   (*Server).cmdWho,
+		},
+		"away": {
+			usage: "/away [message]",
+			help:  "mark yourself away, with an optional message",
+			run:   (*Server).cmdAway,
+		},
+		"busy": {
+			usage: "/busy [message]",
+			help:  "mark yourself busy; mentions will not ring your bell",
+			run:   (*Server).cmdBusy,
+		},
+		"back": {
+			usage: "/back",
+			help:  "mark yourself online again",
+			run:   (*Server).cmdBack,
+		},
+		"seen": {
+			usage: "/seen <name>",
+			help:  "show when a user last spoke and was here",
+			run:   (*Server).cmdSeen,
+		},
+		"edit": {
+			usage: "/edit <id> <text>",
+			help:  "replace the text of one of your recent messages",
+			run:   (*Server).cmdEdit,
+		},
+		"delete": {
+			usage: "/delete <id>",
+			help:  "delete one of your recent messages",
+			run:   (*Server).cmdDelete,
+		},
+		"reply": {
+			usage: "/reply <id> <text>",
+			help:  "reply to a message, quoting it",
+			run:   (*Server).cmdReply,
+		},
+		"thread": {
+			usage: "/thread <id>",
+			help:  "show a message with all of its replies",
+			run:   (*Server).cmdThread,
+		},
+		"msg": {
+			usage: "/msg <name> <text>",
+			help:  "send a private message, queued if the user is offline and registered",
+			run:   (*Server).cmdMsg,
+		},
+		"register": {
+			usage: "/register <password>",
+			help:  "protect your name with a password so private messages can be kept for you",
+			run:   (*Server).cmdRegister,
+		},
+		"identify": {
+			usage: "/identify <password>",
+			help:  "give the password of your name and read the private messages kept for you",
+			run:   (*Server).cmdIdentify,
+		},
+		"mentions": {
+			usage: "/mentions",
+			help:  "list the mentions you missed while away",
+			run:   (*Server).cmdMentions,
+		},
+		"format": {
+			usage: "/format [time <layout>|tz <zone>|<kind> <template>|reset [setting]]",
+			help:  "show or change how timestamps and chat lines look to you",
+			run:   (*Server).cmdFormat,
+		},
+		"color": {
+			usage: "/color [color|reset]",
+			help:  "show or choose the color your name is shown in",
+			run:   (*Server).cmdColor,
+		},
+		"nocolor": {
+			usage: "/nocolor",
+			help:  "turn colors off or back on for your connection",
+			run:   (*Server).cmdNocolor,
+		},
+		"upload": {
+			usage: "/upload <name>",
+			help:  "share a file: send its size in bytes on the next line, then the content",
+			run:   (*Server).cmdUpload,
+		},
+		"get": {
+			usage: "/get <id>",
+			help:  "download a shared file",
+			run:   (*Server).cmdGet,
+		},
+		"oper": {
+			usage: "/oper <password>",
+			help:  "become a chat operator",
+			run:   (*Server).cmdOper,
+		},
+	}
+}
+
+// isCommand reports whether a chat line is a slash command rather than a
+// message. Only the names of commands count, so a line like "/shrug" or a
+// path like "/usr/bin" is still sent to the room.
+func (s *Server) isCommand(message string) bool {
+	if !strings.HasPrefix(message, "/") {
+		return false
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(message, "/"), " ")
+	if _, ok := commands[name]; ok {
+		return true
+	}
+	_, ok := s.pluginCommands[name]
+	return ok
+}
+
+// handleCommand runs a slash command for sender and returns the reply.
+func (s *Server) handleCommand(sender *client.Client, line string) string {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	cmd, ok := commands[name]
+	if !ok {
+		cmd, ok = s.pluginCommands[name]
+	}
+	if !ok {
+		return fmt.Sprintf("unknown command /%s, type /help for a list", name)
+	}
+	logging.Logger(fmt.Sprintf("Command from %s: /%s", sender.Name, name))
+	return cmd.run(s, sender, strings.TrimSpace(args))
+}
+
+// cmdHelp lists every command with its usage.
+func (s *Server) cmdHelp(sender *client.Client, args string) string {
+	all := make(map[string]command, len(commands)+len(s.pluginCommands))
+	for name, cmd := range s.pluginCommands {
+		all[name] = cmd
+	}
+	for name, cmd := range commands {
+		all[name] = cmd
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n  %-20s %s", all[name].usage, all[name].help)
+	}
+	return b.String()
+}
+
+// cmdWho lists the users in the sender's room with their state and idle
+// time, bots and users on linked servers included.
+func (s *Server) cmdWho(sender *client.Client, args string) string {
+	s.Mutex.Lock()
+	room := sender.Room
+	now := time.Now()
+	var names []string
+	for _, c := range s.clients {
+		if c.Room != room {
+			continue
+		}
+		names = append(names, fmt.Sprintf("%s (%s)", c.Name, presenceLabel(c, now)))
+	}
+	s.Mutex.Unlock()
+	if room == DefaultRoom {
+		names = append(names, s.remoteUsers()...)
+	}
+
+	sort.Strings(names)
+	return fmt.Sprintf("In %s (%d): %s", room, len(names), strings.Join(names, ", "))
+}
+
+// cmdEdit replaces the body of a message and tells everyone else about it.
+// The text it replaces is removed from the history file, missed mentions
+// and webhook deliveries not made yet, as for a deleted message.
+func (s *Server) cmdEdit(sender *client.Client, args string) string {
+	idArg, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if idArg == "" || text == "" {
+		return "usage: " + commands["edit"].usage
+	}
+	msg, errMsg := s.editableMessage(sender, idArg)
+	if errMsg != "" {
+		return errMsg
+	}
+	text, notice, ok := s.screenMessage(sender.Name, sender.Room, text)
+	if !ok {
+		return notice
+	}
+
+	if _, err := s.history.Append(storage.Record{Kind: storage.KindEdit, Time: time.Now(), Name: sender.Name, Target: msg.ID, Body: text}); err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("save").Inc()
+		return "could not save the edit, please try again"
+	}
+
+	id := storage.FormatID(msg.ID)
+	if err := s.mentions.Update(msg.ID, text); err != nil {
+		logging.Logger(err.Error())
+	}
+	s.webhooks.Redact(id)
+	s.broadcast(chat.KindSystem, chat.Line{Time: time.Now(), Name: sender.Name, Room: sender.Room, Body: fmt.Sprintf("* %s edited #%s: %s", sender.Name, id, text), ID: id}, sender.Conn)
+	s.webhooks.Send(s.current().Config.Webhooks, webhook.Event{Event: webhook.EventEdit, Time: time.Now(), Room: msg.Room, Name: sender.Name, Body: text, ID: id})
+	return fmt.Sprintf("message #%s edited", id)
+}
+
+// cmdDelete tombstones a message and tells everyone else about it.
+func (s *Server) cmdDelete(sender *client.Client, args string) string {
+	if args == "" || strings.Contains(args, " ") {
+		return "usage: " + commands["delete"].usage
+	}
+	msg, errMsg := s.editableMessage(sender, args)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	if _, err := s.history.Append(storage.Record{Kind: storage.KindDelete, Time: time.Now(), Name: sender.Name, Target: msg.ID}); err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("save").Inc()
+		return "could not delete the message, please try again"
+	}
+
+	id := storage.FormatID(msg.ID)
+	s.redactCopies(msg)
+	s.broadcast(chat.KindSystem, chat.Line{Time: time.Now(), Name: sender.Name, Room: sender.Room, Body: fmt.Sprintf("* %s deleted message #%s", sender.Name, id), ID: id}, sender.Conn)
+	s.webhooks.Send(s.current().Config.Webhooks, webhook.Event{Event: webhook.EventDelete, Time: time.Now(), Room: msg.Room, Name: sender.Name, ID: id})
+	return fmt.Sprintf("message #%s deleted", id)
+}
+
+// redactCopies removes the text of a deleted message from the stores that
+// copied it out of the history: missed mentions and webhook deliveries that
+// were not made yet or were dead-lettered.
+func (s *Server) redactCopies(msg storage.Message) {
+	if err := s.mentions.Redact(msg.ID); err != nil {
+		logging.Logger(err.Error())
+	}
+	s.webhooks.Redact(storage.FormatID(msg.ID))
+}
+
+// cmdReply posts a message that quotes and links to an earlier one.
+func (s *Server) cmdReply(sender *client.Client, args string) string {
+	idArg, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if idArg == "" || text == "" {
+		return "usage: " + commands["reply"].usage
+	}
+	parent, errMsg := s.lookupMessage(idArg)
+	if errMsg != "" {
+		return errMsg
+	}
+	text, notice, ok := s.screenMessage(sender.Name, sender.Room, text)
+	if !ok {
+		return notice
+	}
+
+	s.postMessage(sender.Conn, sender.Name, text, &parent)
+	return ""
+}
+
+// lookupMessage finds the message with the ID the user typed. It returns an
+// error message for the user instead when there is no such message.
+func (s *Server) lookupMessage(idArg string) (storage.Message, string) {
+	id, err := storage.ParseID(idArg)
+	if err != nil {
+		return storage.Message{}, err.Error()
+	}
+	msg, ok, err := s.history.Get(id)
+	if err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("load").Inc()
+		return storage.Message{}, "could not read the history, please try again"
+	}
+	if !ok {
+		return storage.Message{}, fmt.Sprintf("no message #%s", storage.FormatID(id))
+	}
+	return msg, ""
+}
+
+// cmdThread shows the thread a message belongs to.
+func (s *Server) cmdThread(sender *client.Client, args string) string {
+	if args == "" || strings.Contains(args, " ") {
+		return "usage: " + commands["thread"].usage
+	}
+	id, err := storage.ParseID(args)
+	if err != nil {
+		return err.Error()
+	}
+	thread, err := s.history.Thread(id)
+	if err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("load").Inc()
+		return "could not read the history, please try again"
+	}
+	if len(thread) == 0 {
+		return fmt.Sprintf("no message #%s", storage.FormatID(id))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Thread #%s (%d replies):", storage.FormatID(thread[0].ID), len(thread)-1)
+	depth := map[int64]int{thread[0].ID: 0}
+	for _, m := range thread {
+		if m.ID != thread[0].ID {
+			depth[m.ID] = depth[m.Parent] + 1
+		}
+		// Indentation shows the reply links, so no quotes are needed
+		line := historyLine(m, nil)
+		line.Quote = nil
+		s.Mutex.Lock()
+		b.WriteString("\n" + strings.Repeat("  ", depth[m.ID]) + s.render(sender, chat.KindMessage, line))
+		s.Mutex.Unlock()
+	}
+	return b.String()
+}
+
+// editableMessage looks up a message the sender may change: their own and
+// recent enough, or any message if they are an operator. It returns an error
+// message for the sender instead when the change is not allowed.
+func (s *Server) editableMessage(sender *client.Client, idArg string) (storage.Message, string) {
+	id, err := storage.ParseID(idArg)
+	if err != nil {
+		return storage.Message{}, err.Error()
+	}
+	msg, ok, err := s.history.Get(id)
+	if err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("load").Inc()
+		return storage.Message{}, "could not read the history, please try again"
+	}
+	if !ok || msg.Deleted {
+		return storage.Message{}, fmt.Sprintf("no message #%s", storage.FormatID(id))
+	}
+
+	s.Mutex.Lock()
+	operator := sender.Operator
+	s.Mutex.Unlock()
+	if operator {
+		return msg, ""
+	}
+	if msg.Service || msg.Name != sender.Name {
+		return storage.Message{}, "you can only change your own messages"
+	}
+	if time.Since(msg.Time) > editWindow {
+		return storage.Message{}, fmt.Sprintf("messages can only be changed for %s after sending", editWindow)
+	}
+	return msg, ""
+}
+
+// cmdOper grants operator rights when the password matches the config.
+func (s *Server) cmdOper(sender *client.Client, args string) string {
+	password := s.current().Config.OperPassword
+	if password == "" {
+		return "operator login is disabled on this server"
+	}
+	if wait := passwordWait(sender.Conn); wait > 0 {
+		return fmt.Sprintf("too many wrong passwords, try again in %s", wait.Round(time.Second))
+	}
+	if subtle.ConstantTimeCompare([]byte(args), []byte(password)) != 1 {
+		passwordFailed(sender.Conn)
+		logging.Logger("Failed operator login by " + sender.Name)
+		s.record(audit.Event{Action: audit.ActionAuthFailed, Actor: sender.Name, Addr: sender.Conn.RemoteAddr().String(), Detail: "wrong operator password"})
+		return "wrong operator password"
+	}
+
+	s.Mutex.Lock()
+	sender.Operator = true
+	s.Mutex.Unlock()
+	logging.Logger("Operator rights granted to " + sender.Name)
+	s.record(audit.Event{Action: audit.ActionOper, Actor: sender.Name, Target: sender.Name, Addr: sender.Conn.RemoteAddr().String(), Detail: "/oper"})
+	return "you are now a chat operator"
+}
+
+// passwordRetryDelay is how long a connection must wait after a wrong
+// operator or account password before it may try again. It doubles with
+// every further failure.
+const (
+	passwordRetryDelay    = 2 * time.Second
+	maxPasswordRetryDelay = time.Minute
+)
+
+// passwordLimit counts the wrong passwords given on one connection.
+type passwordLimit struct {
+	failures int
+	retryAt  time.Time
+}
+
+// passwordWait returns how long conn must wait before it may give a
+// password again. Only network connections are limited; like the rest of
+// the transport, the limit is only used by the connection's own goroutine.
+func passwordWait(conn net.Conn) time.Duration {
+	t, ok := conn.(*transport)
+	if !ok {
+		return 0
+	}
+	return time.Until(t.passwords.retryAt)
+}
+
+// passwordFailed records a wrong password given on conn.
+func passwordFailed(conn net.Conn) {
+	t, ok := conn.(*transport)
+	if !ok {
+		return
+	}
+	delay := passwordRetryDelay << t.passwords.failures
+	if delay > maxPasswordRetryDelay || delay <= 0 {
+		delay = maxPasswordRetryDelay
+	}
+	t.passwords.failures++
+	t.passwords.retryAt = time.Now().Add(delay)
+}
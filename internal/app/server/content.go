@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"netcat/internal/filter"
+	"netcat/internal/logging"
+)
+
+// screenMessage runs a message username is about to post in room through
+// the configured content filter, then the stages added by plugins. It
+// returns the body to post, masked where needed, or ok false if the message
+// must not be posted, with the notice for its sender. The notice is empty
+// when the message is dropped silently; operators are told instead.
+func (s *Server) screenMessage(username, room, body string) (text string, notice string, ok bool) {
+	stages := append([]filter.Stage{s.current().Filter}, s.pluginFilters...)
+	verdict := filter.Run(stages, room, body)
+	if verdict.Action != "" {
+		filteredMessages.WithLabelValues(verdict.Action).Inc()
+	}
+
+	switch verdict.Action {
+	case filter.ActionReject:
+		logging.Logger(fmt.Sprintf("Message from %s in %s rejected by filter %q", username, room, verdict.Rule))
+		return "", verdict.Notice, false
+	case filter.ActionDrop:
+		logging.Logger(fmt.Sprintf("Message from %s in %s dropped by filter %q: %s", username, room, verdict.Rule, body))
+		log.Printf("Message from '%s' dropped by filter %q", username, verdict.Rule)
+		s.flagToOperators(fmt.Sprintf("[FILTER]: message from %s in %s dropped by %s: %s\n", username, room, verdict.Rule, body))
+		return "", "", false
+	}
+	return verdict.Body, "", true
+}
+
+// flagToOperators sends text to the operators in the chat.
+func (s *Server) flagToOperators(text string) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, c := range s.clients {
+		if c.Operator && !c.Bot {
+			sendNotice(c.Conn, text)
+		}
+	}
+}
+
+// roomOf returns the room of the client on conn.
+func (s *Server) roomOf(conn net.Conn) string {
+	if c := s.clientByConn(conn); c != nil {
+		return c.Room
+	}
+	return DefaultRoom
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/audit"
+	"netcat/internal/logging"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+)
+
+// directLine converts a private message to the line its recipient sees.
+func directLine(dm storage.DirectMessage) chat.Line {
+	return chat.Line{Time: dm.Time, Name: dm.From, Body: dm.Body}
+}
+
+// minPasswordLength is the shortest password accepted by /register.
+const minPasswordLength = 8
+
+// cmdMsg sends a private message. A message to a registered name is queued
+// unless its holder is online and identified, so only they can read it.
+func (s *Server) cmdMsg(sender *client.Client, args string) string {
+	to, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if to == "" || text == "" {
+		return "usage: " + commands["msg"].usage
+	}
+	if to == sender.Name {
+		return "you cannot send a message to yourself"
+	}
+	dm := storage.DirectMessage{From: sender.Name, To: to, Time: time.Now(), Body: text}
+
+	registered := s.users.Registered(to)
+	s.Mutex.Lock()
+	target := s.findClient(to)
+	note, identified := "", false
+	if target != nil {
+		note, identified = presenceNote(target), target.Identified
+	}
+	s.Mutex.Unlock()
+	if target != nil && (identified || !registered) {
+		s.sendTo(target, chat.KindDM, directLine(dm))
+		return fmt.Sprintf("message delivered to %s%s", to, note)
+	}
+
+	if !registered {
+		if s.users.Exists(to) {
+			return fmt.Sprintf("%s is offline and has not registered their name, so the message cannot be kept for them", to)
+		}
+		return fmt.Sprintf("no user named %s", to)
+	}
+	if err := s.inbox.Queue(dm); err != nil {
+		logging.Logger(err.Error())
+		return "could not queue the message, please try again"
+	}
+	logging.Logger(fmt.Sprintf("Direct message from %s queued for %s", sender.Name, to))
+	if target != nil {
+		// Whoever holds the name has not proven it is theirs yet
+		s.notifyQueuedMessages(target.Conn, to)
+		return fmt.Sprintf("%s has not identified; message queued and will be delivered when they do", to)
+	}
+	return fmt.Sprintf("%s is offline; message queued and will be delivered when they next identify", to)
+}
+
+// cmdRegister protects the sender's name with a password. A registered
+// name must be identified before its password can be changed.
+func (s *Server) cmdRegister(sender *client.Client, args string) string {
+	if len(args) < minPasswordLength {
+		return fmt.Sprintf("usage: %s, with at least %d characters", commands["register"].usage, minPasswordLength)
+	}
+	s.Mutex.Lock()
+	identified := sender.Identified
+	s.Mutex.Unlock()
+	if !identified && s.users.Registered(sender.Name) {
+		return "your name is already registered, /identify first to change its password"
+	}
+	if err := s.users.SetPassword(sender.Name, args); err != nil {
+		logging.Logger(err.Error())
+		return "could not register your name, please try again"
+	}
+
+	s.Mutex.Lock()
+	sender.Identified = true
+	s.Mutex.Unlock()
+	logging.Logger("Name registered by " + sender.Name)
+	return "your name is registered; private messages sent while you are offline will be kept until you /identify"
+}
+
+// cmdIdentify checks the password of the sender's registered name and, if
+// it matches, delivers the private messages kept for them.
+func (s *Server) cmdIdentify(sender *client.Client, args string) string {
+	if !s.users.Registered(sender.Name) {
+		return "your name is not registered, use " + commands["register"].usage + " to protect it"
+	}
+	if wait := passwordWait(sender.Conn); wait > 0 {
+		return fmt.Sprintf("too many wrong passwords, try again in %s", wait.Round(time.Second))
+	}
+	ok, err := s.users.CheckPassword(sender.Name, args)
+	if err != nil {
+		logging.Logger(err.Error())
+		return "could not check your password, please try again"
+	}
+	if !ok {
+		passwordFailed(sender.Conn)
+		logging.Logger("Failed identification by " + sender.Name)
+		s.record(audit.Event{Action: audit.ActionAuthFailed, Actor: sender.Name, Addr: sender.Conn.RemoteAddr().String(), Detail: "wrong password for /identify"})
+		return "wrong password"
+	}
+
+	s.Mutex.Lock()
+	sender.Identified = true
+	s.Mutex.Unlock()
+	s.deliverQueuedMessages(sender.Conn, sender.Name)
+	return "you are identified as " + sender.Name
+}
+
+// notifyQueuedMessages tells a user who just joined how many private
+// messages are kept for them until they identify.
+func (s *Server) notifyQueuedMessages(conn net.Conn, username string) {
+	waiting, err := s.inbox.Waiting(username)
+	if err != nil {
+		logging.Logger(err.Error())
+		return
+	}
+	if waiting > 0 {
+		sendNotice(conn, fmt.Sprintf("\nYou have %d private message(s) waiting, type /identify <password> to read them.\n", waiting))
+	}
+}
+
+// deliverQueuedMessages sends a user who identified the direct messages that
+// were queued while they were offline, with their original timestamps.
+func (s *Server) deliverQueuedMessages(conn net.Conn, username string) {
+	queued, err := s.inbox.Take(username)
+	if err != nil {
+		logging.Logger(err.Error())
+		return
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	if jsonMode(conn) {
+		for _, dm := range queued {
+			writeEvent(conn, lineEvent(chat.KindDM, directLine(dm)))
+		}
+		logging.Logger(fmt.Sprintf("Delivered %d queued message(s) to %s", len(queued), username))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nYou have %d message(s) sent while you were away:", len(queued))
+	for _, dm := range queued {
+		b.WriteString("\n" + s.renderForConn(conn, chat.KindDM, directLine(dm)))
+	}
+	conn.Write([]byte(b.String() + "\n"))
+	logging.Logger(fmt.Sprintf("Delivered %d queued message(s) to %s", len(queued), username))
+}
+
+// sendTo renders line for a single client and sends it followed by their prompt.
+func (s *Server) sendTo(target *client.Client, kind string, line chat.Line) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if target.Proto != "" {
+		target.Writer.Write(protocol.Encode(lineEvent(kind, line)))
+		target.Writer.Flush()
+		return
+	}
+	target.Writer.WriteString("\n" + s.render(target, kind, line) + "\n\n" + s.render(target, chat.KindPrompt, promptLine(target.Name, target.Room)))
+	target.Writer.Flush()
+}
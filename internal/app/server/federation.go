@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/federation"
+	"netcat/internal/logging"
+)
+
+// startFederation links the server to its peers as configured. Changes to
+// the federation settings take effect on the next start.
+func (s *Server) startFederation(cfg federation.Config) error {
+	node := federation.NewNode(cfg, s.deliverRemote, s.federationRoster)
+	if cfg.Listen != "" {
+		addr, err := node.Listen(cfg.Listen)
+		if err != nil {
+			return err
+		}
+		log.Printf("Federation %q listening on %s", cfg.Name, addr)
+	}
+	for _, peer := range cfg.Peers {
+		go node.Connect(peer)
+	}
+	s.federation = node
+	return nil
+}
+
+// federate sends an event about a local user to the linked servers, if any.
+func (s *Server) federate(ev federation.Event) {
+	if s.federation != nil {
+		s.federation.Publish(ev)
+	}
+}
+
+// federationRoster returns a join for every local client, sent to each new link.
+func (s *Server) federationRoster() []federation.Event {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	joins := make([]federation.Event, 0, len(s.clients))
+	for _, client := range s.clients {
+		joins = append(joins, federation.Event{Type: federation.TypeJoin, Time: client.Connected, Room: client.Room, Name: client.Name})
+	}
+	return joins
+}
+
+// deliverRemote shows an event relayed from a linked server to the local
+// clients, under the remote user's namespaced name. Remote messages go
+// through the content filter and are stored in the history like local ones;
+// events about a banned name are dropped.
+func (s *Server) deliverRemote(ev federation.Event) {
+	if ev.Room != DefaultRoom {
+		logging.Logger(fmt.Sprintf("Federated %s for unknown room %q dropped", ev.Type, ev.Room))
+		return
+	}
+	name := ev.RemoteName()
+	if s.isBanned(name, nil) {
+		logging.Logger(fmt.Sprintf("Federated %s from banned user %s dropped", ev.Type, name))
+		return
+	}
+	switch ev.Type {
+	case federation.TypeMessage:
+		if errMsg := verifyMessage(ev.Body); errMsg != "" {
+			logging.Logger(fmt.Sprintf("Federated message from %s dropped: %s", name, errMsg))
+			return
+		}
+		// A rejected message cannot be returned to its remote sender, so it is dropped too
+		body, _, ok := s.screenMessage(name, ev.Room, ev.Body)
+		if !ok {
+			return
+		}
+		s.relayMessage(nil, name, body, nil)
+	case federation.TypeJoin:
+		s.broadcast(chat.KindJoin, chat.Line{Time: time.Now(), Name: name, Room: ev.Room}, nil)
+	case federation.TypeLeave:
+		s.broadcast(chat.KindLeave, chat.Line{Time: time.Now(), Name: name, Room: ev.Room}, nil)
+	}
+}
+
+// remoteUsers returns the sorted names of the users on linked servers.
+func (s *Server) remoteUsers() []string {
+	if s.federation == nil {
+		return nil
+	}
+	names := s.federation.Remote()
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/logging"
+	"netcat/internal/storage"
+)
+
+// rendererFor returns the renderer for c: the server's, or one with c's own
+// /format overrides applied over it, rebuilt after the server's changes on a
+// reload. c may be nil for a connection that has not joined. The caller must
+// hold s.Mutex.
+func (s *Server) rendererFor(c *client.Client) *chat.Renderer {
+	base := s.current().Renderer
+	if c == nil || c.Format.IsZero() {
+		return base
+	}
+	if c.Renderer == nil || c.Renderer.Base() != base {
+		r, err := base.Override(c.Format)
+		if err != nil {
+			logging.Logger(fmt.Sprintf("Dropping /format overrides of %s: %v", c.Name, err))
+			c.Format = chat.Format{}
+			return base
+		}
+		c.Renderer = r
+	}
+	return c.Renderer
+}
+
+// render renders line for viewer with their own templates, showing names in
+// color if viewer has colors on; the prompt, being their own, stays plain.
+// viewer may be nil for a connection that has not joined. The caller must
+// hold s.Mutex.
+func (s *Server) render(viewer *client.Client, kind string, line chat.Line) string {
+	if kind != chat.KindPrompt && colorEnabled(viewer) {
+		line = s.colorNames(line)
+	}
+	return s.rendererFor(viewer).Render(kind, line)
+}
+
+// renderForConn renders line for the client on conn.
+func (s *Server) renderForConn(conn net.Conn, kind string, line chat.Line) string {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.render(s.findClientByConn(conn), kind, line)
+}
+
+// promptFor renders the input prompt for the client on conn.
+func (s *Server) promptFor(conn net.Conn, username string) string {
+	return s.renderForConn(conn, chat.KindPrompt, promptLine(username, DefaultRoom))
+}
+
+// promptLine is the data the prompt template is rendered with.
+func promptLine(name string, room string) chat.Line {
+	return chat.Line{Time: time.Now(), Name: name, Room: room}
+}
+
+// historyLine converts a stored message to a chat line, marking edits and
+// deletions. A reply quotes parent, which may be nil if the parent is no
+// longer in the history.
+func historyLine(m storage.Message, parent *storage.Message) chat.Line {
+	line := chat.Line{Time: m.Time, Name: m.Name, Room: m.Room, Body: messageBody(m), ID: storage.FormatID(m.ID)}
+	switch {
+	case parent != nil:
+		body := []rune(messageBody(*parent))
+		if len(body) > quoteLength {
+			body = append(body[:quoteLength], '…')
+		}
+		line.Quote = &chat.Line{Time: parent.Time, Name: parent.Name, Room: parent.Room, Body: string(body), ID: storage.FormatID(parent.ID)}
+	case m.Parent != 0:
+		line.Quote = &chat.Line{Name: "?", Body: "[not in history]", ID: storage.FormatID(m.Parent)}
+	}
+	return line
+}
+
+// cmdFormat shows or changes how the sender sees chat lines.
+func (s *Server) cmdFormat(sender *client.Client, args string) string {
+	if args == "" {
+		return s.describeFormat(sender)
+	}
+
+	s.Mutex.Lock()
+	f := sender.Format.Merge(chat.Format{})
+	s.Mutex.Unlock()
+
+	setting, value, _ := strings.Cut(args, " ")
+	value = strings.TrimSpace(value)
+	switch setting {
+	case "reset":
+		switch value {
+		case "":
+			f = chat.Format{}
+		case "time":
+			f.TimeLayout = ""
+		case "tz":
+			f.TimeZone = ""
+		default:
+			if _, ok := chat.DefaultTemplates[value]; !ok {
+				return fmt.Sprintf("unknown setting %q, expected time, tz or one of %s", value, strings.Join(chat.Kinds(), ", "))
+			}
+			delete(f.Templates, value)
+		}
+	case "time":
+		if value == "" {
+			return "usage: /format time <layout>, e.g. 15:04"
+		}
+		f.TimeLayout = value
+	case "tz":
+		if value == "" {
+			return "usage: /format tz <zone>, e.g. Europe/Paris"
+		}
+		f.TimeZone = value
+	default:
+		if _, ok := chat.DefaultTemplates[setting]; !ok {
+			return "usage: " + commands["format"].usage
+		}
+		if value == "" {
+			return fmt.Sprintf("usage: /format %s <template>", setting)
+		}
+		if err := chat.CheckUserTemplate(value); err != nil {
+			return err.Error()
+		}
+		f.Templates[setting] = value
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	r, err := s.current().Renderer.Override(f)
+	if err != nil {
+		return err.Error()
+	}
+	sender.Format = f
+	sender.Renderer = r
+	return "format updated"
+}
+
+// describeFormat lists the sender's effective format, marking their own overrides.
+func (s *Server) describeFormat(sender *client.Client) string {
+	s.Mutex.Lock()
+	r := s.rendererFor(sender)
+	own := sender.Format.Merge(chat.Format{})
+	s.Mutex.Unlock()
+
+	mark := func(set bool) string {
+		if set {
+			return " *"
+		}
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Format (* set by you, /format reset to undo):")
+	fmt.Fprintf(&b, "\n  %-8s %s%s", "time", r.Layout(), mark(own.TimeLayout != ""))
+	fmt.Fprintf(&b, "\n  %-8s %s%s", "tz", r.Location(), mark(own.TimeZone != ""))
+	for _, kind := range chat.Kinds() {
+		_, set := own.Templates[kind]
+		fmt.Fprintf(&b, "\n  %-8s %s%s", kind, r.Template(kind), mark(set))
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"netcat/internal/config"
+)
+
+// rateWindow is the period conn_rate_per_ip counts connection attempts over.
+const rateWindow = time.Minute
+
+// connGate keeps what the per-address limits need: the open connections and
+// the recent connection attempts of each remote address.
+type connGate struct {
+	mu        sync.Mutex
+	open      map[string]int         // Connections let through and not yet released
+	attempts  map[string][]time.Time // Connection attempts within rateWindow, oldest first
+	lastSweep time.Time              // When addresses seen no more were last forgotten
+}
+
+// admitConn decides, right after Accept and before anything is sent, whether
+// a connection from ip may go on, applying the allow and deny lists and the
+// per-address limits of the config. It returns "" and counts the connection
+// until releaseConn is called, or the reason for refusing it, which is a
+// label of connectionsRejected.
+func (s *Server) admitConn(ip string) string {
+	state := s.current()
+	cfg := state.Config
+	if reason := screenAddress(state, ip); reason != "" {
+		return reason
+	}
+
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(g.lastSweep) > rateWindow {
+		for addr := range g.attempts {
+			g.pruneAttempts(addr, now)
+		}
+		g.lastSweep = now
+	}
+
+	// Refused attempts count too, so an address that keeps hammering stays out
+	g.pruneAttempts(ip, now)
+	g.attempts[ip] = append(g.attempts[ip], now)
+	if cfg.ConnRatePerIP > 0 && len(g.attempts[ip]) > cfg.ConnRatePerIP {
+		return rejectRateLimit
+	}
+	if cfg.MaxConnsPerIP > 0 && g.open[ip] >= cfg.MaxConnsPerIP {
+		return rejectPerIP
+	}
+	g.open[ip]++
+	return ""
+}
+
+// releaseConn is called when a connection let through by admitConn ends.
+func (s *Server) releaseConn(ip string) {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.open[ip]--; g.open[ip] <= 0 {
+		delete(g.open, ip)
+	}
+}
+
+// pruneAttempts forgets the attempts from ip older than rateWindow. The
+// caller must hold g.mu.
+func (g *connGate) pruneAttempts(ip string, now time.Time) {
+	attempts := g.attempts[ip]
+	expired := 0
+	for expired < len(attempts) && now.Sub(attempts[expired]) >= rateWindow {
+		expired++
+	}
+	if expired == len(attempts) {
+		delete(g.attempts, ip)
+		return
+	}
+	g.attempts[ip] = attempts[expired:]
+}
+
+// screenAddress checks ip against the deny and allow lists, returning the
+// reason it is refused or "". The deny list wins; an empty allow list allows
+// every address. Addresses that are not IPs, such as those of pipes, pass.
+func screenAddress(state *reloadable, ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if inNetworks(state.Deny, parsed) {
+		return rejectDenied
+	}
+	if len(state.Allow) > 0 && !inNetworks(state.Allow, parsed) {
+		return rejectNotAllowed
+	}
+	return ""
+}
+
+// parseNetworks parses the entries of allow_cidrs or deny_cidrs, once per
+// config load rather than for every connection.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		network, err := config.ParseNetwork(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR block or IP address", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// inNetworks reports whether ip is in one of networks.
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/app/ui"
+	"netcat/internal/logging"
+	"netcat/internal/storage"
+)
+
+// mentionTrailer is punctuation allowed to follow a mention, as in "@layla, hi".
+const mentionTrailer = ".,:;!?)'\""
+
+// parseMentions returns the distinct names written as @name in body, in order.
+func parseMentions(body string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(body) {
+		word = strings.TrimLeft(word, "(")
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRight(word[1:], mentionTrailer)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// highlightMentions highlights every @name mention in message. Quote lines of
+// replies are left alone so quoting a mention does not notify again. It
+// reports whether name was mentioned.
+func highlightMentions(message string, name string) (string, bool) {
+	mention := "@" + name
+	found := false
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "> ") {
+			continue
+		}
+		var b strings.Builder
+		for rest := line; ; {
+			at := strings.Index(rest, mention)
+			if at < 0 {
+				b.WriteString(rest)
+				break
+			}
+			end := at + len(mention)
+			if isMentionBoundary(rest[:at], true) && isMentionBoundary(rest[end:], false) {
+				b.WriteString(rest[:at] + ui.Highlight(mention))
+				found = true
+			} else {
+				b.WriteString(rest[:end])
+			}
+			rest = rest[end:]
+		}
+		lines[i] = b.String()
+	}
+	return strings.Join(lines, "\n"), found
+}
+
+// highlightFor highlights mentions of viewer in text if they have colors on.
+// It reports whether viewer was mentioned either way.
+func highlightFor(viewer *client.Client, text string) (string, bool) {
+	highlighted, mentioned := highlightMentions(text, viewer.Name)
+	if !colorEnabled(viewer) {
+		return text, mentioned
+	}
+	return highlighted, mentioned
+}
+
+// isMentionBoundary reports whether the text before or after a mention
+// separates it from surrounding words.
+func isMentionBoundary(text string, before bool) bool {
+	if text == "" {
+		return true
+	}
+	if before {
+		r := []rune(text)
+		last := r[len(r)-1]
+		return unicode.IsSpace(last) || last == '('
+	}
+	first := []rune(text)[0]
+	return unicode.IsSpace(first) || strings.ContainsRune(mentionTrailer, first)
+}
+
+// recordMentions stores a missed mention for every registered user named in
+// msg who is not there to see it live: disconnected, away or busy.
+func (s *Server) recordMentions(msg storage.Message) {
+	for _, name := range parseMentions(msg.Body) {
+		if name == msg.Name {
+			continue
+		}
+
+		s.Mutex.Lock()
+		c := s.findClient(name)
+		present := c != nil && c.Presence == ""
+		s.Mutex.Unlock()
+		if present || !s.users.Exists(name) {
+			continue
+		}
+
+		mention := storage.Mention{To: name, From: msg.Name, Time: msg.Time, Room: msg.Room, MessageID: msg.ID, Body: msg.Body}
+		if err := s.mentions.Add(mention); err != nil {
+			logging.Logger(err.Error())
+		}
+	}
+}
+
+// notifyMissedMentions tells a user who just joined how many mentions they missed.
+func (s *Server) notifyMissedMentions(conn net.Conn, username string) {
+	unread, err := s.mentions.Unread(username)
+	if err != nil {
+		logging.Logger(err.Error())
+		return
+	}
+	if len(unread) > 0 {
+		sendNotice(conn, fmt.Sprintf("\nYou were mentioned %d time(s) while away, type /mentions to read them.\n", len(unread)))
+	}
+}
+
+// cmdMentions lists the sender's missed mentions and marks them read.
+func (s *Server) cmdMentions(sender *client.Client, args string) string {
+	unread, err := s.mentions.Take(sender.Name)
+	if err != nil {
+		logging.Logger(err.Error())
+		return "could not read your mentions, please try again"
+	}
+	if len(unread) == 0 {
+		return "no missed mentions"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Missed mentions (%d):", len(unread))
+	s.Mutex.Lock()
+	for _, m := range unread {
+		line := chat.Line{Time: m.Time, Name: m.From, Room: m.Room, Body: m.Body, ID: storage.FormatID(m.MessageID)}
+		if m.Deleted {
+			line.Body = "[message deleted]"
+		}
+		text, _ := highlightFor(sender, s.render(sender, chat.KindMessage, line))
+		b.WriteString("\n" + text)
+	}
+	s.Mutex.Unlock()
+	return b.String()
+}
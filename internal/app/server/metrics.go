@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+
+	"netcat/internal/filter"
+	"netcat/internal/metrics"
+)
+
+// Server metrics, registered with the default registry and exposed by the
+// optional /metrics endpoint.
+var (
+	connectedClients = metrics.Default.NewGauge(
+		"netcat_connected_clients", "Number of clients currently in the chat.")
+	waitingClients = metrics.Default.NewGauge(
+		"netcat_waiting_clients", "Number of clients on the waiting list for a place in the full chat.")
+	connectionsAccepted = metrics.Default.NewCounter(
+		"netcat_connections_accepted_total", "TCP connections accepted by the listener.")
+	connectionsRejected = metrics.Default.NewCounterVec(
+		"netcat_connections_rejected_total", "Connections turned away before joining the chat.", "reason")
+	messagesBroadcast = metrics.Default.NewCounterVec(
+		"netcat_messages_broadcast_total", "Chat messages broadcast, by room.", "room")
+	bytesReceived = metrics.Default.NewCounter(
+		"netcat_bytes_received_total", "Bytes read from client connections.")
+	bytesSent = metrics.Default.NewCounter(
+		"netcat_bytes_sent_total", "Bytes written to client connections.")
+	broadcastDuration = metrics.Default.NewHistogramVec(
+		"netcat_broadcast_duration_seconds", "Time taken to fan a message out to all clients.", nil, "type")
+	historyErrors = metrics.Default.NewCounterVec(
+		"netcat_history_errors_total", "Errors reading or writing the history store.", "op")
+	filteredMessages = metrics.Default.NewCounterVec(
+		"netcat_filtered_messages_total", "Chat messages the content filter masked, rejected or dropped.", "action")
+	typingEvents = metrics.Default.NewCounterVec(
+		"netcat_typing_events_total", "Typing indicators: starts and stops sent, starts held back by the rate limit, and expiries.", "result")
+)
+
+// Rejection reasons used as the label of connectionsRejected.
+const (
+	rejectRoomFull   = "room_full"
+	rejectBanned     = "banned"
+	rejectDenied     = "ip_denied"      // In deny_cidrs
+	rejectNotAllowed = "ip_not_allowed" // Outside allow_cidrs
+	rejectPerIP      = "per_ip_limit"   // max_conns_per_ip reached
+	rejectRateLimit  = "rate_limit"     // conn_rate_per_ip exceeded
+)
+
+// Results used as the label of typingEvents, besides the typing states.
+const (
+	typingLimited = "limited"
+	typingExpired = "expired"
+)
+
+func init() {
+	// Expose every rejection reason from the start so rate() works before the first event.
+	connectionsRejected.WithLabelValues(rejectRoomFull)
+	connectionsRejected.WithLabelValues(rejectBanned)
+	connectionsRejected.WithLabelValues(rejectDenied)
+	connectionsRejected.WithLabelValues(rejectNotAllowed)
+	connectionsRejected.WithLabelValues(rejectPerIP)
+	connectionsRejected.WithLabelValues(rejectRateLimit)
+	messagesBroadcast.WithLabelValues(DefaultRoom)
+	filteredMessages.WithLabelValues(filter.ActionMask)
+	filteredMessages.WithLabelValues(filter.ActionReject)
+	filteredMessages.WithLabelValues(filter.ActionDrop)
+}
+
+// countingConn wraps a net.Conn and records the bytes read and written.
+type countingConn struct {
+	net.Conn
+}
+
+// Read implements net.Conn and counts the bytes received.
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	bytesReceived.Add(float64(n))
+	return n, err
+}
+
+// Write implements net.Conn and counts the bytes sent.
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	bytesSent.Add(float64(n))
+	return n, err
+}
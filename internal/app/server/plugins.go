@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"netcat/internal/app/client"
+	"netcat/internal/filter"
+	"netcat/internal/logging"
+	"netcat/internal/plugin"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+)
+
+// botQueue is how many events a bot may fall behind by before new ones are dropped.
+const botQueue = 256
+
+// botConn is the connection of an in-process bot. The events the server
+// writes to it are decoded and queued for the plugin's own goroutine, so a
+// slow plugin never holds up the chat and may post from HandleEvent.
+type botConn struct {
+	name    string
+	mu      sync.Mutex
+	partial []byte // Start of an event line not yet complete
+	events  chan protocol.Event
+}
+
+// botAddr is the address bots report instead of a network peer.
+type botAddr string
+
+// Network implements net.Addr.
+func (a botAddr) Network() string { return "bot" }
+
+// String implements net.Addr.
+func (a botAddr) String() string { return "bot/" + string(a) }
+
+func newBotConn(name string) *botConn {
+	return &botConn{name: name, events: make(chan protocol.Event, botQueue)}
+}
+
+// Write implements net.Conn, queueing each complete event line for the plugin.
+func (c *botConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.partial = append(c.partial, p...)
+	for {
+		end := bytes.IndexByte(c.partial, '\n')
+		if end < 0 {
+			break
+		}
+		line := string(c.partial[:end])
+		c.partial = c.partial[end+1:]
+
+		ev, err := protocol.Decode(line)
+		if err != nil {
+			logging.Logger(fmt.Sprintf("Bot %s got an invalid event: %v", c.name, err))
+			continue
+		}
+		select {
+		case c.events <- ev:
+		default:
+			logging.Logger(fmt.Sprintf("Bot %s is behind, dropped a %s event", c.name, ev.Type))
+		}
+	}
+	return len(p), nil
+}
+
+// serve delivers queued events to the plugin, one at a time.
+func (c *botConn) serve(p plugin.Plugin) {
+	for ev := range c.events {
+		p.HandleEvent(ev)
+	}
+}
+
+// Read implements net.Conn. Bots act through their Hub, never by sending lines.
+func (c *botConn) Read(p []byte) (int, error) { return 0, io.EOF }
+
+// Close implements net.Conn. Bots stay for the life of the server.
+func (c *botConn) Close() error { return nil }
+
+func (c *botConn) LocalAddr() net.Addr                { return botAddr(c.name) }
+func (c *botConn) RemoteAddr() net.Addr               { return botAddr(c.name) }
+func (c *botConn) SetDeadline(t time.Time) error      { return nil }
+func (c *botConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *botConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// botHub is the plugin.Hub handed to a plugin.
+type botHub struct {
+	s        *Server
+	bot      *client.Client
+	commands map[string]command // Registered during Init, added once it succeeds
+	filters  []filter.Stage     // Registered during Init, added once it succeeds
+}
+
+// Post implements plugin.Hub.
+func (h *botHub) Post(room string, body string) (string, error) {
+	if room != h.bot.Room {
+		return "", fmt.Errorf("no room named %q", room)
+	}
+	if errMsg := verifyMessage(body); errMsg != "" {
+		return "", fmt.Errorf("%s", errMsg)
+	}
+	body, notice, ok := h.s.screenMessage(h.bot.Name, room, body)
+	if !ok && notice != "" {
+		return "", fmt.Errorf("%s", notice)
+	}
+	if !ok {
+		return "", nil
+	}
+	h.s.touchClient(h.bot.Conn)
+	stored := h.s.postMessage(h.bot.Conn, h.bot.Name, body, nil)
+	return storage.FormatID(stored.ID), nil
+}
+
+// RegisterCommand implements plugin.Hub.
+func (h *botHub) RegisterCommand(cmd plugin.Command) error {
+	if h.commands == nil {
+		return fmt.Errorf("commands can only be registered from Init")
+	}
+	if cmd.Name == "" || cmd.Run == nil {
+		return fmt.Errorf("command needs a name and a Run function")
+	}
+	if _, ok := commands[cmd.Name]; ok {
+		return fmt.Errorf("command /%s is already taken", cmd.Name)
+	}
+	if _, ok := h.s.pluginCommands[cmd.Name]; ok {
+		return fmt.Errorf("command /%s is already taken", cmd.Name)
+	}
+	if _, ok := h.commands[cmd.Name]; ok {
+		return fmt.Errorf("command /%s is already taken", cmd.Name)
+	}
+
+	run := cmd.Run
+	h.commands[cmd.Name] = command{
+		usage: cmd.Usage,
+		help:  cmd.Help,
+		run: func(s *Server, sender *client.Client, args string) string {
+			return run(plugin.Call{Sender: sender.Name, Room: sender.Room, Args: args})
+		},
+	}
+	return nil
+}
+
+// RegisterFilter implements plugin.Hub.
+func (h *botHub) RegisterFilter(stage filter.Stage) error {
+	if h.commands == nil {
+		return fmt.Errorf("filters can only be registered from Init")
+	}
+	if stage == nil {
+		return fmt.Errorf("filter stage cannot be nil")
+	}
+	h.filters = append(h.filters, stage)
+	return nil
+}
+
+// addPlugin starts p as a bot client. It is only called from NewServer.
+func (s *Server) addPlugin(p plugin.Plugin) error {
+	name := p.Name()
+	s.Mutex.Lock()
+	err := s.isValidUsername(name)
+	s.Mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("plugin %q: %v", name, err)
+	}
+
+	conn := newBotConn(name)
+	now := time.Now()
+	bot := &client.Client{Name: name, Conn: conn, Writer: bufio.NewWriter(conn), Connected: now, LastActive: now, Room: DefaultRoom, Proto: protocol.Version, Bot: true}
+	hub := &botHub{s: s, bot: bot, commands: make(map[string]command)}
+	if err := p.Init(hub); err != nil {
+		return fmt.Errorf("plugin %q: %v", name, err)
+	}
+	for cmdName, cmd := range hub.commands {
+		s.pluginCommands[cmdName] = cmd
+	}
+	s.pluginFilters = append(s.pluginFilters, hub.filters...)
+	hub.commands, hub.filters = nil, nil
+
+	s.Mutex.Lock()
+	s.clients = append(s.clients, bot)
+	s.Mutex.Unlock()
+	s.registerLogin(name)
+	go conn.serve(p)
+
+	logging.Logger("Plugin started: " + name)
+	log.Printf("Bot '%s' joined", name)
+	return nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/logging"
+)
+
+// Presence states set with /away and /busy; a client with neither is online.
+const (
+	presenceOnline = "online"
+	presenceAway   = "away"
+	presenceBusy   = "busy"
+)
+
+// maxStatus is the longest message /away and /busy accept.
+const maxStatus = 100
+
+// seenLayout is how /seen shows times.
+const seenLayout = "2006-01-02 15:04:05"
+
+// presenceOf returns the state of a client. The caller holds s.Mutex.
+func presenceOf(c *client.Client) string {
+	if c.Presence == "" {
+		return presenceOnline
+	}
+	return c.Presence
+}
+
+// presenceLabel describes a client for /who: its state, any status message
+// and how long it has been idle. The caller holds s.Mutex.
+func presenceLabel(c *client.Client, now time.Time) string {
+	if c.Bot {
+		return "bot"
+	}
+	state := presenceOf(c)
+	if c.Status != "" {
+		state += ": " + c.Status
+	}
+	return fmt.Sprintf("%s, idle %s", state, formatIdle(now.Sub(c.LastActive)))
+}
+
+// formatIdle rounds a duration to what is worth showing: seconds under a
+// minute, minutes under an hour, then hours and minutes.
+func formatIdle(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	default:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
+
+// cmdAway marks the sender away, with an optional message.
+func (s *Server) cmdAway(sender *client.Client, args string) string {
+	return s.setPresence(sender, presenceAway, args)
+}
+
+// cmdBusy marks the sender busy, with an optional message. Busy users are
+// not sent the bell when mentioned.
+func (s *Server) cmdBusy(sender *client.Client, args string) string {
+	return s.setPresence(sender, presenceBusy, args)
+}
+
+// cmdBack marks the sender online again.
+func (s *Server) cmdBack(sender *client.Client, args string) string {
+	s.Mutex.Lock()
+	wasAway := sender.Presence != ""
+	sender.Presence, sender.Status = "", ""
+	s.Mutex.Unlock()
+	if !wasAway {
+		return "you are already online"
+	}
+	s.announcePresence(sender, sender.Name+" is back")
+	reply := "you are back online"
+	if unread, err := s.mentions.Unread(sender.Name); err == nil && len(unread) > 0 {
+		reply += fmt.Sprintf(", you were mentioned %d time(s) while away, type /mentions to read them", len(unread))
+	}
+	return reply
+}
+
+// setPresence changes the sender's state and tells the room.
+func (s *Server) setPresence(sender *client.Client, state string, status string) string {
+	if len(status) > maxStatus {
+		return fmt.Sprintf("the message can be at most %d characters", maxStatus)
+	}
+	s.Mutex.Lock()
+	sender.Presence, sender.Status = state, status
+	s.Mutex.Unlock()
+
+	text := sender.Name + " is " + state
+	if status != "" {
+		text += ": " + status
+	}
+	s.announcePresence(sender, text)
+	return "you are now " + state + ", type /back when you return"
+}
+
+// announcePresence tells everyone else in the sender's room about a change of state.
+func (s *Server) announcePresence(sender *client.Client, text string) {
+	logging.Logger("Presence: " + text)
+	s.broadcast(chat.KindSystem, chat.Line{Time: time.Now(), Name: sender.Name, Room: sender.Room, Body: "* " + text}, sender.Conn)
+}
+
+// presenceNote returns " (away: <message>)" or similar for a user who is
+// not online, to add to replies about them, or "". The caller holds s.Mutex.
+func presenceNote(c *client.Client) string {
+	if c.Presence == "" {
+		return ""
+	}
+	if c.Status == "" {
+		return " (" + c.Presence + ")"
+	}
+	return " (" + c.Presence + ": " + c.Status + ")"
+}
+
+// markSpoke records that the client on conn posted a message.
+func (s *Server) markSpoke(conn net.Conn, at time.Time) {
+	if conn == nil {
+		return
+	}
+	s.Mutex.Lock()
+	c := s.findClientByConn(conn)
+	if c != nil {
+		c.LastSpoke = at
+	}
+	s.Mutex.Unlock()
+	if c == nil {
+		return
+	}
+	if err := s.users.Spoke(c.Name, at); err != nil {
+		logging.Logger(err.Error())
+	}
+}
+
+// recordLogout records that username disconnected, for /seen.
+func (s *Server) recordLogout(username string) {
+	if err := s.users.Logout(username, time.Now()); err != nil {
+		logging.Logger(err.Error())
+	}
+}
+
+// cmdSeen tells when a user last spoke and, if they are gone, when they left.
+func (s *Server) cmdSeen(sender *client.Client, args string) string {
+	if args == "" {
+		return "usage: " + commands["seen"].usage
+	}
+	now := time.Now()
+	ago := func(t time.Time) string {
+		return fmt.Sprintf("%s (%s ago)", t.Format(seenLayout), formatIdle(now.Sub(t)))
+	}
+
+	s.Mutex.Lock()
+	if c := s.findClient(args); c != nil {
+		reply := fmt.Sprintf("%s is here%s, idle %s", c.Name, presenceNote(c), formatIdle(now.Sub(c.LastActive)))
+		if !c.LastSpoke.IsZero() {
+			reply += ", last spoke " + ago(c.LastSpoke)
+		}
+		s.Mutex.Unlock()
+		return reply
+	}
+	s.Mutex.Unlock()
+
+	user, ok, err := s.users.Get(args)
+	if err != nil {
+		logging.Logger(err.Error())
+		return "could not look the user up, please try again"
+	}
+	if !ok {
+		return fmt.Sprintf("%s has never been here", args)
+	}
+	spoke := "has not spoken"
+	if !user.LastSpoke.IsZero() {
+		spoke = "last spoke " + ago(user.LastSpoke)
+	}
+	left := user.LastLogin
+	if user.LastLogout.After(left) {
+		left = user.LastLogout
+	}
+	return fmt.Sprintf("%s %s and was last here %s", user.Name, spoke, ago(left))
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/logging"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+)
+
+// eventTypes maps the kind of a rendered chat line to its protocol event.
+var eventTypes = map[string]string{
+	chat.KindMessage: protocol.TypeMessage,
+	chat.KindJoin:    protocol.TypeJoin,
+	chat.KindLeave:   protocol.TypeLeave,
+	chat.KindSystem:  protocol.TypeNotice,
+	chat.KindDM:      protocol.TypeDM,
+}
+
+// jsonMode reports whether the client on conn negotiated the JSON protocol.
+// Bots always speak it.
+func jsonMode(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *transport:
+		return c.proto == protocol.Version
+	case *botConn:
+		return true
+	}
+	return false
+}
+
+// writeEvent sends a single event to a protocol client.
+func writeEvent(conn net.Conn, ev protocol.Event) {
+	conn.Write(protocol.Encode(ev))
+}
+
+// sendNotice sends text to the client on conn: as is to a human, or as a
+// notice event to a protocol client.
+func sendNotice(conn net.Conn, text string) {
+	if jsonMode(conn) {
+		writeEvent(conn, protocol.Event{Type: protocol.TypeNotice, Body: strings.TrimSpace(text)})
+		return
+	}
+	conn.Write([]byte(text))
+}
+
+// sendError tells the client on conn that something failed, as a line of
+// text or as an error event.
+func sendError(conn net.Conn, text string) {
+	if jsonMode(conn) {
+		writeEvent(conn, protocol.Event{Type: protocol.TypeError, Error: strings.TrimSpace(text)})
+		return
+	}
+	conn.Write([]byte(text + "\n"))
+}
+
+// sendRefusal tells the client on conn that it is turned away for the
+// reason given by code, before the connection is closed: as a line of text
+// or as a refused event, which tells the client not to reconnect.
+func sendRefusal(conn net.Conn, code string, text string) {
+	if jsonMode(conn) {
+		writeEvent(conn, protocol.Event{Type: protocol.TypeRefused, Code: code, Error: strings.TrimSpace(text)})
+		return
+	}
+	conn.Write([]byte(text))
+}
+
+// refuseClient is sendRefusal for a client in the chat, written through its
+// Writer so it cannot interleave with a broadcast. The caller must hold
+// s.Mutex.
+func refuseClient(c *client.Client, code string, text string) {
+	if c.Proto != "" {
+		c.Writer.Write(protocol.Encode(protocol.Event{Type: protocol.TypeRefused, Code: code, Error: strings.TrimSpace(text)}))
+	} else {
+		c.Writer.WriteString(text)
+	}
+	c.Writer.Flush()
+}
+
+// lineEvent converts a chat line to the event protocol clients receive instead.
+func lineEvent(kind string, line chat.Line) protocol.Event {
+	ev := protocol.Event{Type: eventTypes[kind], ID: line.ID, Time: protocol.FormatTime(line.Time), Room: line.Room, Name: line.Name, Body: line.Body}
+	if line.Quote != nil {
+		ev.ReplyTo = line.Quote.ID
+	}
+	return ev
+}
+
+// messageEvent converts a stored message to a message event.
+func messageEvent(m storage.Message) protocol.Event {
+	ev := protocol.Event{Type: protocol.TypeMessage, ID: storage.FormatID(m.ID), Time: protocol.FormatTime(m.Time), Room: m.Room, Name: m.Name, Body: m.Body, Edited: m.Edited, Deleted: m.Deleted}
+	if m.Parent != 0 {
+		ev.ReplyTo = storage.FormatID(m.Parent)
+	}
+	return ev
+}
+
+// handleEvent handles one line from a protocol client that has joined. Every
+// event is answered with an ack or an error carrying its Ref, except typing
+// events and the client's own acks, which are only answered when invalid.
+func (s *Server) handleEvent(conn net.Conn, username string, line string) {
+	ev, err := protocol.Decode(line)
+	if err != nil {
+		writeEvent(conn, protocol.Event{Type: protocol.TypeError, Error: err.Error()})
+		return
+	}
+	fail := func(text string) {
+		writeEvent(conn, protocol.Event{Type: protocol.TypeError, Ref: ev.Ref, Error: text})
+	}
+
+	switch ev.Type {
+	case protocol.TypeMessage:
+		if errMsg := verifyMessage(ev.Body); errMsg != "" {
+			fail(errMsg)
+			return
+		}
+		s.touchClient(conn)
+
+		if s.isCommand(ev.Body) {
+			sender := s.clientByConn(conn)
+			if sender == nil {
+				fail("not in the chat")
+				return
+			}
+			writeEvent(conn, protocol.Event{Type: protocol.TypeAck, Ref: ev.Ref, Body: s.handleCommand(sender, ev.Body)})
+			return
+		}
+
+		var parent *storage.Message
+		if ev.ReplyTo != "" {
+			msg, errMsg := s.lookupMessage(ev.ReplyTo)
+			if errMsg != "" {
+				fail(errMsg)
+				return
+			}
+			parent = &msg
+		}
+		body, notice, ok := s.screenMessage(username, s.roomOf(conn), ev.Body)
+		if !ok && notice != "" {
+			fail(notice)
+			return
+		}
+		if !ok {
+			// Dropped silently: acknowledged like a message that was posted
+			writeEvent(conn, protocol.Event{Type: protocol.TypeAck, Ref: ev.Ref, Time: protocol.FormatTime(time.Now())})
+			return
+		}
+		stored := s.postMessage(conn, username, body, parent)
+		writeEvent(conn, protocol.Event{Type: protocol.TypeAck, Ref: ev.Ref, ID: storage.FormatID(stored.ID), Time: protocol.FormatTime(stored.Time)})
+
+	case protocol.TypeTyping:
+		switch ev.State {
+		case protocol.TypingStart:
+			s.startTyping(conn)
+		case protocol.TypingStop:
+			s.stopTyping(conn)
+		default:
+			fail(fmt.Sprintf("typing state must be %q or %q", protocol.TypingStart, protocol.TypingStop))
+		}
+
+	case protocol.TypeAck:
+		// The client acknowledges the messages up to ev.ID, for resuming
+		if err := s.acknowledge(conn, ev.ID); err != nil {
+			fail(err.Error())
+		}
+
+	case protocol.TypeNick:
+		fail("names cannot be changed after joining")
+
+	case protocol.TypeLeave:
+		// The client leaves for good: its session is not held for resuming
+		s.dropSession(username)
+		conn.Close()
+
+	default:
+		logging.Logger(fmt.Sprintf("Unknown event type %q from %s", ev.Type, username))
+		fail(fmt.Sprintf("unknown event type %q", ev.Type))
+	}
+}
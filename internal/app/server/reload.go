@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
+	"netcat/internal/audit"
+	"netcat/internal/config"
+	"netcat/internal/filter"
+	"netcat/internal/interfaces"
+	"netcat/internal/logging"
+)
+
+// reloadable is the state replaced as a unit when the configuration is reloaded,
+// so a connection never sees a new config paired with an old welcome message.
+type reloadable struct {
+	Config   *config.Config
+	Welcome  string
+	Renderer *chat.Renderer // Renders Config.Format; clients' own renderers derive from it
+	Filter   *filter.Filter // Config.Filters with their word lists read
+	Allow    []*net.IPNet   // Config.AllowCIDRs, parsed
+	Deny     []*net.IPNet   // Config.DenyCIDRs, parsed
+}
+
+// current returns the configuration in effect.
+func (s *Server) current() *reloadable {
+	return s.state.Load()
+}
+
+// loadReloadable reads and validates the config file and the welcome message it names.
+func (s *Server) loadReloadable() (*reloadable, error) {
+	cfg, err := config.Load(s.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	welcome, err := readWelcomeMessage(cfg.WelcomeFile)
+	if err != nil {
+		return nil, err
+	}
+	renderer, err := chat.NewRenderer(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	contentFilter, err := filter.New(cfg.Filters)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parseNetworks(cfg.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %v", err)
+	}
+	deny, err := parseNetworks(cfg.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %v", err)
+	}
+	return &reloadable{Config: cfg, Welcome: welcome, Renderer: renderer, Filter: contentFilter, Allow: allow, Deny: deny}, nil
+}
+
+// Reload implements admin.Controller. It re-reads the configuration and swaps it
+// in, and turns away the clients it bans; an invalid configuration is logged
+// and rejected, and the one already running stays in effect.
+func (s *Server) Reload() error {
+	state, err := s.loadReloadable()
+	if err != nil {
+		logging.Logger("Reload rejected: " + err.Error())
+		s.record(audit.Event{Action: audit.ActionReloadRejected, Actor: audit.ActorServer, Detail: err.Error()})
+		log.Printf("Reload rejected, keeping current configuration: %v", err)
+		return fmt.Errorf("reload rejected: %v", err)
+	}
+
+	s.state.Store(state)
+
+	interfaces.Mutex.Lock()
+	interfaces.WelcomeMessage = state.Welcome
+	interfaces.Mutex.Unlock()
+
+	// The limits may have been raised
+	s.Mutex.Lock()
+	s.admitWaiting()
+	clients := append([]*client.Client(nil), s.clients...)
+	s.Mutex.Unlock()
+
+	// Bans added to the config apply to those already in the chat
+	var banned []*client.Client
+	for _, c := range clients {
+		addr := c.Conn.RemoteAddr()
+		ip := remoteIP(addr)
+		if !c.Bot && (s.isBanned(c.Name, addr) || screenAddress(state, ip) != "") {
+			logging.Logger("Client banned by the reloaded configuration: " + c.Name)
+			s.record(audit.Event{Action: audit.ActionKick, Actor: audit.ActorServer, Target: c.Name, Addr: ip, Detail: "banned by the reloaded configuration"})
+			banned = append(banned, c)
+		}
+	}
+	s.removeBanned(banned)
+
+	logging.Logger("Configuration reloaded")
+	s.record(audit.Event{Action: audit.ActionReload, Actor: audit.ActorServer, Target: s.ConfigPath})
+	log.Println("Configuration reloaded")
+	return nil
+}
+
+// WatchConfig polls the config file, the welcome file and the filter word
+// lists every interval and reloads when one changes. It never returns.
+func (s *Server) WatchConfig(interval time.Duration) {
+	last := s.watchedFiles()
+	for range time.Tick(interval) {
+		files := s.watchedFiles()
+		if files == last {
+			continue
+		}
+		last = files
+		logging.Logger("Configuration change detected")
+		s.Reload()
+	}
+}
+
+// watchedFiles returns a fingerprint of the files a reload would read.
+func (s *Server) watchedFiles() string {
+	cfg := s.current().Config
+	paths := []string{s.ConfigPath, cfg.WelcomeFile}
+	for _, rule := range cfg.Filters {
+		paths = append(paths, rule.WordList)
+	}
+
+	var fingerprint string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			fingerprint += fmt.Sprintf("%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fingerprint += path + ":missing;"
+		}
+	}
+	return fingerprint
+}
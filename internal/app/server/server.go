@@ -5,44 +5,106 @@ package server
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"netcat/internal/app/chat"
 	"netcat/internal/app/client"
+	"netcat/internal/app/ui"
+	"netcat/internal/audit"
+	"netcat/internal/config"
+	"netcat/internal/federation"
+	"netcat/internal/filter"
 	"netcat/internal/interfaces"
 	"netcat/internal/logging"
+	"netcat/internal/plugin"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+	"netcat/internal/webhook"
 )
 
+// DefaultRoom is the room every client joins on connect.
+const DefaultRoom = "general"
+
 // Server represents a TCP server for the NetCat application.
 type Server struct {
 	Addr             string     // Address on which the server listens for incoming connections
 	Mutex            sync.Mutex // Mutex for thread-safe access to server state
 	ActiveClients    int        // Number of active clients connected to the server
 	ActiveClientsMux sync.Mutex // Mutex for thread-safe access to active client count
+
+	ConfigPath  string                     // Optional JSON config file, re-read on reload
+	state       atomic.Pointer[reloadable] // Current config and welcome message, swapped on reload
+	bannedNames map[string]bool            // Usernames banned at runtime, guarded by Mutex
+	bannedIPs   map[string]bool            // Remote IPs banned at runtime, guarded by Mutex
+	history     *storage.History           // Message history with edits and tombstones
+	users       *storage.Users             // Every name that has ever joined
+	mentions    *storage.Mentions          // Mentions missed by users who were away
+	inbox       *storage.Inbox             // Direct messages waiting for offline users
+	uploads     *storage.Uploads           // Files shared with /upload
+	webhooks    *webhook.Dispatcher        // Posts chat events to the configured webhooks
+	trail       *audit.Trail               // Administrative and security events
+	federation  *federation.Node           // Links to other servers, nil unless configured
+	typing      map[net.Conn]*typingState  // Users who are typing, guarded by Mutex
+	sessions    map[string]*session        // Resumable sessions by token, guarded by Mutex
+	clients     []*client.Client           // Clients in the chat, guarded by Mutex
+	waiting     []*waiter                  // Clients waiting for a place, in order, guarded by Mutex
+	gate        connGate                   // Per-address connection counts, with its own lock
+
+	pluginCommands map[string]command // Slash commands added by plugins, fixed after NewServer
+	pluginFilters  []filter.Stage     // Content filter stages added by plugins, fixed after NewServer
 }
 
-// init initializes the server by reading welcome message and setting history file.
-func init() {
-	// Read the content of welcome.txt
-	content, err := os.ReadFile("welcome.txt")
+// NewServer creates a new instance of the server. Each plugin joins the chat
+// as a bot; a plugin that fails to start is logged and left out.
+func NewServer(plugins ...plugin.Plugin) interfaces.ServerInitializer {
+	return newServer("", plugins...)
+}
+
+// newServer creates a server that keeps its history, users, mentions, inbox,
+// uploads, webhook dead letters and audit trail in dir, or in the working
+// directory when dir is empty.
+func newServer(dir string, plugins ...plugin.Plugin) *Server {
+	s := &Server{
+		history:        storage.NewHistory(filepath.Join(dir, interfaces.HistoryFile)),
+		users:          storage.NewUsers(filepath.Join(dir, interfaces.UsersFile)),
+		mentions:       storage.NewMentions(filepath.Join(dir, interfaces.MentionsFile)),
+		inbox:          storage.NewInbox(filepath.Join(dir, interfaces.InboxFile)),
+		uploads:        storage.NewUploads(filepath.Join(dir, interfaces.UploadsDir)),
+		webhooks:       webhook.NewDispatcher(filepath.Join(dir, interfaces.WebhookDeadLetterFile)),
+		trail:          audit.New(filepath.Join(dir, interfaces.AuditFile)),
+		bannedNames:    make(map[string]bool),
+		bannedIPs:      make(map[string]bool),
+		typing:         make(map[net.Conn]*typingState),
+		sessions:       make(map[string]*session),
+		gate:           connGate{open: make(map[string]int), attempts: make(map[string][]time.Time)},
+		pluginCommands: make(map[string]command),
+	}
+	// InitializeServer reads the config and welcome file again and fails if
+	// they are missing; until then the server greets with what it found.
+	welcome, err := readWelcomeMessage(config.Default().WelcomeFile)
 	if err != nil {
 		logging.Logger(err.Error())
-		log.Fatalf("Error reading welcome.txt: %v", err)
-	} else {
-		logging.Logger("Welcome file read successfully")
 	}
-	interfaces.WelcomeMessage = string(content)
-
-	interfaces.HistoryFile = "history.txt"
-}
-
-// NewServer creates a new instance of the server.
-func NewServer() interfaces.ServerInitializer {
-	return &Server{}
+	interfaces.Mutex.Lock()
+	interfaces.WelcomeMessage = welcome
+	interfaces.Mutex.Unlock()
+	renderer, _ := chat.NewRenderer(chat.Format{})
+	s.state.Store(&reloadable{Config: config.Default(), Welcome: welcome, Renderer: renderer})
+
+	for _, p := range plugins {
+		if err := s.addPlugin(p); err != nil {
+			logging.Logger(err.Error())
+			log.Printf("Error starting plugin: %v", err)
+		}
+	}
+	return s
 }
 
 // InitializeServer initializes the server with the specified address.
@@ -52,6 +114,23 @@ func (s *Server) InitializeServer(addr string) error {
 		return nil
 	}
 
+	state, err := s.loadReloadable()
+	if err != nil {
+		logging.Logger(err.Error())
+		return err
+	}
+	s.state.Store(state)
+	interfaces.Mutex.Lock()
+	interfaces.WelcomeMessage = state.Welcome
+	interfaces.Mutex.Unlock()
+
+	if cfg := s.current().Config.Federation; cfg.Enabled() {
+		if err := s.startFederation(cfg); err != nil {
+			logging.Logger(err.Error())
+			return err
+		}
+	}
+
 	s.CleanupHistoryFile()
 	s.Addr = addr
 	return nil
@@ -71,7 +150,7 @@ func (s *Server) ListenAndServe() error {
 	defer listener.Close()
 
 	// log.Printf("Server listening on %s", s.Addr)
-	log.Printf("Listening on the IP: %s and port :%d", GetIpLocal(), ParsePortFromArgs(os.Args))
+	log.Printf("Listening on the IP: %s and port :%d", GetIpLocal(), listener.Addr().(*net.TCPAddr).Port)
 
 	for {
 		conn, err := listener.Accept()
@@ -83,7 +162,30 @@ func (s *Server) ListenAndServe() error {
 		} else {
 			logging.Logger("Connection accepted successfully")
 		}
-		go s.handleConnection(conn)
+
+		// Refuse unwanted addresses before sending them anything
+		ip := remoteIP(conn.RemoteAddr())
+		if reason := s.admitConn(ip); reason != "" {
+			logging.Logger(fmt.Sprintf("Refused connection from %s: %s", ip, reason))
+			log.Printf("Refused connection from %s: %s", ip, reason)
+			connectionsRejected.WithLabelValues(reason).Inc()
+			conn.Close()
+			continue
+		}
+		connectionsAccepted.Inc()
+		go func() {
+			defer s.releaseConn(ip)
+			s.handleConnection(newTransport(countingConn{conn}))
+		}()
+	}
+}
+
+// Close stops the server's background work before it exits: queued webhook
+// deliveries are attempted or dead-lettered and federation links are closed.
+func (s *Server) Close() {
+	s.webhooks.Close()
+	if s.federation != nil {
+		s.federation.Close()
 	}
 }
 
@@ -92,31 +194,84 @@ func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	log.Printf("New connection from %s", conn.RemoteAddr())
 
+	// Refuse banned addresses before anything else is sent
+	if s.isBanned("", conn.RemoteAddr()) {
+		log.Printf("Refused banned address %s", conn.RemoteAddr())
+		connectionsRejected.WithLabelValues(rejectBanned).Inc()
+		s.record(audit.Event{Action: audit.ActionRefused, Addr: conn.RemoteAddr().String(), Detail: "banned address"})
+		conn.Write([]byte("You are banned from this server.\n"))
+		return
+	}
+
 	s.sendWelcomeMessage(conn)
 	username := s.promptUsername(conn)
+	if username == "" {
+		log.Printf("%s left before choosing a name", conn.RemoteAddr())
+		return
+	}
 
-	// Attempt to add the client
-	err1 := s.addClient(conn, username)
-	if err1 != nil {
-		log.Printf("Error adding client: %v", err1)
-		conn.Write([]byte("Sorry, the chat room is full. Please try again later.\n"))
+	if s.isBanned(username, nil) {
+		log.Printf("Refused banned user '%s'", username)
+		connectionsRejected.WithLabelValues(rejectBanned).Inc()
+		s.record(audit.Event{Action: audit.ActionRefused, Actor: username, Addr: conn.RemoteAddr().String(), Detail: "banned name"})
+		sendRefusal(conn, protocol.CodeBanned, "You are banned from this server.\n")
+		if resumedSession(conn) != nil {
+			s.dropSession(username)
+			s.userLeft(nil, username)
+		}
 		return
 	}
 
-	// log.Printf("Client '%s' added", username)
+	if sess := resumedSession(conn); sess != nil {
+		// Back within the grace window: no join is shown, only what was missed is replayed
+		s.record(audit.Event{Action: audit.ActionResume, Actor: username, Addr: conn.RemoteAddr().String()})
+		s.rejoin(conn, sess)
+	} else {
+		// Attempt to add the client, waiting for a place if the chat is full
+		err1 := s.addClient(conn, username)
+		if err1 != nil {
+			err1 = s.waitForPlace(conn, username)
+		}
+		if err1 == errChatFull {
+			log.Printf("Error adding client: %v", err1)
+			connectionsRejected.WithLabelValues(rejectRoomFull).Inc()
+			sendRefusal(conn, protocol.CodeChatFull, "Sorry, the chat room is full. Please try again later.\n")
+			return
+		}
+		if err1 != nil {
+			log.Printf("%s left while waiting for a place", conn.RemoteAddr())
+			return
+		}
+
+		// log.Printf("Client '%s' added", username)
+		s.registerLogin(username)
+		s.record(audit.Event{Action: audit.ActionLogin, Actor: username, Addr: conn.RemoteAddr().String()})
+		if operDeclared(conn) {
+			s.record(audit.Event{Action: audit.ActionOper, Actor: username, Target: username, Addr: conn.RemoteAddr().String(), Detail: "OPER before joining"})
+		}
 
-	// Send join message to all clients except the new client
-	joinMessage := fmt.Sprintf("\n%s has joined our chat...\n", username)
-	s.broadcast(joinMessage, "", conn, "join")
+		// Send join message to all clients except the new client
+		s.broadcast(chat.KindJoin, chat.Line{Time: time.Now(), Name: username, Room: DefaultRoom}, conn)
+		s.federate(federation.Event{Type: federation.TypeJoin, Time: time.Now(), Room: DefaultRoom, Name: username})
 
-	// Load history messages for the newly joined client
-	s.loadHistoryMessages(conn)
+		// Load history messages for the newly joined client
+		s.loadHistoryMessages(conn, username)
+		s.notifyMissedMentions(conn, username)
+		s.notifyQueuedMessages(conn, username)
+		s.openSession(conn)
+	}
 
 	// Send initial message template only to the new client
 	s.sendInitialMessages(conn, username)
 
 	// Handle client messages
 	s.handleClientMessages(conn, username)
+	s.stopTyping(conn)
+
+	// A user who may still resume leaves quietly, the leave is shown if they do not
+	if s.suspendSession(conn) {
+		return
+	}
 
 	// If client disconnects, remove it from the list and broadcast leave message
 	err := s.removeClient(conn)
@@ -127,16 +282,50 @@ func (s *Server) handleConnection(conn net.Conn) {
 		logging.Logger("Client removed successfully")
 
 	}
+	s.userLeft(conn, username)
+}
 
-	leaveMessage := fmt.Sprintf("\n%s has left our chat...\n", username)
-	s.broadcast(leaveMessage, "", conn, "leave")
+// userLeft records that username is gone and tells the room and linked servers.
+func (s *Server) userLeft(conn net.Conn, username string) {
+	s.recordLogout(username)
+	s.broadcast(chat.KindLeave, chat.Line{Time: time.Now(), Name: username, Room: DefaultRoom}, conn)
+	s.federate(federation.Event{Type: federation.TypeLeave, Time: time.Now(), Room: DefaultRoom, Name: username})
 }
 
 // handleClientMessages handles messages received from a client.
 func (s *Server) handleClientMessages(conn net.Conn, username string) {
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		message := scanner.Text()
+	reader := lineReader(conn)
+	var readErr error
+	for {
+		message, err := readLine(reader)
+		if err != nil {
+			readErr = err
+			break
+		}
+		s.receivedLine(conn)
+
+		// Protocol clients send JSON events and get no prompts
+		if jsonMode(conn) {
+			s.handleEvent(conn, username, message)
+			continue
+		}
+
+		// A ``` line starts a block of lines sent as one message
+		isBlock := strings.TrimSpace(message) == blockFence
+		if isBlock {
+			body, errMsg, err := readBlock(reader)
+			if err != nil {
+				readErr = err
+				break
+			}
+			if errMsg != "" {
+				conn.Write([]byte(errMsg + "\n"))
+				s.sendReadyMessages(conn, username)
+				continue
+			}
+			message = body
+		}
+
 		errMsg := verifyMessage(message)
 		if errMsg != "" {
 			// Send error message to the client
@@ -145,27 +334,41 @@ func (s *Server) handleClientMessages(conn net.Conn, username string) {
 			continue
 		}
 
-		time := time.Now().Format("2006-01-02 15:04:05")
-		// Broadcast the message to all clients except the sender
-		formattedMessage := fmt.Sprintf("\n[%s][%s]: %s\n", time, username, message)
-        // Send the message to all clients except the sender
-		s.broadcast(formattedMessage+"hcm", username, conn, "formatted")
-		// Send ready message to the client himself
-		s.sendReadyMessages(conn, username)
+		s.touchClient(conn)
 
-		// Save the message to history
-		if err := SaveHistoryMessage(formattedMessage + "\n"); err != nil {
-			logging.Logger(err.Error())
-			log.Printf("Error saving message to history: %v", err)
-		} else {
-			logging.Logger("Message saved to history successfully")
+		// An upload is followed by its payload, read here from the same connection
+		if name, args, _ := strings.Cut(message, " "); name == "/upload" && !isBlock && strings.TrimSpace(args) != "" {
+			if err := s.receiveUpload(conn, reader, username, strings.TrimSpace(args)); err != nil {
+				readErr = err
+				break
+			}
+			s.sendReadyMessages(conn, username)
+			continue
+		}
+
+		// Slash commands are answered to the sender only
+		if s.isCommand(message) && !isBlock {
+			if sender := s.clientByConn(conn); sender != nil {
+				if reply := s.handleCommand(sender, message); reply != "" {
+					conn.Write([]byte(reply + "\n"))
+				}
+			}
+			s.sendReadyMessages(conn, username)
+			continue
+		}
 
+		if body, notice, ok := s.screenMessage(username, s.roomOf(conn), message); ok {
+			s.postMessage(conn, username, body, nil)
+		} else if notice != "" {
+			conn.Write([]byte(notice + "\n"))
 		}
+		// Send ready message to the client himself
+		s.sendReadyMessages(conn, username)
 	}
 
-	if err := scanner.Err(); err != nil {
-		logging.Logger(err.Error())
-		log.Printf("Error reading from %s: %v", username, err)
+	if readErr != io.EOF {
+		logging.Logger(readErr.Error())
+		log.Printf("Error reading from %s: %v", username, readErr)
 	} else {
 		logging.Logger("Error reading from client")
 
@@ -180,18 +383,19 @@ func (s *Server) sendWelcomeMessage(conn net.Conn) {
 		log.Println("Error: Mock connection is nil or CloseFunc is nil")
 		return
 	}
-	conn.Write([]byte(interfaces.WelcomeMessage))
+	conn.Write([]byte(s.current().Welcome))
 }
 
-// addClient adds a new client to the server.
+// addClient adds a new client to the server, if there is a place for them
+// and nobody is waiting for one.
 func (s *Server) addClient(conn net.Conn, username string) error {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
-	// Check if the maximum number of clients has been reached
-	if len(interfaces.Clients) >= 10 { // Check for maximum limit
+	operator := operDeclared(conn)
+	if !s.hasPlace(operator) || (len(s.waiting) > 0 && !operator) {
 		log.Println("Client tried to connect, but no space available.")
-		return fmt.Errorf("maximum client limit reached")
+		return errChatFull
 	}
 
 	// Add the client to the list of active clients (inside the critical section)
@@ -202,133 +406,218 @@ func (s *Server) addClient(conn net.Conn, username string) error {
 
 func (s *Server) addClientToList(conn net.Conn, username string) {
 	writer := bufio.NewWriter(conn)
-	interfaces.Clients = append(interfaces.Clients, client.Client{Conn: conn, Name: username, Writer: writer})
+	now := time.Now()
+	s.listClient(&client.Client{Conn: conn, Name: username, Writer: writer, Connected: now, LastActive: now, Room: DefaultRoom, Terminal: hasTerminal(conn), Proto: protocolOf(conn), TypingCap: hasCap(conn, protocol.CapTyping), Operator: operDeclared(conn)})
+}
 
-	// Increment the active client count (inside the critical section)
-	s.ActiveClientsMux.Lock()
-	s.ActiveClients++
-	s.ActiveClientsMux.Unlock()
+// registerLogin records that username has joined, so mentions and other
+// per-user data can be kept for them while they are away.
+func (s *Server) registerLogin(username string) {
+	if err := s.users.Login(username, time.Now()); err != nil {
+		logging.Logger(err.Error())
+	}
 }
 
 // sendInitialMessages sends initial messages to a newly connected client.
 func (s *Server) sendInitialMessages(conn net.Conn, username string) {
+	if jsonMode(conn) {
+		return
+	}
 	// Send the template message to the newly joined client
-	templateMessage := fmt.Sprintf("\n[%s][%s]:", time.Now().Format("2006-01-02 15:04:05"), username)
-	conn.Write([]byte(templateMessage))
+	conn.Write([]byte("\n" + s.promptFor(conn, username)))
 }
 
 // sendReadyMessages sends ready messages to a client himself.
 func (s *Server) sendReadyMessages(conn net.Conn, username string) {
-	templateMessage := fmt.Sprintf("\n[%s][%s]:", time.Now().Format("2006-01-02 15:04:05"), username)
-	conn.Write([]byte(templateMessage))
+	if jsonMode(conn) {
+		return
+	}
+	conn.Write([]byte("\n" + s.promptFor(conn, username)))
 }
 
 // loadHistoryMessages loads history messages for a newly connected client.
-func (s *Server) loadHistoryMessages(conn net.Conn) {
-	historyMessages, err := LoadHistoryMessages()
+func (s *Server) loadHistoryMessages(conn net.Conn, username string) {
+	historyMessages, err := s.history.Messages()
 	if err != nil {
 		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("load").Inc()
 		log.Printf("Error loading history messages: %v", err)
 		return
 	} else {
 		logging.Logger("History messages loaded successfully")
 	}
-	writer := bufio.NewWriter(conn)
-	for _, message := range historyMessages {
-		writer.WriteString(message + "\n")
+	s.sendHistory(conn, historyMessages)
+}
+
+// sendHistory sends messages from the history to the client on conn, marked
+// as replayed for protocol clients.
+func (s *Server) sendHistory(conn net.Conn, historyMessages []storage.Message) {
+	if jsonMode(conn) {
+		writer := bufio.NewWriter(conn)
+		for _, message := range historyMessages {
+			ev := messageEvent(message)
+			ev.History = true
+			writer.Write(protocol.Encode(ev))
+		}
 		writer.Flush()
+		return
+	}
+
+	byID := make(map[int64]*storage.Message, len(historyMessages))
+	for i := range historyMessages {
+		byID[historyMessages[i].ID] = &historyMessages[i]
 	}
-}
 
-// broadcast sends a message to all connected clients except the sender.
-func (s *Server) broadcast(message string, senderName string, sender net.Conn, messageType string) {
 	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	viewer := s.findClientByConn(conn)
+	lines := make([]string, 0, len(historyMessages))
+	for _, message := range historyMessages {
+		line := s.render(viewer, chat.KindMessage, historyLine(message, byID[message.Parent]))
+		if viewer != nil {
+			line, _ = highlightFor(viewer, line)
+		}
+		lines = append(lines, line)
+	}
+	s.Mutex.Unlock()
 
-	for _, client := range interfaces.Clients {
-		if client.Conn != sender {
-			switch messageType {
-			case "formatted":
-				//outgoing connection
-				templateMessage := string([]byte(fmt.Sprintf("\n[%s][%s]:", time.Now().Format("2006-01-02 15:04:05"), client.Name)))
-
-				// Broadcast formatted message to client
-				if client.Conn != sender {
-					client.Writer.WriteString(message + templateMessage)
-				} else {
-					client.Writer.WriteString(templateMessage)
-				}
-				client.Writer.Flush()
+	writer := bufio.NewWriter(conn)
+	for _, line := range lines {
+		writer.WriteString("\n" + line + "\n")
+		if writer.Flush() != nil {
+			return
+		}
+	}
+	if len(historyMessages) > 0 {
+		s.Mutex.Lock()
+		s.delivered(conn, historyMessages[len(historyMessages)-1].ID)
+		s.Mutex.Unlock()
+	}
+}
 
-			case "join":
-				templateMessage := string([]byte(fmt.Sprintf("\n[%s][%s]:", time.Now().Format("2006-01-02 15:04:05"), client.Name)))
-				// Send join message to client
-				if client.Conn != sender {
-					client.Writer.WriteString(message + templateMessage)
-				}
-				client.Writer.Flush()
+// postMessage saves a chat message, replying to parent if it is not nil, and
+// broadcasts it to all clients except the sender and to linked servers. It
+// returns the message as stored.
+func (s *Server) postMessage(conn net.Conn, username string, message string, parent *storage.Message) storage.Message {
+	stored := s.relayMessage(conn, username, message, parent)
+	s.federate(federation.Event{Type: federation.TypeMessage, Time: stored.Time, Room: stored.Room, Name: username, Body: message})
+	return stored
+}
 
-			case "leave":
-				templateMessage := string([]byte(fmt.Sprintf("\n[%s][%s]:", time.Now().Format("2006-01-02 15:04:05"), client.Name)))
+// relayMessage saves a message and broadcasts it to the local clients only.
+func (s *Server) relayMessage(conn net.Conn, username string, message string, parent *storage.Message) storage.Message {
+	record := storage.Record{Kind: storage.KindMessage, Time: time.Now(), Room: DefaultRoom, Name: username, Body: message, Service: isService(username)}
+	if parent != nil {
+		record.Parent = parent.ID
+	}
 
-				// Send leave message to client
-				if client.Conn != sender {
-					client.Writer.WriteString(message + templateMessage)
-				}
-				client.Writer.Flush()
-
-			case "ready":
-				// Handle "ready" message differently
-				if client.Conn != sender {
-					// Display "ready" message to the client
-					client.Writer.WriteString(message)
-					client.Writer.Flush()
-				} else {
-					client.Writer.WriteString(message)
-					client.Writer.Flush()
+	// Save the message to history, which assigns its ID
+	record, err := s.history.Append(record)
+	if err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("save").Inc()
+		log.Printf("Error saving message to history: %v", err)
+	} else {
+		logging.Logger("Message saved to history successfully")
+	}
+
+	s.markSpoke(conn, record.Time)
+	s.stopTyping(conn)
+
+	// Broadcast the message to all clients except the sender
+	stored := storage.Message{ID: record.ID, Time: record.Time, Room: record.Room, Name: username, Body: message, Parent: record.Parent, Service: record.Service}
+	s.broadcast(chat.KindMessage, historyLine(stored, parent), conn)
+	s.recordMentions(stored)
+	return stored
+}
+
+// broadcast renders line with each client's own templates and sends it to
+// every connected client except the sender, followed by their prompt.
+func (s *Server) broadcast(kind string, line chat.Line, sender net.Conn) {
+	start := time.Now()
+	defer func() {
+		broadcastDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	}()
+	if kind == chat.KindMessage {
+		messagesBroadcast.WithLabelValues(line.Room).Inc()
+	}
+	s.sendWebhooks(kind, line)
+
+	// Messages written to a text client count as received if its session resumes
+	var id int64
+	if kind == chat.KindMessage {
+		id, _ = storage.ParseID(line.ID)
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, client := range s.clients {
+		if client.Conn == sender {
+			// The sender has its own message on screen as typed
+			s.delivered(client.Conn, id)
+			continue
+		}
+		if client.Proto != "" {
+			client.Writer.Write(protocol.Encode(lineEvent(kind, line)))
+			client.Writer.Flush()
+			continue
+		}
+		text := "\n" + s.render(client, kind, line) + "\n"
+
+		// Highlight mentions of the client and ring their bell
+		if kind == chat.KindMessage {
+			if highlighted, mentioned := highlightFor(client, text); mentioned {
+				text = highlighted
+				if client.Terminal && client.Presence != presenceBusy {
+					text = ui.Bell + text
 				}
-			default:
-				// Invalid message type
-				log.Printf("Invalid message type: %s", messageType)
-				return
 			}
-			// Release the mutex temporarily while formatting and writing messages
-			s.Mutex.Unlock()
-			client.Writer.Flush()
-			s.Mutex.Lock()
+		}
 
+		client.Writer.WriteString(text + "\n" + s.render(client, chat.KindPrompt, promptLine(client.Name, client.Room)))
+		if client.Writer.Flush() == nil {
+			s.delivered(client.Conn, id)
 		}
 	}
 }
 
 // removeClient removes a disconnected client from the list of connected clients.
 func (s *Server) removeClient(conn net.Conn) error {
-	for i, client := range interfaces.Clients {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if !s.unlistClient(conn) {
+		return fmt.Errorf("client not found")
+	}
+	s.admitWaiting()
+	return nil
+}
+
+// unlistClient removes the client on conn from the connected clients and
+// reports whether it was there. The caller must hold s.Mutex.
+func (s *Server) unlistClient(conn net.Conn) bool {
+	for i, client := range s.clients {
 		if client.Conn == conn {
 			// Remove the client from the list
-			interfaces.Clients = append(interfaces.Clients[:i], interfaces.Clients[i+1:]...)
-			return nil
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+
+			// Decrement the active client count (inside the critical section)
+			s.ActiveClientsMux.Lock()
+			s.ActiveClients--
+			connectedClients.Set(float64(s.ActiveClients))
+			s.ActiveClientsMux.Unlock()
+			return true
 		}
 	}
-	return fmt.Errorf("client not found")
+	return false
 }
 
 // CleanupHistoryFile clears the history file.
 func (s *Server) CleanupHistoryFile() error {
-	// Open the history file in write mode
-	file, err := os.OpenFile("history.txt", os.O_WRONLY|os.O_TRUNC, 0644)
-
-	if err != nil {
-		logging.Logger(err.Error())
-		return fmt.Errorf("failed to open history file: %v", err)
-	} else {
-		logging.Logger("History file opened successfully")
-	}
-	defer file.Close()
-
 	// Truncate the file to 0 bytes, effectively clearing its contents
-	if err := file.Truncate(0); err != nil {
+	if err := s.history.Truncate(); err != nil {
 		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("cleanup").Inc()
 		return fmt.Errorf("failed to truncate history file: %v", err)
 	} else {
 		logging.Logger("History file truncated successfully")
@@ -340,19 +629,78 @@ func (s *Server) CleanupHistoryFile() error {
 
 // promptUsername prompts the client to enter a username.
 func (s *Server) promptUsername(conn net.Conn) string {
-	reader := bufio.NewReader(conn)
+	reader := lineReader(conn)
+	prompt := true
 	for {
-		conn.Write([]byte(interfaces.NamePrompt))
-		username, _ := reader.ReadString('\n')
+		if prompt && !jsonMode(conn) {
+			conn.Write([]byte(interfaces.NamePrompt))
+		}
+		username, err := reader.ReadString('\n')
+		if err != nil && username == "" {
+			// The client went away before choosing a name
+			return ""
+		}
 		username = strings.TrimSpace(username)
-		if err := isValidUsername(username); err != nil {
+
+		// Handshake lines may come before the name and are answered by declare
+		if t, ok := conn.(*transport); ok && t.declare(username) {
+			if t.resume != nil {
+				if name := s.claimSession(t); name != "" {
+					return name
+				}
+				prompt = true
+				continue
+			}
+			if t.oper != "" {
+				s.checkOper(t)
+				prompt = true
+				continue
+			}
+			prompt = false
+			continue
+		}
+		prompt = true
+
+		// Protocol clients choose their name with a nick event
+		var ref string
+		if jsonMode(conn) {
+			ev, err := protocol.Decode(username)
+			if err != nil {
+				sendError(conn, err.Error())
+				continue
+			}
+			if ev.Type != protocol.TypeNick {
+				writeEvent(conn, protocol.Event{Type: protocol.TypeError, Ref: ev.Ref, Error: "choose a name with a nick event first"})
+				continue
+			}
+			username, ref = ev.Name, ev.Ref
+		}
+
+		s.Mutex.Lock()
+		err = s.isValidUsername(username)
+		s.Mutex.Unlock()
+		if err == nil && s.nameHeld(username) {
+			err = errNameTaken
+		}
+		if err != nil {
 			logging.Logger(err.Error())
 			// Invalid username, prompt again
-			conn.Write([]byte(err.Error() + "\n"))
+			if jsonMode(conn) {
+				ev := protocol.Event{Type: protocol.TypeError, Ref: ref, Error: err.Error()}
+				if err == errNameTaken {
+					ev.Code = protocol.CodeNameTaken
+				}
+				writeEvent(conn, ev)
+			} else {
+				conn.Write([]byte(err.Error() + "\n"))
+			}
 		} else {
 			// Valid username, return it
-			return username
 			logging.Logger("Username entered successfully")
+			if jsonMode(conn) {
+				writeEvent(conn, protocol.Event{Type: protocol.TypeAck, Ref: ref, Name: username, Room: DefaultRoom})
+			}
+			return username
 		}
 	}
 }
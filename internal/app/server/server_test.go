@@ -1,9 +1,27 @@
 package server
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"netcat/internal/app/chat"
+	"netcat/internal/app/client"
 	colortest "netcat/internal/app/colorTest"
+	"netcat/internal/app/ui"
+	"netcat/internal/audit"
+	"netcat/internal/config"
+	"netcat/internal/federation"
+	"netcat/internal/filter"
+	"netcat/internal/plugin"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+	"netcat/internal/webhook"
 	mocks "netcat/internal/app/mocks"
 	"netcat/internal/interfaces"
 	"strings"
@@ -11,6 +29,31 @@ import (
 	"time"
 )
 
+// newTestServer returns a server that keeps its files in a temporary
+// directory, so that tests never write to the package directory. Removing
+// the directory is retried for a moment, as a listening server may still be
+// recording the logout of a client the test has just disconnected.
+func newTestServer(t *testing.T, plugins ...plugin.Plugin) *Server {
+	dir, err := os.MkdirTemp("", "netcat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for i := 0; os.RemoveAll(dir) != nil && i < 50; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return newTestServerIn(t, dir, plugins...)
+}
+
+// newTestServerIn returns a server that keeps its files in dir, which other
+// servers of the same test may share, and closes it when the test ends.
+func newTestServerIn(t *testing.T, dir string, plugins ...plugin.Plugin) *Server {
+	srv := newServer(dir, plugins...)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 // TestNewServer tests the NewServer function.
 func TestNewServer(t *testing.T) {
 	// Run subtests using t.Run
@@ -30,7 +73,7 @@ func TestNewServer(t *testing.T) {
 func TestInitializeServer(t *testing.T) {
 	colortest.LogInfo(t, "Running TestInitializeServer...")
 	// Create a new instance of Server
-	srv := NewServer().(*Server) // Cast to Server type
+	srv := newTestServer(t) // Cast to Server type
 
 	// Call InitializeServer with a test address
 	err := srv.InitializeServer("127.0.0.1:8989")
@@ -51,7 +94,7 @@ func TestInitializeServer(t *testing.T) {
 func TestSendWelcomeMessage(t *testing.T) {
     colortest.LogInfo(t, "Running TestSendWelcomeMessage...")
     // Create a new Server instance
-    srv := NewServer().(*Server)
+    srv := newTestServer(t)
 
     // Create a mock net.Conn object
     mockConn := &mocks.MockConn{
@@ -89,7 +132,7 @@ func TestPromptUsername(t *testing.T) {
     }
 
     // Create a new server instance
-	srv := NewServer().(*Server)
+	srv := newTestServer(t)
 
     // Call the promptUsername function with the mock connection
     username := srv.promptUsername(mockConn)
@@ -103,7 +146,7 @@ func TestPromptUsername(t *testing.T) {
 
  func TestSendReadyMessages(t *testing.T) {
     colortest.LogInfo(t, "Running TestSendReadyMessages...")
-    srv := NewServer().(*Server)
+    srv := newTestServer(t)
 
     username := "layla"
 
@@ -128,47 +171,875 @@ func TestPromptUsername(t *testing.T) {
 func TestMaximumClientLimitReached(t *testing.T) {
 	colortest.LogInfo(t, "Running TestMaximumClientLimitReached...")
     // Initialize server
-	srv := NewServer().(*Server)
+	srv := newTestServer(t)
     addr := "localhost:9898"
     go func() {
         err := srv.InitializeServer(addr)
         if err != nil {
             t.Errorf( "\033[31m"+"Error initializing server: %v"+ "\033[0m", err)
-			
-        }else{
-			colortest.LogSuccess(t, "TestMaximumClientLimitReached completed successfully")
-		}
+        }
         err = srv.ListenAndServe()
         if err != nil {
 			t.Errorf( "\033[31m"+"Error listening and serving: %v"+ "\033[0m", err)
-        }else{
-			colortest.LogSuccess(t, "TestMaximumClientLimitReached completed successfully")
-		}
+        }
     }()
-    
+
     // Simulate connections until the maximum client limit is reached
     maxClients := 10
     for i := 0; i < maxClients; i++ {
-        conn, err := net.Dial("tcp", addr)
+        conn, err := dialWithRetry(addr)
         if err != nil {
 			t.Errorf( "\033[31m"+"Error connecting: %v"+ "\033[0m", err)
-        }else{
-			colortest.LogSuccess(t, "TestMaximumClientLimitReached completed successfully")
-		}
+			return
+        }
         defer conn.Close()
-        // Additional testing as needed
+        // Join the chat and wait for the prompt so the client is registered
+        name := fmt.Sprintf("client%d", i)
+        conn.Write([]byte(name + "\n"))
+        if _, err := readUntil(conn, "]["+name+"]:"); err != nil {
+			t.Errorf( "\033[31m"+"Client %s did not join: %v"+ "\033[0m", name, err)
+			return
+        }
     }
-    
-    // Attempt to connect when the maximum client limit is reached
-    _, err := net.Dial("tcp", addr)
-    if err == nil {
-		t.Errorf( "\033[31m"+"Expected error when maximum client limit reached, got %v"+ "\033[0m",err)
+
+    // Attempt to join when the maximum client limit is reached
+    conn, err := dialWithRetry(addr)
+    if err != nil {
+		t.Errorf( "\033[31m"+"Error connecting: %v"+ "\033[0m", err)
         return
     }
+    defer conn.Close()
+    conn.Write([]byte("overflow\n"))
+
     expectedErrMsg := "Sorry, the chat room is full. Please try again later."
-    if err.Error() != expectedErrMsg {
-        t.Errorf( "\033[31m"+"Expected error message: %s, got: %s", expectedErrMsg, err.Error())
-    }
+    if _, err := readUntil(conn, expectedErrMsg); err != nil {
+        t.Errorf( "\033[31m"+"Expected error message: %s, got: %v", expectedErrMsg, err)
+    } else {
+		colortest.LogSuccess(t, "TestMaximumClientLimitReached completed successfully")
+	}
+}
+
+// dialWithRetry connects to addr, giving a server started in a goroutine time to listen.
+func dialWithRetry(addr string) (net.Conn, error) {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			return conn, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// readUntil reads from conn until the received text contains want.
+func readUntil(conn net.Conn, want string) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var received strings.Builder
+	buf := make([]byte, 1024)
+	for !strings.Contains(received.String(), want) {
+		n, err := conn.Read(buf)
+		received.Write(buf[:n])
+		if err != nil {
+			return received.String(), err
+		}
+	}
+	return received.String(), nil
+}
+
+// TestReloadRejectsInvalidConfig tests that a bad config keeps the running one in effect.
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	colortest.LogInfo(t, "Running TestReloadRejectsInvalidConfig...")
+	dir := t.TempDir()
+	welcomePath := filepath.Join(dir, "welcome.txt")
+	configPath := filepath.Join(dir, "config.json")
+	os.WriteFile(welcomePath, []byte("hello v1"), 0644)
+	os.WriteFile(configPath, []byte(`{"max_clients": 3, "welcome_file": "`+welcomePath+`"}`), 0644)
+
+	srv := newTestServer(t)
+	srv.ConfigPath = configPath
+	if err := srv.Reload(); err != nil {
+		colortest.LogError(t, "Reload of a valid config failed: "+err.Error())
+		return
+	}
+
+	os.WriteFile(configPath, []byte(`{"max_clients": 0, "welcome_file": "`+welcomePath+`"}`), 0644)
+	if err := srv.Reload(); err == nil {
+		colortest.LogError(t, "Reload accepted max_clients 0")
+	}
+	if got := srv.current(); got.Config.MaxClients != 3 || got.Welcome != "hello v1" {
+		colortest.LogError(t, fmt.Sprintf("config changed after rejected reload: %+v", got))
+	} else {
+		colortest.LogSuccess(t, "TestReloadRejectsInvalidConfig completed successfully")
+	}
+}
+
+// addrConn gives a pipe the remote address of a TCP client.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// TestReloadBans tests that a reload turns away the clients in the chat that
+// the new config bans by name or network, and only them.
+func TestReloadBans(t *testing.T) {
+	colortest.LogInfo(t, "Running TestReloadBans...")
+	dir := t.TempDir()
+	welcomePath := filepath.Join(dir, "welcome.txt")
+	configPath := filepath.Join(dir, "config.json")
+	os.WriteFile(welcomePath, []byte("hello"), 0644)
+	os.WriteFile(configPath, []byte(`{"welcome_file": "`+welcomePath+`"}`), 0644)
+	srv := newTestServer(t)
+	srv.ConfigPath = configPath
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// join adds a client from ip and returns all it is sent until closed
+	join := func(name string, ip string) <-chan string {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { conn.Close() })
+		received := make(chan string, 1)
+		go func() {
+			content, _ := io.ReadAll(peer)
+			received <- string(content)
+		}()
+		wrapped := addrConn{conn, &net.TCPAddr{IP: net.ParseIP(ip), Port: 4000}}
+		srv.Mutex.Lock()
+		srv.listClient(&client.Client{Name: name, Conn: wrapped, Writer: bufio.NewWriter(wrapped), Room: DefaultRoom})
+		srv.Mutex.Unlock()
+		return received
+	}
+	stays := join("reload-a", "192.0.2.1")
+	byName := join("reload-b", "192.0.2.2")
+	byNetwork := join("reload-c", "10.9.0.5")
+
+	os.WriteFile(configPath, []byte(`{"welcome_file": "`+welcomePath+`", "banned_names": ["reload-b"], "deny_cidrs": ["10.9.0.0/16"]}`), 0644)
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for name, received := range map[string]<-chan string{"reload-b": byName, "reload-c": byNetwork} {
+		select {
+		case text := <-received:
+			if !strings.Contains(text, "You have been banned from this server.") {
+				colortest.LogError(t, name+" not told of the ban: "+text)
+			}
+		case <-time.After(2 * time.Second):
+			colortest.LogError(t, name+" still connected after the reload banned them")
+		}
+	}
+	select {
+	case text := <-stays:
+		colortest.LogError(t, "client not banned was turned away: "+text)
+	case <-time.After(100 * time.Millisecond):
+		colortest.LogSuccess(t, "TestReloadBans completed successfully")
+	}
+}
+
+// TestMentions tests parsing and per-user highlighting of @name mentions.
+func TestMentions(t *testing.T) {
+	colortest.LogInfo(t, "Running TestMentions...")
+	names := parseMentions("hi @layla, (@sara) and @layla again, mail@nobody")
+	if strings.Join(names, " ") != "layla sara" {
+		colortest.LogError(t, "unexpected mentions: "+strings.Join(names, " "))
+	}
+
+	message := "> sara #1: ping @layla\n[2024-01-01 10:00:00][sara] #2: @layla! not @laylab"
+	highlighted, mentioned := highlightMentions(message, "layla")
+	expected := "> sara #1: ping @layla\n[2024-01-01 10:00:00][sara] #2: " + ui.Highlight("@layla") + "! not @laylab"
+	if !mentioned || highlighted != expected {
+		colortest.LogError(t, "unexpected highlight: "+highlighted)
+	}
+	if _, mentioned := highlightMentions(message, "sara"); mentioned {
+		colortest.LogError(t, "sara was not mentioned outside the quote")
+	} else {
+		colortest.LogSuccess(t, "TestMentions completed successfully")
+	}
+}
+
+// TestMissedMentions tests that mentions are kept for users who are away,
+// busy or disconnected, but not for those who saw them live.
+func TestMissedMentions(t *testing.T) {
+	colortest.LogInfo(t, "Running TestMissedMentions...")
+	srv := newTestServer(t)
+
+	var present []*client.Client
+	for _, name := range []string{"seen-online", "seen-away", "seen-busy"} {
+		conn, peer := net.Pipe()
+		go io.Copy(io.Discard, peer)
+		c := &client.Client{Name: name, Conn: conn, Writer: bufio.NewWriter(conn), Room: DefaultRoom}
+		srv.Mutex.Lock()
+		srv.clients = append(srv.clients, c)
+		srv.Mutex.Unlock()
+		srv.registerLogin(name)
+		present = append(present, c)
+	}
+	defer func() {
+		for _, c := range present {
+			srv.removeClient(c.Conn)
+			c.Conn.Close()
+		}
+	}()
+	srv.registerLogin("seen-gone")
+	srv.handleCommand(present[1], "/away")
+	srv.handleCommand(present[2], "/busy")
+
+	srv.postMessage(nil, "seen-poster", "@seen-online @seen-away @seen-busy @seen-gone look", nil)
+	for name, want := range map[string]int{"seen-online": 0, "seen-away": 1, "seen-busy": 1, "seen-gone": 1} {
+		if unread, _ := srv.mentions.Unread(name); len(unread) != want {
+			colortest.LogError(t, fmt.Sprintf("%s has %d missed mentions, want %d", name, len(unread), want))
+		}
+	}
+
+	if reply := srv.handleCommand(present[1], "/back"); !strings.Contains(reply, "you were mentioned 1 time(s) while away") {
+		colortest.LogError(t, "missed mentions not told on /back: "+reply)
+	}
+	if reply := srv.handleCommand(present[1], "/mentions"); !strings.Contains(reply, "Missed mentions (1):") || !strings.Contains(reply, "look") {
+		colortest.LogError(t, "unexpected /mentions reply: "+reply)
+	}
+	if reply := srv.handleCommand(present[1], "/mentions"); reply != "no missed mentions" {
+		colortest.LogError(t, "mentions were not marked read: "+reply)
+	} else {
+		colortest.LogSuccess(t, "TestMissedMentions completed successfully")
+	}
+}
+
+// TestNameColors tests stable name colors and that they are left out for
+// clients without a terminal.
+func TestNameColors(t *testing.T) {
+	colortest.LogInfo(t, "Running TestNameColors...")
+	srv := newTestServer(t)
+	if ui.DefaultNameColor("layla") != ui.DefaultNameColor("layla") {
+		colortest.LogError(t, "default color is not stable")
+	}
+
+	line := srv.colorNames(chat.Line{Name: "layla", Quote: &chat.Line{Name: "sara"}})
+	if line.Name != ui.Colorize("layla", ui.DefaultNameColor("layla")) || line.Quote.Name != ui.Colorize("sara", ui.DefaultNameColor("sara")) {
+		colortest.LogError(t, "names not colored: "+line.Name)
+	}
+
+	dumb := newTransport(&mocks.MockConn{RemoteAddrFunc: func() net.Addr { return &net.TCPAddr{} }})
+	if !dumb.declare("TERM dumb") || hasTerminal(dumb) {
+		colortest.LogError(t, "TERM dumb handshake not honoured")
+	}
+	viewer := &client.Client{Name: "sara", Terminal: hasTerminal(dumb)}
+	if colorEnabled(viewer) {
+		colortest.LogError(t, "colors enabled without a terminal")
+	}
+	if text, mentioned := highlightFor(viewer, "hi @sara"); !mentioned || text != "hi @sara" {
+		colortest.LogError(t, "mention highlighted without a terminal: "+text)
+	} else {
+		colortest.LogSuccess(t, "TestNameColors completed successfully")
+	}
+}
+
+// TestProtocolMode tests that a JSON protocol client and a human chat in the
+// same room, and that the JSON client gets events and no prompts.
+func TestProtocolMode(t *testing.T) {
+	colortest.LogInfo(t, "Running TestProtocolMode...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.MaxClients = 50 // Clients of other tests may still be leaving
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+	addr := "localhost:9899"
+	go func() {
+		srv.Addr = addr
+		srv.ListenAndServe()
+	}()
+
+	human, err := dialWithRetry(addr)
+	if err != nil {
+		colortest.LogError(t, "Error connecting: "+err.Error())
+		return
+	}
+	defer human.Close()
+	human.Write([]byte("proto-human\n"))
+	if _, err := readUntil(human, "[proto-human]:"); err != nil {
+		colortest.LogError(t, "human did not join: "+err.Error())
+		return
+	}
+
+	bot, err := dialWithRetry(addr)
+	if err != nil {
+		colortest.LogError(t, "Error connecting: "+err.Error())
+		return
+	}
+	defer bot.Close()
+	bot.Write([]byte(protocol.Handshake + "\n" + `{"type":"nick","name":"proto-bot","ref":"1"}` + "\n"))
+	if _, err := readUntil(bot, `{"type":"ack","ref":"1","room":"general","name":"proto-bot"}`); err != nil {
+		colortest.LogError(t, "bot did not join: "+err.Error())
+		return
+	}
+
+	taken, err := dialWithRetry(addr)
+	if err != nil {
+		colortest.LogError(t, "Error connecting: "+err.Error())
+		return
+	}
+	defer taken.Close()
+	taken.Write([]byte(protocol.Handshake + "\n" + `{"type":"nick","name":"proto-bot","ref":"1"}` + "\n"))
+	if _, err := readUntil(taken, `"code":"name_taken"}`); err != nil {
+		colortest.LogError(t, "taken name not refused with its code: "+err.Error())
+		return
+	}
+
+	bot.Write([]byte(`{"type":"message","body":"beep","ref":"2"}` + "\n"))
+	if _, err := readUntil(human, ": beep"); err != nil {
+		colortest.LogError(t, "human did not see the bot's message: "+err.Error())
+		return
+	}
+	human.Write([]byte("hello bot\n"))
+	received, err := readUntil(bot, `"body":"hello bot"}`)
+	if err != nil {
+		colortest.LogError(t, "bot did not get the human's message: "+err.Error())
+		return
+	}
+	if !strings.Contains(received, `{"type":"ack","ref":"2","id":`) || strings.Contains(received, "[proto-bot]:") {
+		colortest.LogError(t, "unexpected protocol output: "+received)
+	} else {
+		colortest.LogSuccess(t, "TestProtocolMode completed successfully")
+	}
+}
+
+// testPlugin records the events it receives and adds a /ping command.
+type testPlugin struct {
+	events chan plugin.Event
+}
+
+func (p *testPlugin) Name() string { return "test-bot" }
+
+func (p *testPlugin) Init(hub plugin.Hub) error {
+	return hub.RegisterCommand(plugin.Command{Name: "ping", Usage: "/ping", Help: "test", Run: func(call plugin.Call) string {
+		return "pong " + call.Sender
+	}})
+}
+
+func (p *testPlugin) HandleEvent(ev plugin.Event) { p.events <- ev }
+
+// TestPlugins tests that a plugin joins as a bot, adds commands and gets events.
+func TestPlugins(t *testing.T) {
+	colortest.LogInfo(t, "Running TestPlugins...")
+	bot := &testPlugin{events: make(chan plugin.Event, 1)}
+	srv := newTestServer(t, bot, &testPlugin{})
+	sender := &client.Client{Name: "plugin-user", Room: DefaultRoom}
+
+	if who := srv.handleCommand(sender, "/who"); !strings.Contains(who, "test-bot (bot)") {
+		colortest.LogError(t, "bot missing from /who: "+who)
+	}
+	if reply := srv.handleCommand(sender, "/ping"); reply != "pong plugin-user" {
+		colortest.LogError(t, "unexpected /ping reply: "+reply)
+	}
+	bots := 0
+	srv.Mutex.Lock()
+	for _, c := range srv.clients {
+		if c.Bot {
+			bots++
+		}
+	}
+	srv.Mutex.Unlock()
+	if bots != 1 {
+		colortest.LogError(t, "plugin with a taken name was started")
+	}
+
+	srv.broadcast(chat.KindMessage, chat.Line{Time: time.Now(), Name: "plugin-user", Room: DefaultRoom, Body: "hi bot", ID: "1"}, nil)
+	// The bot may be sent other events first
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-bot.events:
+			if ev.Type != protocol.TypeMessage {
+				continue
+			}
+			if ev.Body != "hi bot" {
+				colortest.LogError(t, "unexpected message: "+ev.Body)
+			} else {
+				colortest.LogSuccess(t, "TestPlugins completed successfully")
+			}
+			return
+		case <-timeout:
+			colortest.LogError(t, "bot did not receive the message")
+			return
+		}
+	}
+}
+
+// TestAPI tests that a message posted through the HTTP API backend is
+// stored and broadcast like a typed one under the service's own name, which
+// no user can take or edit, and can be read back.
+func TestAPI(t *testing.T) {
+	colortest.LogInfo(t, "Running TestAPI...")
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"api_tokens": [{"name": "ci", "token": "0123456789abcdef"}]}`), 0644)
+	srv := newTestServer(t)
+	srv.ConfigPath = configPath
+	if err := srv.Reload(); err != nil {
+		colortest.LogError(t, "Reload failed: "+err.Error())
+		return
+	}
+	if name, ok := srv.Authenticate("0123456789abcdef", "127.0.0.1:50000"); !ok || name != "ci" {
+		colortest.LogError(t, "token was not accepted")
+	}
+	if _, ok := srv.Authenticate("0123456789abcdeX", "127.0.0.1:50000"); ok {
+		colortest.LogError(t, "wrong token was accepted")
+	}
+	os.WriteFile(configPath, []byte(`{"api_tokens": [{"name": "ci@home", "token": "0123456789abcdef"}]}`), 0644)
+	if err := srv.Reload(); err == nil {
+		colortest.LogError(t, "a token name outside the service namespace was accepted")
+	}
+
+	watcher, peer := net.Pipe()
+	defer watcher.Close()
+	srv.Mutex.Lock()
+	srv.clients = append(srv.clients, &client.Client{Name: "api-watcher", Conn: watcher, Writer: bufio.NewWriter(watcher), Room: DefaultRoom, Proto: protocol.Version})
+	srv.Mutex.Unlock()
+	defer srv.removeClient(watcher)
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(peer).ReadString('\n')
+		received <- line
+	}()
+
+	if _, err := srv.PostAs("ci", "random", "build failed", ""); err == nil {
+		colortest.LogError(t, "post to an unknown room was accepted")
+	}
+	stored, err := srv.PostAs("ci", DefaultRoom, "build failed", "")
+	if err != nil {
+		colortest.LogError(t, "PostAs failed: "+err.Error())
+		return
+	}
+	select {
+	case line := <-received:
+		if !strings.Contains(line, `"name":"api/ci","body":"build failed"`) {
+			colortest.LogError(t, "unexpected broadcast: "+line)
+		}
+	case <-time.After(2 * time.Second):
+		colortest.LogError(t, "message was not broadcast")
+	}
+
+	// A user cannot take the service's name or change its messages
+	impostor := &client.Client{Name: "ci", Room: DefaultRoom}
+	if reply := srv.handleCommand(impostor, "/edit "+storage.FormatID(stored.ID)+" build passed"); !strings.Contains(reply, "only change your own messages") {
+		colortest.LogError(t, "a user changed a service message: "+reply)
+	}
+	srv.Mutex.Lock()
+	err = srv.isValidUsername("api/ci")
+	srv.Mutex.Unlock()
+	if err == nil {
+		colortest.LogError(t, "a user may join with a service name")
+	}
+
+	page, _, err := srv.RoomHistory(DefaultRoom, 0, 1)
+	if err != nil || len(page) != 1 || page[0].ID != stored.ID || !page[0].Service {
+		colortest.LogError(t, "posted message missing from history or not marked as a service's")
+	} else {
+		colortest.LogSuccess(t, "TestAPI completed successfully")
+	}
+}
+
+// TestFederation tests two linked servers on loopback: remote users are
+// namespaced, messages are relayed once, and a dropped link makes them leave.
+func TestFederation(t *testing.T) {
+	colortest.LogInfo(t, "Running TestFederation...")
+	alpha := newTestServer(t)
+	beta := newTestServer(t)
+
+	local, peer := net.Pipe()
+	defer local.Close()
+	go io.Copy(io.Discard, peer)
+	alpha.Mutex.Lock()
+	alpha.clients = append(alpha.clients, &client.Client{Name: "fed-local", Conn: local, Writer: bufio.NewWriter(local), Room: DefaultRoom})
+	alpha.Mutex.Unlock()
+
+	if err := alpha.startFederation(federation.Config{Name: "alpha", Secret: "0123456789abcdef", Listen: "127.0.0.1:9897"}); err != nil {
+		colortest.LogError(t, "alpha failed to start: "+err.Error())
+		return
+	}
+	defer alpha.federation.Close()
+	beta.startFederation(federation.Config{Name: "beta", Secret: "0123456789abcdef", Peers: []string{"127.0.0.1:9897"}})
+	defer beta.federation.Close()
+
+	// waitFor polls cond until it holds or a few seconds pass.
+	waitFor := func(cond func() bool) bool {
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+	hasRemote := func(srv *Server, name string) bool {
+		for _, remote := range srv.remoteUsers() {
+			if remote == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !waitFor(func() bool { return len(alpha.federation.Peers()) == 1 }) {
+		colortest.LogError(t, "beta never linked to alpha")
+		return
+	}
+	alpha.federate(federation.Event{Type: federation.TypeJoin, Time: time.Now(), Room: DefaultRoom, Name: "layla"})
+	if !waitFor(func() bool { return hasRemote(beta, "layla@alpha") }) {
+		colortest.LogError(t, "layla@alpha never joined beta")
+		return
+	}
+	if who := beta.handleCommand(&client.Client{Name: "sara", Room: DefaultRoom}, "/who"); !strings.Contains(who, "layla@alpha") || !strings.Contains(who, "fed-local@alpha") {
+		colortest.LogError(t, "remote user missing from /who: "+who)
+	}
+	beta.Mutex.Lock()
+	for _, c := range beta.clients {
+		if c.Name == "fed-local" {
+			colortest.LogError(t, "alpha's client is in beta's local client list")
+		}
+	}
+	beta.Mutex.Unlock()
+
+	alpha.PostAs("ci", DefaultRoom, "build failed", "")
+	relayed := func() int {
+		page, _, _ := beta.RoomHistory(DefaultRoom, 0, 50)
+		count := 0
+		for _, m := range page {
+			if m.Name == "api/ci@alpha" && m.Body == "build failed" {
+				count++
+			}
+		}
+		return count
+	}
+	if !waitFor(func() bool { return relayed() > 0 }) {
+		colortest.LogError(t, "message was not relayed to beta")
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := relayed(); n != 1 {
+		colortest.LogError(t, fmt.Sprintf("message was relayed %d times", n))
+	}
+	page, _, _ := alpha.RoomHistory(DefaultRoom, 0, 50)
+	for _, m := range page {
+		if strings.Contains(m.Name, "@") {
+			colortest.LogError(t, "message looped back to alpha as "+m.Name)
+		}
+	}
+
+	// Remote messages are screened like local ones, and banned names are dropped
+	contentFilter, _ := filter.New([]filter.Rule{{Words: []string{"darn"}, Action: filter.ActionMask}, {Words: []string{"spam"}, Action: filter.ActionReject}})
+	renderer, _ := chat.NewRenderer(chat.Format{})
+	beta.state.Store(&reloadable{Config: config.Default(), Renderer: renderer, Filter: contentFilter})
+	beta.Ban("troll@alpha")
+	for _, ev := range []federation.Event{
+		{Type: federation.TypeMessage, Origin: "alpha", Room: DefaultRoom, Name: "layla", Body: "darn it"},
+		{Type: federation.TypeMessage, Origin: "alpha", Room: DefaultRoom, Name: "layla", Body: "buy spam"},
+		{Type: federation.TypeMessage, Origin: "alpha", Room: DefaultRoom, Name: "troll", Body: "let me in"},
+	} {
+		beta.deliverRemote(ev)
+	}
+	page, _, _ = beta.RoomHistory(DefaultRoom, 0, 50)
+	var screened []string
+	for _, m := range page {
+		if m.Name == "layla@alpha" || m.Name == "troll@alpha" {
+			screened = append(screened, m.Body)
+		}
+	}
+	if strings.Join(screened, "|") != "**** it" {
+		colortest.LogError(t, "remote messages were not screened: "+strings.Join(screened, "|"))
+	}
+
+	alpha.federation.Close()
+	if !waitFor(func() bool { return !hasRemote(beta, "layla@alpha") }) {
+		colortest.LogError(t, "layla@alpha did not leave when the link dropped")
+		return
+	}
+	colortest.LogSuccess(t, "TestFederation completed successfully")
+}
+
+// TestBlocksAndUploads tests that a ``` block arrives as one message and that
+// a file can be uploaded, fetched back, and is refused when too large.
+func TestBlocksAndUploads(t *testing.T) {
+	colortest.LogInfo(t, "Running TestBlocksAndUploads...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.MaxClients = 50 // Clients of other tests may still be leaving
+	cfg.MaxUploadSize = 16
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+	addr := "localhost:9896"
+	go func() {
+		srv.Addr = addr
+		srv.ListenAndServe()
+	}()
+
+	join := func(name string) net.Conn {
+		conn, err := dialWithRetry(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("TERM dumb\n" + name + "\n"))
+		if _, err := readUntil(conn, "["+name+"]:"); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	sender, watcher := join("block-sender"), join("block-watcher")
+	defer sender.Close()
+	defer watcher.Close()
+
+	sender.Write([]byte("```\nfunc main() {\n/not a command\n}\n```\n"))
+	if _, err := readUntil(watcher, ": func main() {\n/not a command\n}\n"); err != nil {
+		colortest.LogError(t, "block did not arrive as one message: "+err.Error())
+		return
+	}
+
+	sender.Write([]byte("/upload notes.txt\n6\nhello\n"))
+	announced, err := readUntil(watcher, " to download it")
+	if err != nil || !strings.Contains(announced, "shared notes.txt (6 bytes), type /get ") {
+		colortest.LogError(t, "upload was not announced: "+announced)
+		return
+	}
+	id := strings.Fields(announced[strings.Index(announced, "/get ")+5:])[0]
+	if _, err := readUntil(sender, "Uploaded notes.txt as file #"+id+"\n"); err != nil {
+		colortest.LogError(t, "upload was not confirmed: "+err.Error())
+	}
+
+	sender.Write([]byte("/upload big.bin\n20\n0123456789/delete 1\n/get " + id + "\n"))
+	if reply, err := readUntil(sender, "hello\n"); err != nil || !strings.Contains(reply, "at most 16 bytes") || !strings.Contains(reply, "[file #"+id+": notes.txt, 6 bytes]\nhello\n") {
+		colortest.LogError(t, "unexpected replies: "+reply)
+	}
+
+	// Terminal escapes in a file are shown, not run
+	sender.Write([]byte("/upload clear.txt\n8\n\x1b[2Jhi\xff\n"))
+	announced, err = readUntil(sender, "Uploaded clear.txt as file #")
+	if err != nil {
+		colortest.LogError(t, "upload was not confirmed: "+announced)
+		return
+	}
+	id = strings.Fields(announced[strings.LastIndex(announced, "#")+1:])[0]
+	sender.Write([]byte("/get " + id + "\n"))
+	if reply, err := readUntil(sender, "hi"); err != nil || !strings.Contains(reply, `\x1b[2Jhi\xff`) || strings.Contains(reply, "\x1b") {
+		colortest.LogError(t, "control characters sent as they are: "+reply)
+	} else {
+		colortest.LogSuccess(t, "TestBlocksAndUploads completed successfully")
+	}
+}
+
+// TestPresence tests /away in /who and that /seen reads what was persisted
+// by an earlier server.
+func TestPresence(t *testing.T) {
+	colortest.LogInfo(t, "Running TestPresence...")
+	dir := t.TempDir()
+	srv := newTestServerIn(t, dir)
+
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	now := time.Now()
+	away := &client.Client{Name: "presence-a", Conn: conn, Writer: bufio.NewWriter(conn), Connected: now, LastActive: now, Room: DefaultRoom}
+	srv.Mutex.Lock()
+	srv.clients = append(srv.clients, away)
+	srv.Mutex.Unlock()
+	srv.registerLogin(away.Name)
+
+	srv.handleCommand(away, "/away lunch")
+	if who := srv.handleCommand(away, "/who"); !strings.Contains(who, "presence-a (away: lunch, idle 0s)") {
+		colortest.LogError(t, "away state missing from /who: "+who)
+	}
+	srv.markSpoke(conn, now)
+	srv.removeClient(conn)
+	srv.recordLogout(away.Name)
+	conn.Close()
+
+	seen := newTestServerIn(t, dir).handleCommand(&client.Client{Name: "presence-b", Room: DefaultRoom}, "/seen presence-a")
+	if !strings.Contains(seen, "presence-a last spoke "+now.Format(seenLayout)) || !strings.Contains(seen, "was last here") {
+		colortest.LogError(t, "unexpected /seen reply: "+seen)
+	} else {
+		colortest.LogSuccess(t, "TestPresence completed successfully")
+	}
+}
+
+// TestResume tests that a dropped user rejoins with their session token
+// without a leave or join being shown and gets exactly what they missed, and
+// that a session not resumed in time ends with a leave.
+func TestResume(t *testing.T) {
+	colortest.LogInfo(t, "Running TestResume...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.MaxClients = 50 // Clients of other tests may still be leaving
+	cfg.ResumeGrace = 1
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+	addr := "localhost:9895"
+	go func() {
+		srv.Addr = addr
+		srv.ListenAndServe()
+	}()
+
+	// join connects, sends lines and returns what was read up to the prompt
+	join := func(lines string, prompt string) (net.Conn, string) {
+		conn, err := dialWithRetry(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("TERM dumb\n" + lines))
+		received, err := readUntil(conn, prompt)
+		if err != nil {
+			t.Fatal(fmt.Errorf("%v: %s", err, received))
+		}
+		return conn, received
+	}
+	watcher, _ := join("resume-w\n", "[resume-w]:")
+	defer watcher.Close()
+	dropped, welcome := join("resume-a\n", "[resume-a]:")
+	if _, err := readUntil(watcher, "resume-a has joined"); err != nil {
+		t.Fatal(err)
+	}
+	start := strings.Index(welcome, "Your session token is ")
+	if start < 0 {
+		t.Fatal("no session token in: " + welcome)
+	}
+	token := strings.Fields(welcome[start:])[4]
+	token = strings.TrimSuffix(token, ".")
+
+	// resume-a sees a message but never posts, so only the next is missed
+	watcher.Write([]byte("seen before the drop\n"))
+	if _, err := readUntil(dropped, ": seen before the drop"); err != nil {
+		t.Fatal(err)
+	}
+	dropped.Close()
+	for held := false; !held; time.Sleep(10 * time.Millisecond) {
+		srv.Mutex.Lock()
+		for _, sess := range srv.sessions {
+			held = held || (sess.held && sess.client.Name == "resume-a")
+		}
+		srv.Mutex.Unlock()
+	}
+	watcher.Write([]byte("while you were out\n"))
+	if taken, _ := join("resume-a\n", "username already exists"); taken != nil {
+		taken.Close()
+	}
+	resumed, replay := join("RESUME "+token+"\n", "[resume-a]:")
+	defer resumed.Close()
+	if !strings.Contains(replay, ": while you were out") || strings.Contains(replay, "seen before the drop") || !strings.Contains(replay, "Welcome back, resume-a: 1 missed messages replayed.") {
+		colortest.LogError(t, "unexpected replay: "+replay)
+	}
+
+	resumed.Write([]byte("back again\n"))
+	seen, err := readUntil(watcher, ": back again")
+	if err != nil || strings.Contains(seen, "resume-a has") {
+		colortest.LogError(t, "watcher saw the reconnection: "+seen)
+		return
+	}
+
+	// A protocol client that leaves for good is not held for the grace window
+	leaving, err := dialWithRetry(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaving.Close()
+	leaving.Write([]byte(protocol.Handshake + "\n" + `{"type":"nick","name":"resume-j"}` + "\n"))
+	if _, err := readUntil(leaving, `"type":"session"`); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(watcher, "resume-j has joined")
+	left := time.Now()
+	leaving.Write([]byte(`{"type":"leave"}` + "\n"))
+	if _, err := readUntil(watcher, "resume-j has left our chat..."); err != nil || time.Since(left) > 500*time.Millisecond {
+		colortest.LogError(t, "leave event did not end the session at once")
+	}
+
+	resumed.Close()
+	if _, err := readUntil(watcher, "resume-a has left our chat..."); err != nil {
+		colortest.LogError(t, "expired session did not leave: "+err.Error())
+	} else {
+		colortest.LogSuccess(t, "TestResume completed successfully")
+	}
+}
+
+// TestTyping tests that typing events reach only the protocol clients in the
+// typist's room that declared the capability, rate limited and expiring.
+func TestTyping(t *testing.T) {
+	colortest.LogInfo(t, "Running TestTyping...")
+	srv := newTestServer(t)
+	if caps := newTransport(&mocks.MockConn{RemoteAddrFunc: func() net.Addr { return &net.TCPAddr{} }}); !caps.declare("CAPS Typing") || !hasCap(caps, protocol.CapTyping) {
+		colortest.LogError(t, "CAPS typing was not recorded")
+	}
+
+	// join adds a client on a pipe and returns the lines it receives
+	join := func(name string, proto string, typingCap bool) (net.Conn, chan string) {
+		conn, peer := net.Pipe()
+		lines := make(chan string, 10)
+		go func() {
+			reader := bufio.NewReader(peer)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimSpace(line) != "" {
+					lines <- line
+				}
+			}
+		}()
+		now := time.Now()
+		srv.Mutex.Lock()
+		srv.clients = append(srv.clients, &client.Client{Name: name, Conn: conn, Writer: bufio.NewWriter(conn), Connected: now, LastActive: now, Room: DefaultRoom, Proto: proto, TypingCap: typingCap})
+		srv.Mutex.Unlock()
+		return conn, lines
+	}
+	typist, _ := join("typing-a", protocol.Version, true)
+	capable, events := join("typing-b", protocol.Version, true)
+	plain, plainLines := join("typing-c", protocol.Version, false)
+	human, humanLines := join("typing-d", "", false)
+	defer func() {
+		for _, conn := range []net.Conn{typist, capable, plain, human} {
+			srv.removeClient(conn)
+			conn.Close()
+		}
+	}()
+
+	expect := func(want string) {
+		select {
+		case line := <-events:
+			if !strings.Contains(line, want) {
+				colortest.LogError(t, "unexpected event: "+line)
+			}
+		case <-time.After(2 * time.Second):
+			colortest.LogError(t, "no event containing "+want)
+		}
+	}
+	srv.handleEvent(typist, "typing-a", `{"type":"typing","state":"start"}`)
+	expect(`"name":"typing-a","state":"start"`)
+	srv.handleEvent(typist, "typing-a", `{"type":"typing","state":"start"}`)
+	srv.handleEvent(typist, "typing-a", `{"type":"typing","state":"stop"}`)
+	expect(`"state":"stop"`) // The repeated start was held back
+
+	srv.startTyping(typist)
+	expect(`"state":"start"`)
+	srv.Mutex.Lock()
+	st := srv.typing[typist]
+	st.expires = time.Now()
+	srv.Mutex.Unlock()
+	srv.expireTyping(typist, st)
+	expect(`"state":"stop"`)
+
+	// Clients without the capability see nothing before the next broadcast
+	srv.broadcast(chat.KindSystem, chat.Line{Time: time.Now(), Room: DefaultRoom, Body: "typing-done"}, typist)
+	expect("typing-done")
+	for _, lines := range []chan string{plainLines, humanLines} {
+		select {
+		case line := <-lines:
+			if !strings.Contains(line, "typing-done") {
+				colortest.LogError(t, "typing event sent to a client without the capability: "+line)
+				return
+			}
+		case <-time.After(2 * time.Second):
+			colortest.LogError(t, "broadcast not received")
+			return
+		}
+	}
+	colortest.LogSuccess(t, "TestTyping completed successfully")
 }
 
 // TestBroadcast tests the broadcast function.
@@ -252,3 +1123,750 @@ func TestIntegration(t *testing.T) {
 }
 
 
+
+// TestWaitingList tests that places kept for operators are only taken by
+// clients who sent OPER, and that a client refused for lack of a place waits
+// on the list and is admitted when one frees up.
+func TestWaitingList(t *testing.T) {
+	colortest.LogInfo(t, "Running TestWaitingList...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.MaxClients = 2
+	cfg.OperSlots = 1
+	cfg.WaitingList = 1
+	cfg.ResumeGrace = 0
+	cfg.OperPassword = "letmein"
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+	addr := "localhost:9894"
+	go func() {
+		srv.Addr = addr
+		srv.ListenAndServe()
+	}()
+
+	join := func(lines string, want string) net.Conn {
+		conn, err := dialWithRetry(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("TERM dumb\n" + lines))
+		if received, err := readUntil(conn, want); err != nil {
+			t.Fatal(fmt.Errorf("%v: %s: %s", err, want, received))
+		}
+		return conn
+	}
+	first := join("wait-a\n", "[wait-a]:")
+	defer first.Close()
+	waiting := join("wait-b\n", "You are number 1 on the waiting list")
+	defer waiting.Close()
+	refused := join("wait-c\n", "Sorry, the chat room is full.")
+	refused.Close()
+
+	waiting.Write([]byte("let me in\n"))
+	if _, err := readUntil(waiting, "you are number 1 on the waiting list"); err != nil {
+		colortest.LogError(t, "waiting client not told its place")
+	}
+	join("wait-b\n", "username already exists").Close()
+
+	oper := join("OPER letmein\nwait-op\n", "[wait-op]:")
+	operator := false
+	srv.Mutex.Lock()
+	for _, c := range srv.clients {
+		operator = operator || (c.Name == "wait-op" && c.Operator)
+	}
+	srv.Mutex.Unlock()
+	if !operator {
+		colortest.LogError(t, "OPER client did not join as an operator")
+	}
+
+	// The operator took the place kept for operators, so wait-b only gets in
+	// once a place for everyone frees up
+	oper.Close()
+	first.Close()
+	if received, err := readUntil(waiting, "[wait-b]:"); err != nil {
+		colortest.LogError(t, "waiting client not admitted: "+received)
+	} else {
+		colortest.LogSuccess(t, "TestWaitingList completed successfully")
+	}
+}
+
+// TestWaitingNotices tests that a waiting client that does not read its
+// notices does not hold up the server when the waiting list moves.
+func TestWaitingNotices(t *testing.T) {
+	colortest.LogInfo(t, "Running TestWaitingNotices...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.MaxClients, cfg.OperSlots, cfg.WaitingList = 1, 0, 3
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+
+	inside, insidePeer := net.Pipe()
+	defer inside.Close()
+	go io.Copy(io.Discard, insidePeer)
+	srv.Mutex.Lock()
+	srv.listClient(&client.Client{Name: "notice-in", Conn: inside, Writer: bufio.NewWriter(inside), Room: DefaultRoom})
+	srv.Mutex.Unlock()
+
+	first, firstPeer := net.Pipe()
+	slow, slowPeer := net.Pipe()
+	defer slow.Close()
+	admitted := make(chan error, 1)
+	go srv.waitForPlace(first, "notice-a")
+	readUntil(firstPeer, "You are number 1")
+	go func() { admitted <- srv.waitForPlace(slow, "notice-b") }()
+	readUntil(slowPeer, "You are number 2")
+
+	// notice-b is told its new place but does not read it
+	firstPeer.Close()
+	locked := make(chan bool)
+	go func() {
+		for {
+			srv.Mutex.Lock()
+			left := len(srv.waiting)
+			srv.Mutex.Unlock()
+			if left == 1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		srv.Mutex.Lock()
+		srv.Mutex.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		colortest.LogError(t, "the server was held up by a waiting client that does not read")
+		return
+	}
+
+	if received, err := readUntil(slowPeer, "You are now number 1"); err != nil {
+		colortest.LogError(t, "waiting client not told its new place: "+received)
+	}
+	go io.Copy(io.Discard, slowPeer)
+	srv.removeClient(inside)
+	select {
+	case err := <-admitted:
+		if err != nil {
+			colortest.LogError(t, "waiting client not admitted: "+err.Error())
+		} else {
+			colortest.LogSuccess(t, "TestWaitingNotices completed successfully")
+		}
+	case <-time.After(2 * time.Second):
+		colortest.LogError(t, "waiting client not admitted")
+	}
+}
+
+// TestWaitingLineKept tests that a line a waiting client is sending when it
+// is admitted is left for the chat loop instead of being lost.
+func TestWaitingLineKept(t *testing.T) {
+	colortest.LogInfo(t, "Running TestWaitingLineKept...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.MaxClients, cfg.OperSlots, cfg.WaitingList = 1, 0, 3
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+
+	inside, insidePeer := net.Pipe()
+	defer inside.Close()
+	go io.Copy(io.Discard, insidePeer)
+	srv.Mutex.Lock()
+	srv.listClient(&client.Client{Name: "kept-in", Conn: inside, Writer: bufio.NewWriter(inside), Room: DefaultRoom})
+	srv.Mutex.Unlock()
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	waiting := newTransport(conn)
+	admitted := make(chan error, 1)
+	go func() { admitted <- srv.waitForPlace(waiting, "kept-a") }()
+	readUntil(peer, "You are number 1")
+	go io.Copy(io.Discard, peer)
+
+	// The first half of the line is read by waitForPlace, the rest after
+	peer.Write([]byte("hello "))
+	srv.removeClient(inside)
+	select {
+	case err := <-admitted:
+		if err != nil {
+			colortest.LogError(t, "waiting client not admitted: "+err.Error())
+			return
+		}
+	case <-time.After(2 * time.Second):
+		colortest.LogError(t, "waiting client not admitted")
+		return
+	}
+	go peer.Write([]byte("world\n"))
+	line, err := readLine(lineReader(waiting))
+	if err != nil || line != "hello world" {
+		colortest.LogError(t, fmt.Sprintf("line sent during admission not kept: %q, %v", line, err))
+		return
+	}
+	colortest.LogSuccess(t, "TestWaitingLineKept completed successfully")
+}
+
+// TestConnectionGate tests the allow and deny lists and the per-address
+// limits, and that a refused connection is closed before anything is sent.
+func TestConnectionGate(t *testing.T) {
+	colortest.LogInfo(t, "Running TestConnectionGate...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.AllowCIDRs = []string{"127.0.0.0/8", "10.0.0.0/8", "2001:db8::/32"}
+	cfg.DenyCIDRs = []string{"10.9.0.0/16", "2001:db8::1"}
+	cfg.MaxConnsPerIP = 2
+	cfg.ConnRatePerIP = 3
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	allow, _ := parseNetworks(cfg.AllowCIDRs)
+	deny, _ := parseNetworks(cfg.DenyCIDRs)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer, Allow: allow, Deny: deny})
+
+	for ip, want := range map[string]string{
+		"192.168.1.1": rejectNotAllowed,
+		"10.9.4.2":    rejectDenied,
+		"2001:db8::1": rejectDenied,
+		"2001:db8::2": "",
+		"10.1.2.3":    "",
+	} {
+		if got := srv.admitConn(ip); got != want {
+			colortest.LogError(t, fmt.Sprintf("%s: got %q, want %q", ip, got, want))
+		}
+	}
+
+	// Two at once, then the third attempt is over the per-address cap and
+	// the fourth, after one closed, over the rate
+	for i, want := range []string{"", "", rejectPerIP} {
+		if got := srv.admitConn("127.0.0.2"); got != want {
+			colortest.LogError(t, fmt.Sprintf("attempt %d: got %q, want %q", i+1, got, want))
+		}
+	}
+	srv.releaseConn("127.0.0.2")
+	if got := srv.admitConn("127.0.0.2"); got != rejectRateLimit {
+		colortest.LogError(t, "rate limit not applied: "+got)
+	}
+	srv.gate.attempts["127.0.0.2"][0] = time.Now().Add(-rateWindow)
+	srv.gate.attempts["127.0.0.2"] = srv.gate.attempts["127.0.0.2"][:1]
+	if got := srv.admitConn("127.0.0.2"); got != "" {
+		colortest.LogError(t, "attempts older than the window still counted: "+got)
+	}
+
+	// Over TCP: the second connection from this address gets nothing
+	cfg.MaxConnsPerIP = 1
+	cfg.ConnRatePerIP = 0
+	cfg.AllowCIDRs = nil
+	srv = newTestServer(t)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+	addr := "localhost:9893"
+	go func() {
+		srv.Addr = addr
+		srv.ListenAndServe()
+	}()
+	first, err := dialWithRetry(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := readUntil(first, "[ENTER YOUR NAME]:"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if received, err := readUntil(second, "[ENTER YOUR NAME]:"); err != io.EOF || received != "" {
+		colortest.LogError(t, fmt.Sprintf("refused connection received %q (%v)", received, err))
+	} else {
+		colortest.LogSuccess(t, "TestConnectionGate completed successfully")
+	}
+}
+
+// TestContentFilter tests that messages are masked, rejected or dropped as
+// the filters say, that drops are flagged to operators only, and that an
+// edited word list takes effect on reload.
+func TestContentFilter(t *testing.T) {
+	colortest.LogInfo(t, "Running TestContentFilter...")
+	dir := t.TempDir()
+	words := filepath.Join(dir, "words.txt")
+	os.WriteFile(words, []byte("darn\n"), 0644)
+	configPath := filepath.Join(dir, "config.json")
+	os.WriteFile(configPath, []byte(`{"filters": [
+		{"word_list": "`+words+`", "action": "mask"},
+		{"words": ["spam*"], "action": "reject", "notice": "no spam here"},
+		{"name": "scam", "patterns": ["free\\s+crypto"], "action": "drop"}
+	]}`), 0644)
+	srv := newTestServer(t)
+	srv.ConfigPath = configPath
+	if err := srv.Reload(); err != nil {
+		colortest.LogError(t, "Reload failed: "+err.Error())
+		return
+	}
+
+	watcher, watcherPeer := net.Pipe()
+	defer watcher.Close()
+	oper, operPeer := net.Pipe()
+	defer oper.Close()
+	srv.Mutex.Lock()
+	srv.clients = append(srv.clients,
+		&client.Client{Name: "filter-watcher", Conn: watcher, Writer: bufio.NewWriter(watcher), Room: DefaultRoom, Proto: protocol.Version},
+		&client.Client{Name: "filter-oper", Conn: oper, Writer: bufio.NewWriter(oper), Room: DefaultRoom, Operator: true})
+	srv.Mutex.Unlock()
+	defer srv.removeClient(watcher)
+	defer srv.removeClient(oper)
+
+	lines := func(conn net.Conn) chan string {
+		ch := make(chan string, 16)
+		go func() {
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					close(ch)
+					return
+				}
+				ch <- line
+			}
+		}()
+		return ch
+	}
+	watched, flagged := lines(watcherPeer), lines(operPeer)
+	// expect waits for a line containing want and returns those before it
+	expect := func(ch chan string, want string) (string, bool) {
+		var skipped string
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case line, ok := <-ch:
+				if !ok {
+					return skipped, false
+				}
+				if strings.Contains(line, want) {
+					return skipped, true
+				}
+				skipped += line
+			case <-timeout:
+				return skipped, false
+			}
+		}
+	}
+
+	if _, err := srv.PostAs("ci", DefaultRoom, "dаrn it", ""); err != nil {
+		colortest.LogError(t, "masked message was refused: "+err.Error())
+	} else if _, ok := expect(watched, `"body":"**** it"`); !ok {
+		colortest.LogError(t, "masked message was not broadcast")
+	}
+	if _, err := srv.PostAs("ci", DefaultRoom, "buy SP4MMY things", ""); err == nil || err.Error() != "no spam here" {
+		colortest.LogError(t, "expected the message to be rejected with the rule's notice")
+	}
+	if _, err := srv.PostAs("ci", DefaultRoom, "free  crypto for all", ""); err != nil {
+		colortest.LogError(t, "dropped message was refused: "+err.Error())
+	} else if _, ok := expect(flagged, "[FILTER]: message from api/ci in general dropped by scam: free  crypto for all"); !ok {
+		colortest.LogError(t, "operator was not told about the dropped message")
+	}
+
+	os.WriteFile(words, []byte("darn\nheck\n"), 0644)
+	if err := srv.Reload(); err != nil {
+		colortest.LogError(t, "Reload failed: "+err.Error())
+		return
+	}
+	srv.PostAs("ci", DefaultRoom, "oh heck", "")
+	skipped, ok := expect(watched, `"body":"oh ****"`)
+	if !ok {
+		colortest.LogError(t, "word added to the list was not masked")
+	} else if strings.Contains(skipped, "spam") || strings.Contains(skipped, "crypto") {
+		colortest.LogError(t, "refused message was broadcast: "+skipped)
+	} else {
+		colortest.LogSuccess(t, "TestContentFilter completed successfully")
+	}
+}
+
+// TestAuditTrail tests that bans, failed authentication and reloads are
+// recorded in a trail that verifies.
+func TestAuditTrail(t *testing.T) {
+	colortest.LogInfo(t, "Running TestAuditTrail...")
+	dir := t.TempDir()
+	path := filepath.Join(dir, interfaces.AuditFile)
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"max_clients": 0}`), 0644)
+	srv := newTestServerIn(t, dir)
+	srv.ConfigPath = configPath
+
+	srv.Ban("203.0.113.7")
+	srv.Unban("203.0.113.7")
+	srv.Authenticate("not-a-token", "198.51.100.1:40000")
+	srv.Reload()
+
+	content, _ := os.ReadFile(path)
+	count, _, err := audit.Verify(path)
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var ev audit.Event
+		json.Unmarshal([]byte(line), &ev)
+		actions = append(actions, ev.Action+" "+ev.Actor+" "+ev.Target+" "+ev.Addr)
+	}
+	want := []string{
+		"ban admin 203.0.113.7 ",
+		"unban admin 203.0.113.7 ",
+		"auth_failed   198.51.100.1:40000",
+		"reload_rejected server  ",
+	}
+	if err != nil || count != 4 || strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		colortest.LogError(t, fmt.Sprintf("unexpected trail (%v):\n%s", err, content))
+	} else {
+		colortest.LogSuccess(t, "TestAuditTrail completed successfully")
+	}
+}
+
+// TestAdminCommands tests the commands of the admin socket against clients
+// in the chat: list, kick, ban, unban, notice, reload and export.
+func TestAdminCommands(t *testing.T) {
+	colortest.LogInfo(t, "Running TestAdminCommands...")
+	srv := newTestServer(t)
+
+	// join adds a client on a pipe and returns the lines it receives, closed
+	// when the server closes the connection
+	join := func(name string) (net.Conn, chan string) {
+		conn, peer := net.Pipe()
+		lines := make(chan string, 16)
+		go func() {
+			reader := bufio.NewReader(peer)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					close(lines)
+					return
+				}
+				lines <- line
+			}
+		}()
+		now := time.Now()
+		srv.Mutex.Lock()
+		srv.clients = append(srv.clients, &client.Client{Name: name, Conn: conn, Writer: bufio.NewWriter(conn), Connected: now, LastActive: now, Room: DefaultRoom})
+		srv.Mutex.Unlock()
+		return conn, lines
+	}
+	// expect reads lines until one contains want or the connection is closed
+	expect := func(lines chan string, want string) bool {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return false
+				}
+				if strings.Contains(line, want) {
+					return true
+				}
+			case <-timeout:
+				return false
+			}
+		}
+	}
+	watcher, watched := join("admin-w")
+	kicked, kickedLines := join("admin-k")
+	banned, bannedLines := join("admin-b")
+	defer func() {
+		for _, conn := range []net.Conn{watcher, kicked, banned} {
+			srv.removeClient(conn)
+			conn.Close()
+		}
+	}()
+
+	listed := map[string]bool{}
+	for _, info := range srv.ListClients() {
+		listed[info.Name] = true
+	}
+	if !listed["admin-w"] || !listed["admin-k"] || !listed["admin-b"] {
+		colortest.LogError(t, fmt.Sprintf("clients missing from the list: %v", listed))
+	}
+
+	if err := srv.Kick("admin-nobody"); err == nil {
+		colortest.LogError(t, "kicking an unknown client succeeded")
+	}
+	if err := srv.Kick("admin-k"); err != nil || !expect(kickedLines, "You have been kicked") {
+		colortest.LogError(t, "kicked client was not told")
+	} else if expect(kickedLines, "\n") {
+		colortest.LogError(t, "kicked client was not disconnected")
+	}
+
+	if err := srv.Ban("admin-b"); err != nil || !expect(bannedLines, "You have been banned") {
+		colortest.LogError(t, "banned client was not told")
+	}
+	if !srv.isBanned("admin-b", nil) {
+		colortest.LogError(t, "name was not banned")
+	}
+	if err := srv.Unban("admin-b"); err != nil || srv.isBanned("admin-b", nil) {
+		colortest.LogError(t, "ban was not lifted")
+	}
+	if err := srv.Unban("admin-b"); err == nil {
+		colortest.LogError(t, "lifting a missing ban succeeded")
+	}
+
+	srv.Notice("maintenance at noon")
+	if !expect(watched, "[SERVER NOTICE]: maintenance at noon") {
+		colortest.LogError(t, "notice was not broadcast")
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"max_clients": 5}`), 0644)
+	srv.ConfigPath = configPath
+	if err := srv.Reload(); err != nil || srv.current().Config.MaxClients != 5 {
+		colortest.LogError(t, fmt.Sprintf("config was not reloaded: %v", err))
+	}
+
+	posted, err := srv.PostAs("ci", DefaultRoom, "exported", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := srv.Export()
+	if err != nil || len(messages) == 0 || messages[len(messages)-1].ID != posted.ID || messages[len(messages)-1].Body != "exported" {
+		colortest.LogError(t, fmt.Sprintf("unexpected export: %v %v", messages, err))
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestAdminCommands completed successfully")
+	}
+}
+
+// TestSlashLines tests that only the names of commands are taken for
+// commands, and that wrong operator passwords are rate limited per
+// connection.
+func TestSlashLines(t *testing.T) {
+	colortest.LogInfo(t, "Running TestSlashLines...")
+	srv := newTestServer(t)
+	cfg := config.Default()
+	cfg.OperPassword = "letmein"
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+
+	for line, want := range map[string]bool{"/who": true, "/oper x": true, "/shrug": false, "/usr/bin/env": false, "/": false, "see /who": false} {
+		if srv.isCommand(line) != want {
+			colortest.LogError(t, fmt.Sprintf("isCommand(%q) is not %v", line, want))
+		}
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go io.Copy(io.Discard, peer)
+	sender := &client.Client{Name: "oper-a", Conn: newTransport(conn), Room: DefaultRoom}
+	if reply := srv.handleCommand(sender, "/oper wrong"); reply != "wrong operator password" {
+		colortest.LogError(t, "unexpected reply: "+reply)
+	}
+	if reply := srv.handleCommand(sender, "/oper letmein"); !strings.HasPrefix(reply, "too many wrong passwords, try again in 2s") || sender.Operator {
+		colortest.LogError(t, "password tried again at once: "+reply)
+	}
+	sender.Conn.(*transport).passwords.retryAt = time.Now()
+	if reply := srv.handleCommand(sender, "/oper letmein"); reply != "you are now a chat operator" || !sender.Operator {
+		colortest.LogError(t, "unexpected reply after waiting: "+reply)
+	} else {
+		colortest.LogSuccess(t, "TestSlashLines completed successfully")
+	}
+}
+
+// TestEditAndDelete tests the edit window, the operator override and the
+// notices of /edit and /delete, and that the text of a deleted message, or
+// the text an edit replaced, is removed from the history file and missed
+// mentions and the change announced to webhooks.
+func TestEditAndDelete(t *testing.T) {
+	colortest.LogInfo(t, "Running TestEditAndDelete...")
+	dir := t.TempDir()
+	srv := newTestServerIn(t, dir)
+
+	hooked := make(chan webhook.Event, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhook.Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		hooked <- ev
+	}))
+	defer receiver.Close()
+	cfg := config.Default()
+	cfg.Webhooks = []webhook.Hook{{URL: receiver.URL, Events: []string{webhook.EventDelete, webhook.EventEdit}}}
+	renderer, _ := chat.NewRenderer(cfg.Format)
+	srv.state.Store(&reloadable{Config: cfg, Renderer: renderer})
+
+	join := func(name string, operator bool) (*client.Client, chan string) {
+		conn, peer := net.Pipe()
+		lines := make(chan string, 16)
+		go func() {
+			reader := bufio.NewReader(peer)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- line
+			}
+		}()
+		c := &client.Client{Name: name, Conn: conn, Writer: bufio.NewWriter(conn), Room: DefaultRoom, Operator: operator}
+		srv.Mutex.Lock()
+		srv.clients = append(srv.clients, c)
+		srv.Mutex.Unlock()
+		return c, lines
+	}
+	expect := func(lines chan string, want string) bool {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if strings.Contains(line, want) {
+					return true
+				}
+			case <-timeout:
+				return false
+			}
+		}
+	}
+	author, _ := join("edit-a", false)
+	other, watched := join("edit-b", false)
+	oper, _ := join("edit-op", true)
+	defer func() {
+		for _, c := range []*client.Client{author, other, oper} {
+			srv.removeClient(c.Conn)
+			c.Conn.Close()
+		}
+	}()
+	srv.registerLogin("edit-away")
+
+	recent := srv.postMessage(author.Conn, "edit-a", "hi @edit-away", nil)
+	old, _ := srv.history.Append(storage.Record{Kind: storage.KindMessage, Time: time.Now().Add(-editWindow - time.Minute), Room: DefaultRoom, Name: "edit-a", Body: "long ago"})
+	recentID, oldID := storage.FormatID(recent.ID), storage.FormatID(old.ID)
+
+	replies := []struct{ sender *client.Client; line, want string }{
+		{other, "/edit " + recentID + " mine now", "you can only change your own messages"},
+		{author, "/edit " + oldID + " too late", "messages can only be changed for 15m0s after sending"},
+		{author, "/edit " + recentID + " hi again @edit-away", "message #" + recentID + " edited"},
+		{oper, "/delete " + oldID, "message #" + oldID + " deleted"},
+		{author, "/delete " + recentID, "message #" + recentID + " deleted"},
+		{author, "/edit " + recentID + " back", "no message #" + recentID},
+	}
+	for _, r := range replies {
+		if reply := srv.handleCommand(r.sender, r.line); reply != r.want {
+			colortest.LogError(t, r.line+": unexpected reply: "+reply)
+		}
+	}
+	for _, want := range []string{"* edit-a edited #" + recentID + ": hi again @edit-away", "* edit-op deleted message #" + oldID, "* edit-a deleted message #" + recentID} {
+		if !expect(watched, want) {
+			colortest.LogError(t, "room was not told: "+want)
+		}
+	}
+
+	// An edited message keeps no copy of the text it replaced
+	draft := srv.postMessage(author.Conn, "edit-a", "@edit-away draft one", nil)
+	draftID := storage.FormatID(draft.ID)
+	if reply := srv.handleCommand(author, "/edit "+draftID+" @edit-away final"); reply != "message #"+draftID+" edited" {
+		colortest.LogError(t, "unexpected reply: "+reply)
+	}
+
+	if unread, err := srv.mentions.Unread("edit-away"); err != nil || len(unread) != 2 || !unread[0].Deleted || unread[0].Body != "" || unread[1].Body != "@edit-away final" {
+		colortest.LogError(t, fmt.Sprintf("deleted or replaced text kept in mentions: %v %v", unread, err))
+	}
+	for _, file := range []string{interfaces.MentionsFile, interfaces.HistoryFile} {
+		content, _ := os.ReadFile(filepath.Join(dir, file))
+		if strings.Contains(string(content), "hi @edit-away") || strings.Contains(string(content), "draft one") {
+			colortest.LogError(t, "deleted or replaced text left in "+file)
+		}
+	}
+	events := map[string]string{}
+	for len(events) < 4 {
+		select {
+		case ev := <-hooked:
+			events[ev.Event+" "+ev.ID] = ev.Body
+		case <-time.After(2 * time.Second):
+			colortest.LogError(t, fmt.Sprintf("edit and delete events were not posted: %v", events))
+			return
+		}
+	}
+	if body, ok := events["edit "+draftID]; !ok || body != "@edit-away final" || events["delete "+recentID] != "" || events["delete "+oldID] != "" {
+		colortest.LogError(t, fmt.Sprintf("unexpected edit and delete events: %v", events))
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestEditAndDelete completed successfully")
+	}
+}
+
+// TestDirectMessages tests that messages are only kept for offline users
+// who registered their name, and only delivered once the password of the
+// name is given.
+func TestDirectMessages(t *testing.T) {
+	colortest.LogInfo(t, "Running TestDirectMessages...")
+	srv := newTestServer(t)
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go io.Copy(io.Discard, peer)
+	sender := &client.Client{Name: "dm-lucas", Conn: newTransport(conn), Room: DefaultRoom}
+	srv.registerLogin("dm-lucas")
+	srv.registerLogin("dm-layla")
+	srv.registerLogin("dm-mina")
+
+	if reply := srv.handleCommand(sender, "/msg dm-mina hi"); !strings.Contains(reply, "has not registered their name") {
+		colortest.LogError(t, "message kept for an unregistered name: "+reply)
+	}
+	if reply := srv.handleCommand(sender, "/msg dm-nobody hi"); reply != "no user named dm-nobody" {
+		colortest.LogError(t, "unexpected reply: "+reply)
+	}
+
+	owner := &client.Client{Name: "dm-layla", Conn: sender.Conn, Room: DefaultRoom}
+	if reply := srv.handleCommand(owner, "/register short"); !strings.HasPrefix(reply, "usage:") {
+		colortest.LogError(t, "short password accepted: "+reply)
+	}
+	if reply := srv.handleCommand(owner, "/register hunter22pw"); !strings.HasPrefix(reply, "your name is registered") || !owner.Identified {
+		colortest.LogError(t, "unexpected reply: "+reply)
+	}
+	if reply := srv.handleCommand(sender, "/msg dm-layla meet at noon"); !strings.Contains(reply, "message queued") {
+		colortest.LogError(t, "message not queued: "+reply)
+	}
+
+	// Someone else joins under the registered name
+	conn, peer = net.Pipe()
+	defer conn.Close()
+	other := &client.Client{Name: "dm-layla", Conn: newTransport(conn), Room: DefaultRoom}
+	go srv.notifyQueuedMessages(other.Conn, other.Name)
+	if received, err := readUntil(peer, "type /identify"); err != nil || strings.Contains(received, "noon") {
+		colortest.LogError(t, "unexpected notice: "+received)
+	}
+	if reply := srv.handleCommand(other, "/register letmein99"); !strings.Contains(reply, "already registered") {
+		colortest.LogError(t, "password changed without identifying: "+reply)
+	}
+	if reply := srv.handleCommand(other, "/identify wrongpass"); reply != "wrong password" || other.Identified {
+		colortest.LogError(t, "unexpected reply: "+reply)
+	}
+	if reply := srv.handleCommand(other, "/identify hunter22pw"); !strings.HasPrefix(reply, "too many wrong passwords") {
+		colortest.LogError(t, "password tried again at once: "+reply)
+	}
+	// While the holder of the name is online but not identified, messages
+	// to it are queued too
+	srv.Mutex.Lock()
+	srv.clients = append(srv.clients, other)
+	srv.Mutex.Unlock()
+	notified := make(chan string)
+	go func() {
+		text, _ := readUntil(peer, "type /identify")
+		notified <- text
+	}()
+	if reply := srv.handleCommand(sender, "/msg dm-layla bring the keys"); !strings.Contains(reply, "has not identified; message queued") {
+		colortest.LogError(t, "message not queued for an unidentified holder: "+reply)
+	}
+	if text := <-notified; strings.Contains(text, "keys") || !strings.Contains(text, "2 private message(s)") {
+		colortest.LogError(t, "unexpected notice: "+text)
+	}
+	if waiting, _ := srv.inbox.Waiting("dm-layla"); waiting != 2 {
+		colortest.LogError(t, "queued message given out without the password")
+	}
+
+	other.Conn.(*transport).passwords.retryAt = time.Now()
+	received := make(chan string)
+	go func() {
+		text, _ := readUntil(peer, "noon")
+		received <- text
+	}()
+	reply := srv.handleCommand(other, "/identify hunter22pw")
+	text := <-received
+	waiting, _ := srv.inbox.Waiting("dm-layla")
+	if reply != "you are identified as dm-layla" || !other.Identified || !strings.Contains(text, "2 message(s) sent while you were away") || waiting != 0 {
+		colortest.LogError(t, "queued message not delivered on identifying: "+reply+"\n"+text)
+	} else {
+		colortest.LogSuccess(t, "TestDirectMessages completed successfully")
+	}
+}
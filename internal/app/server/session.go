@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"netcat/internal/app/client"
+	"netcat/internal/audit"
+	"netcat/internal/logging"
+	"netcat/internal/protocol"
+	"netcat/internal/storage"
+)
+
+// session lets a user whose connection drops come back as the same client.
+// Every user gets one with a token when they join. When the connection
+// drops, the session is held for the configured grace window: the name stays
+// taken and no leave is shown. A new connection that sends the token with
+// RESUME takes the client over, with its name, room, presence and settings,
+// and is sent the messages it missed. A held session that is not resumed in
+// time ends with the usual leave.
+type session struct {
+	token    string
+	client   *client.Client // The user, kept while the session is held
+	held     bool           // The connection dropped and the session awaits RESUME
+	acked    bool           // The client acknowledges messages with ack events
+	lastID   int64          // Last message acknowledged, where the replay starts
+	timer    *time.Timer    // Ends a held session when the grace window closes
+	replaced net.Conn       // A live connection taken over by RESUME, whose handler ends quietly
+}
+
+// newSessionToken returns a random token that is hard to guess.
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating session token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findSession returns the session of the client on conn, or nil. The caller must hold s.Mutex.
+func (s *Server) findSession(conn net.Conn) *session {
+	for _, sess := range s.sessions {
+		if !sess.held && sess.client.Conn == conn {
+			return sess
+		}
+	}
+	return nil
+}
+
+// nameHeld reports whether name belongs to a session awaiting RESUME or to
+// a client on the waiting list.
+func (s *Server) nameHeld(name string) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.held && sess.client.Name == name {
+			return true
+		}
+	}
+	for _, w := range s.waiting {
+		if w.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// openSession gives the client who just joined on conn a session and sends
+// them its token, unless resuming is turned off.
+func (s *Server) openSession(conn net.Conn) {
+	grace := s.current().Config.ResumeGrace
+	if grace == 0 {
+		return
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		logging.Logger(err.Error())
+		return
+	}
+
+	lastID := s.history.LastID()
+	s.Mutex.Lock()
+	c := s.findClientByConn(conn)
+	if c != nil {
+		s.sessions[token] = &session{token: token, client: c, lastID: lastID}
+	}
+	s.Mutex.Unlock()
+	if c == nil {
+		return
+	}
+
+	if jsonMode(conn) {
+		writeEvent(conn, protocol.Event{Type: protocol.TypeSession, Name: c.Name, Session: token})
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("Your session token is %s. If you are disconnected, send RESUME %s [last message ID] before your name within %d seconds to rejoin.\n", token, token, grace)))
+}
+
+// suspendSession is called when the connection of a client ends. If the
+// user can still resume, it takes the client out of the chat without a
+// leave and reports true; the leave is shown if the grace window closes.
+func (s *Server) suspendSession(conn net.Conn) bool {
+	grace := time.Duration(s.current().Config.ResumeGrace) * time.Second
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.replaced == conn {
+			// The user is already back on a new connection
+			sess.replaced = nil
+			return true
+		}
+	}
+	sess := s.findSession(conn)
+	if sess == nil {
+		return false
+	}
+	if grace == 0 {
+		delete(s.sessions, sess.token)
+		return false
+	}
+	s.unlistClient(conn)
+	sess.held = true
+	sess.timer = time.AfterFunc(grace, func() { s.expireSession(sess) })
+	log.Printf("Holding the session of '%s' for %s", sess.client.Name, grace)
+	return true
+}
+
+// expireSession ends a held session that was not resumed in time.
+func (s *Server) expireSession(sess *session) {
+	s.Mutex.Lock()
+	if s.sessions[sess.token] != sess || !sess.held {
+		s.Mutex.Unlock()
+		return
+	}
+	delete(s.sessions, sess.token)
+	s.admitWaiting()
+	s.Mutex.Unlock()
+
+	log.Printf("Session of '%s' expired", sess.client.Name)
+	s.userLeft(nil, sess.client.Name)
+}
+
+// dropSession ends the session of the user name, live or held, so they
+// cannot resume it. Used when a user is kicked, banned or leaves for good.
+func (s *Server) dropSession(name string) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for token, sess := range s.sessions {
+		if sess.client.Name == name {
+			if sess.timer != nil {
+				sess.timer.Stop()
+			}
+			delete(s.sessions, token)
+		}
+	}
+	s.admitWaiting()
+}
+
+// claimSession handles a RESUME sent on conn. It returns the name of the
+// resumed user, or "" after telling the client why it cannot resume. A
+// session whose old connection has not been noticed as dropped yet is taken
+// over from it.
+func (s *Server) claimSession(t *transport) string {
+	args := t.resume
+	t.resume = nil
+	fail := func(text string) string {
+		logging.Logger("Resume refused: " + text)
+		sendError(t, text)
+		return ""
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fail("usage: RESUME <token> [last message ID]")
+	}
+	var after int64
+	if len(args) == 2 {
+		id, err := storage.ParseID(args[1])
+		if err != nil {
+			return fail(err.Error())
+		}
+		after = id
+	}
+
+	s.Mutex.Lock()
+	sess := s.sessions[args[0]]
+	if sess == nil {
+		s.Mutex.Unlock()
+		s.record(audit.Event{Action: audit.ActionAuthFailed, Addr: t.RemoteAddr().String(), Detail: "unknown or expired session token"})
+		return fail("the session has expired, please choose a name")
+	}
+	var old net.Conn
+	if sess.held {
+		sess.timer.Stop()
+		sess.held = false
+	} else {
+		old = sess.client.Conn
+		sess.replaced = old
+		s.unlistClient(old)
+	}
+	if after != 0 {
+		sess.lastID = after
+	}
+	t.session = sess
+	name := sess.client.Name
+	s.Mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	log.Printf("'%s' resumed their session from %s", name, t.RemoteAddr())
+	if jsonMode(t) {
+		writeEvent(t, protocol.Event{Type: protocol.TypeAck, Name: name, Room: sess.client.Room, Session: sess.token})
+	}
+	return name
+}
+
+// rejoin puts the client of a resumed session back in the chat on conn and
+// sends it the messages it missed.
+func (s *Server) rejoin(conn net.Conn, sess *session) {
+	s.Mutex.Lock()
+	c := sess.client
+	c.Conn, c.Writer = conn, bufio.NewWriter(conn)
+	c.Terminal, c.Proto, c.TypingCap = hasTerminal(conn), protocolOf(conn), hasCap(conn, protocol.CapTyping)
+	s.listClient(c)
+	after, identified := sess.lastID, c.Identified
+	s.Mutex.Unlock()
+
+	messages, err := s.history.Messages()
+	if err != nil {
+		logging.Logger(err.Error())
+		historyErrors.WithLabelValues("load").Inc()
+	}
+	var missed []storage.Message
+	for _, m := range messages {
+		if m.ID > after && inRoom(m, c.Room) {
+			missed = append(missed, m)
+		}
+	}
+	s.sendHistory(conn, missed)
+	s.notifyMissedMentions(conn, c.Name)
+	if identified {
+		s.deliverQueuedMessages(conn, c.Name)
+	} else {
+		s.notifyQueuedMessages(conn, c.Name)
+	}
+	if !jsonMode(conn) {
+		conn.Write([]byte(fmt.Sprintf("\nWelcome back, %s: %d missed messages replayed.\n", c.Name, len(missed))))
+	}
+}
+
+// receivedLine is called for every line the client on conn sends. A client
+// that does not send ack events thereby acknowledges every message before
+// it, as it was still connected to receive them.
+func (s *Server) receivedLine(conn net.Conn) {
+	lastID := s.history.LastID()
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if sess := s.findSession(conn); sess != nil && !sess.acked {
+		sess.lastID = lastID
+	}
+}
+
+// delivered records that the message with the given ID was written to the
+// text client on conn. Text clients cannot send ack events, so this is the
+// nearest the server comes to knowing what they received, and the replay of
+// a resumed session starts after it. The caller must hold s.Mutex.
+func (s *Server) delivered(conn net.Conn, id int64) {
+	if sess := s.findSession(conn); sess != nil && sess.client.Proto == "" && id > sess.lastID {
+		sess.lastID = id
+	}
+}
+
+// acknowledge records the last message a protocol client has received, for
+// the replay if it resumes its session.
+func (s *Server) acknowledge(conn net.Conn, id string) error {
+	n, err := storage.ParseID(id)
+	if err != nil {
+		return err
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if sess := s.findSession(conn); sess != nil && (!sess.acked || n > sess.lastID) {
+		sess.lastID, sess.acked = n, true
+	}
+	return nil
+}
+
+// listClient adds c to the connected clients. The caller must hold s.Mutex.
+func (s *Server) listClient(c *client.Client) {
+	s.clients = append(s.clients, c)
+
+	// Increment the active client count (inside the critical section)
+	s.ActiveClientsMux.Lock()
+	s.ActiveClients++
+	connectedClients.Set(float64(s.ActiveClients))
+	s.ActiveClientsMux.Unlock()
+}
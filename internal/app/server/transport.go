@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"netcat/internal/logging"
+	"netcat/internal/protocol"
+)
+
+// transport wraps an accepted connection with the line reader shared by the
+// name prompt and the chat loop, so nothing a client sends early is lost
+// between the two, and with what the client declared about itself.
+//
+// Before answering the name prompt a client may send handshake lines:
+//
+//	TERM <type>    the terminal type; "dumb" or "none" turns off ANSI escapes
+//	PROTO json/1   switch to the machine-readable protocol, see package protocol
+//	CAPS <cap>...  optional events the client can handle, e.g. "typing"
+//	RESUME <token> [<id>]  rejoin as the user of a dropped session, see session
+//	OPER <password>  join as an operator, who may take the places kept for operators
+type transport struct {
+	net.Conn
+	reader    *bufio.Reader
+	term      string          // Terminal type declared with TERM, empty if none was given
+	proto     string          // Protocol negotiated with PROTO, empty for the human text mode
+	caps      map[string]bool // Capabilities declared with CAPS
+	resume    []string        // Token and optional message ID of the last RESUME, until it is tried
+	session   *session        // Session resumed by this connection, nil for a new user
+	oper      string          // Password given with OPER, until it is checked
+	opered    bool            // OPER was given the operator password
+	passwords passwordLimit   // Wrong operator and account passwords given on this connection
+}
+
+// newTransport wraps conn for handleConnection.
+func newTransport(conn net.Conn) *transport {
+	return &transport{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Read implements net.Conn, reading through the shared buffer.
+func (t *transport) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+// declare records a handshake line and reports whether line was one.
+func (t *transport) declare(line string) bool {
+	keyword, value, _ := strings.Cut(line, " ")
+	switch keyword {
+	case "TERM":
+		t.term = strings.ToLower(strings.TrimSpace(value))
+	case "PROTO":
+		value = strings.TrimSpace(value)
+		if value != protocol.Version {
+			t.Write(protocol.Encode(protocol.Event{Type: protocol.TypeError, Error: fmt.Sprintf("unsupported protocol %q, this server speaks %s", value, protocol.Version)}))
+			break
+		}
+		t.proto = value
+		t.Write(protocol.Encode(protocol.Event{Type: protocol.TypeAck, Proto: value}))
+	case "CAPS":
+		t.caps = make(map[string]bool)
+		for _, capability := range strings.Fields(strings.ToLower(value)) {
+			t.caps[capability] = true
+		}
+	case "RESUME":
+		t.resume = strings.Fields(value)
+		// Keep the token out of the log
+		line = keyword
+	case "OPER":
+		t.oper = strings.TrimSpace(value)
+		// Keep the password out of the log
+		line = keyword
+	default:
+		return false
+	}
+	logging.Logger("Handshake from " + t.RemoteAddr().String() + ": " + line)
+	return true
+}
+
+// lineReader returns the buffered reader for conn, creating one for
+// connections that were not wrapped by the listener.
+func lineReader(conn net.Conn) *bufio.Reader {
+	if t, ok := conn.(*transport); ok {
+		return t.reader
+	}
+	return bufio.NewReader(conn)
+}
+
+// unread puts data back in front of what is read from conn next, so input
+// read ahead by one reader of the connection reaches the next.
+func unread(conn net.Conn, data string) {
+	if t, ok := conn.(*transport); ok && data != "" {
+		t.reader = bufio.NewReader(io.MultiReader(strings.NewReader(data), t.reader))
+	}
+}
+
+// hasTerminal reports whether conn can display ANSI escapes. Only clients
+// that declare otherwise during the handshake, or speak the JSON protocol,
+// are treated as plain text.
+func hasTerminal(conn net.Conn) bool {
+	t, ok := conn.(*transport)
+	if !ok {
+		return true
+	}
+	return t.proto == "" && t.term != "dumb" && t.term != "none"
+}
+
+// protocolOf returns the protocol negotiated on conn, empty for text mode.
+func protocolOf(conn net.Conn) string {
+	if t, ok := conn.(*transport); ok {
+		return t.proto
+	}
+	return ""
+}
+
+// hasCap reports whether the client on conn declared capability with CAPS.
+func hasCap(conn net.Conn, capability string) bool {
+	t, ok := conn.(*transport)
+	return ok && t.caps[capability]
+}
+
+// operDeclared reports whether the client on conn proved to be an operator
+// with OPER before joining, which lets it take the places kept for operators.
+func operDeclared(conn net.Conn) bool {
+	t, ok := conn.(*transport)
+	return ok && t.opered
+}
+
+// resumedSession returns the session the client on conn resumed, or nil.
+func resumedSession(conn net.Conn) *session {
+	if t, ok := conn.(*transport); ok {
+		return t.session
+	}
+	return nil
+}
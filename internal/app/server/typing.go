@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"netcat/internal/protocol"
+)
+
+// Typing indicator timing.
+const (
+	typingExpiry   = 6 * time.Second // A typing state not renewed within this stops by itself
+	typingInterval = 3 * time.Second // Least time between two start events sent for one user
+)
+
+// typingState is a user who is typing, kept in Server.typing until they stop,
+// post their message, leave, or let it expire.
+type typingState struct {
+	name    string
+	room    string
+	sent    time.Time   // When a start was last sent to the room
+	expires time.Time   // When the state stops unless renewed
+	timer   *time.Timer // Fires at expires
+}
+
+// startTyping records that the client on conn is typing and tells the room.
+// Repeated starts only push the expiry back, and are passed on at most once
+// per typingInterval.
+func (s *Server) startTyping(conn net.Conn) {
+	now := time.Now()
+	s.Mutex.Lock()
+	st := s.typing[conn]
+	if st == nil {
+		c := s.findClientByConn(conn)
+		if c == nil {
+			s.Mutex.Unlock()
+			return
+		}
+		st = &typingState{name: c.Name, room: c.Room}
+		st.timer = time.AfterFunc(typingExpiry, func() { s.expireTyping(conn, st) })
+		s.typing[conn] = st
+	} else {
+		st.timer.Reset(typingExpiry)
+	}
+	st.expires = now.Add(typingExpiry)
+	if now.Sub(st.sent) < typingInterval {
+		s.Mutex.Unlock()
+		typingEvents.WithLabelValues(typingLimited).Inc()
+		return
+	}
+	st.sent = now
+	s.Mutex.Unlock()
+	s.sendTyping(conn, st, protocol.TypingStart)
+}
+
+// stopTyping ends the typing state of the client on conn, if any, and tells the room.
+func (s *Server) stopTyping(conn net.Conn) {
+	s.Mutex.Lock()
+	st := s.typing[conn]
+	if st != nil {
+		delete(s.typing, conn)
+		st.timer.Stop()
+	}
+	s.Mutex.Unlock()
+	if st != nil {
+		s.sendTyping(conn, st, protocol.TypingStop)
+	}
+}
+
+// expireTyping stops a typing state whose timer fired, unless it was renewed
+// or replaced meanwhile.
+func (s *Server) expireTyping(conn net.Conn, st *typingState) {
+	s.Mutex.Lock()
+	if s.typing[conn] != st || time.Now().Before(st.expires) {
+		s.Mutex.Unlock()
+		return
+	}
+	delete(s.typing, conn)
+	s.Mutex.Unlock()
+	typingEvents.WithLabelValues(typingExpired).Inc()
+	s.sendTyping(conn, st, protocol.TypingStop)
+}
+
+// sendTyping sends a typing event to the protocol clients in the typist's
+// room that asked for them. Text clients never see typing events.
+func (s *Server) sendTyping(conn net.Conn, st *typingState, state string) {
+	ev := protocol.Encode(protocol.Event{Type: protocol.TypeTyping, Time: protocol.FormatTime(time.Now()), Room: st.room, Name: st.name, State: state})
+	typingEvents.WithLabelValues(state).Inc()
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, client := range s.clients {
+		if client.Conn == conn || client.Proto == "" || !client.TypingCap || client.Room != st.room {
+			continue
+		}
+		client.Writer.Write(ev)
+		client.Writer.Flush()
+	}
+}
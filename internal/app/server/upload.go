@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"netcat/internal/app/client"
+	"netcat/internal/logging"
+	"netcat/internal/storage"
+)
+
+// Limits on what a text client sends.
+const (
+	maxLineLength = 64 * 1024 // Longest line, as with the bufio.Scanner default
+	blockFence    = "```"     // A line of its own that starts and ends a multi-line block
+	maxBlockLines = 200       // Lines in one block
+	maxBlockSize  = 16 * 1024 // Bytes in one block
+	maxUploadName = 64        // Length of an upload's file name
+)
+
+// errLineTooLong is returned by readLine for a line over maxLineLength.
+var errLineTooLong = fmt.Errorf("line longer than %d bytes", maxLineLength)
+
+// readLine reads one line without its line ending. A last line without a
+// newline is returned before io.EOF; on any other error, what was read of
+// the line is returned with it.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return string(line), err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+// readBlock reads the lines of a block after its opening fence, up to the
+// closing one, and returns them as one message body. When the block is too
+// long it returns an error message for the user instead, after reading the
+// rest of it so its lines are not sent as separate messages.
+func readBlock(reader *bufio.Reader) (string, string, error) {
+	var lines []string
+	size, tooLong := 0, false
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return "", "", err
+		}
+		if strings.TrimSpace(line) == blockFence {
+			break
+		}
+		size += len(line) + 1
+		if len(lines) >= maxBlockLines || size > maxBlockSize {
+			tooLong = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if tooLong {
+		return "", fmt.Sprintf("block not sent: it may have at most %d lines and %d bytes", maxBlockLines, maxBlockSize), nil
+	}
+	return strings.Join(lines, "\n"), "", nil
+}
+
+// receiveUpload reads the payload of an /upload typed by username: a line
+// with the size in bytes, then exactly that many bytes. The file is stored
+// and announced in the room. The returned error is a read error that ends
+// the connection; problems with the upload itself are told to the user.
+func (s *Server) receiveUpload(conn net.Conn, reader *bufio.Reader, username string, name string) error {
+	conn.Write([]byte("Send the size in bytes on one line, then the content.\n"))
+	sizeLine, err := readLine(reader)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeLine), 10, 64)
+	if err != nil || size < 1 {
+		conn.Write([]byte("upload cancelled: the size must be a positive number of bytes\n"))
+		return nil
+	}
+
+	// The total is checked again when the file is saved, as other uploads
+	// may be stored while this one is read
+	cfg := s.current().Config
+	if size > cfg.MaxUploadSize || s.uploads.Total()+size > cfg.MaxUploadTotal {
+		// Read the payload anyway so it is not taken for chat lines
+		if _, err := io.CopyN(io.Discard, reader, size); err != nil {
+			return err
+		}
+		if size > cfg.MaxUploadSize {
+			conn.Write([]byte(fmt.Sprintf("upload rejected: files may be at most %d bytes\n", cfg.MaxUploadSize)))
+		} else {
+			conn.Write([]byte("upload rejected: the server has no room for more files\n"))
+		}
+		logging.Logger(fmt.Sprintf("Upload of %d bytes from %s rejected", size, username))
+		return nil
+	}
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return err
+	}
+	if errMsg := checkUploadName(name); errMsg != "" {
+		conn.Write([]byte("upload rejected: " + errMsg + "\n"))
+		return nil
+	}
+
+	up, ok, err := s.uploads.Save(storage.Upload{Name: name, From: username, Time: time.Now()}, content, cfg.MaxUploadTotal)
+	if err != nil {
+		logging.Logger(err.Error())
+		conn.Write([]byte("upload failed, please try again\n"))
+		return nil
+	}
+	if !ok {
+		conn.Write([]byte("upload rejected: the server has no room for more files\n"))
+		logging.Logger(fmt.Sprintf("Upload of %d bytes from %s rejected", size, username))
+		return nil
+	}
+	id := storage.FormatID(up.ID)
+	logging.Logger(fmt.Sprintf("Upload #%s (%s, %d bytes) from %s", id, up.Name, up.Size, username))
+	conn.Write([]byte(fmt.Sprintf("Uploaded %s as file #%s\n", up.Name, id)))
+	s.postMessage(conn, username, fmt.Sprintf("shared %s (%d bytes), type /get %s to download it", up.Name, up.Size, id), nil)
+	return nil
+}
+
+// checkUploadName returns why name cannot be used for an upload, or "".
+func checkUploadName(name string) string {
+	if name == "" || len(name) > maxUploadName {
+		return fmt.Sprintf("the file name must be 1 to %d characters", maxUploadName)
+	}
+	if strings.ContainsAny(name, "/\\") || strings.IndexFunc(name, func(r rune) bool { return r < ' ' }) >= 0 {
+		return "the file name cannot contain slashes or control characters"
+	}
+	return ""
+}
+
+// cmdUpload answers /upload when it was not handled by the text chat loop:
+// without a name, or from a protocol client.
+func (s *Server) cmdUpload(sender *client.Client, args string) string {
+	if args == "" {
+		return "usage: " + commands["upload"].usage + ", then the size in bytes on one line and the content"
+	}
+	return "uploads can only be sent from the text chat"
+}
+
+// cmdGet sends the content of an uploaded file to the sender, after a line
+// giving its name and size. Control characters and bytes that are not
+// UTF-8 are escaped, so a file cannot drive the sender's terminal.
+func (s *Server) cmdGet(sender *client.Client, args string) string {
+	if args == "" {
+		return "usage: " + commands["get"].usage
+	}
+	id, err := storage.ParseID(args)
+	if err != nil {
+		return err.Error()
+	}
+	up, content, ok, err := s.uploads.Get(id)
+	if err != nil {
+		logging.Logger(err.Error())
+		return "could not read the file, please try again"
+	}
+	if !ok {
+		return fmt.Sprintf("no file #%s", storage.FormatID(id))
+	}
+	return fmt.Sprintf("[file #%s: %s, %d bytes]\n%s", storage.FormatID(up.ID), up.Name, up.Size, escapeContent(content))
+}
+
+// escapeContent returns content as text, with control characters other
+// than line endings and tabs, and bytes that are not UTF-8, written as
+// \xNN or \uNNNN escapes.
+func escapeContent(content []byte) string {
+	var b strings.Builder
+	for len(content) > 0 {
+		r, size := utf8.DecodeRune(content)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, "\\x%02x", content[0])
+		case r == '\n' || r == '\t' || (r == '\r' && len(content) > 1 && content[1] == '\n'):
+			b.WriteRune(r)
+		case unicode.IsControl(r) && r < 0x80:
+			fmt.Fprintf(&b, "\\x%02x", r)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.Write(content[:size])
+		}
+		content = content[size:]
+	}
+	return b.String()
+}
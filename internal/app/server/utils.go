@@ -1,12 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
-	"netcat/internal/interfaces"
 	"netcat/internal/logging"
+	"netcat/internal/storage"
 	"os"
 	"strconv"
 	"strings"
@@ -19,8 +19,11 @@ func verifyMessage(message string) string {
 	return ""
 }
 
-// isValidUsername checks if the provided username is valid.
-func isValidUsername(username string) error {
+// errNameTaken is returned for a name that someone is using or holding.
+var errNameTaken = errors.New("username already exists")
+
+// isValidUsername checks if the provided username is valid. Callers must hold s.Mutex.
+func (s *Server) isValidUsername(username string) error {
 	// Check if the username is empty
 	if username == "" {
 		return fmt.Errorf("username cannot be empty")
@@ -31,10 +34,20 @@ func isValidUsername(username string) error {
 		return fmt.Errorf("username cannot be more than 15 characters long")
 	}
 
+	// @ is reserved for users of linked servers, shown as name@server
+	if strings.Contains(username, "@") {
+		return fmt.Errorf("username cannot contain @")
+	}
+
+	// / is reserved for services posting through the HTTP API, shown as api/name
+	if strings.Contains(username, "/") {
+		return fmt.Errorf("username cannot contain /")
+	}
+
 	// Check if the username already exists
-	for _, client := range interfaces.Clients {
+	for _, client := range s.clients {
 		if client.Name == username {
-			return fmt.Errorf("username already exists")
+			return errNameTaken
 		}
 	}
 
@@ -42,50 +55,27 @@ func isValidUsername(username string) error {
 	return nil
 }
 
-// loadHistoryMessages reads previous messages from a history file.
-func LoadHistoryMessages() ([]string, error) {
-	// Read the content of the history file
-	content, err := ioutil.ReadFile("history.txt")
-
+// readWelcomeMessage reads the welcome banner from path.
+func readWelcomeMessage(path string) (string, error) {
+	content, err := os.ReadFile(path)
 	if err != nil {
-		logging.Logger(err.Error())
-		return nil, fmt.Errorf("error reading history file: %v", err)
-	}else{
-		logging.Logger("History file read successfully")
-	
+		return "", fmt.Errorf("error reading welcome file: %v", err)
 	}
-
-	// Split the content into individual messages
-	messages := strings.Split(string(content), "\n")
-
-	return messages, nil
+	return string(content), nil
 }
 
-// saveHistoryMessage appends a message to the history file.
-func SaveHistoryMessage(message string) error {
-	// Open the history file in append mode
-	file, err := os.OpenFile("history.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// quoteLength is how much of a parent message is quoted above a reply.
+const quoteLength = 60
 
-	if err != nil {
-		logging.Logger(err.Error())
-		return fmt.Errorf("error opening history file: %v", err)
-	}else{
-		logging.Logger("History file opened successfully")
-	
+// messageBody returns the text shown for a message, marking edits and deletions.
+func messageBody(m storage.Message) string {
+	switch {
+	case m.Deleted:
+		return "[message deleted]"
+	case m.Edited:
+		return m.Body + " (edited)"
 	}
-	defer file.Close()
-
-	// Write the message to the file
-	_, err = file.WriteString(message)
-
-	if err != nil {
-		logging.Logger(err.Error())
-		return fmt.Errorf("error writing to history file: %v", err)
-	}else{
-		logging.Logger("History file written successfully")
-	}
-
-	return nil
+	return m.Body
 }
 
 func GetIpLocal() string {
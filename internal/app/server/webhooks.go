@@ -0,0 +1,28 @@
+package server
+
+import (
+	"netcat/internal/app/chat"
+	"netcat/internal/webhook"
+)
+
+// webhookEvents maps the kind of a chat line to the webhook event it triggers.
+var webhookEvents = map[string]string{
+	chat.KindMessage: webhook.EventMessage,
+	chat.KindJoin:    webhook.EventJoin,
+	chat.KindLeave:   webhook.EventLeave,
+}
+
+// sendWebhooks queues a broadcast line for the configured webhooks. It never
+// blocks: delivery happens on the dispatcher's own goroutines.
+func (s *Server) sendWebhooks(kind string, line chat.Line) {
+	event, ok := webhookEvents[kind]
+	hooks := s.current().Config.Webhooks
+	if !ok || len(hooks) == 0 {
+		return
+	}
+	ev := webhook.Event{Event: event, Time: line.Time, Room: line.Room, Name: line.Name, Body: line.Body, ID: line.ID}
+	if line.Quote != nil {
+		ev.ReplyTo = line.Quote.ID
+	}
+	s.webhooks.Send(hooks, ev)
+}
@@ -1,4 +1,72 @@
+// Package ui holds the ANSI terminal rendering helpers used for chat output.
 package ui
 
+import (
+	"hash/fnv"
+	"sort"
+)
 
-//TODO
\ No newline at end of file
+// ANSI escape sequences understood by common terminals.
+const (
+	Reset   = "\033[0m"
+	Bold    = "\033[1m"
+	Red     = "\033[31m"
+	Green   = "\033[32m"
+	Yellow  = "\033[33m"
+	Blue    = "\033[34m"
+	Magenta = "\033[35m"
+	Cyan    = "\033[36m"
+
+	// Bell makes the receiving terminal beep or flash.
+	Bell = "\a"
+)
+
+// NameColors are the colors a user's name can be shown in, by the name used
+// with /color. Bright variants are included so neighbours are easier to tell apart.
+var NameColors = map[string]string{
+	"red":            Red,
+	"green":          Green,
+	"yellow":         Yellow,
+	"blue":           Blue,
+	"magenta":        Magenta,
+	"cyan":           Cyan,
+	"bright-red":     "\033[91m",
+	"bright-green":   "\033[92m",
+	"bright-yellow":  "\033[93m",
+	"bright-blue":    "\033[94m",
+	"bright-magenta": "\033[95m",
+	"bright-cyan":    "\033[96m",
+}
+
+// Highlight renders text in bold yellow so it stands out in a busy room.
+func Highlight(text string) string {
+	return Bold + Yellow + text + Reset
+}
+
+// Colorize renders text in the named color, or unchanged if the name is unknown.
+func Colorize(text string, color string) string {
+	code, ok := NameColors[color]
+	if !ok {
+		return text
+	}
+	return code + text + Reset
+}
+
+// ColorNames returns the names of NameColors in sorted order.
+func ColorNames() []string {
+	names := make([]string, 0, len(NameColors))
+	for name := range NameColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultNameColor picks a color for a user from a hash of their name, so the
+// same name is shown in the same color on every connection and restart.
+func DefaultNameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	names := ColorNames()
+	return names[h.Sum32()%uint32(len(names))]
+}
@@ -1,16 +1,68 @@
 package utils
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Usage is printed when the port cannot be parsed. Wrong flags also print
+// the flags the server accepts.
+const Usage = "[USAGE]: ./TCPChat $port"
+
+// Options holds the settings given on the server command line.
+type Options struct {
+	Port        int      // TCP port the chat listens on
+	MetricsAddr string   // Address of the Prometheus /metrics endpoint, empty to disable
+	APIAddr     string   // Address of the HTTP API, empty to disable
+	AdminSocket string   // Path of the admin control socket, empty to disable
+	ConfigPath  string   // Optional JSON config file
+	Bots        []string // Built-in bots to start, by name
+
+	WatchInterval time.Duration // How often to poll the config, welcome and word list files, 0 to disable
+}
+
+// ParseOptions parses the server flags and the optional port from command-line arguments.
+// If no port number is provided, it defaults to 8989.
+func ParseOptions(args []string) Options {
+	var opts Options
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), Usage)
+		fmt.Fprintln(fs.Output(), "\nFlags, given before $port:")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.MetricsAddr, "metrics", "", "serve Prometheus metrics on this address, e.g. :9100")
+	fs.StringVar(&opts.APIAddr, "api", "", "serve the HTTP API on this address, e.g. :8080")
+	fs.StringVar(&opts.AdminSocket, "admin", "", "path of the admin control socket, off unless given")
+	fs.StringVar(&opts.ConfigPath, "config", "", "JSON config file with reloadable settings")
+	fs.DurationVar(&opts.WatchInterval, "watch", 0, "reload when the config, welcome or a filter word list file changes, polling at this interval")
+	bots := fs.String("bots", "", "comma-separated built-in bots to start, e.g. dice")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+	for _, name := range strings.Split(*bots, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			opts.Bots = append(opts.Bots, name)
+		}
+	}
+
+	opts.Port = ParsePortFromArgs(append([]string{args[0]}, fs.Args()...))
+	return opts
+}
+
 // parsePortFromArgs parses the port number from command-line arguments.
 // If no port number is provided, it defaults to 8989.
 func ParsePortFromArgs(args []string) int {
 	if len(args) > 2 {
-		fmt.Println("[USAGE]: ./TCPChat $port")
+		fmt.Println(Usage)
 		os.Exit(1)
 	}
 
@@ -20,10 +72,9 @@ func ParsePortFromArgs(args []string) int {
 
 	port, err := strconv.Atoi(args[1])
 	if err != nil || port < 1 || port > 65535 {
-		fmt.Println("[USAGE]: ./TCPChat $port")
+		fmt.Println(Usage)
 		os.Exit(1)
 	}
 
 	return port
 }
-
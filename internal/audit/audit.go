@@ -0,0 +1,200 @@
+// Package audit keeps an append-only trail of administrative and security
+// events, apart from the activity log: logins, failed authentication,
+// operator grants, kicks, bans and configuration reloads.
+//
+// Each event is a JSON line that carries the hash of the event before it and
+// a SHA-256 hash of its own content, so changing, removing or reordering
+// lines breaks the chain, which Verify detects. Cutting lines off the end
+// leaves a valid chain; keep the last hash Verify reports somewhere else to
+// notice that too.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the trail.
+const (
+	ActionLogin          = "login"           // A user joined the chat
+	ActionResume         = "resume"          // A user came back on a session token
+	ActionAuthFailed     = "auth_failed"     // A wrong operator or account password, session token or API token
+	ActionRefused        = "refused"         // A banned user or address was turned away
+	ActionOper           = "oper"            // Operator rights were granted
+	ActionKick           = "kick"            // A user was disconnected by the admin
+	ActionBan            = "ban"             // A name or address was banned
+	ActionUnban          = "unban"           // A ban was lifted
+	ActionReload         = "reload"          // The configuration was reloaded
+	ActionReloadRejected = "reload_rejected" // A new configuration was invalid and not applied
+)
+
+// Actors that are not users.
+const (
+	ActorAdmin  = "admin"  // The admin socket
+	ActorServer = "server" // The server itself, e.g. on SIGHUP or a watched file change
+)
+
+// Event is one line of the trail.
+type Event struct {
+	Seq    int64     `json:"seq"`              // Position in the trail, from 1
+	Time   time.Time `json:"time"`             // When it happened
+	Action string    `json:"action"`           // One of the Action* constants
+	Actor  string    `json:"actor,omitempty"`  // Who did it: a user, an API service or one of the Actor* constants
+	Target string    `json:"target,omitempty"` // Who or what it was done to
+	Addr   string    `json:"addr,omitempty"`   // Remote address it came from
+	Detail string    `json:"detail,omitempty"` // Anything else worth knowing, such as an error
+	Prev   string    `json:"prev"`             // Hash of the event before, empty for the first
+	Hash   string    `json:"hash"`             // Hex SHA-256 of the event encoded with Hash empty
+}
+
+// sum returns the hash of ev: the SHA-256 of its JSON encoding with Hash
+// empty. Prev is part of it, which links the events into a chain.
+func sum(ev Event) string {
+	ev.Hash = ""
+	content, _ := json.Marshal(ev)
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// Trail is the audit trail stored at a path. Its methods are safe for
+// concurrent use; only one Trail may write to a file.
+type Trail struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool   // seq and last have been read from the file
+	seq    int64  // Seq of the last event
+	last   string // Hash of the last event
+}
+
+// New opens the audit trail stored at path. The file is read on the first Record.
+func New(path string) *Trail {
+	return &Trail{path: path}
+}
+
+// Record appends ev to the trail, setting its place in the chain and, if
+// it is zero, its time.
+func (t *Trail) Record(ev Event) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.loaded {
+		seq, last, err := tail(t.path)
+		if err != nil {
+			return err
+		}
+		t.seq, t.last, t.loaded = seq, last, true
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Time = ev.Time.UTC()
+	ev.Seq, ev.Prev = t.seq+1, t.last
+	ev.Hash = sum(ev)
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("error encoding audit event: %v", err)
+	}
+
+	file, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit trail: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing audit trail: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error writing audit trail: %v", err)
+	}
+	t.seq, t.last = ev.Seq, ev.Hash
+	return nil
+}
+
+// tail returns the Seq and Hash of the last event stored at path, which the
+// next one chains to. A missing file is an empty trail.
+func tail(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("error reading audit trail: %v", err)
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := newScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, "", fmt.Errorf("error reading audit trail: %v", err)
+	}
+	if last == nil {
+		return 0, "", nil
+	}
+	var ev Event
+	if err := json.Unmarshal(last, &ev); err != nil {
+		return 0, "", fmt.Errorf("audit trail %s ends with a damaged line: %v", path, err)
+	}
+	return ev.Seq, ev.Hash, nil
+}
+
+// Verify checks the chain of the trail stored at path. It returns the
+// number of events and the hash of the last one, or an error naming the
+// first line that was changed, removed or moved.
+func Verify(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("error reading audit trail: %v", err)
+	}
+	defer file.Close()
+	return verify(file)
+}
+
+// verify checks the chain of the trail read from r.
+func verify(r io.Reader) (int64, string, error) {
+	var count int64
+	var last string
+	scanner := newScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var ev Event
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&ev); err != nil {
+			return count, last, fmt.Errorf("line %d: not an audit event: %v", line, err)
+		}
+		switch {
+		case ev.Seq != count+1:
+			return count, last, fmt.Errorf("line %d: event %d found where %d was expected, events were removed or reordered", line, ev.Seq, count+1)
+		case ev.Prev != last:
+			return count, last, fmt.Errorf("line %d: does not follow the event before it", line)
+		case ev.Hash != sum(ev):
+			return count, last, fmt.Errorf("line %d: event %d was changed", line, ev.Seq)
+		}
+		count, last = ev.Seq, ev.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return count, last, fmt.Errorf("error reading audit trail: %v", err)
+	}
+	return count, last, nil
+}
+
+// newScanner returns a line scanner that accepts long events.
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestChain tests that recorded events chain across reopening and verify.
+func TestChain(t *testing.T) {
+	colortest.LogInfo(t, "Running TestChain...")
+	path := filepath.Join(t.TempDir(), "audit.txt")
+	trail := New(path)
+	trail.Record(Event{Action: ActionLogin, Actor: "layla", Addr: "127.0.0.1:4242"})
+	trail.Record(Event{Action: ActionKick, Actor: ActorAdmin, Target: "layla"})
+	// A new Trail, as after a restart, continues the chain
+	New(path).Record(Event{Action: ActionReload, Actor: ActorServer})
+
+	count, last, err := Verify(path)
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	switch {
+	case err != nil:
+		colortest.LogError(t, "unexpected error: "+err.Error())
+	case count != 3 || len(lines) != 3:
+		colortest.LogError(t, "expected 3 events, got:\n"+string(content))
+	case !strings.Contains(lines[2], `"hash":"`+last+`"`):
+		colortest.LogError(t, "last hash does not match the last event")
+	default:
+		colortest.LogSuccess(t, "TestChain completed successfully")
+	}
+}
+
+// TestTampering tests that changed, removed, reordered and forged events
+// are found.
+func TestTampering(t *testing.T) {
+	colortest.LogInfo(t, "Running TestTampering...")
+	path := filepath.Join(t.TempDir(), "audit.txt")
+	trail := New(path)
+	for _, name := range []string{"layla", "lucas", "mina"} {
+		trail.Record(Event{Action: ActionBan, Actor: ActorAdmin, Target: name})
+	}
+	content, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(content), "\n")
+
+	// A forger who knows the scheme can rehash the event they change, but
+	// the next event still points at the old hash
+	var forged Event
+	json.Unmarshal([]byte(lines[1]), &forged)
+	forged.Target = "nobody"
+	forged.Hash = sum(forged)
+	forgedLine, _ := json.Marshal(forged)
+
+	tampered := map[string]string{
+		"changed":   strings.Replace(string(content), `"target":"lucas"`, `"target":"nobody"`, 1),
+		"removed":   lines[0] + lines[2],
+		"reordered": lines[1] + lines[0] + lines[2],
+		"added":     strings.Replace(string(content), `"target":"lucas"`, `"target":"lucas","note":"x"`, 1),
+		"rehashed":  lines[0] + string(forgedLine) + "\n" + lines[2],
+	}
+	for name, text := range tampered {
+		if _, _, err := verify(strings.NewReader(text)); err == nil {
+			colortest.LogError(t, name+": tampering was not detected")
+		}
+	}
+
+	var out bytes.Buffer
+	if code := RunCLI([]string{"-file", path, "verify"}, &out); code != 0 || !strings.HasPrefix(out.String(), "OK: 3 events") {
+		colortest.LogError(t, "unexpected verify output: "+out.String())
+	}
+	os.WriteFile(path, []byte(tampered["changed"]), 0600)
+	out.Reset()
+	if code := RunCLI([]string{"-file", path, "verify"}, &out); code != 1 || !strings.Contains(out.String(), "line 2: event 2 was changed") {
+		colortest.LogError(t, "unexpected verify output for a changed trail: "+out.String())
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestTampering completed successfully")
+	}
+}
@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// DefaultFile is where the server keeps the audit trail.
+const DefaultFile = "audit.txt"
+
+// CLIUsage is printed when the audit subcommand is used incorrectly.
+const CLIUsage = `[USAGE]: ./TCPChat audit [-file path] <command>
+
+Commands:
+  verify               check that no event of the trail was changed, removed or reordered`
+
+// RunCLI runs the audit subcommand with the given arguments and returns the exit code.
+func RunCLI(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := fs.String("file", DefaultFile, "path of the audit trail")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || fs.Arg(0) != "verify" {
+		fmt.Fprintln(out, CLIUsage)
+		return 2
+	}
+
+	count, last, err := Verify(*path)
+	if err != nil {
+		fmt.Fprintln(out, "Error:", err)
+		return 1
+	}
+	if count == 0 {
+		fmt.Fprintf(out, "OK: %s has no events\n", *path)
+		return 0
+	}
+	fmt.Fprintf(out, "OK: %d events, chain intact, last hash %s\n", count, last)
+	return 0
+}
@@ -0,0 +1,173 @@
+// Package config loads the server settings that can be changed without a rebuild.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"netcat/internal/api"
+	"netcat/internal/app/chat"
+	"netcat/internal/federation"
+	"netcat/internal/filter"
+	"netcat/internal/webhook"
+)
+
+// Config holds the reloadable server settings.
+type Config struct {
+	MaxClients  int      `json:"max_clients"`  // Maximum number of clients in the chat
+	WelcomeFile string   `json:"welcome_file"` // File sent to every new connection
+	BannedNames []string `json:"banned_names"` // Usernames that may not join
+	BannedIPs   []string `json:"banned_ips"`   // Remote IPs that are refused on connect
+
+	AllowCIDRs    []string `json:"allow_cidrs"`      // If set, only addresses in these networks may connect
+	DenyCIDRs     []string `json:"deny_cidrs"`       // Networks whose addresses are refused on connect
+	MaxConnsPerIP int      `json:"max_conns_per_ip"` // Open connections allowed from one address, 0 for no limit
+	ConnRatePerIP int      `json:"conn_rate_per_ip"` // Connection attempts allowed from one address per minute, 0 for no limit
+
+	OperSlots   int `json:"oper_slots"`   // Places of max_clients kept for operators
+	WaitingList int `json:"waiting_list"` // Clients that may wait for a place when the chat is full, 0 turns the list off
+
+	OperPassword string `json:"oper_password"` // Password for /oper, empty disables it
+
+	ResumeGrace int `json:"resume_grace"` // Seconds a dropped client may resume its session, 0 disables it
+
+	MaxUploadSize  int64 `json:"max_upload_size"`  // Largest file /upload accepts, in bytes
+	MaxUploadTotal int64 `json:"max_upload_total"` // Bytes all uploads together may take on disk
+
+	Format chat.Format `json:"format"` // Default timestamp layout, time zone and templates
+
+	Filters []filter.Rule `json:"filters"` // Content rules chat messages are checked against before they are posted
+
+	Webhooks []webhook.Hook `json:"webhooks"` // Endpoints chat events are posted to
+
+	APITokens []api.Token `json:"api_tokens"` // Credentials for the HTTP API
+
+	Federation federation.Config `json:"federation"` // Links to other servers, applied on start
+}
+
+// Default returns the settings used when no config file is given.
+func Default() *Config {
+	return &Config{
+		MaxClients:  10,
+		WelcomeFile: "welcome.txt",
+		ResumeGrace: 30,
+
+		MaxUploadSize:  1 << 20,
+		MaxUploadTotal: 100 << 20,
+	}
+}
+
+// Load reads and validates a JSON config file. Fields missing from the file
+// keep their defaults; unknown fields are rejected so typos are not ignored.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the settings can be applied to a running server.
+func (c *Config) Validate() error {
+	if c.MaxClients < 1 {
+		return fmt.Errorf("max_clients must be at least 1, got %d", c.MaxClients)
+	}
+	if c.OperSlots < 0 || c.OperSlots >= c.MaxClients {
+		return fmt.Errorf("oper_slots must be at least 0 and less than max_clients, got %d", c.OperSlots)
+	}
+	if c.WaitingList < 0 {
+		return fmt.Errorf("waiting_list cannot be negative, got %d", c.WaitingList)
+	}
+	if c.WelcomeFile == "" {
+		return fmt.Errorf("welcome_file cannot be empty")
+	}
+	if c.ResumeGrace < 0 {
+		return fmt.Errorf("resume_grace cannot be negative, got %d", c.ResumeGrace)
+	}
+	if c.MaxUploadSize < 1 || c.MaxUploadTotal < c.MaxUploadSize {
+		return fmt.Errorf("max_upload_size must be at least 1 and at most max_upload_total")
+	}
+	for _, name := range c.BannedNames {
+		if name == "" {
+			return fmt.Errorf("banned_names cannot contain an empty name")
+		}
+	}
+	for _, ip := range c.BannedIPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("banned_ips entry %q is not an IP address", ip)
+		}
+	}
+	for _, network := range c.AllowCIDRs {
+		if _, err := ParseNetwork(network); err != nil {
+			return fmt.Errorf("allow_cidrs entry %q is not a CIDR block or IP address", network)
+		}
+	}
+	for _, network := range c.DenyCIDRs {
+		if _, err := ParseNetwork(network); err != nil {
+			return fmt.Errorf("deny_cidrs entry %q is not a CIDR block or IP address", network)
+		}
+	}
+	if c.MaxConnsPerIP < 0 {
+		return fmt.Errorf("max_conns_per_ip cannot be negative, got %d", c.MaxConnsPerIP)
+	}
+	if c.ConnRatePerIP < 0 {
+		return fmt.Errorf("conn_rate_per_ip cannot be negative, got %d", c.ConnRatePerIP)
+	}
+	if _, err := chat.NewRenderer(c.Format); err != nil {
+		return fmt.Errorf("format: %v", err)
+	}
+	for _, rule := range c.Filters {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, hook := range c.Webhooks {
+		if err := hook.Validate(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, token := range c.APITokens {
+		if err := token.Validate(); err != nil {
+			return err
+		}
+		if names[token.Name] {
+			return fmt.Errorf("api token name %q is used twice", token.Name)
+		}
+		names[token.Name] = true
+	}
+	if err := c.Federation.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseNetwork parses an entry of allow_cidrs or deny_cidrs: a CIDR block
+// such as "10.0.0.0/8", or a single IP address.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
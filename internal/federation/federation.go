@@ -0,0 +1,485 @@
+// Package federation links chat servers so their rooms are shared.
+//
+// Linked servers exchange newline-delimited JSON Events over TCP. A link
+// starts with a handshake in which both sides send a hello with their name
+// and a random nonce, then prove they know the shared secret with an HMAC
+// over their own name and the other side's nonce. After that each side sends
+// a join for every user it knows of, then relays messages, joins and leaves
+// as they happen.
+//
+// Every event carries an ID assigned by the server it started on. A server
+// delivers and forwards an event only the first time it sees its ID, so
+// events never loop even when links form a cycle. When a link drops, the
+// server delivers and forwards a leave for each user that was reached
+// through it. Links are best kept to a tree, such as a star around one hub,
+// so that every user is reached by exactly one link.
+package federation
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"netcat/internal/logging"
+	"netcat/internal/metrics"
+)
+
+// Event types.
+const (
+	TypeHello   = "hello"   // First event of a link: the sender's name and nonce
+	TypeAuth    = "auth"    // Second event of a link: proof of the shared secret
+	TypeMessage = "message" // A chat message
+	TypeJoin    = "join"    // A user joined a room
+	TypeLeave   = "leave"   // A user left a room
+)
+
+// Link settings.
+const (
+	handshakeTimeout = 10 * time.Second
+	redialDelay      = time.Second
+	maxRedialDelay   = time.Minute
+	seenSize         = 4096 // Event IDs remembered for loop prevention
+)
+
+var relayed = metrics.Default.NewCounterVec(
+	"netcat_federation_events_total", "Federation events, by direction and type.", "direction", "type")
+
+// Config describes this server's place in the federation.
+type Config struct {
+	Name   string   `json:"name"`   // This server's name, shown after the @ of its users on peers
+	Secret string   `json:"secret"` // Shared by every linked server
+	Listen string   `json:"listen"` // Address to accept links on, empty to only dial
+	Peers  []string `json:"peers"`  // Addresses of servers to link to
+}
+
+// Enabled reports whether federation is configured.
+func (c Config) Enabled() bool {
+	return c.Name != ""
+}
+
+// Validate checks that the settings can be used.
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		if c.Secret != "" || c.Listen != "" || len(c.Peers) > 0 {
+			return fmt.Errorf("federation needs a name")
+		}
+		return nil
+	}
+	if strings.ContainsAny(c.Name, "@/ ") || len(c.Name) > 15 {
+		return fmt.Errorf("federation name %q must be at most 15 characters without @, / or spaces", c.Name)
+	}
+	if len(c.Secret) < 16 {
+		return fmt.Errorf("federation secret must be at least 16 characters")
+	}
+	for _, peer := range c.Peers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return fmt.Errorf("federation peer %q: %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// Event is one line of a link, in either direction.
+type Event struct {
+	Type   string    `json:"type"`
+	ID     string    `json:"id,omitempty"`     // Unique across the federation, "<server>/<epoch>/<sequence>"
+	Origin string    `json:"origin,omitempty"` // Server the user is on
+	Time   time.Time `json:"time,omitempty"`   // When it happened
+	Room   string    `json:"room,omitempty"`   // Room it happened in
+	Name   string    `json:"name,omitempty"`   // User it is about, without the @origin
+	Body   string    `json:"body,omitempty"`   // Message text
+	Server string    `json:"server,omitempty"` // Sender's name, in hello
+	Nonce  string    `json:"nonce,omitempty"`  // Random challenge, in hello
+	MAC    string    `json:"mac,omitempty"`    // Answer to the challenge, in auth
+}
+
+// RemoteName returns the name the user an event is about is shown as.
+func (ev Event) RemoteName() string {
+	return ev.Name + "@" + ev.Origin
+}
+
+// Node is this server's end of its federation links.
+type Node struct {
+	cfg     Config
+	deliver func(Event)    // Called for every new event from a peer
+	roster  func() []Event // Joins for the local users, sent to each new link
+
+	mu       sync.Mutex
+	links    map[*link]bool // Authenticated links
+	listener net.Listener
+	epoch    string // Random per process, so IDs stay unique across restarts
+	seq      int64
+	seen     map[string]bool
+	seenList []string // seen in insertion order, oldest first
+	closed   bool
+}
+
+// link is one authenticated connection to a peer.
+type link struct {
+	conn    net.Conn
+	reader  *bufio.Reader // Used from the handshake on, so nothing sent after it is lost
+	peer    string
+	writeMu sync.Mutex
+	users   map[string]Event // Joins of the users reached through this link, by RemoteName
+}
+
+// NewNode returns a node for cfg. deliver is called, one event at a time per
+// link, for every message, join and leave relayed from a peer; roster returns
+// a join for each local user.
+func NewNode(cfg Config, deliver func(Event), roster func() []Event) *Node {
+	return &Node{cfg: cfg, deliver: deliver, roster: roster, links: make(map[*link]bool), seen: make(map[string]bool), epoch: newNonce()[:8]}
+}
+
+// Listen accepts links on addr until the node is closed, and returns the
+// address it listens on.
+func (n *Node) Listen(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("federation listen: %v", err)
+	}
+	n.mu.Lock()
+	n.listener = listener
+	n.mu.Unlock()
+	logging.Logger("Federation listening on " + listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				l, err := n.handshake(conn)
+				if err != nil {
+					logging.Logger(fmt.Sprintf("Federation link from %s refused: %v", conn.RemoteAddr(), err))
+					conn.Close()
+					return
+				}
+				n.run(l)
+			}()
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// Link dials addr and, once the handshake succeeds, relays over the link in
+// the background. It returns the handshake error, if any.
+func (n *Node) Link(addr string) error {
+	l, err := n.dial(addr)
+	if err != nil {
+		return err
+	}
+	go n.run(l)
+	return nil
+}
+
+// Connect keeps a link to addr up until the node is closed, dialing again
+// with backoff whenever it fails or drops.
+func (n *Node) Connect(addr string) {
+	delay := redialDelay
+	for !n.isClosed() {
+		l, err := n.dial(addr)
+		if err != nil {
+			logging.Logger(fmt.Sprintf("Federation link to %s failed: %v", addr, err))
+		} else {
+			delay = redialDelay
+			n.run(l)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRedialDelay {
+			delay = maxRedialDelay
+		}
+	}
+}
+
+// Publish sends an event about a local user to every peer.
+func (n *Node) Publish(ev Event) {
+	n.mu.Lock()
+	ev.Origin = n.cfg.Name
+	ev.ID = n.nextID()
+	n.remember(ev.ID)
+	n.mu.Unlock()
+
+	n.forward(ev, nil)
+}
+
+// Peers returns the names of the linked servers.
+func (n *Node) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers := make([]string, 0, len(n.links))
+	for l := range n.links {
+		peers = append(peers, l.peer)
+	}
+	return peers
+}
+
+// Remote returns the names of the users reached through links.
+func (n *Node) Remote() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var names []string
+	for l := range n.links {
+		for name := range l.users {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Close closes the listener and every link.
+func (n *Node) Close() {
+	n.mu.Lock()
+	n.closed = true
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for l := range n.links {
+		l.conn.Close()
+	}
+	n.mu.Unlock()
+}
+
+func (n *Node) isClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.closed
+}
+
+// dial connects to addr and runs the handshake.
+func (n *Node) dial(addr string) (*link, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	l, err := n.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// handshake authenticates conn. Both sides run the same steps, so it serves
+// accepted and dialed connections alike.
+func (n *Node) handshake(conn net.Conn) (*link, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	nonce := newNonce()
+	if err := writeEvent(conn, Event{Type: TypeHello, Server: n.cfg.Name, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+	hello, err := readEvent(reader)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Type != TypeHello || hello.Server == "" || hello.Nonce == "" {
+		return nil, fmt.Errorf("expected a hello")
+	}
+	if hello.Server == n.cfg.Name {
+		return nil, fmt.Errorf("peer uses our own name %q", hello.Server)
+	}
+
+	if err := writeEvent(conn, Event{Type: TypeAuth, MAC: sign(n.cfg.Secret, n.cfg.Name, hello.Nonce)}); err != nil {
+		return nil, err
+	}
+	auth, err := readEvent(reader)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Type != TypeAuth || !hmac.Equal([]byte(auth.MAC), []byte(sign(n.cfg.Secret, hello.Server, nonce))) {
+		return nil, fmt.Errorf("peer %q failed authentication", hello.Server)
+	}
+
+	l := &link{conn: conn, reader: reader, peer: hello.Server, users: make(map[string]Event)}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for other := range n.links {
+		if other.peer == l.peer {
+			return nil, fmt.Errorf("already linked to %q", l.peer)
+		}
+	}
+	n.links[l] = true
+	return l, nil
+}
+
+// run relays events from l until it drops, then announces that the users
+// reached through it have left.
+func (n *Node) run(l *link) {
+	logging.Logger("Federation link up: " + l.peer)
+	n.sendRoster(l)
+
+	for {
+		ev, err := readEvent(l.reader)
+		if err != nil {
+			break
+		}
+		n.receive(l, ev)
+	}
+	l.conn.Close()
+
+	n.mu.Lock()
+	delete(n.links, l)
+	var leaves []Event
+	for _, join := range l.users {
+		leave := Event{Type: TypeLeave, ID: n.nextID(), Origin: join.Origin, Time: time.Now(), Room: join.Room, Name: join.Name}
+		n.remember(leave.ID)
+		leaves = append(leaves, leave)
+	}
+	n.mu.Unlock()
+
+	logging.Logger(fmt.Sprintf("Federation link down: %s, %d remote user(s) left", l.peer, len(leaves)))
+	for _, leave := range leaves {
+		n.deliver(leave)
+		n.forward(leave, l)
+	}
+}
+
+// sendRoster sends l a join for every user it may not know of yet: the
+// local ones and those reached through other links.
+func (n *Node) sendRoster(l *link) {
+	var joins []Event
+	for _, join := range n.roster() {
+		n.mu.Lock()
+		join.Type = TypeJoin
+		join.Origin = n.cfg.Name
+		join.ID = n.nextID()
+		n.remember(join.ID)
+		n.mu.Unlock()
+		joins = append(joins, join)
+	}
+	n.mu.Lock()
+	for other := range n.links {
+		if other == l {
+			continue
+		}
+		for _, join := range other.users {
+			joins = append(joins, join)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, join := range joins {
+		l.send(join)
+	}
+}
+
+// receive handles one event from l: new events are delivered locally and
+// forwarded to the other links, repeats are dropped.
+func (n *Node) receive(l *link, ev Event) {
+	if ev.Type != TypeMessage && ev.Type != TypeJoin && ev.Type != TypeLeave {
+		logging.Logger(fmt.Sprintf("Federation peer %s sent an unknown %q event", l.peer, ev.Type))
+		return
+	}
+	n.mu.Lock()
+	if ev.ID == "" || ev.Origin == "" || ev.Origin == n.cfg.Name || n.seen[ev.ID] {
+		n.mu.Unlock()
+		relayed.WithLabelValues("dropped", ev.Type).Inc()
+		return
+	}
+	n.remember(ev.ID)
+	switch ev.Type {
+	case TypeJoin:
+		l.users[ev.RemoteName()] = ev
+	case TypeLeave:
+		delete(l.users, ev.RemoteName())
+	}
+	n.mu.Unlock()
+
+	relayed.WithLabelValues("in", ev.Type).Inc()
+	n.deliver(ev)
+	n.forward(ev, l)
+}
+
+// forward sends ev to every link except from.
+func (n *Node) forward(ev Event, from *link) {
+	n.mu.Lock()
+	targets := make([]*link, 0, len(n.links))
+	for l := range n.links {
+		if l != from {
+			targets = append(targets, l)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, l := range targets {
+		relayed.WithLabelValues("out", ev.Type).Inc()
+		l.send(ev)
+	}
+}
+
+// nextID returns a new event ID. The caller holds n.mu.
+func (n *Node) nextID() string {
+	n.seq++
+	return fmt.Sprintf("%s/%s/%d", n.cfg.Name, n.epoch, n.seq)
+}
+
+// remember marks id as seen, forgetting the oldest IDs past seenSize. The
+// caller holds n.mu.
+func (n *Node) remember(id string) {
+	n.seen[id] = true
+	n.seenList = append(n.seenList, id)
+	if len(n.seenList) > seenSize {
+		delete(n.seen, n.seenList[0])
+		n.seenList = n.seenList[1:]
+	}
+}
+
+// send writes ev to the peer, closing the link if it fails.
+func (l *link) send(ev Event) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if err := writeEvent(l.conn, ev); err != nil {
+		logging.Logger(fmt.Sprintf("Federation link to %s failed: %v", l.peer, err))
+		l.conn.Close()
+	}
+}
+
+// writeEvent writes ev as one JSON line.
+func writeEvent(conn net.Conn, ev Event) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+// readEvent reads one JSON line.
+func readEvent(reader *bufio.Reader) (Event, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return Event{}, err
+	}
+	var ev Event
+	if err := json.Unmarshal(line, &ev); err != nil {
+		return Event{}, fmt.Errorf("invalid federation event: %v", err)
+	}
+	return ev, nil
+}
+
+// sign answers a challenge: the hex HMAC-SHA256 of name and nonce keyed with secret.
+func sign(secret, name, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newNonce returns a random challenge.
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
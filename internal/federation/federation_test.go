@@ -0,0 +1,122 @@
+package federation
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+const testSecret = "0123456789abcdef"
+
+// testNode is a node listening on loopback that records what it delivers.
+type testNode struct {
+	*Node
+	addr      string
+	delivered chan Event
+}
+
+func newTestNode(t *testing.T, name string, secret string, roster ...Event) *testNode {
+	tn := &testNode{delivered: make(chan Event, 64)}
+	tn.Node = NewNode(Config{Name: name, Secret: secret},
+		func(ev Event) { tn.delivered <- ev },
+		func() []Event { return roster })
+	addr, err := tn.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.addr = addr.String()
+	t.Cleanup(tn.Close)
+	return tn
+}
+
+// expect waits for the next delivered event and checks its type, name and body.
+func (tn *testNode) expect(t *testing.T, typ, name, body string) bool {
+	select {
+	case ev := <-tn.delivered:
+		if ev.Type != typ || ev.RemoteName() != name || ev.Body != body {
+			colortest.LogError(t, fmt.Sprintf("%s delivered %s %s %q, want %s %s %q", tn.cfg.Name, ev.Type, ev.RemoteName(), ev.Body, typ, name, body))
+			return false
+		}
+		return true
+	case <-time.After(2 * time.Second):
+		colortest.LogError(t, fmt.Sprintf("%s did not deliver %s %s", tn.cfg.Name, typ, name))
+		return false
+	}
+}
+
+// expectNothing checks that tn delivers nothing more.
+func (tn *testNode) expectNothing(t *testing.T) bool {
+	select {
+	case ev := <-tn.delivered:
+		colortest.LogError(t, fmt.Sprintf("%s delivered an extra %s %s", tn.cfg.Name, ev.Type, ev.RemoteName()))
+		return false
+	case <-time.After(100 * time.Millisecond):
+		return true
+	}
+}
+
+// TestChainRelayAndLeave tests that events cross two links and that users
+// behind a dropped link leave on every server.
+func TestChainRelayAndLeave(t *testing.T) {
+	colortest.LogInfo(t, "Running TestChainRelayAndLeave...")
+	a := newTestNode(t, "alpha", testSecret, Event{Room: "general", Name: "layla"})
+	b := newTestNode(t, "beta", testSecret)
+	c := newTestNode(t, "gamma", testSecret)
+	if err := c.Link(b.addr); err != nil {
+		colortest.LogError(t, "gamma could not link to beta: "+err.Error())
+		return
+	}
+	if err := a.Link(b.addr); err != nil {
+		colortest.LogError(t, "alpha could not link to beta: "+err.Error())
+		return
+	}
+
+	ok := b.expect(t, TypeJoin, "layla@alpha", "") && c.expect(t, TypeJoin, "layla@alpha", "")
+	a.Publish(Event{Type: TypeMessage, Room: "general", Name: "layla", Body: "hello"})
+	ok = ok && b.expect(t, TypeMessage, "layla@alpha", "hello") && c.expect(t, TypeMessage, "layla@alpha", "hello")
+
+	a.Close()
+	ok = ok && b.expect(t, TypeLeave, "layla@alpha", "") && c.expect(t, TypeLeave, "layla@alpha", "")
+	if ok && a.expectNothing(t) && len(c.Remote()) == 0 {
+		colortest.LogSuccess(t, "TestChainRelayAndLeave completed successfully")
+	}
+}
+
+// TestCycleDeliversOnce tests that message IDs stop events from looping
+// around a cycle of links.
+func TestCycleDeliversOnce(t *testing.T) {
+	colortest.LogInfo(t, "Running TestCycleDeliversOnce...")
+	a := newTestNode(t, "alpha", testSecret)
+	b := newTestNode(t, "beta", testSecret)
+	c := newTestNode(t, "gamma", testSecret)
+	for _, pair := range [][2]*testNode{{a, b}, {b, c}, {c, a}} {
+		if err := pair[0].Link(pair[1].addr); err != nil {
+			colortest.LogError(t, "link failed: "+err.Error())
+			return
+		}
+	}
+
+	a.Publish(Event{Type: TypeMessage, Room: "general", Name: "layla", Body: "once"})
+	ok := b.expect(t, TypeMessage, "layla@alpha", "once") && c.expect(t, TypeMessage, "layla@alpha", "once")
+	if ok && a.expectNothing(t) && b.expectNothing(t) && c.expectNothing(t) {
+		colortest.LogSuccess(t, "TestCycleDeliversOnce completed successfully")
+	}
+}
+
+// TestWrongSecret tests that a peer without the shared secret is refused.
+func TestWrongSecret(t *testing.T) {
+	colortest.LogInfo(t, "Running TestWrongSecret...")
+	a := newTestNode(t, "alpha", testSecret)
+	intruder := newTestNode(t, "mallory", "fedcba9876543210")
+	if err := intruder.Link(a.addr); err == nil {
+		colortest.LogError(t, "link with the wrong secret was accepted")
+		return
+	}
+	if err := newTestNode(t, "alpha", testSecret).Link(a.addr); err == nil {
+		colortest.LogError(t, "link from a server with the same name was accepted")
+		return
+	}
+	colortest.LogSuccess(t, "TestWrongSecret completed successfully")
+}
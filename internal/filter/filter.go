@@ -0,0 +1,275 @@
+// Package filter screens chat messages against a content policy before they
+// are posted.
+//
+// Rules match words, listed in the config or in a word list file, or regular
+// expressions. Messages are normalized before matching, so letters from other
+// scripts that look like Latin ones, fullwidth and mathematical forms,
+// accents, invisible characters, leet spelling, repeated letters and letters
+// spaced out do not get a word past a rule. Each rule masks what it matches,
+// rejects the message with a notice to its sender, or drops it silently so
+// operators can look into it.
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Actions a rule can take on a message it matches.
+const (
+	ActionMask   = "mask"   // Replace the matches with asterisks and post the message
+	ActionReject = "reject" // Refuse the message and tell the sender why
+	ActionDrop   = "drop"   // Refuse the message without telling the sender, and flag it to operators
+)
+
+// strength orders the actions: when several rules match, the strongest wins.
+var strength = map[string]int{"": 0, ActionMask: 1, ActionReject: 2, ActionDrop: 3}
+
+// DefaultNotice is told to the sender of a rejected message when the rule has no notice.
+const DefaultNotice = "your message was not sent because it goes against the content policy of this room"
+
+// Rule is one configured content rule.
+type Rule struct {
+	Name     string   `json:"name"`      // Shown to operators and in the log, "rule N" if empty
+	Words    []string `json:"words"`     // Words matched whole; a trailing * also matches longer words
+	WordList string   `json:"word_list"` // File with more words, one per line, # starts a comment
+	Patterns []string `json:"patterns"`  // Regular expressions matched against the normalized message
+	Action   string   `json:"action"`    // mask, reject or drop
+	Rooms    []string `json:"rooms"`     // Rooms the rule applies in, all if empty
+	Notice   string   `json:"notice"`    // Told to the sender of a rejected message
+}
+
+// Validate checks that the rule can be used. The word list is only read by New.
+func (r Rule) Validate() error {
+	if strength[r.Action] == 0 {
+		return fmt.Errorf("filter action %q must be one of mask, reject or drop", r.Action)
+	}
+	if len(r.Words) == 0 && r.WordList == "" && len(r.Patterns) == 0 {
+		return fmt.Errorf("filter %q needs words, a word_list or patterns", r.Name)
+	}
+	for _, w := range r.Words {
+		if len(strings.Fields(w)) > 1 {
+			return fmt.Errorf("filter word %q must be a single word, use patterns for phrases", w)
+		}
+		if _, ok := parseWord(w); !ok {
+			return fmt.Errorf("filter word %q has no letters", w)
+		}
+	}
+	for _, pattern := range r.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("filter pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// appliesIn reports whether the rule applies to messages posted in room.
+func (r Rule) appliesIn(room string) bool {
+	if len(r.Rooms) == 0 {
+		return true
+	}
+	for _, name := range r.Rooms {
+		if name == room {
+			return true
+		}
+	}
+	return false
+}
+
+// Verdict is what a stage decided about a message.
+type Verdict struct {
+	Action string // The strongest action taken, "" if the message passed untouched
+	Body   string // The message to post, masked where needed
+	Rule   string // Name of the rule that rejected or dropped the message
+	Notice string // What to tell the sender of a rejected message
+}
+
+// Blocked reports whether the message must not be posted.
+func (v Verdict) Blocked() bool {
+	return v.Action == ActionReject || v.Action == ActionDrop
+}
+
+// Stage is a step messages go through before they are posted. A Filter is
+// one; plugins may add their own.
+type Stage interface {
+	// Check screens body, about to be posted in room. A stage that lets the
+	// message through unchanged may return the zero Verdict.
+	Check(room, body string) Verdict
+}
+
+// Run passes body through stages in order, each seeing the message as the
+// ones before masked it, and stops at the first that rejects or drops it.
+func Run(stages []Stage, room, body string) Verdict {
+	verdict := Verdict{Body: body}
+	for _, stage := range stages {
+		next := stage.Check(room, verdict.Body)
+		switch {
+		case next.Blocked():
+			next.Body = verdict.Body
+			return next
+		case next.Action == ActionMask:
+			verdict.Action, verdict.Body = ActionMask, next.Body
+		}
+	}
+	return verdict
+}
+
+// compiled is a rule ready to match messages.
+type compiled struct {
+	Rule
+	words    []word
+	patterns []*regexp.Regexp
+}
+
+// Filter applies the configured rules to messages. The nil Filter passes
+// every message.
+type Filter struct {
+	rules []compiled
+}
+
+// New compiles rules, reading their word lists.
+func New(rules []Rule) (*Filter, error) {
+	f := &Filter{}
+	for i, r := range rules {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		c := compiled{Rule: r}
+		words := r.Words
+		if r.WordList != "" {
+			listed, err := readWordList(r.WordList)
+			if err != nil {
+				return nil, err
+			}
+			words = append(append([]string(nil), words...), listed...)
+		}
+		for _, w := range words {
+			if parsed, ok := parseWord(w); ok && len(strings.Fields(w)) == 1 {
+				c.words = append(c.words, parsed)
+			}
+		}
+		for _, pattern := range r.Patterns {
+			c.patterns = append(c.patterns, regexp.MustCompile("(?i)"+pattern))
+		}
+		f.rules = append(f.rules, c)
+	}
+	return f, nil
+}
+
+// readWordList reads a word list file: one word per line, blank lines and
+// lines starting with # are skipped.
+func readWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading filter word list: %v", err)
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading filter word list: %v", err)
+	}
+	return words, nil
+}
+
+// Check implements Stage. Every rule that applies in room is tried: the
+// matches of mask rules are masked, and a rule that rejects or drops the
+// message decides the verdict, drop winning over reject.
+func (f *Filter) Check(room, body string) Verdict {
+	verdict := Verdict{Body: body}
+	if f == nil || len(f.rules) == 0 {
+		return verdict
+	}
+
+	text := fold(body)
+	words := text.tokens()
+	masked := make([]bool, len(text.original))
+	for _, rule := range f.rules {
+		if !rule.appliesIn(room) {
+			continue
+		}
+		spans := rule.find(text, words)
+		if len(spans) == 0 {
+			continue
+		}
+		if rule.Action == ActionMask {
+			for _, span := range spans {
+				text.maskSpan(masked, span[0], span[1])
+			}
+			if verdict.Action == "" {
+				verdict.Action = ActionMask
+			}
+			continue
+		}
+		if strength[rule.Action] > strength[verdict.Action] {
+			verdict.Action, verdict.Rule, verdict.Notice = rule.Action, rule.Name, rule.Notice
+			if verdict.Notice == "" {
+				verdict.Notice = DefaultNotice
+			}
+		}
+	}
+	if verdict.Action == ActionMask {
+		verdict.Body = text.mask(masked)
+	}
+	return verdict
+}
+
+// find returns what the rule matches in a message, as the indexes in
+// text.runes of the first and last rune of each match.
+func (c *compiled) find(text *folded, words []token) [][2]int {
+	var spans [][2]int
+	for _, t := range words {
+		for _, w := range c.words {
+			if !t.spaced {
+				if w.matches(t.letters) {
+					spans = append(spans, [2]int{t.at[0], t.at[len(t.at)-1]})
+				}
+				continue
+			}
+			// Any part of a run of spaced-out letters may be the word
+			for i := range t.letters {
+				for j := i + 1; j <= len(t.letters); j++ {
+					if w.matches(t.letters[i:j]) {
+						spans = append(spans, [2]int{t.at[i], t.at[j-1]})
+					}
+				}
+			}
+		}
+	}
+	if len(c.patterns) == 0 {
+		return spans
+	}
+
+	// Patterns see the folded text, and report byte offsets into it
+	normalized := string(text.runes)
+	offsets := make([]int, 0, len(text.runes))
+	for offset := range normalized {
+		offsets = append(offsets, offset)
+	}
+	runeAt := func(offset int) int {
+		return sort.SearchInts(offsets, offset+1) - 1
+	}
+	for _, re := range c.patterns {
+		for _, loc := range re.FindAllStringIndex(normalized, -1) {
+			if loc[0] < loc[1] {
+				spans = append(spans, [2]int{runeAt(loc[0]), runeAt(loc[1] - 1)})
+			}
+		}
+	}
+	return spans
+}
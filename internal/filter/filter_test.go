@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestLookalikeEvasion tests that words spelled with look-alike characters,
+// invisible characters, leet or spacing are still caught, and that ordinary
+// words containing them are not.
+func TestLookalikeEvasion(t *testing.T) {
+	colortest.LogInfo(t, "Running TestLookalikeEvasion...")
+	f, err := New([]Rule{{Words: []string{"badword", "spam*"}, Action: ActionReject}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caught := map[string]string{
+		"plain":            "this is a badword",
+		"capitals":         "BadWord!",
+		"cyrillic":         "bаdwоrd", // а and о
+		"greek":            "ΒΑDWORD", // Β and Α
+		"fullwidth":        "ｂａｄｗｏｒｄ",
+		"math bold":        "\U0001d41b\U0001d41a\U0001d41d\U0001d430\U0001d428\U0001d42b\U0001d41d",
+		"circled":          "ⓑⓐⓓⓦⓞⓡⓓ",
+		"zero width":       "bad\u200bwo\u200drd",
+		"soft hyphen":      "bad\u00adword",
+		"combining accent": "ba\u0301dwo\u0308rd",
+		"accents":          "bädwörd",
+		"leet":             "b4dw0rd",
+		"symbols":          "b@dword",
+		"repeats":          "baaaadwooord",
+		"dots":             "b.a.d.w.o.r.d",
+		"spaced":           "b a d w o r d",
+		"spaced in text":   "you are a b a d w o r d",
+		"prefix":           "SP4MMING",
+	}
+	for name, body := range caught {
+		if v := f.Check("general", body); v.Action != ActionReject {
+			colortest.LogError(t, name+": "+body+" was not caught")
+		}
+	}
+
+	passed := []string{"bad words", "a bad word", "spa day", "I have 2024 apples", "b4d", "badwords"}
+	for _, body := range passed {
+		if v := f.Check("general", body); v.Action != "" {
+			colortest.LogError(t, body+" was caught by mistake")
+		}
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestLookalikeEvasion completed successfully")
+	}
+}
+
+// TestActions tests masking, the strongest action winning, per-room rules,
+// patterns and word lists.
+func TestActions(t *testing.T) {
+	colortest.LogInfo(t, "Running TestActions...")
+	list := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(list, []byte("# listed words\ndarn\n\nheck\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := New([]Rule{
+		{WordList: list, Action: ActionMask},
+		{Name: "links", Patterns: []string{`https?://\S+`}, Action: ActionReject, Notice: "no links please", Rooms: []string{"lobby"}},
+		{Name: "scam", Patterns: []string{`crypto\s+giveaway`}, Action: ActionDrop},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		room, body string
+		want       Verdict
+	}{
+		{"general", "oh dаrn it, h e c k", Verdict{Action: ActionMask, Body: "oh **** it, * * * *"}},
+		{"general", "da\u200brn", Verdict{Action: ActionMask, Body: "****"}},
+		{"general", "see https://example.com", Verdict{Body: "see https://example.com"}},
+		{"lobby", "darn, see HTTPS://example.com", Verdict{Action: ActionReject, Body: "darn, see HTTPS://example.com", Rule: "links", Notice: "no links please"}},
+		{"lobby", "http://x crypto  GIVEAWAY", Verdict{Action: ActionDrop, Body: "http://x crypto  GIVEAWAY", Rule: "scam", Notice: DefaultNotice}},
+	}
+	for _, test := range tests {
+		if got := f.Check(test.room, test.body); got != test.want {
+			colortest.LogError(t, "unexpected verdict for "+test.body+": "+got.Action+" "+got.Body)
+		}
+	}
+
+	// Later stages see the masked message
+	v := Run([]Stage{f, stageFunc(func(room, body string) Verdict {
+		if body != "**** that" {
+			return Verdict{Action: ActionReject, Notice: body}
+		}
+		return Verdict{}
+	})}, "general", "darn that")
+	if v.Action != ActionMask || v.Body != "**** that" {
+		colortest.LogError(t, "unexpected chained verdict: "+v.Action+" "+v.Body+" "+v.Notice)
+	}
+
+	if _, err := New([]Rule{{Words: []string{"x"}, Action: "ban"}}); err == nil {
+		colortest.LogError(t, "expected an unknown action to be refused")
+	}
+	if _, err := New([]Rule{{Words: []string{"two words"}, Action: ActionMask}}); err == nil {
+		colortest.LogError(t, "expected a phrase in words to be refused")
+	}
+	if _, err := New([]Rule{{Patterns: []string{"("}, Action: ActionMask}}); err == nil {
+		colortest.LogError(t, "expected an invalid pattern to be refused")
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestActions completed successfully")
+	}
+}
+
+// stageFunc adapts a function to Stage.
+type stageFunc func(room, body string) Verdict
+
+func (f stageFunc) Check(room, body string) Verdict {
+	return f(room, body)
+}
@@ -0,0 +1,273 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+)
+
+// folded is a message reduced to the plain lowercase letters a reader sees,
+// so look-alike characters cannot slip a word past the rules. Every rune
+// remembers where it came from in the original, for masking.
+type folded struct {
+	original []rune
+	runes    []rune
+	from     []int // Index in original of each rune of runes
+}
+
+// fold normalizes text: case is folded, fullwidth, mathematical and circled
+// letters and the Cyrillic and Greek letters that look like Latin ones become
+// plain Latin letters, accents are removed and invisible characters dropped.
+func fold(text string) *folded {
+	f := &folded{original: []rune(text)}
+	for i, r := range f.original {
+		if r = foldRune(r); r < 0 {
+			continue
+		}
+		f.runes = append(f.runes, r)
+		f.from = append(f.from, i)
+	}
+	return f
+}
+
+// foldRune returns the plain form of r, or -1 if r is invisible.
+func foldRune(r rune) rune {
+	switch {
+	case invisible(r):
+		return -1
+	case r >= 0xFF01 && r <= 0xFF5E:
+		// Fullwidth forms of ASCII
+		r -= 0xFEE0
+	case r >= 0x1D400 && r <= 0x1D6A3:
+		// Mathematical bold, italic, script, fraktur, double-struck, sans-serif and monospace letters
+		if n := (r - 0x1D400) % 52; n < 26 {
+			r = 'a' + n
+		} else {
+			r = 'a' + n - 26
+		}
+	case r >= 0x1D7CE && r <= 0x1D7FF:
+		// Mathematical digits
+		r = '0' + (r-0x1D7CE)%10
+	case r >= 0x24B6 && r <= 0x24CF:
+		// Circled capital letters
+		r = 'a' + r - 0x24B6
+	case r >= 0x24D0 && r <= 0x24E9:
+		// Circled small letters
+		r = 'a' + r - 0x24D0
+	}
+	if plain, ok := lookalikes[r]; ok {
+		return plain
+	}
+	r = unicode.ToLower(r)
+	if plain, ok := lookalikes[r]; ok {
+		return plain
+	}
+	return r
+}
+
+// invisible reports whether r shows nothing, such as a zero-width space,
+// soft hyphen or combining accent, so it can split a word without changing
+// how it reads.
+func invisible(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Mn, r)
+}
+
+// lookalikes maps letters to the Latin letter they are mistaken for. Capitals
+// are listed where their lowercase form reads differently, such as Greek Ν.
+var lookalikes = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i', 'ј': 'j', 'к': 'k',
+	'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'ѕ': 's', 'т': 't', 'у': 'y', 'х': 'x',
+	'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ѵ': 'v', 'ү': 'y', 'ɡ': 'g',
+	'Н': 'h', 'В': 'b', 'М': 'm', 'Т': 't',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ϲ': 'c', 'ϳ': 'j',
+	'Η': 'h', 'Μ': 'm', 'Ν': 'n', 'Ζ': 'z', 'Χ': 'x', 'Ρ': 'p', 'Β': 'b', 'Τ': 't', 'Υ': 'y',
+	// Latin with accents and other marks
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ā': 'a', 'ă': 'a', 'ą': 'a',
+	'ç': 'c', 'ć': 'c', 'ĉ': 'c', 'č': 'c', 'ď': 'd', 'đ': 'd',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ē': 'e', 'ė': 'e', 'ę': 'e', 'ě': 'e',
+	'ĝ': 'g', 'ğ': 'g', 'ģ': 'g', 'ĥ': 'h',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ī': 'i', 'į': 'i', 'ı': 'i',
+	'ķ': 'k', 'ĺ': 'l', 'ļ': 'l', 'ľ': 'l', 'ł': 'l',
+	'ñ': 'n', 'ń': 'n', 'ņ': 'n', 'ň': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ō': 'o', 'ő': 'o',
+	'ŕ': 'r', 'ř': 'r', 'ś': 's', 'ŝ': 's', 'ş': 's', 'š': 's', 'ţ': 't', 'ť': 't',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ū': 'u', 'ů': 'u', 'ű': 'u', 'ų': 'u',
+	'ŵ': 'w', 'ý': 'y', 'ÿ': 'y', 'ŷ': 'y', 'ź': 'z', 'ż': 'z', 'ž': 'z',
+}
+
+// leet maps the digits and symbols used in place of letters to the letter
+// they usually stand for. They are only read as letters in words that have
+// at least one real letter, so numbers are left alone.
+var leet = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+}
+
+// separators split words in addition to spaces. Other punctuation inside a
+// word, as in "f.u.c.k", is skipped.
+const separators = ",;:?()[]{}<>\"/\\"
+
+// token is one word of a folded message.
+type token struct {
+	letters []rune // The word's letters, digits and leet symbols, read as letters
+	at      []int  // Index in folded.runes of each of letters
+	spaced  bool   // Joined from single letters, any part of which may be a word
+}
+
+// tokens splits the folded message into words. Runs of single letters
+// separated by spaces, as in "f u c k", are also read as one word.
+func (f *folded) tokens() []token {
+	var words []token
+	var current token
+	flush := func() {
+		if len(current.letters) > 0 {
+			words = append(words, current.readLeet())
+		}
+		current = token{}
+	}
+	for i, r := range f.runes {
+		switch {
+		case unicode.IsSpace(r) || strings.ContainsRune(separators, r):
+			flush()
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || leet[r] != 0:
+			current.letters = append(current.letters, r)
+			current.at = append(current.at, i)
+		}
+	}
+	flush()
+
+	var joined []token
+	for i := 0; i < len(words); i++ {
+		if len(words[i].letters) != 1 {
+			joined = append(joined, words[i])
+			continue
+		}
+		run := words[i]
+		run.spaced = true
+		for i+1 < len(words) && len(words[i+1].letters) == 1 {
+			i++
+			run.letters = append(run.letters, words[i].letters...)
+			run.at = append(run.at, words[i].at...)
+		}
+		joined = append(joined, run)
+	}
+	return joined
+}
+
+// readLeet reads the leet symbols of a word that has a real letter as the
+// letters they stand for. Symbols at either end of such a word, as in
+// "shit!", are punctuation and dropped.
+func (t token) readLeet() token {
+	hasLetter := false
+	for _, r := range t.letters {
+		if unicode.IsLetter(r) {
+			hasLetter = true
+			break
+		}
+	}
+	if !hasLetter {
+		return t
+	}
+	start, end := 0, len(t.letters)
+	for start < end && isSymbol(t.letters[start]) {
+		start++
+	}
+	for end > start && isSymbol(t.letters[end-1]) {
+		end--
+	}
+	read := token{at: t.at[start:end], spaced: t.spaced}
+	for _, r := range t.letters[start:end] {
+		if l, ok := leet[r]; ok {
+			r = l
+		}
+		read.letters = append(read.letters, r)
+	}
+	return read
+}
+
+// isSymbol reports whether r is a leet symbol that is not a digit.
+func isSymbol(r rune) bool {
+	return leet[r] != 0 && !unicode.IsDigit(r)
+}
+
+// run is a letter and how many times it repeats.
+type run struct {
+	letter rune
+	count  int
+}
+
+// runs collapses repeated letters, so "fuuuck" and "fuck" compare alike.
+func runs(letters []rune) []run {
+	var out []run
+	for _, r := range letters {
+		if n := len(out); n > 0 && out[n-1].letter == r {
+			out[n-1].count++
+			continue
+		}
+		out = append(out, run{letter: r, count: 1})
+	}
+	return out
+}
+
+// word is a word of a rule, folded like messages are.
+type word struct {
+	runs   []run
+	prefix bool // The word ended in *, so longer words starting with it match
+}
+
+// parseWord folds a word from a rule. It returns false for a word with no letters.
+func parseWord(w string) (word, bool) {
+	prefix := strings.HasSuffix(w, "*")
+	var letters []rune
+	for _, t := range fold(strings.TrimSuffix(w, "*")).tokens() {
+		letters = append(letters, t.letters...)
+	}
+	if len(letters) == 0 {
+		return word{}, false
+	}
+	return word{runs: runs(letters), prefix: prefix}, true
+}
+
+// matches reports whether the letters of a word of a message spell w,
+// allowing them to repeat more often than in w.
+func (w word) matches(letters []rune) bool {
+	have := runs(letters)
+	if len(have) < len(w.runs) || (!w.prefix && len(have) != len(w.runs)) {
+		return false
+	}
+	for i, want := range w.runs {
+		if have[i].letter != want.letter || have[i].count < want.count {
+			return false
+		}
+	}
+	return true
+}
+
+// maskSpan marks the runes of the original from the one folded rune start
+// came from to the one end came from, both included, to be masked. Spaces
+// are kept, so "f u c k" becomes "* * * *".
+func (f *folded) maskSpan(masked []bool, start, end int) {
+	for i := f.from[start]; i <= f.from[end]; i++ {
+		if !unicode.IsSpace(f.original[i]) {
+			masked[i] = true
+		}
+	}
+}
+
+// mask returns the original text with the marked runes replaced by
+// asterisks. Marked invisible characters are removed, so the asterisks line
+// up with what was shown.
+func (f *folded) mask(masked []bool) string {
+	var b strings.Builder
+	for i, r := range f.original {
+		switch {
+		case !masked[i]:
+			b.WriteRune(r)
+		case !invisible(r):
+			b.WriteRune('*')
+		}
+	}
+	return b.String()
+}
@@ -2,15 +2,19 @@
 package interfaces
 
 import (
-	"netcat/internal/app/client"
 	"sync"
 )
 
 var (
-	Clients []client.Client
-
-	Mutex       sync.Mutex
-	HistoryFile = "history.txt"
+	Mutex        sync.Mutex
+	HistoryFile  = "history.txt"
+	UsersFile    = "users.json"
+	MentionsFile = "mentions.txt"
+	InboxFile    = "inbox.txt"
+
+	AuditFile             = "audit.txt"
+	WebhookDeadLetterFile = "webhook-deadletters.txt"
+	UploadsDir            = "uploads"
 
 	NamePrompt     = "\n[ENTER YOUR NAME]: "
 	WelcomeMessage string
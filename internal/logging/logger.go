@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"time"
 )
 
 func CreateLogger() {
@@ -43,6 +44,20 @@ func Logger(message string) bool {
 }
 
 
+// Rotate moves logger.txt aside with a timestamp suffix so the next Logger
+// call starts a fresh file.
+func Rotate() error {
+	rotated := fmt.Sprintf("logger-%s.txt", time.Now().Format("20060102-150405"))
+	if err := os.Rename("logger.txt", rotated); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to rotate logger file: %v", err)
+	}
+	Logger("Log rotated from " + rotated)
+	return nil
+}
+
 // // LogLevel represents different levels of logging.
 // type LogLevel int
 
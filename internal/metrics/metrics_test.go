@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestCounterAndGaugeText tests the exposition of counters and gauges.
+func TestCounterAndGaugeText(t *testing.T) {
+	colortest.LogInfo(t, "Running TestCounterAndGaugeText...")
+	reg := NewRegistry()
+	clients := reg.NewGauge("netcat_connected_clients", "Number of connected clients.")
+	rejected := reg.NewCounterVec("netcat_connections_rejected_total", "Rejected connections.", "reason")
+
+	clients.Inc()
+	clients.Inc()
+	clients.Dec()
+	rejected.WithLabelValues("room_full").Inc()
+	rejected.WithLabelValues("banned").Add(2)
+
+	var b strings.Builder
+	if err := reg.WriteText(&b); err != nil {
+		colortest.LogError(t, "WriteText failed: "+err.Error())
+		return
+	}
+
+	expected := `# HELP netcat_connected_clients Number of connected clients.
+# TYPE netcat_connected_clients gauge
+netcat_connected_clients 1
+# HELP netcat_connections_rejected_total Rejected connections.
+# TYPE netcat_connections_rejected_total counter
+netcat_connections_rejected_total{reason="banned"} 2
+netcat_connections_rejected_total{reason="room_full"} 1
+`
+	if b.String() != expected {
+		colortest.LogError(t, "Expected:\n"+expected+"got:\n"+b.String())
+	} else {
+		colortest.LogSuccess(t, "TestCounterAndGaugeText completed successfully")
+	}
+}
+
+// TestHistogramText tests that histogram buckets are cumulative and followed by _sum and _count.
+func TestHistogramText(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHistogramText...")
+	reg := NewRegistry()
+	latency := reg.NewHistogramVec("netcat_broadcast_duration_seconds", "Broadcast latency.", []float64{0.1, 1}, "type")
+
+	h := latency.WithLabelValues("join")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var b strings.Builder
+	reg.WriteText(&b)
+
+	expected := `# HELP netcat_broadcast_duration_seconds Broadcast latency.
+# TYPE netcat_broadcast_duration_seconds histogram
+netcat_broadcast_duration_seconds_bucket{type="join",le="0.1"} 1
+netcat_broadcast_duration_seconds_bucket{type="join",le="1"} 2
+netcat_broadcast_duration_seconds_bucket{type="join",le="+Inf"} 3
+netcat_broadcast_duration_seconds_sum{type="join"} 2.55
+netcat_broadcast_duration_seconds_count{type="join"} 3
+`
+	if b.String() != expected {
+		colortest.LogError(t, "Expected:\n"+expected+"got:\n"+b.String())
+	} else {
+		colortest.LogSuccess(t, "TestHistogramText completed successfully")
+	}
+}
+
+// TestEscaping tests escaping of HELP text and label values.
+func TestEscaping(t *testing.T) {
+	colortest.LogInfo(t, "Running TestEscaping...")
+	reg := NewRegistry()
+	c := reg.NewCounterVec("netcat_test_total", "Line one\nback\\slash", "room")
+	c.WithLabelValues("a \"quoted\"\nroom\\").Inc()
+
+	var b strings.Builder
+	reg.WriteText(&b)
+
+	if !strings.Contains(b.String(), `# HELP netcat_test_total Line one\nback\\slash`) {
+		colortest.LogError(t, "HELP text not escaped: "+b.String())
+	}
+	if !strings.Contains(b.String(), `netcat_test_total{room="a \"quoted\"\nroom\\"} 1`) {
+		colortest.LogError(t, "label value not escaped: "+b.String())
+	}
+}
+
+// TestHandler tests the HTTP handler content type and body.
+func TestHandler(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHandler...")
+	reg := NewRegistry()
+	reg.NewCounter("netcat_bytes_received_total", "Bytes read from clients.").Add(42)
+
+	rec := httptest.NewRecorder()
+	Handler(reg).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		colortest.LogError(t, "unexpected content type: "+ct)
+	}
+	if !strings.Contains(rec.Body.String(), "netcat_bytes_received_total 42\n") {
+		colortest.LogError(t, "unexpected body: "+rec.Body.String())
+	} else {
+		colortest.LogSuccess(t, "TestHandler completed successfully")
+	}
+}
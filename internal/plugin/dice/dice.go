@@ -0,0 +1,100 @@
+// Package dice is an example plugin: a bot that rolls dice for the room.
+package dice
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"netcat/internal/plugin"
+)
+
+// Limits on a single roll, so one command cannot flood the room.
+const (
+	maxDice  = 20
+	maxSides = 1000
+)
+
+// Bot rolls dice with /roll and posts the result for everyone to see.
+type Bot struct {
+	hub  plugin.Hub
+	roll func(sides int) int // Returns a number from 1 to sides
+}
+
+// New returns a dice bot.
+func New() *Bot {
+	return &Bot{roll: func(sides int) int { return rand.Intn(sides) + 1 }}
+}
+
+// Name implements plugin.Plugin.
+func (b *Bot) Name() string {
+	return "dice"
+}
+
+// Init implements plugin.Plugin.
+func (b *Bot) Init(hub plugin.Hub) error {
+	b.hub = hub
+	return hub.RegisterCommand(plugin.Command{
+		Name:  "roll",
+		Usage: "/roll [NdM]",
+		Help:  "roll N dice with M sides for the room, 1d6 by default",
+		Run:   b.cmdRoll,
+	})
+}
+
+// HandleEvent implements plugin.Plugin. The bot only answers /roll.
+func (b *Bot) HandleEvent(ev plugin.Event) {}
+
+// cmdRoll rolls the dice and posts the result to the sender's room.
+func (b *Bot) cmdRoll(call plugin.Call) string {
+	count, sides, err := parseDice(call.Args)
+	if err != nil {
+		return err.Error()
+	}
+
+	rolls := make([]string, count)
+	total := 0
+	for i := range rolls {
+		n := b.roll(sides)
+		rolls[i] = strconv.Itoa(n)
+		total += n
+	}
+	result := fmt.Sprintf("%s rolled %dd%d: %d", call.Sender, count, sides, total)
+	if count > 1 {
+		result += " (" + strings.Join(rolls, " + ") + ")"
+	}
+
+	if _, err := b.hub.Post(call.Room, result); err != nil {
+		return "could not post the roll: " + err.Error()
+	}
+	return ""
+}
+
+// parseDice parses "NdM", "dM" or "" into a number of dice and their sides.
+func parseDice(spec string) (int, int, error) {
+	if spec == "" {
+		return 1, 6, nil
+	}
+	usage := fmt.Errorf("usage: /roll [NdM], e.g. /roll 2d6")
+	countArg, sidesArg, ok := strings.Cut(strings.ToLower(spec), "d")
+	if !ok {
+		return 0, 0, usage
+	}
+	count := 1
+	if countArg != "" {
+		n, err := strconv.Atoi(countArg)
+		if err != nil {
+			return 0, 0, usage
+		}
+		count = n
+	}
+	sides, err := strconv.Atoi(sidesArg)
+	if err != nil {
+		return 0, 0, usage
+	}
+	if count < 1 || count > maxDice || sides < 2 || sides > maxSides {
+		return 0, 0, fmt.Errorf("roll 1 to %d dice with 2 to %d sides", maxDice, maxSides)
+	}
+	return count, sides, nil
+}
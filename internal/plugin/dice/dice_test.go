@@ -0,0 +1,34 @@
+package dice
+
+import (
+	"testing"
+
+	colortest "netcat/internal/app/colorTest"
+	"netcat/internal/plugin/plugintest"
+)
+
+// TestRoll tests the dice bot against a fake hub.
+func TestRoll(t *testing.T) {
+	colortest.LogInfo(t, "Running TestRoll...")
+	hub := plugintest.NewHub()
+	bot := New()
+	bot.roll = func(sides int) int { return sides }
+	if err := bot.Init(hub); err != nil {
+		colortest.LogError(t, "init failed: "+err.Error())
+		return
+	}
+
+	if reply, _ := hub.Run("roll", "layla", "general", "2d6"); reply != "" {
+		colortest.LogError(t, "unexpected reply: "+reply)
+	}
+	if reply, _ := hub.Run("roll", "layla", "general", "500d6"); reply == "" {
+		colortest.LogError(t, "oversized roll accepted")
+	}
+
+	posts := hub.Posts()
+	if len(posts) != 1 || posts[0].Room != "general" || posts[0].Body != "layla rolled 2d6: 12 (6 + 6)" {
+		colortest.LogError(t, "unexpected posts")
+	} else {
+		colortest.LogSuccess(t, "TestRoll completed successfully")
+	}
+}
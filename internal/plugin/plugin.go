@@ -0,0 +1,60 @@
+// Package plugin defines the interface for in-process bots and other
+// server-side extensions.
+//
+// Plugins are registered when the server is constructed. Each one joins the
+// chat as a bot user named after it, which shows up in /who like any other
+// client, receives the same events a protocol client would, and may post
+// messages, add slash commands and screen messages through its Hub.
+package plugin
+
+import (
+	"netcat/internal/filter"
+	"netcat/internal/protocol"
+)
+
+// Event is a chat event delivered to a plugin: a message, join, leave,
+// notice or direct message, as described in package protocol.
+type Event = protocol.Event
+
+// Plugin is a server-side extension.
+type Plugin interface {
+	// Name is the bot's user name; it must be a valid, unused chat name.
+	Name() string
+	// Init is called once when the server is constructed, before any client
+	// connects. Commands must be registered here.
+	Init(hub Hub) error
+	// HandleEvent is called for every event the bot sees, one at a time, on a
+	// goroutine of its own. The bot's own messages are not delivered.
+	HandleEvent(ev Event)
+}
+
+// Hub is the plugin's handle on the server.
+type Hub interface {
+	// Post sends a chat message to room as the bot and returns its ID.
+	Post(room string, body string) (string, error)
+	// RegisterCommand adds a slash command. Names already taken by the server
+	// or another plugin are refused.
+	RegisterCommand(cmd Command) error
+	// RegisterFilter adds a stage every chat message goes through before it
+	// is posted, after the configured content filter. Stages must be
+	// registered from Init and may be called from many goroutines at once.
+	RegisterFilter(stage filter.Stage) error
+}
+
+// Command is a slash command added by a plugin.
+type Command struct {
+	Name  string // Name without the leading slash
+	Usage string // e.g. "/roll [NdM]"
+	Help  string // One line shown by /help
+
+	// Run handles the command and returns the reply shown to the sender only,
+	// or "" for none. It runs on the sender's connection goroutine.
+	Run func(call Call) string
+}
+
+// Call describes one use of a Command.
+type Call struct {
+	Sender string // Name of the user who typed the command
+	Room   string // Room they typed it in
+	Args   string // Text after the command name, trimmed
+}
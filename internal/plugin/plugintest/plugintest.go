@@ -0,0 +1,89 @@
+// Package plugintest provides a fake Hub for unit-testing plugins without a server.
+package plugintest
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"netcat/internal/filter"
+	"netcat/internal/plugin"
+)
+
+// Post is a message posted through the fake hub.
+type Post struct {
+	Room string
+	Body string
+}
+
+// Hub is a plugin.Hub that records what the plugin does.
+type Hub struct {
+	mu       sync.Mutex
+	posts    []Post
+	commands map[string]plugin.Command
+	filters  []filter.Stage
+}
+
+// NewHub returns an empty fake hub.
+func NewHub() *Hub {
+	return &Hub{commands: make(map[string]plugin.Command)}
+}
+
+// Post implements plugin.Hub. Message IDs count up from 1.
+func (h *Hub) Post(room string, body string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.posts = append(h.posts, Post{Room: room, Body: body})
+	return strconv.Itoa(len(h.posts)), nil
+}
+
+// RegisterCommand implements plugin.Hub.
+func (h *Hub) RegisterCommand(cmd plugin.Command) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.commands[cmd.Name]; ok {
+		return fmt.Errorf("command /%s is already registered", cmd.Name)
+	}
+	h.commands[cmd.Name] = cmd
+	return nil
+}
+
+// RegisterFilter implements plugin.Hub.
+func (h *Hub) RegisterFilter(stage filter.Stage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.filters = append(h.filters, stage)
+	return nil
+}
+
+// Check runs body, posted in room, through the registered filter stages and returns their verdict.
+func (h *Hub) Check(room string, body string) filter.Verdict {
+	h.mu.Lock()
+	stages := append([]filter.Stage(nil), h.filters...)
+	h.mu.Unlock()
+
+	return filter.Run(stages, room, body)
+}
+
+// Posts returns the messages posted so far.
+func (h *Hub) Posts() []Post {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Post(nil), h.posts...)
+}
+
+// Run runs a registered command as if sender typed it in room, and returns its reply.
+func (h *Hub) Run(name string, sender string, room string, args string) (string, error) {
+	h.mu.Lock()
+	cmd, ok := h.commands[name]
+	h.mu.Unlock()
+
+	if !ok {
+		return "", fmt.Errorf("command /%s is not registered", name)
+	}
+	return cmd.Run(plugin.Call{Sender: sender, Room: room, Args: args}), nil
+}
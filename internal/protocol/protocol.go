@@ -0,0 +1,125 @@
+// Package protocol defines the machine-readable mode of the chat, spoken by
+// bots and custom clients instead of the human prompt format.
+//
+// A client opts in by sending the Handshake line before anything else. The
+// server answers with an ack event, after which both sides exchange one JSON
+// Event per line and the server sends no prompts. The client then picks its
+// name with a nick event and sends message events; the server answers each
+// one with an ack or an error carrying the same Ref. Text sent by the server
+// before the handshake ack, such as the welcome banner, should be discarded.
+//
+// After joining, the client is sent a session event with a token. A client
+// that loses its connection can reconnect, send the Handshake, then
+// "RESUME <token> [<id>]" instead of a nick event, within the server's grace
+// window. It gets its name back without a leave or join being shown, and the
+// messages after <id> are replayed. Without <id>, the replay starts after the
+// last message the client acknowledged by sending {"type":"ack","id":"<id>"}.
+// A client leaving for good sends a leave event, which ends its session and
+// closes the connection, so its name is free at once.
+//
+// A server that turns a client away on purpose, because it was kicked or
+// banned or the chat is full, sends a refused event with a Code before
+// closing the connection. Reconnecting will not help then; a connection that
+// drops without one may be resumed. Errors a client can act on carry a Code
+// too: a nick whose name is taken, and a message sent from the waiting list.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is the protocol version this server speaks.
+const Version = "json/1"
+
+// Handshake is the first line a client sends to switch to this protocol.
+const Handshake = "PROTO " + Version
+
+// Event types.
+const (
+	TypeMessage = "message" // A chat message, sent by either side
+	TypeJoin    = "join"    // A user joined the room
+	TypeLeave   = "leave"   // A user left the room, or the client leaves
+	TypeNick    = "nick"    // Sent by the client to choose its name
+	TypeError   = "error"   // A request failed, or the server refused the client
+	TypeAck     = "ack"     // A request succeeded
+	TypeNotice  = "notice"  // Server notices and edit/delete notifications
+	TypeDM      = "dm"      // A private message
+	TypeTyping  = "typing"  // A user started or stopped typing, see CapTyping
+	TypeSession = "session" // Carries the token for resuming the session
+	TypeRefused = "refused" // The server turns the client away and closes the connection
+)
+
+// Codes of refused events, telling why the client was turned away, and of
+// the errors a client can act on.
+const (
+	CodeKicked    = "kicked"     // An operator removed the client
+	CodeBanned    = "banned"     // The name or address is banned
+	CodeChatFull  = "chat_full"  // No place, and no room on the waiting list
+	CodeNameTaken = "name_taken" // Error: the nick is the name of someone else
+	CodeWaiting   = "waiting"    // Error: the client is on the waiting list, not in the chat yet
+)
+
+// CapTyping is the capability a client declares with "CAPS typing" during
+// the handshake to be sent typing events. It sends its own as
+// {"type":"typing","state":"start"} when input starts, again every few
+// seconds while it goes on, and with "stop" when it is cleared. Typing events
+// are not acknowledged; the server stops a typing state that is not renewed.
+const CapTyping = "typing"
+
+// Typing states.
+const (
+	TypingStart = "start"
+	TypingStop  = "stop"
+)
+
+// Event is one line of the protocol, in either direction.
+type Event struct {
+	Type    string `json:"type"`
+	Ref     string `json:"ref,omitempty"`      // Chosen by the client, echoed in the ack or error
+	Proto   string `json:"proto,omitempty"`    // Protocol version, in the handshake ack
+	ID      string `json:"id,omitempty"`       // Message ID
+	Time    string `json:"time,omitempty"`     // RFC 3339 timestamp
+	Room    string `json:"room,omitempty"`     // Room the event happened in
+	Name    string `json:"name,omitempty"`     // User the event is about
+	Body    string `json:"body,omitempty"`     // Message text, or the reply to a command
+	ReplyTo string `json:"reply_to,omitempty"` // ID of the message replied to
+	Edited  bool   `json:"edited,omitempty"`   // The message was edited
+	Deleted bool   `json:"deleted,omitempty"`  // The message was deleted
+	State   string `json:"state,omitempty"`    // TypingStart or TypingStop, in typing events
+	History bool   `json:"history,omitempty"`  // Replayed from history on join
+	Session string `json:"session,omitempty"`  // Token for RESUME, in session events
+	Error   string `json:"error,omitempty"`    // What went wrong, in error and refused events
+	Code    string `json:"code,omitempty"`     // Why the client was refused or the request failed, one of the Code* constants
+}
+
+// FormatTime formats t for the Time field.
+func FormatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+// Encode returns ev as a single JSON line.
+func Encode(ev Event) []byte {
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(ev); err != nil {
+		// Event only holds strings and bools, which always encode.
+		panic(err)
+	}
+	return line.Bytes()
+}
+
+// Decode parses a line sent by a client.
+func Decode(line string) (Event, error) {
+	var ev Event
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return Event{}, fmt.Errorf("invalid event: %v", err)
+	}
+	if ev.Type == "" {
+		return Event{}, fmt.Errorf("invalid event: missing type")
+	}
+	return ev, nil
+}
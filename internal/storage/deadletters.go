@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a webhook delivery that was given up on.
+type DeadLetter struct {
+	Time     time.Time       `json:"time"`     // When it was given up on
+	URL      string          `json:"url"`      // Endpoint it was for
+	Payload  json.RawMessage `json:"payload"`  // Body that would have been posted
+	Attempts int             `json:"attempts"` // Deliveries tried
+	Error    string          `json:"error"`    // Why the last attempt failed
+}
+
+// DeadLetters is an append-only log of failed webhook deliveries, kept so
+// they can be inspected and replayed by hand.
+type DeadLetters struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewDeadLetters opens the dead-letter log stored at path.
+func NewDeadLetters(path string) *DeadLetters {
+	return &DeadLetters{path: path}
+}
+
+// Add records a failed delivery.
+func (d *DeadLetters) Add(letter DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return appendJSONLine(d.path, letter)
+}
+
+// All returns every failed delivery in the order they were recorded.
+func (d *DeadLetters) All() ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return readJSONLines[DeadLetter](d.path)
+}
+
+// Rewrite passes the payload of every failed delivery to change, and
+// rewrites the log if change reports that it changed any. It is used to
+// remove the text of deleted messages.
+func (d *DeadLetters) Rewrite(change func(payload json.RawMessage) (json.RawMessage, bool)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	letters, err := readJSONLines[DeadLetter](d.path)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i, letter := range letters {
+		if payload, ok := change(letter.Payload); ok {
+			letters[i].Payload = payload
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeJSONLines(d.path, letters)
+}
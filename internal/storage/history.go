@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Record kinds stored in the history file.
+const (
+	KindMessage = "message" // A chat line
+	KindEdit    = "edit"    // Replaces the body of Target
+	KindDelete  = "delete"  // Tombstones Target
+
+	// KindSequence carries the last assigned ID across a truncation so IDs stay unique.
+	KindSequence = "sequence"
+)
+
+// Record is one line of the history file.
+type Record struct {
+	ID      int64     `json:"id,omitempty"`
+	Kind    string    `json:"kind"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room,omitempty"`
+	Name    string    `json:"name"`
+	Body    string    `json:"body,omitempty"`
+	Target  int64     `json:"target,omitempty"`
+	Parent  int64     `json:"parent,omitempty"`  // Message this one replies to
+	Service bool      `json:"service,omitempty"` // Posted by a service through the HTTP API
+}
+
+// Message is a chat line with its edits and tombstone applied.
+type Message struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room,omitempty"`
+	Name    string    `json:"name"`
+	Body    string    `json:"body"`
+	Parent  int64     `json:"parent,omitempty"`
+	Edited  bool      `json:"edited,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+	Service bool      `json:"service,omitempty"`
+}
+
+// History is an append-only message store backed by a JSON lines file.
+type History struct {
+	mu     sync.Mutex
+	path   string
+	nextID int64
+}
+
+// NewHistory opens the history stored at path, continuing its ID sequence.
+func NewHistory(path string) *History {
+	h := &History{path: path, nextID: 1}
+	if records, err := h.readRecords(); err == nil {
+		for _, r := range records {
+			if r.ID >= h.nextID {
+				h.nextID = r.ID + 1
+			}
+		}
+	}
+	return h
+}
+
+// FormatID renders a message ID in the short form shown to users.
+func FormatID(id int64) string {
+	return strconv.FormatInt(id, 36)
+}
+
+// ParseID parses an ID as shown to users, with or without a leading '#'.
+func ParseID(s string) (int64, error) {
+	if len(s) > 0 && s[0] == '#' {
+		s = s[1:]
+	}
+	id, err := strconv.ParseInt(s, 36, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid message id %q", s)
+	}
+	return id, nil
+}
+
+// Append stores a record. Messages are assigned the next ID, which is returned
+// even if writing fails so the caller can still show the line. Deleting a
+// message also scrubs its text from the file, and editing it the text the
+// edit replaces.
+func (h *History) Append(r Record) (Record, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r.Kind == KindMessage {
+		r.ID = h.nextID
+		h.nextID++
+	}
+	if err := h.appendRecord(r); err != nil {
+		return r, err
+	}
+	switch r.Kind {
+	case KindDelete:
+		return r, h.redact(r.Target, false)
+	case KindEdit:
+		return r, h.redact(r.Target, true)
+	}
+	return r, nil
+}
+
+// LastID returns the ID of the latest message, or 0 if there is none.
+func (h *History) LastID() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.nextID - 1
+}
+
+// Messages returns every message in order with edits and tombstones applied.
+func (h *History) Messages() ([]Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records, err := h.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	return fold(records), nil
+}
+
+// Get returns the current state of a single message.
+func (h *History) Get(id int64) (Message, bool, error) {
+	messages, err := h.Messages()
+	if err != nil {
+		return Message{}, false, err
+	}
+	for _, m := range messages {
+		if m.ID == id {
+			return m, true, nil
+		}
+	}
+	return Message{}, false, nil
+}
+
+// Thread returns the root of the thread containing id followed by every reply
+// below it, in the order they were sent.
+func (h *History) Thread(id int64) ([]Message, error) {
+	messages, err := h.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]Message, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+	}
+	root, ok := byID[id]
+	if !ok {
+		return nil, nil
+	}
+	for root.Parent != 0 {
+		parent, ok := byID[root.Parent]
+		if !ok {
+			break
+		}
+		root = parent
+	}
+
+	// Messages only reply to earlier ones, so one pass in order finds every descendant.
+	inThread := map[int64]bool{root.ID: true}
+	thread := []Message{root}
+	for _, m := range messages {
+		if m.ID != root.ID && inThread[m.Parent] {
+			inThread[m.ID] = true
+			thread = append(thread, m)
+		}
+	}
+	return thread, nil
+}
+
+// Truncate clears the history file. The ID sequence carries on, so IDs seen
+// before the truncation are never reused.
+func (h *History) Truncate() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %v", err)
+	}
+	file.Close()
+
+	if h.nextID > 1 {
+		return h.appendRecord(Record{Kind: KindSequence, Time: time.Now(), ID: h.nextID - 1})
+	}
+	return nil
+}
+
+// fold applies edits and tombstones to the messages they target.
+func fold(records []Record) []Message {
+	var messages []Message
+	index := make(map[int64]int)
+	for _, r := range records {
+		switch r.Kind {
+		case KindMessage:
+			index[r.ID] = len(messages)
+			messages = append(messages, Message{ID: r.ID, Time: r.Time, Room: r.Room, Name: r.Name, Body: r.Body, Parent: r.Parent, Service: r.Service})
+		case KindEdit:
+			if i, ok := index[r.Target]; ok && !messages[i].Deleted {
+				messages[i].Body = r.Body
+				messages[i].Edited = true
+			}
+		case KindDelete:
+			if i, ok := index[r.Target]; ok {
+				messages[i].Body = ""
+				messages[i].Deleted = true
+			}
+		}
+	}
+	return messages
+}
+
+// appendRecord writes one record to the end of the file. Callers must hold h.mu.
+func (h *History) appendRecord(r Record) error {
+	return appendJSONLine(h.path, r)
+}
+
+// readRecords reads every record in the file. Callers must hold h.mu, except NewHistory.
+func (h *History) readRecords() ([]Record, error) {
+	return readJSONLines[Record](h.path)
+}
+
+// redact rewrites the file with the body of the target message and of every
+// edit to it removed, so deleted or replaced text does not stay on disk. With
+// keepLast, the last record, the edit just appended, keeps its body. Callers
+// must hold h.mu.
+func (h *History) redact(target int64, keepLast bool) error {
+	records, err := h.readRecords()
+	if err != nil {
+		return err
+	}
+
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	for i, r := range records {
+		kept := keepLast && i == len(records)-1
+		if !kept && ((r.Kind == KindMessage && r.ID == target) || (r.Kind == KindEdit && r.Target == target)) {
+			r.Body = ""
+		}
+		if err := encoder.Encode(r); err != nil {
+			return fmt.Errorf("error encoding history record: %v", err)
+		}
+	}
+	return writeFileAtomic(h.path, content.Bytes())
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestHistoryEditAndDelete tests that replays apply edits and tombstones.
+func TestHistoryEditAndDelete(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHistoryEditAndDelete...")
+	path := filepath.Join(t.TempDir(), "history.txt")
+	h := NewHistory(path)
+
+	first, _ := h.Append(Record{Kind: KindMessage, Time: time.Now(), Name: "layla", Body: "helo"})
+	second, _ := h.Append(Record{Kind: KindMessage, Time: time.Now(), Name: "layla", Body: "secret: hunter2"})
+	h.Append(Record{Kind: KindEdit, Time: time.Now(), Name: "layla", Target: first.ID, Body: "hello"})
+	if _, err := h.Append(Record{Kind: KindDelete, Time: time.Now(), Name: "layla", Target: second.ID}); err != nil {
+		colortest.LogError(t, "delete failed: "+err.Error())
+		return
+	}
+
+	messages, err := h.Messages()
+	if err != nil || len(messages) != 2 {
+		colortest.LogError(t, "expected 2 messages")
+		return
+	}
+	if messages[0].Body != "hello" || !messages[0].Edited {
+		colortest.LogError(t, "edit not applied: "+messages[0].Body)
+	}
+	if messages[1].Body != "" || !messages[1].Deleted {
+		colortest.LogError(t, "delete not applied: "+messages[1].Body)
+	}
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "hunter2") {
+		colortest.LogError(t, "deleted text is still on disk")
+	}
+	if strings.Contains(string(content), `"helo"`) {
+		colortest.LogError(t, "edited text is still on disk")
+	}
+
+	// A reopened store continues the ID sequence
+	third, _ := NewHistory(path).Append(Record{Kind: KindMessage, Time: time.Now(), Name: "layla", Body: "again"})
+	if third.ID != second.ID+1 {
+		colortest.LogError(t, "ID sequence restarted after reopening")
+	} else {
+		colortest.LogSuccess(t, "TestHistoryEditAndDelete completed successfully")
+	}
+}
+
+// TestHistoryThread tests that a thread is found from any of its messages and
+// that reply links and IDs survive a truncation.
+func TestHistoryThread(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHistoryThread...")
+	path := filepath.Join(t.TempDir(), "history.txt")
+	h := NewHistory(path)
+
+	root, _ := h.Append(Record{Kind: KindMessage, Time: time.Now(), Name: "layla", Body: "lunch?"})
+	h.Append(Record{Kind: KindMessage, Time: time.Now(), Name: "sara", Body: "unrelated"})
+	reply, _ := h.Append(Record{Kind: KindMessage, Time: time.Now(), Name: "sara", Body: "yes", Parent: root.ID})
+	nested, _ := h.Append(Record{Kind: KindMessage, Time: time.Now(), Name: "layla", Body: "noon", Parent: reply.ID})
+
+	thread, err := NewHistory(path).Thread(nested.ID)
+	if err != nil || len(thread) != 3 {
+		colortest.LogError(t, "expected a thread of 3 messages")
+		return
+	}
+	if thread[0].ID != root.ID || thread[1].ID != reply.ID || thread[2].Parent != reply.ID {
+		colortest.LogError(t, "thread is out of order or lost its links")
+	}
+
+	h.Truncate()
+	after, _ := NewHistory(path).Append(Record{Kind: KindMessage, Time: time.Now(), Name: "layla", Body: "new day"})
+	if after.ID <= nested.ID {
+		colortest.LogError(t, "ID reused after truncation")
+	} else {
+		colortest.LogSuccess(t, "TestHistoryThread completed successfully")
+	}
+}
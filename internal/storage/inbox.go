@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// DirectMessage is a private message queued for a user who was offline.
+type DirectMessage struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+	Body string    `json:"body"`
+}
+
+// Inbox queues direct messages for offline users, backed by a JSON lines file.
+type Inbox struct {
+	mu   sync.Mutex
+	path string
+}
+
+// inboxEntry is one line of the inbox file: a queued message, or, in files
+// written before delivered messages were removed, a marker that everything
+// queued for To before it has been delivered.
+type inboxEntry struct {
+	DirectMessage
+	Delivered bool `json:"delivered,omitempty"`
+}
+
+// NewInbox opens the offline message queue stored at path.
+func NewInbox(path string) *Inbox {
+	return &Inbox{path: path}
+}
+
+// Queue stores a message until its recipient next identifies.
+func (in *Inbox) Queue(dm DirectMessage) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return appendJSONLine(in.path, inboxEntry{DirectMessage: dm})
+}
+
+// Waiting returns how many messages are waiting for name.
+func (in *Inbox) Waiting(name string) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	entries, err := readJSONLines[inboxEntry](in.path)
+	if err != nil {
+		return 0, err
+	}
+	pending, _ := splitInbox(entries, name)
+	return len(pending), nil
+}
+
+// Take returns the messages waiting for name, oldest first, and removes
+// them from the file.
+func (in *Inbox) Take(name string) ([]DirectMessage, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	entries, err := readJSONLines[inboxEntry](in.path)
+	if err != nil {
+		return nil, err
+	}
+	pending, rest := splitInbox(entries, name)
+	if len(rest) == len(entries) {
+		return nil, nil
+	}
+	if err := writeJSONLines(in.path, rest); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// splitInbox separates the messages still waiting for name from the entries for
+// everyone else. Messages before a delivered marker for name are dropped.
+func splitInbox(entries []inboxEntry, name string) (pending []DirectMessage, rest []inboxEntry) {
+	for _, e := range entries {
+		switch {
+		case e.To != name:
+			rest = append(rest, e)
+		case e.Delivered:
+			pending = nil
+		default:
+			pending = append(pending, e.DirectMessage)
+		}
+	}
+	return pending, rest
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestInboxTake tests that taking the messages waiting for a user removes
+// them from the file and leaves those for others, and that messages
+// before a delivered marker from an older file are not delivered again.
+func TestInboxTake(t *testing.T) {
+	colortest.LogInfo(t, "Running TestInboxTake...")
+	path := filepath.Join(t.TempDir(), "inbox.txt")
+	os.WriteFile(path, []byte(`{"from":"lucas","to":"layla","time":"2024-05-01T10:00:00Z","body":"old"}
+{"from":"","to":"layla","time":"2024-05-01T11:00:00Z","body":"","delivered":true}
+`), 0644)
+	in := NewInbox(path)
+	in.Queue(DirectMessage{From: "lucas", To: "layla", Time: time.Now(), Body: "secret"})
+	in.Queue(DirectMessage{From: "lucas", To: "mina", Time: time.Now(), Body: "hello"})
+
+	if waiting, err := in.Waiting("layla"); err != nil || waiting != 1 {
+		colortest.LogError(t, "unexpected count of waiting messages")
+	}
+	taken, err := in.Take("layla")
+	if err != nil || len(taken) != 1 || taken[0].Body != "secret" {
+		colortest.LogError(t, "unexpected messages taken")
+	}
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "secret") || strings.Contains(string(content), "old") {
+		colortest.LogError(t, "delivered messages left in the file:\n"+string(content))
+	}
+	again, _ := in.Take("layla")
+	others, _ := in.Take("mina")
+	if len(again) != 0 || len(others) != 1 || others[0].Body != "hello" {
+		colortest.LogError(t, "unexpected messages after taking")
+	} else {
+		colortest.LogSuccess(t, "TestInboxTake completed successfully")
+	}
+}
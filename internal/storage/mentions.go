@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Mention records that a user was named in a message they did not see live.
+type Mention struct {
+	To        string    `json:"to"`
+	From      string    `json:"from"`
+	Time      time.Time `json:"time"`
+	Room      string    `json:"room,omitempty"`
+	MessageID int64     `json:"message_id,omitempty"`
+	Body      string    `json:"body"`
+	Deleted   bool      `json:"deleted,omitempty"` // The message was deleted and Body removed
+}
+
+// Mentions is a per-user inbox of missed mentions backed by a JSON lines file.
+type Mentions struct {
+	mu   sync.Mutex
+	path string
+}
+
+// mentionEntry is one line of the mentions file: a mention, or a marker that
+// everything addressed to To up to Time has been read.
+type mentionEntry struct {
+	Mention
+	Read bool `json:"read,omitempty"`
+}
+
+// NewMentions opens the mentions inbox stored at path.
+func NewMentions(path string) *Mentions {
+	return &Mentions{path: path}
+}
+
+// Add stores a missed mention.
+func (m *Mentions) Add(mention Mention) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return appendJSONLine(m.path, mentionEntry{Mention: mention})
+}
+
+// Unread returns the mentions of name that have not been marked read, oldest first.
+func (m *Mentions) Unread(name string) ([]Mention, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unread(name)
+}
+
+// Take returns the unread mentions of name, oldest first, and marks them
+// read, so a mention stored meanwhile is neither lost nor marked read unseen.
+func (m *Mentions) Take(name string) ([]Mention, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unread, err := m.unread(name)
+	if err != nil || len(unread) == 0 {
+		return nil, err
+	}
+	if err := appendJSONLine(m.path, mentionEntry{Mention: Mention{To: name, Time: time.Now()}, Read: true}); err != nil {
+		return nil, err
+	}
+	return unread, nil
+}
+
+// unread returns the mentions of name after the last read marker. Callers must hold m.mu.
+func (m *Mentions) unread(name string) ([]Mention, error) {
+	entries, err := readJSONLines[mentionEntry](m.path)
+	if err != nil {
+		return nil, err
+	}
+	var unread []Mention
+	for _, e := range entries {
+		if e.To != name {
+			continue
+		}
+		if e.Read {
+			unread = nil
+			continue
+		}
+		unread = append(unread, e.Mention)
+	}
+	return unread, nil
+}
+
+// Update replaces the body of every unread mention of the message with the
+// given ID, which was edited, so the text it replaced is not kept.
+func (m *Mentions) Update(messageID int64, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries, err := readJSONLines[mentionEntry](m.path)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i, e := range entries {
+		if !e.Read && e.MessageID == messageID && !e.Deleted {
+			entries[i].Body = body
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeJSONLines(m.path, entries)
+}
+
+// Redact removes the body of every mention of the message with the given ID,
+// which was deleted.
+func (m *Mentions) Redact(messageID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries, err := readJSONLines[mentionEntry](m.path)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i, e := range entries {
+		if !e.Read && e.MessageID == messageID && !e.Deleted {
+			entries[i].Body, entries[i].Deleted = "", true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeJSONLines(m.path, entries)
+}
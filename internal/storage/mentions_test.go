@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestMentionsRedact tests that the text of a deleted message is removed
+// from the mentions of it, and only from those.
+func TestMentionsRedact(t *testing.T) {
+	colortest.LogInfo(t, "Running TestMentionsRedact...")
+	path := filepath.Join(t.TempDir(), "mentions.txt")
+	m := NewMentions(path)
+	m.Add(Mention{To: "layla", From: "lucas", Time: time.Now(), MessageID: 1, Body: "@layla secret"})
+	m.Add(Mention{To: "mina", From: "lucas", Time: time.Now(), MessageID: 1, Body: "@layla secret"})
+	m.Add(Mention{To: "layla", From: "lucas", Time: time.Now(), MessageID: 2, Body: "@layla hello"})
+
+	if err := m.Redact(1); err != nil {
+		t.Fatal(err)
+	}
+	unread, err := m.Unread("layla")
+	content, _ := os.ReadFile(path)
+	switch {
+	case err != nil || len(unread) != 2:
+		colortest.LogError(t, "mentions were lost")
+	case !unread[0].Deleted || unread[0].Body != "" || unread[1].Deleted || unread[1].Body != "@layla hello":
+		colortest.LogError(t, "wrong mentions redacted")
+	case strings.Contains(string(content), "secret"):
+		colortest.LogError(t, "deleted text left in the file:\n"+string(content))
+	default:
+		colortest.LogSuccess(t, "TestMentionsRedact completed successfully")
+	}
+}
+
+// TestMentionsTake tests that taking the unread mentions marks them read,
+// and that a mention stored after is still unread.
+func TestMentionsTake(t *testing.T) {
+	colortest.LogInfo(t, "Running TestMentionsTake...")
+	m := NewMentions(filepath.Join(t.TempDir(), "mentions.txt"))
+	m.Add(Mention{To: "layla", From: "lucas", Time: time.Now(), MessageID: 1, Body: "@layla one"})
+	m.Add(Mention{To: "mina", From: "lucas", Time: time.Now(), MessageID: 1, Body: "@mina one"})
+
+	taken, err := m.Take("layla")
+	if err != nil || len(taken) != 1 || taken[0].Body != "@layla one" {
+		colortest.LogError(t, "unexpected mentions taken")
+	}
+	m.Add(Mention{To: "layla", From: "lucas", Time: time.Now(), MessageID: 2, Body: "@layla two"})
+	unread, _ := m.Unread("layla")
+	others, _ := m.Unread("mina")
+	if len(unread) != 1 || unread[0].Body != "@layla two" || len(others) != 1 {
+		colortest.LogError(t, "unexpected unread mentions after taking")
+	} else {
+		colortest.LogSuccess(t, "TestMentionsTake completed successfully")
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// passwordRounds is the PBKDF2 iteration count used for stored passwords.
+const passwordRounds = 100000
+
+// hashPassword derives a 32 byte key from password and salt with
+// PBKDF2-HMAC-SHA256 (RFC 8018). The standard library only has it from Go 1.24.
+func hashPassword(password string, salt []byte, rounds int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1}) // A single block: the key is as long as the hash
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < rounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// newPasswordHash returns a random salt and the hash of password with it, hex encoded.
+func newPasswordHash(password string) (salt, hash string, err error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("error generating password salt: %v", err)
+	}
+	return hex.EncodeToString(raw), hex.EncodeToString(hashPassword(password, raw, passwordRounds)), nil
+}
+
+// passwordMatches reports whether password has the given hex salt and hash.
+func passwordMatches(password, salt, hash string) bool {
+	rawSalt, err := hex.DecodeString(salt)
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashPassword(password, rawSalt, passwordRounds), want) == 1
+}
@@ -1 +1,83 @@
-package storage
\ No newline at end of file
+// Package storage persists chat data on disk: the message history, and the
+// per-user records the server needs to keep across connections.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// appendJSONLine writes v as a new line at the end of the file at path.
+func appendJSONLine(path string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing to %s: %v", path, err)
+	}
+	return nil
+}
+
+// readJSONLines decodes every line of the file at path. A missing file reads as empty.
+func readJSONLines[T any](path string) ([]T, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var items []T
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var item T
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return items, nil
+}
+
+// writeJSONLines replaces the file at path with items, one per line.
+func writeJSONLines[T any](path string, items []T) error {
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			return fmt.Errorf("error encoding %s: %v", path, err)
+		}
+	}
+	return writeFileAtomic(path, content.Bytes())
+}
+
+// writeFileAtomic replaces path with content by writing a temporary file and renaming it.
+func writeFileAtomic(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
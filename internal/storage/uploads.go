@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Upload describes a file shared in the chat.
+type Upload struct {
+	ID     int64     `json:"id"`
+	Name   string    `json:"name"`   // File name given by the uploader
+	Size   int64     `json:"size"`   // Length of the content in bytes
+	From   string    `json:"from"`   // Who uploaded it
+	Time   time.Time `json:"time"`   // When it was uploaded
+	SHA256 string    `json:"sha256"` // Hex digest of the content
+}
+
+// Uploads stores shared files in a directory: the content of each in a file
+// named after its ID, and their descriptions in a JSON lines index.
+type Uploads struct {
+	mu     sync.Mutex
+	dir    string
+	nextID int64
+	total  int64 // Bytes stored
+}
+
+// uploadIndex is the name of the index file in the uploads directory.
+const uploadIndex = "index.txt"
+
+// NewUploads opens the uploads stored in dir, continuing their ID sequence.
+func NewUploads(dir string) *Uploads {
+	u := &Uploads{dir: dir, nextID: 1}
+	if uploads, err := readJSONLines[Upload](u.indexPath()); err == nil {
+		for _, up := range uploads {
+			if up.ID >= u.nextID {
+				u.nextID = up.ID + 1
+			}
+			u.total += up.Size
+		}
+	}
+	return u
+}
+
+// Save stores content under up, assigning its ID, size and digest, and
+// returns the stored description. It reports false, and stores nothing, if
+// the uploads would then take more than maxTotal bytes.
+func (u *Uploads) Save(up Upload, content []byte, maxTotal int64) (Upload, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.total+int64(len(content)) > maxTotal {
+		return Upload{}, false, nil
+	}
+	if err := os.MkdirAll(u.dir, 0755); err != nil {
+		return Upload{}, false, fmt.Errorf("error creating %s: %v", u.dir, err)
+	}
+	up.ID = u.nextID
+	up.Size = int64(len(content))
+	sum := sha256.Sum256(content)
+	up.SHA256 = hex.EncodeToString(sum[:])
+
+	// Write the content first so the index never names a missing file
+	if err := writeFileAtomic(u.contentPath(up.ID), content); err != nil {
+		return Upload{}, false, err
+	}
+	if err := appendJSONLine(u.indexPath(), up); err != nil {
+		os.Remove(u.contentPath(up.ID))
+		return Upload{}, false, err
+	}
+	u.nextID++
+	u.total += up.Size
+	return up, true, nil
+}
+
+// Get returns the description and content of an upload.
+func (u *Uploads) Get(id int64) (Upload, []byte, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	uploads, err := readJSONLines[Upload](u.indexPath())
+	if err != nil {
+		return Upload{}, nil, false, err
+	}
+	for _, up := range uploads {
+		if up.ID != id {
+			continue
+		}
+		content, err := os.ReadFile(u.contentPath(id))
+		if err != nil {
+			return Upload{}, nil, false, fmt.Errorf("error reading upload %s: %v", FormatID(id), err)
+		}
+		return up, content, true, nil
+	}
+	return Upload{}, nil, false, nil
+}
+
+// Total returns the number of bytes stored.
+func (u *Uploads) Total() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.total
+}
+
+func (u *Uploads) indexPath() string {
+	return filepath.Join(u.dir, uploadIndex)
+}
+
+func (u *Uploads) contentPath(id int64) string {
+	return filepath.Join(u.dir, FormatID(id))
+}
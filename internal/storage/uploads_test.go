@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestUploadsTotal tests that uploads saved at the same time never take the
+// total over its limit.
+func TestUploadsTotal(t *testing.T) {
+	colortest.LogInfo(t, "Running TestUploadsTotal...")
+	u := NewUploads(t.TempDir())
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	saved := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := u.Save(Upload{Name: "notes.txt", From: "layla", Time: time.Now()}, []byte("0123456789"), 35)
+			if err != nil {
+				colortest.LogError(t, err.Error())
+			}
+			if ok {
+				mu.Lock()
+				saved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	reopened := NewUploads(u.dir)
+	if saved != 3 || u.Total() != 30 || reopened.Total() != 30 {
+		colortest.LogError(t, "uploads went over the total limit")
+	} else {
+		colortest.LogSuccess(t, "TestUploadsTotal completed successfully")
+	}
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// User is what the server remembers about a name that has logged in.
+type User struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastLogin time.Time `json:"last_login"`
+	Color     string    `json:"color,omitempty"` // Name color chosen with /color, empty for the default
+
+	LastSpoke  time.Time `json:"last_spoke"`  // When they last sent a message, zero if never
+	LastLogout time.Time `json:"last_logout"` // When they last disconnected, zero if never
+
+	PasswordSalt string `json:"password_salt,omitempty"` // Hex salt of the password set with /register
+	PasswordHash string `json:"password_hash,omitempty"` // Hex PBKDF2 hash of that password, empty if unregistered
+}
+
+// spokeSaveInterval is how often Spoke writes the file; the time in memory is
+// always current and is written by the next save, at the latest on logout.
+const spokeSaveInterval = time.Minute
+
+// Users is the registry of every name that has ever joined the chat, kept in
+// a JSON file that is rewritten on each change.
+type Users struct {
+	mu     sync.Mutex
+	path   string
+	users  map[string]*User
+	loaded bool
+	saved  time.Time // When the file was last written
+}
+
+// NewUsers opens the user registry stored at path. The file is read on first use.
+func NewUsers(path string) *Users {
+	return &Users{path: path}
+}
+
+// Login registers name, or records a new login for a known name.
+func (u *Users) Login(name string, at time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.load(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		user = &User{Name: name, FirstSeen: at}
+		u.users[name] = user
+	}
+	user.LastLogin = at
+	return u.save()
+}
+
+// Spoke records that a known user sent a message.
+func (u *Users) Spoke(name string, at time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.load(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("no user named %s", name)
+	}
+	user.LastSpoke = at
+	if time.Since(u.saved) < spokeSaveInterval {
+		return nil
+	}
+	return u.save()
+}
+
+// Logout records that a known user disconnected.
+func (u *Users) Logout(name string, at time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.load(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("no user named %s", name)
+	}
+	user.LastLogout = at
+	return u.save()
+}
+
+// SetColor records the name color chosen by a known user; an empty color
+// restores the default.
+func (u *Users) SetColor(name string, color string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.load(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("no user named %s", name)
+	}
+	user.Color = color
+	return u.save()
+}
+
+// SetPassword protects the name of a known user with password.
+func (u *Users) SetPassword(name, password string) error {
+	salt, hash, err := newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.load(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("no user named %s", name)
+	}
+	user.PasswordSalt, user.PasswordHash = salt, hash
+	return u.save()
+}
+
+// CheckPassword reports whether password is the one registered for name.
+// It is false for names without a password.
+func (u *Users) CheckPassword(name, password string) (bool, error) {
+	user, ok, err := u.Get(name)
+	if err != nil || !ok || user.PasswordHash == "" {
+		return false, err
+	}
+	return passwordMatches(password, user.PasswordSalt, user.PasswordHash), nil
+}
+
+// Registered reports whether name is protected by a password. Read errors
+// count as unregistered.
+func (u *Users) Registered(name string) bool {
+	user, ok, _ := u.Get(name)
+	return ok && user.PasswordHash != ""
+}
+
+// Get returns the record for name.
+func (u *Users) Get(name string) (User, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.load(); err != nil {
+		return User{}, false, err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return User{}, false, nil
+	}
+	return *user, true, nil
+}
+
+// Exists reports whether name has ever logged in. Read errors count as unknown.
+func (u *Users) Exists(name string) bool {
+	_, ok, _ := u.Get(name)
+	return ok
+}
+
+// load reads the file the first time the registry is used. Callers must hold u.mu.
+func (u *Users) load() error {
+	if u.loaded {
+		return nil
+	}
+	u.users = make(map[string]*User)
+	content, err := os.ReadFile(u.path)
+	if os.IsNotExist(err) {
+		u.loaded = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading users file: %v", err)
+	}
+	var users []*User
+	if err := json.Unmarshal(content, &users); err != nil {
+		return fmt.Errorf("error parsing users file: %v", err)
+	}
+	for _, user := range users {
+		u.users[user.Name] = user
+	}
+	u.loaded = true
+	return nil
+}
+
+// save atomically rewrites the file sorted by name. Callers must hold u.mu.
+func (u *Users) save() error {
+	users := make([]*User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	content, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding users file: %v", err)
+	}
+	if err := writeFileAtomic(u.path, append(content, '\n')); err != nil {
+		return err
+	}
+	u.saved = time.Now()
+	return nil
+}
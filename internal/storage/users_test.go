@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+)
+
+// TestHashPassword tests the key derivation against the PBKDF2-HMAC-SHA256
+// test vectors of RFC 7914.
+func TestHashPassword(t *testing.T) {
+	colortest.LogInfo(t, "Running TestHashPassword...")
+	tests := []struct {
+		password, salt string
+		rounds         int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(hashPassword(test.password, []byte(test.salt), test.rounds)); got != test.want {
+			colortest.LogError(t, test.password+": unexpected key "+got)
+		}
+	}
+	if !t.Failed() {
+		colortest.LogSuccess(t, "TestHashPassword completed successfully")
+	}
+}
+
+// TestUsersPassword tests that a registered password is checked, kept
+// across reloads and not stored in the clear.
+func TestUsersPassword(t *testing.T) {
+	colortest.LogInfo(t, "Running TestUsersPassword...")
+	path := filepath.Join(t.TempDir(), "users.json")
+	u := NewUsers(path)
+	u.Login("layla", time.Now())
+
+	if u.Registered("layla") || u.SetPassword("lucas", "hunter22") == nil {
+		colortest.LogError(t, "unexpected registration before setting a password")
+	}
+	if err := u.SetPassword("layla", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewUsers(path)
+	ok, err := reloaded.CheckPassword("layla", "hunter22")
+	wrong, _ := reloaded.CheckPassword("layla", "hunter23")
+	content, _ := os.ReadFile(path)
+	switch {
+	case err != nil || !ok || wrong || !reloaded.Registered("layla"):
+		colortest.LogError(t, "password not checked after reloading")
+	case strings.Contains(string(content), "hunter22"):
+		colortest.LogError(t, "password stored in the clear")
+	default:
+		colortest.LogSuccess(t, "TestUsersPassword completed successfully")
+	}
+}
@@ -0,0 +1,401 @@
+// Package webhook mirrors chat events to other systems by POSTing them as
+// JSON to configured HTTP endpoints.
+//
+// Events are queued without blocking and delivered by a small pool of
+// workers. Each request is signed with HMAC-SHA256 over the body using the
+// hook's secret, sent as "X-TCPChat-Signature: sha256=<hex>". Failed
+// deliveries are retried with exponential backoff and, once the attempts run
+// out, written to a dead-letter log.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"netcat/internal/logging"
+	"netcat/internal/metrics"
+	"netcat/internal/storage"
+)
+
+// Event types a hook can subscribe to.
+const (
+	EventMessage = "message"
+	EventJoin    = "join"
+	EventLeave   = "leave"
+	EventKick    = "kick"
+	EventDelete  = "delete"
+	EventEdit    = "edit"
+)
+
+// eventTypes is the set of valid Hook.Events entries.
+var eventTypes = map[string]bool{EventMessage: true, EventJoin: true, EventLeave: true, EventKick: true, EventDelete: true, EventEdit: true}
+
+// Defaults for a new Dispatcher.
+const (
+	queueSize   = 1024
+	workers     = 4
+	maxAttempts = 5
+	baseDelay   = time.Second
+	maxDelay    = time.Minute
+	httpTimeout = 10 * time.Second
+)
+
+var deliveries = metrics.Default.NewCounterVec(
+	"netcat_webhook_deliveries_total", "Webhook delivery attempts, by result.", "result")
+
+// Hook is one configured endpoint.
+type Hook struct {
+	URL    string   `json:"url"`    // http or https endpoint to POST to
+	Secret string   `json:"secret"` // Key for the HMAC signature, empty to send unsigned
+	Events []string `json:"events"` // Event types to send, all if empty
+	Rooms  []string `json:"rooms"`  // Rooms to send events for, all if empty
+}
+
+// Validate checks that the hook can be used.
+func (h Hook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url %q must be an http or https URL", h.URL)
+	}
+	for _, event := range h.Events {
+		if !eventTypes[event] {
+			return fmt.Errorf("webhook event %q must be one of message, join, leave, kick or delete", event)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the hook subscribes to ev.
+func (h Hook) wants(ev Event) bool {
+	return matches(h.Events, ev.Event) && matches(h.Rooms, ev.Room)
+}
+
+// matches reports whether value is in list, treating an empty list as all values.
+func matches(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the JSON payload posted to a hook.
+type Event struct {
+	Event   string    `json:"event"`              // One of the Event* types
+	Time    time.Time `json:"time"`               // When it happened
+	Room    string    `json:"room"`               // Room it happened in
+	Name    string    `json:"name"`               // User it is about
+	Body    string    `json:"body,omitempty"`     // Message text
+	ID      string    `json:"id,omitempty"`       // Message ID
+	ReplyTo string    `json:"reply_to,omitempty"` // ID of the message replied to
+	Reason  string    `json:"reason,omitempty"`   // Why a user was kicked
+}
+
+// delivery is one event on its way to one hook.
+type delivery struct {
+	hook     Hook
+	id       string
+	event    string
+	message  string // ID of the message a message event carries, for Redact
+	payload  []byte
+	attempts int
+	redacted bool // The message was deleted or edited, so the delivery is given up; guarded by Dispatcher.mu
+}
+
+// Dispatcher delivers events to hooks in the background.
+type Dispatcher struct {
+	Client      *http.Client  // Client used for requests
+	MaxAttempts int           // Attempts before a delivery is dead-lettered
+	BaseDelay   time.Duration // Wait before the first retry, doubled for each one after
+	MaxDelay    time.Duration // Longest wait between retries
+
+	queue       chan *delivery
+	deadLetters *storage.DeadLetters
+	workers     sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[string][]*delivery    // Message event deliveries not done yet, by message ID
+	retries map[*delivery]*time.Timer // Deliveries waiting to be retried
+	closed  bool                      // Close was called; the queue takes no more deliveries
+}
+
+// NewDispatcher starts a dispatcher that records failed deliveries in the
+// dead-letter log at deadLetterPath.
+func NewDispatcher(deadLetterPath string) *Dispatcher {
+	d := &Dispatcher{
+		Client:      &http.Client{Timeout: httpTimeout},
+		MaxAttempts: maxAttempts,
+		BaseDelay:   baseDelay,
+		MaxDelay:    maxDelay,
+		queue:       make(chan *delivery, queueSize),
+		deadLetters: storage.NewDeadLetters(deadLetterPath),
+		pending:     make(map[string][]*delivery),
+		retries:     make(map[*delivery]*time.Timer),
+	}
+	d.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Close stops the workers once they have attempted the deliveries already
+// queued. Deliveries that fail, wait for a retry or are sent after Close are
+// dead-lettered instead of tried again, so none are lost on shutdown.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.queue)
+	d.mu.Unlock()
+	d.workers.Wait()
+
+	var waiting []*delivery
+	d.mu.Lock()
+	for dl, timer := range d.retries {
+		if timer.Stop() {
+			waiting = append(waiting, dl)
+		}
+		delete(d.retries, dl)
+	}
+	d.mu.Unlock()
+	for _, dl := range waiting {
+		d.deadLetter(dl, "webhook dispatcher closed before retry")
+	}
+}
+
+// Send queues ev for every hook that wants it and returns at once.
+func (d *Dispatcher) Send(hooks []Hook, ev Event) {
+	var payload []byte
+	for _, hook := range hooks {
+		if !hook.wants(ev) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(ev); err != nil {
+				logging.Logger(fmt.Sprintf("Error encoding webhook event: %v", err))
+				return
+			}
+		}
+		dl := &delivery{hook: hook, id: newDeliveryID(), event: ev.Event, payload: payload}
+		if ev.Event == EventMessage && ev.ID != "" {
+			dl.message = ev.ID
+			d.mu.Lock()
+			d.pending[ev.ID] = append(d.pending[ev.ID], dl)
+			d.mu.Unlock()
+		}
+		d.enqueue(dl)
+	}
+}
+
+// Redact gives up the deliveries of the message event for the message with
+// the given ID, which was deleted or edited, and removes its text from the
+// dead-letter log. An attempt already on its way cannot be called back; hooks
+// learn of the change from the delete or edit event.
+func (d *Dispatcher) Redact(id string) {
+	d.mu.Lock()
+	for _, dl := range d.pending[id] {
+		dl.redacted = true
+	}
+	delete(d.pending, id)
+	d.mu.Unlock()
+
+	err := d.deadLetters.Rewrite(func(payload json.RawMessage) (json.RawMessage, bool) {
+		var ev Event
+		if json.Unmarshal(payload, &ev) != nil || ev.Event != EventMessage || ev.ID != id || ev.Body == "" {
+			return payload, false
+		}
+		ev.Body = ""
+		redacted, err := json.Marshal(ev)
+		if err != nil {
+			return payload, false
+		}
+		return redacted, true
+	})
+	if err != nil {
+		logging.Logger(err.Error())
+	}
+}
+
+// done forgets a delivery that will not be attempted again. It reports
+// whether the delivery was redacted.
+func (d *Dispatcher) done(dl *delivery) bool {
+	if dl.message == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := d.pending[dl.message]
+	for i, other := range pending {
+		if other == dl {
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(d.pending, dl.message)
+	} else {
+		d.pending[dl.message] = pending
+	}
+	return dl.redacted
+}
+
+// isRedacted reports whether the message of dl was deleted or edited.
+func (d *Dispatcher) isRedacted(dl *delivery) bool {
+	if dl.message == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return dl.redacted
+}
+
+// enqueue hands a delivery to the workers, dead-lettering it if they are
+// too far behind or were stopped by Close.
+func (d *Dispatcher) enqueue(dl *delivery) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		d.deadLetter(dl, "webhook dispatcher closed")
+		return
+	}
+	select {
+	case d.queue <- dl:
+	default:
+		go d.deadLetter(dl, "webhook queue is full")
+	}
+	d.mu.Unlock()
+}
+
+// work delivers queued events until Close empties and closes the queue.
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for dl := range d.queue {
+		d.attempt(dl)
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry or dead-letters on failure.
+func (d *Dispatcher) attempt(dl *delivery) {
+	if d.isRedacted(dl) {
+		d.done(dl)
+		return
+	}
+	dl.attempts++
+	retry, err := d.post(dl)
+	if err == nil {
+		deliveries.WithLabelValues("ok").Inc()
+		d.done(dl)
+		return
+	}
+
+	if !retry || dl.attempts >= d.MaxAttempts {
+		d.deadLetter(dl, err.Error())
+		return
+	}
+	delay := d.BaseDelay << (dl.attempts - 1)
+	if delay > d.MaxDelay || delay <= 0 {
+		delay = d.MaxDelay
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		d.deadLetter(dl, err.Error())
+		return
+	}
+	d.retries[dl] = time.AfterFunc(delay, func() { d.retry(dl) })
+	d.mu.Unlock()
+	deliveries.WithLabelValues("retry").Inc()
+	logging.Logger(fmt.Sprintf("Webhook %s failed (%v), retrying in %s", dl.hook.URL, err, delay))
+}
+
+// retry queues a delivery again once its wait is over.
+func (d *Dispatcher) retry(dl *delivery) {
+	d.mu.Lock()
+	delete(d.retries, dl)
+	d.mu.Unlock()
+	d.enqueue(dl)
+}
+
+// post sends the delivery once. It reports whether a failure is worth retrying:
+// network errors, 429 and 5xx are; other responses will not change.
+func (d *Dispatcher) post(dl *delivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, dl.hook.URL, bytes.NewReader(dl.payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TCPChat-Webhook/1")
+	req.Header.Set("X-TCPChat-Event", dl.event)
+	req.Header.Set("X-TCPChat-Delivery", dl.id)
+	if dl.hook.Secret != "" {
+		req.Header.Set("X-TCPChat-Signature", Sign(dl.hook.Secret, dl.payload))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+}
+
+// deadLetter records a delivery that will not be retried.
+func (d *Dispatcher) deadLetter(dl *delivery, reason string) {
+	if d.done(dl) {
+		// The message was deleted or edited meanwhile, so its text is not kept
+		return
+	}
+	deliveries.WithLabelValues("dead").Inc()
+	logging.Logger(fmt.Sprintf("Webhook %s gave up after %d attempt(s): %s", dl.hook.URL, dl.attempts, reason))
+	log.Printf("Webhook delivery to %s dead-lettered: %s", dl.hook.URL, reason)
+
+	letter := storage.DeadLetter{Time: time.Now(), URL: dl.hook.URL, Payload: dl.payload, Attempts: dl.attempts, Error: reason}
+	if err := d.deadLetters.Add(letter); err != nil {
+		logging.Logger(err.Error())
+	}
+}
+
+// Sign returns the signature header value for body: "sha256=" and the hex
+// HMAC-SHA256 of body keyed with secret. Receivers should compute the same
+// and compare in constant time.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newDeliveryID returns a random ID that identifies a delivery across retries.
+func newDeliveryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,197 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	colortest "netcat/internal/app/colorTest"
+	"netcat/internal/storage"
+)
+
+// newTestDispatcher returns a dispatcher that retries quickly.
+func newTestDispatcher(t *testing.T) (*Dispatcher, string) {
+	path := filepath.Join(t.TempDir(), "deadletters.txt")
+	d := NewDispatcher(path)
+	d.BaseDelay = 10 * time.Millisecond
+	d.MaxDelay = 40 * time.Millisecond
+	d.MaxAttempts = 3
+	return d, path
+}
+
+// TestDeliveryRetriesAndSigns tests that a delivery is signed, filtered by
+// event and room, and retried until the receiver accepts it.
+func TestDeliveryRetriesAndSigns(t *testing.T) {
+	colortest.LogInfo(t, "Running TestDeliveryRetriesAndSigns...")
+	var calls atomic.Int32
+	received := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !hmac.Equal([]byte(r.Header.Get("X-TCPChat-Signature")), []byte(Sign("s3cret", body))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- body
+	}))
+	defer receiver.Close()
+
+	d, _ := newTestDispatcher(t)
+	hooks := []Hook{{URL: receiver.URL, Secret: "s3cret", Events: []string{EventMessage}, Rooms: []string{"general"}}}
+	d.Send(hooks, Event{Event: EventJoin, Room: "general", Name: "layla"})
+	d.Send(hooks, Event{Event: EventMessage, Room: "random", Name: "layla", Body: "wrong room"})
+	d.Send(hooks, Event{Event: EventMessage, Room: "general", Name: "layla", Body: "hello"})
+
+	select {
+	case body := <-received:
+		if string(body) != `{"event":"message","time":"0001-01-01T00:00:00Z","room":"general","name":"layla","body":"hello"}` {
+			colortest.LogError(t, "unexpected payload: "+string(body))
+		} else if calls.Load() != 3 {
+			colortest.LogError(t, "expected 2 retries before success")
+		} else {
+			colortest.LogSuccess(t, "TestDeliveryRetriesAndSigns completed successfully")
+		}
+	case <-time.After(5 * time.Second):
+		colortest.LogError(t, "delivery never succeeded")
+	}
+}
+
+// TestDeadLetter tests that deliveries are dead-lettered once the attempts
+// run out, and at once for a response that retrying will not change.
+func TestDeadLetter(t *testing.T) {
+	colortest.LogInfo(t, "Running TestDeadLetter...")
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	d, path := newTestDispatcher(t)
+	d.Send([]Hook{{URL: failing.URL}, {URL: rejecting.URL}}, Event{Event: EventKick, Room: "general", Name: "troll"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	var letters []storage.DeadLetter
+	for time.Now().Before(deadline) {
+		letters, _ = storage.NewDeadLetters(path).All()
+		if len(letters) == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(letters) != 2 {
+		colortest.LogError(t, "expected 2 dead letters")
+		return
+	}
+	attempts := map[string]int{letters[0].URL: letters[0].Attempts, letters[1].URL: letters[1].Attempts}
+	if attempts[failing.URL] != 3 || attempts[rejecting.URL] != 1 {
+		colortest.LogError(t, "unexpected attempt counts")
+	} else {
+		colortest.LogSuccess(t, "TestDeadLetter completed successfully")
+	}
+}
+
+// TestRedact tests that the deliveries of a deleted message are given up
+// and that its text is removed from the dead letters.
+func TestRedact(t *testing.T) {
+	colortest.LogInfo(t, "Running TestRedact...")
+	calls := make(chan string, 16)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		calls <- ev.ID
+		if ev.ID == "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	d, path := newTestDispatcher(t)
+	d.BaseDelay = 100 * time.Millisecond
+	hooks := []Hook{{URL: failing.URL}}
+	d.Send(hooks, Event{Event: EventMessage, Room: "general", Name: "layla", Body: "dead letter", ID: "1"})
+	d.Send(hooks, Event{Event: EventMessage, Room: "general", Name: "layla", Body: "kept", ID: "2"})
+	d.Send(hooks, Event{Event: EventMessage, Room: "general", Name: "layla", Body: "retried", ID: "3"})
+	for i := 0; i < 3; i++ {
+		select {
+		case <-calls:
+		case <-time.After(2 * time.Second):
+			t.Fatal("events were not posted")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if letters, _ := storage.NewDeadLetters(path).All(); len(letters) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	d.Redact("1")
+	d.Redact("3")
+	retried := map[string]int{}
+	for deadline := time.After(time.Second); ; {
+		select {
+		case id := <-calls:
+			retried[id]++
+			continue
+		case <-deadline:
+		}
+		break
+	}
+	if retried["3"] != 0 || retried["2"] == 0 {
+		colortest.LogError(t, "only the message that was not deleted should be retried")
+	}
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "dead letter") || strings.Contains(string(content), "retried") || !strings.Contains(string(content), `"id":"1"`) {
+		colortest.LogError(t, "unexpected dead letters:\n"+string(content))
+	} else {
+		colortest.LogSuccess(t, "TestRedact completed successfully")
+	}
+}
+
+// TestClose tests that Close waits for the queued deliveries, dead-letters
+// the ones waiting for a retry and anything sent afterwards.
+func TestClose(t *testing.T) {
+	colortest.LogInfo(t, "Running TestClose...")
+	var calls atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	d, path := newTestDispatcher(t)
+	d.BaseDelay = time.Hour
+	d.MaxDelay = time.Hour
+	hooks := []Hook{{URL: failing.URL}}
+	d.Send(hooks, Event{Event: EventJoin, Room: "general", Name: "layla"})
+	for i := 0; i < 100 && calls.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Close()
+	d.Close()
+	d.Send(hooks, Event{Event: EventLeave, Room: "general", Name: "layla"})
+
+	letters, _ := storage.NewDeadLetters(path).All()
+	if calls.Load() != 1 || len(letters) != 2 {
+		colortest.LogError(t, "expected one attempt and two dead letters after Close")
+	} else {
+		colortest.LogSuccess(t, "TestClose completed successfully")
+	}
+}